@@ -211,6 +211,54 @@ func (s *QueueStream) Read(size uint) ([]byte, error) {
 	return data, nil
 }
 
+// ReadReference reads size bytes lying in the head chunk without copying.
+// The reference of the chunk is added for the returned data, caller should
+// release it after using the data. If the bytes span chunks, nothing is read
+// and false is returned
+func (s *QueueStream) ReadReference(size uint) ([]byte, pool.Reference, bool) {
+	if size == 0 || s.len == 0 || size > uint(len(s.head.data)) {
+		return nil, nil, false
+	}
+	ref := s.head.ref
+	if ref != nil {
+		ref.AddRef()
+	}
+	data, err := s.Read(size)
+	if err != nil {
+		if ref != nil {
+			ref.Release()
+		}
+		return nil, nil, false
+	}
+	return data, ref, true
+}
+
+// ReadTo reads len(buf) bytes into buf
+func (s *QueueStream) ReadTo(buf []byte) error {
+	size := uint(len(buf))
+	if size == 0 {
+		return nil
+	} else if s.len == 0 || size > s.size {
+		return io.EOF
+	}
+	s.size -= size
+	cur := s.head.data
+	var need uint
+	for i := uint(0); size > 0; i += need {
+		if need = uint(len(cur)); need > size {
+			need = size
+			s.head.data = cur[need:]
+			copy(buf[i:], cur[:need])
+			break
+		}
+		copy(buf[i:], cur)
+		s.readNext()
+		size -= need
+		cur = s.head.data
+	}
+	return nil
+}
+
 func (s *QueueStream) ReadAll() ([]byte, error) {
 	defer s.Clear()
 	return s.PeekAll()
@@ -15,3 +15,42 @@ func TestStream(t *testing.T) {
 		fmt.Println(s)
 	}
 }
+
+type testReference struct {
+	ref int
+}
+
+func (r *testReference) AddRef() {
+	r.ref++
+}
+
+func (r *testReference) Release() {
+	r.ref--
+}
+
+func TestQueueStreamReference(t *testing.T) {
+	stream := NewQueueStream(0)
+	first, second := &testReference{ref: 1}, &testReference{ref: 1}
+	stream.Write([]byte("hello"), first)
+	stream.Write([]byte("world"), second)
+
+	data, ref, ok := stream.ReadReference(3)
+	if !ok || string(data) != "hel" || ref != first || first.ref != 2 {
+		t.Fatalf("unexpected reference read: %s %d", data, first.ref)
+	}
+	ref.Release()
+	if _, _, ok := stream.ReadReference(4); ok {
+		t.Fatal("expect reference read spanning chunks failed")
+	}
+	buf := make([]byte, 4)
+	if err := stream.ReadTo(buf); err != nil || string(buf) != "lowo" || first.ref != 0 {
+		t.Fatalf("unexpected read: %s %v %d", buf, err, first.ref)
+	}
+	data, ref, ok = stream.ReadReference(3)
+	if !ok || string(data) != "rld" || ref != second || second.ref != 1 || stream.Size() != 0 {
+		t.Fatalf("unexpected reference read: %s %d", data, second.ref)
+	}
+	if err := stream.ReadTo(buf); err == nil {
+		t.Fatal("expect EOF of empty stream")
+	}
+}
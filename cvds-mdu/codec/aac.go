@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+)
+
+var InvalidAudioSpecificConfigError = errors.New("invalid aac audio specific config")
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// AudioSpecificConfig is the fields of MPEG-4 AudioSpecificConfig of AAC,
+// see ISO/IEC 14496-3 1.6.2.1
+type AudioSpecificConfig struct {
+	ObjectType int    `json:"objectType"`
+	Profile    string `json:"profile"`
+	// output sample rate, which is the extension sample rate of SBR
+	SampleRate int `json:"sampleRate"`
+	// 0 if channels are defined in program config element
+	Channels int  `json:"channels"`
+	SBR      bool `json:"sbr"`
+	PS       bool `json:"ps"`
+}
+
+func aacProfileName(objectType int, sbr bool, ps bool) string {
+	switch {
+	case ps:
+		return "HE-AAC v2"
+	case sbr:
+		return "HE-AAC"
+	}
+	switch objectType {
+	case 1:
+		return "Main"
+	case 2:
+		return "LC"
+	case 3:
+		return "SSR"
+	case 4:
+		return "LTP"
+	case 23:
+		return "LD"
+	case 39:
+		return "ELD"
+	}
+	return fmt.Sprintf("%d", objectType)
+}
+
+func readAudioObjectType(r *bitReader) int {
+	objectType := int(r.readBits(5))
+	if objectType == 31 {
+		objectType = 32 + int(r.readBits(6))
+	}
+	return objectType
+}
+
+func readSampleRate(r *bitReader) (int, error) {
+	index := int(r.readBits(4))
+	if index == 15 {
+		return int(r.readBits(24)), nil
+	}
+	if index >= len(aacSampleRates) {
+		return 0, fmt.Errorf("%w: sampling frequency index %d", InvalidAudioSpecificConfigError, index)
+	}
+	return aacSampleRates[index], nil
+}
+
+// ParseAudioSpecificConfig parses AudioSpecificConfig, which is the config
+// of fmtp of mpeg4-generic
+func ParseAudioSpecificConfig(config []byte) (*AudioSpecificConfig, error) {
+	r := newBitReader(config)
+	asc := &AudioSpecificConfig{}
+	asc.ObjectType = readAudioObjectType(r)
+	var err error
+	if asc.SampleRate, err = readSampleRate(r); err != nil {
+		return nil, err
+	}
+	asc.Channels = int(r.readBits(4))
+	if asc.ObjectType == 5 || asc.ObjectType == 29 {
+		// explicit hierarchical signaling of SBR, followed by the
+		// extension sample rate and the core object type
+		asc.SBR, asc.PS = true, asc.ObjectType == 29
+		if asc.SampleRate, err = readSampleRate(r); err != nil {
+			return nil, err
+		}
+		asc.ObjectType = readAudioObjectType(r)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidAudioSpecificConfigError, r.err)
+	}
+	if asc.ObjectType == 0 || asc.SampleRate == 0 {
+		return nil, fmt.Errorf("%w: object type %d, sample rate %d", InvalidAudioSpecificConfigError, asc.ObjectType, asc.SampleRate)
+	}
+	if asc.Channels == 7 {
+		asc.Channels = 8
+	}
+	asc.Profile = aacProfileName(asc.ObjectType, asc.SBR, asc.PS)
+	return asc, nil
+}
@@ -0,0 +1,37 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		config     []byte
+		profile    string
+		objectType int
+		sampleRate int
+		channels   int
+	}{
+		{[]byte{0x14, 0x10}, "LC", 2, 16000, 2},
+		{[]byte{0x12, 0x10}, "LC", 2, 44100, 2},
+		{[]byte{0x15, 0x88}, "LC", 2, 8000, 1},
+		// SBR signaled explicitly, output at the extension sample rate
+		{[]byte{0x2B, 0x11, 0x88}, "HE-AAC", 2, 48000, 2},
+	}
+	for _, test := range tests {
+		asc, err := ParseAudioSpecificConfig(test.config)
+		if err != nil {
+			t.Fatalf("%X: %v", test.config, err)
+		}
+		if asc.Profile != test.profile || asc.ObjectType != test.objectType || asc.SampleRate != test.sampleRate || asc.Channels != test.channels {
+			t.Errorf("%X: unexpected config %+v", test.config, asc)
+		}
+	}
+	if _, err := ParseAudioSpecificConfig([]byte{0x14}); !errors.Is(err, InvalidAudioSpecificConfigError) {
+		t.Fatalf("expect truncated config failed, got %v", err)
+	}
+	if _, err := ParseAudioSpecificConfig([]byte{0x17, 0x90}); !errors.Is(err, InvalidAudioSpecificConfigError) {
+		t.Fatalf("expect invalid sample rate failed, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package codec
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+)
+
+var ShortBitstreamError = errors.New("bitstream too short")
+var InvalidNALUTypeError = errors.New("invalid nal unit type")
+
+// bitReader reads bits of RBSP in big endian. Errors are sticky, values read
+// after the first error are zero, and the error is checked once parsed
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+// unescapeRBSP removes emulation prevention bytes of NAL unit payload
+func unescapeRBSP(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		rbsp = append(rbsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return rbsp
+}
+
+func (r *bitReader) readBits(n int) uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+n > len(r.data)*8 {
+		r.err = fmt.Errorf("%w: read %d bits at %d of %d", ShortBitstreamError, n, r.pos, len(r.data)*8)
+		return 0
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(r.data[r.pos>>3]>>(7-r.pos&7)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) readFlag() bool {
+	return r.readBits(1) == 1
+}
+
+func (r *bitReader) skipBits(n int) {
+	for n > 32 {
+		r.readBits(32)
+		n -= 32
+	}
+	r.readBits(n)
+}
+
+// readUE reads unsigned Exp-Golomb code
+func (r *bitReader) readUE() uint32 {
+	zeros := 0
+	for r.err == nil && !r.readFlag() {
+		zeros++
+		if zeros > 31 {
+			r.err = fmt.Errorf("%w: exp-golomb code too long", ShortBitstreamError)
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.readBits(zeros)
+}
+
+// readSE reads signed Exp-Golomb code
+func (r *bitReader) readSE() int32 {
+	k := r.readUE()
+	if k&1 == 1 {
+		return int32((k + 1) / 2)
+	}
+	return -int32(k / 2)
+}
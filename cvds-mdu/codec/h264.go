@@ -0,0 +1,245 @@
+package codec
+
+import (
+	"fmt"
+)
+
+const (
+	H264NALUTypeIDR = 5
+	H264NALUTypeSPS = 7
+	H264NALUTypePPS = 8
+)
+
+// H264SPS is the fields of H.264 sequence parameter set describing the
+// stream, see ITU-T H.264 7.3.2.1
+type H264SPS struct {
+	ID              uint32 `json:"id"`
+	ProfileIDC      uint8  `json:"profileIdc"`
+	Profile         string `json:"profile"`
+	ConstraintFlags uint8  `json:"constraintFlags"`
+	LevelIDC        uint8  `json:"levelIdc"`
+	Level           string `json:"level"`
+	ChromaFormatIDC uint32 `json:"chromaFormatIdc"`
+	BitDepth        int    `json:"bitDepth"`
+	MaxRefFrames    uint32 `json:"maxRefFrames"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	Interlaced      bool   `json:"interlaced"`
+	// frame rate of VUI timing info, 0 if not present
+	FrameRate float64 `json:"frameRate"`
+}
+
+// H264PPS is the fields of H.264 picture parameter set
+type H264PPS struct {
+	ID    uint32 `json:"id"`
+	SPSID uint32 `json:"spsId"`
+	CABAC bool   `json:"cabac"`
+}
+
+// H264NALUType returns type of H.264 NAL unit
+func H264NALUType(nal []byte) int {
+	if len(nal) == 0 {
+		return -1
+	}
+	return int(nal[0] & 0x1F)
+}
+
+func h264ProfileName(idc uint8, constraints uint8) string {
+	switch idc {
+	case 66:
+		if constraints&0x40 != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4 Predictive"
+	case 44:
+		return "CAVLC 4:4:4 Intra"
+	}
+	return fmt.Sprintf("%d", idc)
+}
+
+func h264LevelName(idc uint8, constraints uint8) string {
+	if idc == 11 && constraints&0x10 != 0 {
+		return "1b"
+	}
+	if idc%10 == 0 {
+		return fmt.Sprintf("%d", idc/10)
+	}
+	return fmt.Sprintf("%d.%d", idc/10, idc%10)
+}
+
+// hasChromaInfo reports whether SPS of profile carries chroma format and bit
+// depth, which are 4:2:0 and 8 bits otherwise
+func hasChromaInfo(profileIDC uint8) bool {
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+// ParseH264SPS parses H.264 SPS NAL unit with header
+func ParseH264SPS(nal []byte) (*H264SPS, error) {
+	if H264NALUType(nal) != H264NALUTypeSPS {
+		return nil, fmt.Errorf("%w: expect h264 sps, got %d", InvalidNALUTypeError, H264NALUType(nal))
+	}
+	r := newBitReader(unescapeRBSP(nal[1:]))
+	sps := &H264SPS{ChromaFormatIDC: 1, BitDepth: 8}
+	sps.ProfileIDC = uint8(r.readBits(8))
+	sps.ConstraintFlags = uint8(r.readBits(8))
+	sps.LevelIDC = uint8(r.readBits(8))
+	sps.ID = r.readUE()
+	separateColourPlane := false
+	if hasChromaInfo(sps.ProfileIDC) {
+		sps.ChromaFormatIDC = r.readUE()
+		if sps.ChromaFormatIDC == 3 {
+			separateColourPlane = r.readFlag()
+		}
+		sps.BitDepth = int(r.readUE()) + 8
+		r.readUE() // bit_depth_chroma_minus8
+		r.readFlag()
+		if r.readFlag() {
+			lists := 8
+			if sps.ChromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.readFlag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				skipScalingList(r, size)
+			}
+		}
+	}
+	r.readUE() // log2_max_frame_num_minus4
+	switch r.readUE() {
+	case 0:
+		r.readUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.readFlag()
+		r.readSE()
+		r.readSE()
+		cycle := r.readUE()
+		for i := uint32(0); i < cycle && r.err == nil; i++ {
+			r.readSE()
+		}
+	}
+	sps.MaxRefFrames = r.readUE()
+	r.readFlag()
+	widthInMbs := int(r.readUE()) + 1
+	heightInMapUnits := int(r.readUE()) + 1
+	frameMbsOnly := r.readFlag()
+	if !frameMbsOnly {
+		r.readFlag()
+	}
+	r.readFlag()
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.readFlag() {
+		cropLeft, cropRight = int(r.readUE()), int(r.readUE())
+		cropTop, cropBottom = int(r.readUE()), int(r.readUE())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	vui := r.readFlag()
+
+	fields := 2
+	if frameMbsOnly {
+		fields = 1
+	}
+	cropX, cropY := 1, fields
+	if sps.ChromaFormatIDC != 0 && !separateColourPlane {
+		subWidth, subHeight := 2, 2
+		if sps.ChromaFormatIDC == 2 {
+			subHeight = 1
+		} else if sps.ChromaFormatIDC == 3 {
+			subWidth, subHeight = 1, 1
+		}
+		cropX, cropY = subWidth, subHeight*fields
+	}
+	sps.Width = widthInMbs*16 - cropX*(cropLeft+cropRight)
+	sps.Height = fields*heightInMapUnits*16 - cropY*(cropTop+cropBottom)
+	sps.Interlaced = !frameMbsOnly
+	sps.Profile = h264ProfileName(sps.ProfileIDC, sps.ConstraintFlags)
+	sps.Level = h264LevelName(sps.LevelIDC, sps.ConstraintFlags)
+	if vui {
+		// VUI truncated is ignored, frame rate is not signaled then
+		sps.FrameRate = parseH264VUITiming(r)
+	}
+	return sps, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.readSE() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseH264VUITiming returns frame rate of VUI timing info, see ITU-T H.264
+// E.1.1
+func parseH264VUITiming(r *bitReader) float64 {
+	if r.readFlag() { // aspect_ratio_info_present_flag
+		if r.readBits(8) == 255 {
+			r.readBits(32)
+		}
+	}
+	if r.readFlag() { // overscan_info_present_flag
+		r.readFlag()
+	}
+	if r.readFlag() { // video_signal_type_present_flag
+		r.readBits(4)
+		if r.readFlag() {
+			r.readBits(24)
+		}
+	}
+	if r.readFlag() { // chroma_loc_info_present_flag
+		r.readUE()
+		r.readUE()
+	}
+	if !r.readFlag() { // timing_info_present_flag
+		return 0
+	}
+	unitsInTick := r.readBits(32)
+	timeScale := r.readBits(32)
+	if r.err != nil || unitsInTick == 0 {
+		return 0
+	}
+	return float64(timeScale) / float64(2*unitsInTick)
+}
+
+// ParseH264PPS parses H.264 PPS NAL unit with header
+func ParseH264PPS(nal []byte) (*H264PPS, error) {
+	if H264NALUType(nal) != H264NALUTypePPS {
+		return nil, fmt.Errorf("%w: expect h264 pps, got %d", InvalidNALUTypeError, H264NALUType(nal))
+	}
+	r := newBitReader(unescapeRBSP(nal[1:]))
+	pps := &H264PPS{}
+	pps.ID = r.readUE()
+	pps.SPSID = r.readUE()
+	pps.CABAC = r.readFlag()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return pps, nil
+}
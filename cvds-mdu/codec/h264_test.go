@@ -0,0 +1,44 @@
+package codec
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestParseH264SPS(t *testing.T) {
+	nal, _ := base64.StdEncoding.DecodeString("Z00AKZpkA8ARPy4C3AQEBQAAAwPoAADDUOhgAJiWAAJiVlF3lgA=")
+	sps, err := ParseH264SPS(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Profile != "Main" || sps.Level != "4.1" || sps.ChromaFormatIDC != 1 || sps.BitDepth != 8 {
+		t.Fatalf("unexpected profile and level: %+v", sps)
+	}
+	// 1088 lines of macroblocks cropped to 1080
+	if sps.Width != 1920 || sps.Height != 1080 || sps.Interlaced || sps.MaxRefFrames != 1 {
+		t.Fatalf("unexpected size: %+v", sps)
+	}
+	// timing info of VUI after emulation prevention bytes
+	if sps.FrameRate != 25 {
+		t.Fatalf("expect frame rate 25, got %v", sps.FrameRate)
+	}
+
+	if _, err := ParseH264SPS(nal[:6]); !errors.Is(err, ShortBitstreamError) {
+		t.Fatalf("expect truncated sps failed, got %v", err)
+	}
+	if _, err := ParseH264SPS([]byte{0x68, 0xEE}); !errors.Is(err, InvalidNALUTypeError) {
+		t.Fatalf("expect pps not parsed as sps, got %v", err)
+	}
+}
+
+func TestParseH264PPS(t *testing.T) {
+	nal, _ := base64.StdEncoding.DecodeString("aO48gA==")
+	pps, err := ParseH264PPS(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pps.ID != 0 || pps.SPSID != 0 || !pps.CABAC {
+		t.Fatalf("unexpected pps: %+v", pps)
+	}
+}
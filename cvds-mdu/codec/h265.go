@@ -0,0 +1,212 @@
+package codec
+
+import (
+	"fmt"
+)
+
+const (
+	H265NALUTypeVPS = 32
+	H265NALUTypeSPS = 33
+	H265NALUTypePPS = 34
+)
+
+// H265ProfileTierLevel is the general profile, tier and level of H.265
+// parameter sets, see ITU-T H.265 7.3.3
+type H265ProfileTierLevel struct {
+	ProfileIDC uint8  `json:"profileIdc"`
+	Profile    string `json:"profile"`
+	Tier       string `json:"tier"`
+	LevelIDC   uint8  `json:"levelIdc"`
+	Level      string `json:"level"`
+}
+
+// H265VPS is the fields of H.265 video parameter set, see ITU-T H.265
+// 7.3.2.1
+type H265VPS struct {
+	ID           uint32 `json:"id"`
+	MaxLayers    int    `json:"maxLayers"`
+	MaxSubLayers int    `json:"maxSubLayers"`
+	H265ProfileTierLevel
+	// frame rate of VPS timing info, 0 if not present
+	FrameRate float64 `json:"frameRate"`
+}
+
+// H265SPS is the fields of H.265 sequence parameter set describing the
+// stream, see ITU-T H.265 7.3.2.2
+type H265SPS struct {
+	ID           uint32 `json:"id"`
+	VPSID        uint32 `json:"vpsId"`
+	MaxSubLayers int    `json:"maxSubLayers"`
+	H265ProfileTierLevel
+	ChromaFormatIDC uint32 `json:"chromaFormatIdc"`
+	BitDepth        int    `json:"bitDepth"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+}
+
+// H265PPS is the fields of H.265 picture parameter set
+type H265PPS struct {
+	ID    uint32 `json:"id"`
+	SPSID uint32 `json:"spsId"`
+}
+
+// H265NALUType returns type of H.265 NAL unit
+func H265NALUType(nal []byte) int {
+	if len(nal) < 2 {
+		return -1
+	}
+	return int(nal[0] >> 1 & 0x3F)
+}
+
+func h265ProfileName(idc uint8) string {
+	switch idc {
+	case 1:
+		return "Main"
+	case 2:
+		return "Main 10"
+	case 3:
+		return "Main Still Picture"
+	case 4:
+		return "Range Extensions"
+	case 5:
+		return "High Throughput"
+	case 9:
+		return "Screen Content Coding"
+	}
+	return fmt.Sprintf("%d", idc)
+}
+
+// parseH265ProfileTierLevel parses profile_tier_level with profile present
+func parseH265ProfileTierLevel(r *bitReader, maxSubLayersMinus1 int) H265ProfileTierLevel {
+	ptl := H265ProfileTierLevel{Tier: "Main"}
+	r.readBits(2) // general_profile_space
+	if r.readFlag() {
+		ptl.Tier = "High"
+	}
+	ptl.ProfileIDC = uint8(r.readBits(5))
+	r.readBits(32) // general_profile_compatibility_flags
+	r.skipBits(48) // source flags and constraint flags
+	ptl.LevelIDC = uint8(r.readBits(8))
+	profilePresent := make([]bool, maxSubLayersMinus1)
+	levelPresent := make([]bool, maxSubLayersMinus1)
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.readFlag()
+		levelPresent[i] = r.readFlag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		r.skipBits(2 * (8 - maxSubLayersMinus1))
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.skipBits(88)
+		}
+		if levelPresent[i] {
+			r.skipBits(8)
+		}
+	}
+	ptl.Profile = h265ProfileName(ptl.ProfileIDC)
+	// level_idc is 30 times the level number
+	if ptl.LevelIDC%30 == 0 {
+		ptl.Level = fmt.Sprintf("%d", ptl.LevelIDC/30)
+	} else {
+		ptl.Level = fmt.Sprintf("%d.%d", ptl.LevelIDC/30, ptl.LevelIDC%30/3)
+	}
+	return ptl
+}
+
+// ParseH265VPS parses H.265 VPS NAL unit with header
+func ParseH265VPS(nal []byte) (*H265VPS, error) {
+	if H265NALUType(nal) != H265NALUTypeVPS {
+		return nil, fmt.Errorf("%w: expect h265 vps, got %d", InvalidNALUTypeError, H265NALUType(nal))
+	}
+	r := newBitReader(unescapeRBSP(nal[2:]))
+	vps := &H265VPS{}
+	vps.ID = r.readBits(4)
+	r.readBits(2)
+	vps.MaxLayers = int(r.readBits(6)) + 1
+	maxSubLayersMinus1 := int(r.readBits(3))
+	vps.MaxSubLayers = maxSubLayersMinus1 + 1
+	r.readBits(17)
+	vps.H265ProfileTierLevel = parseH265ProfileTierLevel(r, maxSubLayersMinus1)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// timing info truncated is ignored, frame rate is not signaled then
+	first := maxSubLayersMinus1
+	if r.readFlag() { // vps_sub_layer_ordering_info_present_flag
+		first = 0
+	}
+	for i := first; i <= maxSubLayersMinus1; i++ {
+		r.readUE()
+		r.readUE()
+		r.readUE()
+	}
+	maxLayerID := int(r.readBits(6))
+	layerSets := r.readUE()
+	for i := uint32(1); i <= layerSets && r.err == nil; i++ {
+		r.skipBits(maxLayerID + 1)
+	}
+	if r.readFlag() { // vps_timing_info_present_flag
+		unitsInTick := r.readBits(32)
+		timeScale := r.readBits(32)
+		if r.err == nil && unitsInTick > 0 {
+			vps.FrameRate = float64(timeScale) / float64(unitsInTick)
+		}
+	}
+	return vps, nil
+}
+
+// ParseH265SPS parses H.265 SPS NAL unit with header
+func ParseH265SPS(nal []byte) (*H265SPS, error) {
+	if H265NALUType(nal) != H265NALUTypeSPS {
+		return nil, fmt.Errorf("%w: expect h265 sps, got %d", InvalidNALUTypeError, H265NALUType(nal))
+	}
+	r := newBitReader(unescapeRBSP(nal[2:]))
+	sps := &H265SPS{}
+	sps.VPSID = r.readBits(4)
+	maxSubLayersMinus1 := int(r.readBits(3))
+	sps.MaxSubLayers = maxSubLayersMinus1 + 1
+	r.readFlag()
+	sps.H265ProfileTierLevel = parseH265ProfileTierLevel(r, maxSubLayersMinus1)
+	sps.ID = r.readUE()
+	sps.ChromaFormatIDC = r.readUE()
+	if sps.ChromaFormatIDC == 3 {
+		r.readFlag()
+	}
+	width, height := int(r.readUE()), int(r.readUE())
+	var left, right, top, bottom int
+	if r.readFlag() { // conformance_window_flag
+		left, right = int(r.readUE()), int(r.readUE())
+		top, bottom = int(r.readUE()), int(r.readUE())
+	}
+	sps.BitDepth = int(r.readUE()) + 8
+	if r.err != nil {
+		return nil, r.err
+	}
+	subWidth, subHeight := 1, 1
+	switch sps.ChromaFormatIDC {
+	case 1:
+		subWidth, subHeight = 2, 2
+	case 2:
+		subWidth = 2
+	}
+	sps.Width = width - subWidth*(left+right)
+	sps.Height = height - subHeight*(top+bottom)
+	return sps, nil
+}
+
+// ParseH265PPS parses H.265 PPS NAL unit with header
+func ParseH265PPS(nal []byte) (*H265PPS, error) {
+	if H265NALUType(nal) != H265NALUTypePPS {
+		return nil, fmt.Errorf("%w: expect h265 pps, got %d", InvalidNALUTypeError, H265NALUType(nal))
+	}
+	r := newBitReader(unescapeRBSP(nal[2:]))
+	pps := &H265PPS{}
+	pps.ID = r.readUE()
+	pps.SPSID = r.readUE()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return pps, nil
+}
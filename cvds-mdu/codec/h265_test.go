@@ -0,0 +1,43 @@
+package codec
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParseH265(t *testing.T) {
+	nal, _ := base64.StdEncoding.DecodeString("QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ")
+	vps, err := ParseH265VPS(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vps.ID != 0 || vps.MaxLayers != 1 || vps.MaxSubLayers != 1 || vps.FrameRate != 0 {
+		t.Fatalf("unexpected vps: %+v", vps)
+	}
+	if vps.Profile != "Main" || vps.Tier != "Main" || vps.Level != "3.1" {
+		t.Fatalf("unexpected profile of vps: %+v", vps.H265ProfileTierLevel)
+	}
+
+	nal, _ = base64.StdEncoding.DecodeString("QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyvAQEAAAAMAQAAABkI=")
+	sps, err := ParseH265SPS(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.ID != 0 || sps.VPSID != 0 || sps.Profile != "Main" || sps.Level != "3.1" {
+		t.Fatalf("unexpected sps: %+v", sps)
+	}
+	if sps.Width != 1280 || sps.Height != 720 || sps.ChromaFormatIDC != 1 || sps.BitDepth != 8 {
+		t.Fatalf("unexpected size: %+v", sps)
+	}
+	if _, err := ParseH265SPS(nal[:10]); err == nil {
+		t.Fatal("expect truncated sps failed")
+	}
+
+	pps, err := ParseH265PPS([]byte{0x44, 0x01, 0xC1, 0x72, 0xB4, 0x62, 0x40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pps.ID != 0 || pps.SPSID != 0 {
+		t.Fatalf("unexpected pps: %+v", pps)
+	}
+}
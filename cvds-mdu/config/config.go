@@ -12,6 +12,10 @@ import (
 type Config struct {
 	Http     Http              `yaml:"http" json:"http"`
 	RTSP     Rtsp              `yaml:"rtsp" json:"rtsp"`
+	GB28181  GB28181           `yaml:"gb28181" json:"gb28181"`
+	Onvif    Onvif             `yaml:"onvif" json:"onvif"`
+	MSU      Msu               `yaml:"msu" json:"msu"`
+	Users    []User            `yaml:"users" json:"users"`
 	Log      Log               `yaml:"log" json:"log"`
 	Service  Service           `yaml:"service" json:"service"`
 	Figure   Figure            `yaml:"figure" json:"figure"`
@@ -110,6 +114,22 @@ func RtspConfig() *Rtsp {
 	return &GlobalConfig().RTSP
 }
 
+func GB28181Config() *GB28181 {
+	return &GlobalConfig().GB28181
+}
+
+func OnvifConfig() *Onvif {
+	return &GlobalConfig().Onvif
+}
+
+func MsuConfig() *Msu {
+	return &GlobalConfig().MSU
+}
+
+func UsersConfig() []User {
+	return GlobalConfig().Users
+}
+
 func LogConfig() *Log {
 	return &GlobalConfig().Log
 }
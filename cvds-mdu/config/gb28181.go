@@ -0,0 +1,114 @@
+package config
+
+import (
+	"github.com/CVDS2020/CVDS2020/common/config"
+	"github.com/CVDS2020/CVDS2020/common/def"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/common/unit"
+	"net"
+	"strconv"
+	"time"
+)
+
+var InvalidGB28181RTPPortRangeError = errors.New("invalid gb28181 rtp port range")
+
+type GB28181 struct {
+	// enable gb28181 sip server, default false
+	Enable bool `yaml:"enable" json:"enable"`
+	// sip server listening host, default 0.0.0.0
+	Host string `yaml:"host" json:"host"`
+	// sip server listening port, default 5060
+	Port int `yaml:"port" json:"port"`
+	// sip server listening address, calculate by Host and Port
+	addr *net.UDPAddr
+
+	// ip address advertised to devices in Contact and SDP, default is Host
+	// if Host is not unspecified address, otherwise the first non-loopback
+	// address of this machine
+	ExternalIP string `yaml:"external-ip" json:"external-ip"`
+
+	// sip server id, default 34020000002000000001
+	ID string `yaml:"id" json:"id"`
+	// sip domain, default first 10 characters of ID
+	Domain string `yaml:"domain" json:"domain"`
+	// password required for device register, if empty register without authentication
+	Password string `yaml:"password" json:"password"`
+
+	// register expires returned to device if device not specified, default 3600
+	RegisterExpires int `yaml:"register-expires" json:"register-expires"`
+	// device is offline if no keepalive received within this timeout, default 3m
+	KeepaliveTimeout time.Duration `yaml:"keepalive-timeout" json:"keepalive-timeout"`
+	// sip transaction response timeout, default 5s
+	TransactionTimeout time.Duration `yaml:"transaction-timeout" json:"transaction-timeout"`
+
+	RTP struct {
+		// rtp receiver listening port range, if PortMin is zero use random port
+		PortMin int `yaml:"port-min" json:"port-min"`
+		PortMax int `yaml:"port-max" json:"port-max"`
+		// stream is closed if no rtp packet received within this timeout, default 10s
+		Timeout    time.Duration `yaml:"timeout" json:"timeout"`
+		ReadBuffer int           `yaml:"read-buffer" json:"read-buffer"`
+	} `yaml:"rtp" json:"rtp"`
+
+	// rtsp path prefix of device channel stream, path is <PathPrefix>/<DeviceID>/<ChannelID>,
+	// default /gb28181
+	PathPrefix string `yaml:"path-prefix" json:"path-prefix"`
+}
+
+func (g *GB28181) PreHandle() config.PreHandlerConfig {
+	if g == nil {
+		g = new(GB28181)
+	}
+	g.Host = "0.0.0.0"
+	g.Port = 5060
+	g.ID = "34020000002000000001"
+	g.RegisterExpires = 3600
+	g.KeepaliveTimeout = 3 * time.Minute
+	g.TransactionTimeout = 5 * time.Second
+	g.RTP.Timeout = 10 * time.Second
+	g.RTP.ReadBuffer = unit.MeBiByte
+	g.PathPrefix = "/gb28181"
+	return g
+}
+
+func (g *GB28181) PostHandle() (config.PostHandlerConfig, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(g.Host, strconv.Itoa(g.Port)))
+	if err != nil {
+		return nil, err
+	}
+	g.addr = addr
+	if g.Domain == "" && len(g.ID) >= 10 {
+		g.Domain = g.ID[:10]
+	}
+	if g.ExternalIP == "" {
+		if addr.IP != nil && !addr.IP.IsUnspecified() {
+			g.ExternalIP = addr.IP.String()
+		} else {
+			g.ExternalIP = localIP()
+		}
+	}
+	if g.RTP.PortMin > 0 {
+		def.SetDefault(&g.RTP.PortMax, g.RTP.PortMin)
+		if g.RTP.PortMax < g.RTP.PortMin || g.RTP.PortMax > 65535 {
+			return nil, InvalidGB28181RTPPortRangeError
+		}
+	}
+	return g, nil
+}
+
+func (g *GB28181) GetAddr() *net.UDPAddr {
+	return g.addr
+}
+
+func localIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "127.0.0.1"
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return "127.0.0.1"
+}
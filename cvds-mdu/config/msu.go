@@ -0,0 +1,28 @@
+package config
+
+import (
+	"github.com/CVDS2020/CVDS2020/common/config"
+	"strings"
+	"time"
+)
+
+type Msu struct {
+	// base url of msu http api, default http://127.0.0.1:8382
+	Addr string `yaml:"addr" json:"addr"`
+	// msu http api request timeout, default 5s
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+}
+
+func (m *Msu) PreHandle() config.PreHandlerConfig {
+	if m == nil {
+		m = new(Msu)
+	}
+	m.Addr = "http://127.0.0.1:8382"
+	m.Timeout = 5 * time.Second
+	return m
+}
+
+func (m *Msu) PostHandle() (config.PostHandlerConfig, error) {
+	m.Addr = strings.TrimRight(m.Addr, "/")
+	return m, nil
+}
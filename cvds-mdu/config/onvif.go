@@ -0,0 +1,106 @@
+package config
+
+import (
+	"github.com/CVDS2020/CVDS2020/common/config"
+	"github.com/CVDS2020/CVDS2020/common/def"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"time"
+)
+
+var InvalidOnvifEventActionError = errors.New("invalid onvif event action")
+
+type Onvif struct {
+	Discovery struct {
+		// ws-discovery probe address, default 239.255.255.250:3702
+		Addr string `yaml:"addr" json:"addr"`
+		// how long to wait for probe matches, default 3s
+		Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	} `yaml:"discovery" json:"discovery"`
+
+	// default credential of devices if not specified when adding device
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+
+	// soap request timeout, default 5s
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+
+	// rtsp path prefix of provisioned relays, path is <PathPrefix>/<Device>/<Profile>,
+	// default /onvif
+	PathPrefix string `yaml:"path-prefix" json:"path-prefix"`
+
+	Event struct {
+		// timeout of a PullMessages request, default 10s
+		PullTimeout time.Duration `yaml:"pull-timeout" json:"pull-timeout"`
+		// max messages of a PullMessages request, default 100
+		MessageLimit int `yaml:"message-limit" json:"message-limit"`
+		// subscription termination time, renewed before expired, default 60s
+		Termination time.Duration `yaml:"termination" json:"termination"`
+		// interval to resubscribe after subscription failed, default 5s
+		RetryInterval time.Duration `yaml:"retry-interval" json:"retry-interval"`
+		// how many recent events kept for event api, default 1000
+		History int `yaml:"history" json:"history"`
+	} `yaml:"event" json:"event"`
+
+	// cameras subscribed for events
+	Cameras []OnvifCamera `yaml:"cameras" json:"cameras"`
+}
+
+// OnvifCamera is a camera whose events are subscribed
+type OnvifCamera struct {
+	// device service address, e.g. http://192.168.1.64/onvif/device_service
+	XAddr string `yaml:"xaddr" json:"xaddr"`
+	// credential, default credential of onvif config if empty
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// uuid of MSU record channel actions work on, if empty, channel of the
+	// provisioned path of the device is used
+	Channel string `yaml:"channel" json:"channel"`
+	// actions triggered by events
+	Actions []OnvifEventAction `yaml:"actions" json:"actions"`
+}
+
+// OnvifEventAction triggers action when event of type happened
+type OnvifEventAction struct {
+	// event type: motion, tamper, line-crossing, intrusion, other or * for all
+	Event string `yaml:"event" json:"event"`
+	// action: mark to mark MSU recordings, record to start event recording
+	Action string `yaml:"action" json:"action"`
+	// duration of event recording, default 30s
+	Duration time.Duration `yaml:"duration" json:"duration"`
+}
+
+func (o *Onvif) PreHandle() config.PreHandlerConfig {
+	if o == nil {
+		o = new(Onvif)
+	}
+	o.Discovery.Addr = "239.255.255.250:3702"
+	o.Discovery.Timeout = 3 * time.Second
+	o.Timeout = 5 * time.Second
+	o.PathPrefix = "/onvif"
+	o.Event.PullTimeout = 10 * time.Second
+	o.Event.MessageLimit = 100
+	o.Event.Termination = 60 * time.Second
+	o.Event.RetryInterval = 5 * time.Second
+	o.Event.History = 1000
+	return o
+}
+
+func (o *Onvif) PostHandle() (config.PostHandlerConfig, error) {
+	for i := range o.Cameras {
+		camera := &o.Cameras[i]
+		if camera.Username == "" {
+			camera.Username, camera.Password = o.Username, o.Password
+		}
+		for j := range camera.Actions {
+			action := &camera.Actions[j]
+			switch action.Action {
+			case "mark", "record":
+			default:
+				return nil, InvalidOnvifEventActionError
+			}
+			def.SetDefault(&action.Event, "*")
+			def.SetDefault(&action.Duration, 30*time.Second)
+		}
+	}
+	return o, nil
+}
@@ -3,12 +3,78 @@ package config
 import (
 	"github.com/CVDS2020/CVDS2020/common/config"
 	"github.com/CVDS2020/CVDS2020/common/def"
+	"github.com/CVDS2020/CVDS2020/common/errors"
 	"github.com/CVDS2020/CVDS2020/common/unit"
 	"net"
+	"net/url"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
+var InvalidLagPolicyError = errors.New("invalid player lag policy")
+var InvalidPathPatternError = errors.New("invalid rtsp path pattern")
+var InvalidPathPublisherError = errors.New("invalid rtsp path publisher")
+var InvalidPathSourceError = errors.New("invalid rtsp path source trans type")
+var InvalidPathRecordModeError = errors.New("invalid rtsp path record mode")
+var InvalidEdgeOriginError = errors.New("invalid rtsp edge origin")
+var InvalidEdgeTransTypeError = errors.New("invalid rtsp edge trans type")
+var InvalidClusterAddressError = errors.New("invalid rtsp cluster address")
+var InvalidClusterRedirectStatusError = errors.New("invalid rtsp cluster redirect status")
+var InvalidSDPChangeError = errors.New("invalid rtsp pusher sdp change policy")
+var InvalidAuthSchemeError = errors.New("invalid rtsp auth scheme")
+var InvalidClientProfileError = errors.New("invalid rtsp client profile")
+var InvalidAutoTransportError = errors.New("invalid rtsp client auto transport")
+var InvalidSRTPSuiteError = errors.New("invalid rtsp srtp crypto suite")
+var InvalidNackHistoryError = errors.New("invalid rtsp nack history")
+
+// policies of player lagging behind pusher more than its queue limit
+const (
+	// drop the oldest packets, frames may be corrupted until next keyframe
+	LagPolicyDropOldest = "drop-oldest"
+	// drop the rest packets of frame damaged by lagging
+	LagPolicyDropFrame = "drop-frame"
+	// drop video packets until next keyframe
+	LagPolicyDropToKeyframe = "drop-to-keyframe"
+	// drop video packets until next keyframe, disconnect player if lagging
+	// sustained longer than DisconnectLag
+	LagPolicyDisconnect = "disconnect"
+)
+
+// policies of players when SDP of pusher changed incompatibly by the source
+// re-announced or reconnected
+const (
+	// players are stopped to reconnect and DESCRIBE the new SDP
+	SDPChangeReconnect = "reconnect"
+	// players are sent ANNOUNCE of the new SDP if tracks and codecs are
+	// unchanged, and stopped to reconnect otherwise
+	SDPChangeAnnounce = "announce"
+)
+
+// schemes of RTSP authentication challenged by server, see RFC 7617 and
+// RFC 7616
+const (
+	// credentials are sent in plain text, for clients supporting no digest
+	AuthSchemeBasic        = "basic"
+	AuthSchemeDigestMD5    = "digest-md5"
+	AuthSchemeDigestSHA256 = "digest-sha256"
+)
+
+// crypto suites of SRTP keys exchanged by SDES, see RFC 4568 6.2
+const (
+	SRTPSuiteAES128SHA1_80 = "AES_CM_128_HMAC_SHA1_80"
+	SRTPSuiteAES128SHA1_32 = "AES_CM_128_HMAC_SHA1_32"
+)
+
+// requests of RTSP client keeping session alive
+const (
+	KeepaliveOptions      = "options"
+	KeepaliveGetParameter = "get-parameter"
+	KeepaliveSetParameter = "set-parameter"
+)
+
 type ReadWriteBuffer struct {
 	ReadBuffer  int `yaml:"read-buffer" json:"read-buffer"`
 	WriteBuffer int `yaml:"write-buffer" json:"write-buffer"`
@@ -46,24 +112,145 @@ type Rtsp struct {
 	ReaderWriter    `yaml:",inline"`
 
 	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// write deadline of connections, peers not reading for this long are
+	// disconnected, default timeout or 10s if timeout not set
+	WriteTimeout time.Duration `yaml:"write-timeout" json:"write-timeout"`
+	// RTSP session timeout advertised in Session header, sessions receiving
+	// no request, RTP or RTCP for this long are closed, default 60s
+	SessionTimeout time.Duration `yaml:"session-timeout" json:"session-timeout"`
+
+	// disable UDP GSO of batched UDP writes on linux, for NICs or drivers
+	// not sending GSO datagrams properly
+	DisableUDPGSO bool `yaml:"disable-udp-gso" json:"disable-udp-gso"`
 
 	EnableAuthorization bool `yaml:"enable-authorization" json:"enable-authorization"`
 	CloseOld            bool `yaml:"close-old" json:"close-old"`
 
+	// authentication of sessions of paths with authorization enabled, users
+	// are the users config
+	Auth struct {
+		// realm of challenges, default CVDS
+		Realm string `yaml:"realm" json:"realm"`
+		// schemes challenged in order of preference, default digest-sha256
+		// and digest-md5
+		Schemes []string `yaml:"schemes" json:"schemes"`
+		// how long a nonce issued is valid, requests of expired nonce are
+		// challenged again with stale, default 5m
+		NonceExpiry time.Duration `yaml:"nonce-expiry" json:"nonce-expiry"`
+	} `yaml:"auth" json:"auth"`
+
 	Client struct {
 		ReaderWriter `yaml:",inline"`
 		Timeout      time.Duration
+		// quirks of cameras pulled, selected by source-profile of paths or
+		// by hosts of URLs
+		Profiles []RtspClientProfile `yaml:"profiles" json:"profiles"`
+		// transport selection of streams pulled of trans type auto
+		AutoTransport struct {
+			// transport tried first, udp or tcp, default udp
+			Prefer string `yaml:"prefer" json:"prefer"`
+			// the other transport is set up if no RTP received for this long
+			// after PLAY, and loss of UDP is measured in windows of it,
+			// default 3s
+			Timeout time.Duration `yaml:"timeout" json:"timeout"`
+			// UDP is switched to TCP if fraction of RTP lost in a window
+			// exceeds it, negative disables, default 0.2
+			LossThreshold float64 `yaml:"loss-threshold" json:"loss-threshold"`
+		} `yaml:"auto-transport" json:"auto-transport"`
 	} `yaml:"client" json:"client"`
 
 	Player struct {
 		QueueLimit           uint `yaml:"queue-limit" json:"queue-limit"`
 		DropPacketWhenPaused bool `yaml:"drop-packet-when-paused" json:"drop-packet-when-paused"`
+		// policy of player lagging more than queue limit, drop-oldest,
+		// drop-frame, drop-to-keyframe or disconnect, default drop-oldest
+		LagPolicy string `yaml:"lag-policy" json:"lag-policy"`
+		// max packets written to player connection in one vectored write,
+		// default 64
+		WriteBatch int `yaml:"write-batch" json:"write-batch"`
+		// how long a packet waits for more packets to be written together,
+		// also of requests and backchannel packets written by clients
+		// pulling sources, 0 writes packets ready immediately, default 2ms
+		WriteLatency time.Duration `yaml:"write-latency" json:"write-latency"`
+		// how long lagging sustained before player disconnected by disconnect
+		// policy, default 10s
+		DisconnectLag time.Duration `yaml:"disconnect-lag" json:"disconnect-lag"`
 	} `yaml:"player" json:"player"`
 
 	Pusher struct {
 		DisableGopCache bool `yaml:"disable-gop-cache" json:"disable-gop-cache"`
+		// max bytes of GOP cache, a larger GOP is not cached, 0 means no limit
+		GopCacheSize unit.Size `yaml:"gop-cache-size" json:"gop-cache-size"`
+		// packets buffered for players of a pusher, rounded up to power of 2,
+		// player lagging more than it loses packets, default 4096
+		RingSize uint `yaml:"ring-size" json:"ring-size"`
+		// reconnect or announce, default reconnect
+		SDPChange string `yaml:"sdp-change" json:"sdp-change"`
+		// reordering of RTP of UDP sources by sequence numbers
+		JitterBuffer struct {
+			// how long a packet out of order waits for packets before it,
+			// 0 disables the buffer, such as 50ms
+			Delay time.Duration `yaml:"delay" json:"delay"`
+			// max packets held of a track, default 256
+			Size int `yaml:"size" json:"size"`
+		} `yaml:"jitter-buffer" json:"jitter-buffer"`
 	} `yaml:"pusher" json:"pusher"`
 
+	// retransmission of RTP lost of UDP by RTCP Generic NACK of RFC 4585
+	Nack struct {
+		// NACKs of UDP players are honored and announced to players by
+		// a=rtcp-fb, and NACKs are sent to UDP sources announcing them
+		Enable bool `yaml:"enable" json:"enable"`
+		// RTP packets of a track kept for retransmission, default 512
+		History int `yaml:"history" json:"history"`
+	} `yaml:"nack" json:"nack"`
+
+	// SRTP of RTP/SAVP transport of UDP, keys exchanged by SDES a=crypto of
+	// RFC 4568, MIKEY is not supported. Pushers and sources offering keys
+	// by a=crypto may set up RTP/SAVP regardless of it
+	Srtp struct {
+		// SDP described to players offers keys of SRTP, and players may set
+		// up RTP/SAVP
+		Enable bool `yaml:"enable" json:"enable"`
+		// players and pushers must set up RTP/SAVP of UDP, TCP interleaved
+		// transport is refused, and SDP described to players declares
+		// RTP/SAVP, implies enable
+		Require bool `yaml:"require" json:"require"`
+		// crypto suite offered to players, default AES_CM_128_HMAC_SHA1_80
+		Suite string `yaml:"suite" json:"suite"`
+	} `yaml:"srtp" json:"srtp"`
+
+	// ONVIF backchannel of two-way audio, see ONVIF streaming specification
+	// 5.3. Talk audio of players is forwarded to sources pulled
+	Backchannel struct {
+		// sources are pulled requiring backchannel, and the backchannel
+		// track is described to players requiring it
+		Enable bool `yaml:"enable" json:"enable"`
+		// backchannel of a source is held by the talker until no audio of
+		// it for talk timeout, default 3s
+		TalkTimeout time.Duration `yaml:"talk-timeout" json:"talk-timeout"`
+	} `yaml:"backchannel" json:"backchannel"`
+
+	Memory struct {
+		// max bytes of RTP packets buffered by GOP caches, pusher queues and
+		// player queues, caches are trimmed and the laggiest players
+		// disconnected above it, 0 means no limit
+		Limit unit.Size `yaml:"limit" json:"limit"`
+		// new pushers and players are rejected above it, default 90% of limit
+		AdmissionLimit unit.Size `yaml:"admission-limit" json:"admission-limit"`
+		// interval of checking buffered bytes against limit, default 1s
+		CheckInterval time.Duration `yaml:"check-interval" json:"check-interval"`
+	} `yaml:"memory" json:"memory"`
+
+	// policies of paths, the first entry matched applies
+	Paths []RtspPath `yaml:"paths" json:"paths"`
+
+	// edge mode, paths played without pusher are pulled from origins
+	Edge RtspEdge `yaml:"edge" json:"edge"`
+
+	// cluster of MDU nodes sharing load and paths
+	Cluster RtspCluster `yaml:"cluster" json:"cluster"`
+
 	Audio        AV `yaml:"audio" json:"audio"`
 	AudioControl AV `yaml:"audio-control" json:"audio-control"`
 	Video        AV `yaml:"video" json:"video"`
@@ -82,6 +269,7 @@ func (r *Rtsp) PreHandle() config.PreHandlerConfig {
 	r.ReaderSize = 200 * unit.KiBiByte
 	r.Audio.ReadBuffer = 256 * unit.KiBiByte
 	r.Video.ReadBuffer = unit.MeBiByte
+	r.Player.WriteLatency = 2 * time.Millisecond
 	return r
 }
 
@@ -97,6 +285,86 @@ func (r *Rtsp) PostHandle() (config.PostHandlerConfig, error) {
 	def.SetDefault(&r.Client.ReaderSize, r.ReaderSize)
 	def.SetDefault(&r.Client.WriterSize, r.WriterSize)
 	def.SetDefault(&r.Client.Timeout, r.Timeout)
+	def.SetDefault(&r.WriteTimeout, r.Timeout)
+	def.SetDefault(&r.WriteTimeout, 10*time.Second)
+	def.SetDefault(&r.SessionTimeout, 60*time.Second)
+	def.SetDefault(&r.Pusher.RingSize, 4096)
+	def.SetDefault(&r.Pusher.SDPChange, SDPChangeReconnect)
+	switch r.Pusher.SDPChange {
+	case SDPChangeReconnect, SDPChangeAnnounce:
+	default:
+		return nil, InvalidSDPChangeError
+	}
+	def.SetDefault(&r.Pusher.JitterBuffer.Size, 256)
+	def.SetDefault(&r.Nack.History, 512)
+	if r.Nack.History <= 0 {
+		return nil, InvalidNackHistoryError
+	}
+	def.SetDefault(&r.Backchannel.TalkTimeout, 3*time.Second)
+	r.Srtp.Enable = r.Srtp.Enable || r.Srtp.Require
+	def.SetDefault(&r.Srtp.Suite, SRTPSuiteAES128SHA1_80)
+	switch r.Srtp.Suite = strings.ToUpper(r.Srtp.Suite); r.Srtp.Suite {
+	case SRTPSuiteAES128SHA1_80, SRTPSuiteAES128SHA1_32:
+	default:
+		return nil, InvalidSRTPSuiteError
+	}
+	def.SetDefault(&r.Auth.Realm, "CVDS")
+	if len(r.Auth.Schemes) == 0 {
+		r.Auth.Schemes = []string{AuthSchemeDigestSHA256, AuthSchemeDigestMD5}
+	}
+	for _, scheme := range r.Auth.Schemes {
+		switch scheme {
+		case AuthSchemeBasic, AuthSchemeDigestMD5, AuthSchemeDigestSHA256:
+		default:
+			return nil, InvalidAuthSchemeError
+		}
+	}
+	def.SetDefault(&r.Auth.NonceExpiry, 5*time.Minute)
+	def.SetDefault(&r.Player.LagPolicy, LagPolicyDropOldest)
+	switch r.Player.LagPolicy {
+	case LagPolicyDropOldest, LagPolicyDropFrame, LagPolicyDropToKeyframe, LagPolicyDisconnect:
+	default:
+		return nil, InvalidLagPolicyError
+	}
+	def.SetDefault(&r.Player.DisconnectLag, 10*time.Second)
+	def.SetDefault(&r.Player.WriteBatch, 64)
+	def.SetDefault(&r.Memory.AdmissionLimit, r.Memory.Limit/10*9)
+	def.SetDefault(&r.Memory.CheckInterval, time.Second)
+	def.SetDefault(&r.Client.AutoTransport.Prefer, "udp")
+	switch r.Client.AutoTransport.Prefer = strings.ToLower(r.Client.AutoTransport.Prefer); r.Client.AutoTransport.Prefer {
+	case "udp", "tcp":
+	default:
+		return nil, InvalidAutoTransportError
+	}
+	def.SetDefault(&r.Client.AutoTransport.Timeout, 3*time.Second)
+	def.SetDefault(&r.Client.AutoTransport.LossThreshold, 0.2)
+	if r.Client.AutoTransport.LossThreshold >= 1 {
+		return nil, InvalidAutoTransportError
+	}
+	for i := range r.Client.Profiles {
+		if err := r.Client.Profiles[i].compile(); err != nil {
+			return nil, err
+		}
+		for _, p := range r.Client.Profiles[:i] {
+			if p.Name == r.Client.Profiles[i].Name {
+				return nil, InvalidClientProfileError
+			}
+		}
+	}
+	for i := range r.Paths {
+		if err := r.Paths[i].compile(); err != nil {
+			return nil, err
+		}
+		if p := r.Paths[i].SourceProfile; p != "" && r.ClientProfile(p, "") == nil {
+			return nil, InvalidClientProfileError
+		}
+	}
+	if err := r.Edge.compile(); err != nil {
+		return nil, err
+	}
+	if err := r.Cluster.compile(); err != nil {
+		return nil, err
+	}
 
 	def.SetDefault(&r.Audio.WriteBuffer, r.Audio.ReadBuffer)
 	def.SetDefault(&r.AudioControl.ReadBuffer, r.Audio.ReadBuffer)
@@ -111,3 +379,348 @@ func (r *Rtsp) PostHandle() (config.PostHandlerConfig, error) {
 func (r *Rtsp) GetAddr() *net.TCPAddr {
 	return r.addr
 }
+
+// ClientProfile returns the client profile of name, or the first one of
+// hosts containing host if name is empty, nil if none
+func (r *Rtsp) ClientProfile(name string, host string) *RtspClientProfile {
+	for i := range r.Client.Profiles {
+		p := &r.Client.Profiles[i]
+		if name != "" {
+			if p.Name == name {
+				return p
+			}
+			continue
+		}
+		for _, h := range p.Hosts {
+			if strings.EqualFold(h, host) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// RtspClientProfile is the quirks of cameras of a vendor or model pulled by
+// RTSP client
+type RtspClientProfile struct {
+	Name string `yaml:"name" json:"name"`
+	// hosts of URLs the profile applies to if no profile named
+	Hosts []string `yaml:"hosts" json:"hosts"`
+	// request keeping session alive, options, get-parameter or
+	// set-parameter, default GET_PARAMETER if listed in Public of OPTIONS
+	// response, or OPTIONS
+	Keepalive string `yaml:"keepalive" json:"keepalive"`
+	// keepalive interval, default half of session timeout advertised, or of
+	// 60s if not advertised
+	KeepaliveInterval time.Duration `yaml:"keepalive-interval" json:"keepalive-interval"`
+	// DESCRIBE without OPTIONS first, for cameras closing connection of
+	// OPTIONS
+	SkipOptions bool `yaml:"skip-options" json:"skip-options"`
+	// control URLs resolved against URL requested, for cameras advertising
+	// Content-Base not reachable, such as of private address behind NAT
+	IgnoreContentBase bool `yaml:"ignore-content-base" json:"ignore-content-base"`
+	// PLAY requested with Range of npt=0.000-
+	PlayRange bool `yaml:"play-range" json:"play-range"`
+	// User-Agent instead of MDU, for cameras accepting known players only
+	UserAgent string `yaml:"user-agent" json:"user-agent"`
+	// extra headers of requests
+	Headers map[string]string `yaml:"headers" json:"headers"`
+}
+
+func (p *RtspClientProfile) compile() error {
+	if p.Name == "" {
+		return InvalidClientProfileError
+	}
+	switch p.Keepalive {
+	case "", KeepaliveOptions, KeepaliveGetParameter, KeepaliveSetParameter:
+	default:
+		return InvalidClientProfileError
+	}
+	return nil
+}
+
+// PathPolicy resolves the effective policy of path, by the first entry of
+// Paths matched and the global config
+func (r *Rtsp) PathPolicy(path string) *PathPolicy {
+	policy := &PathPolicy{
+		EnableAuthorization: r.EnableAuthorization,
+		CloseOld:            r.CloseOld,
+		DisableGopCache:     r.Pusher.DisableGopCache,
+		GopCacheSize:        r.Pusher.GopCacheSize.Int64(),
+		QueueLimit:          r.Player.QueueLimit,
+	}
+	for i := range r.Paths {
+		if p := &r.Paths[i]; p.Match(path) {
+			p.apply(policy)
+			break
+		}
+	}
+	return policy
+}
+
+// RtspPath sets policy of paths matched, fields not set inherit the global
+// config
+type RtspPath struct {
+	// pattern of paths, matched as ptz pattern of users, or a regular
+	// expression prefixed with "~", such as ~^/cam[0-9]+$
+	Path string `yaml:"path" json:"path"`
+	// addresses or CIDRs of hosts allowed to push to path, empty allows all
+	Publishers []string `yaml:"publishers" json:"publishers"`
+
+	EnableAuthorization *bool     `yaml:"enable-authorization" json:"enable-authorization"`
+	CloseOld            *bool     `yaml:"close-old" json:"close-old"`
+	DisableGopCache     *bool     `yaml:"disable-gop-cache" json:"disable-gop-cache"`
+	GopCacheSize        unit.Size `yaml:"gop-cache-size" json:"gop-cache-size"`
+	QueueLimit          uint      `yaml:"queue-limit" json:"queue-limit"`
+	// max players of path, 0 means no limit
+	MaxPlayers int `yaml:"max-players" json:"max-players"`
+
+	// rtsp url pulled on demand when path played without pusher
+	Source string `yaml:"source" json:"source"`
+	// backup rtsp urls of source in order of priority, pulled instead if
+	// source delivers no packets for failover timeout. Sources of higher
+	// priority are switched back to once recovered
+	BackupSources []string `yaml:"backup-sources" json:"backup-sources"`
+	// default 3s
+	FailoverTimeout time.Duration `yaml:"failover-timeout" json:"failover-timeout"`
+	// transport of pulling source, tcp, udp or auto, default tcp
+	SourceTransType string `yaml:"source-trans-type" json:"source-trans-type"`
+	// source stopped after no player for this long, default 10s
+	SourceIdleTimeout time.Duration `yaml:"source-idle-timeout" json:"source-idle-timeout"`
+	// name of client profile of sources, default the profile of hosts
+	// matched
+	SourceProfile string `yaml:"source-profile" json:"source-profile"`
+
+	// hand off pushers of path to MSU for recording, a record channel is
+	// started with pusher and stopped when pusher stopped
+	Record bool `yaml:"record" json:"record"`
+	// record mode of channel, continuous or event, default continuous
+	RecordMode string `yaml:"record-mode" json:"record-mode"`
+
+	regexp     *regexp.Regexp
+	publishers []*net.IPNet
+}
+
+func (p *RtspPath) compile() (err error) {
+	if p.Path == "" {
+		return InvalidPathPatternError
+	}
+	if strings.HasPrefix(p.Path, "~") {
+		if p.regexp, err = regexp.Compile(p.Path[1:]); err != nil {
+			return InvalidPathPatternError
+		}
+	} else if _, err = path.Match(strings.TrimSuffix(p.Path, "/**"), ""); err != nil {
+		return InvalidPathPatternError
+	}
+	p.publishers = p.publishers[:0]
+	for _, publisher := range p.Publishers {
+		if !strings.Contains(publisher, "/") {
+			if ip := net.ParseIP(publisher); ip != nil && ip.To4() != nil {
+				publisher += "/32"
+			} else {
+				publisher += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(publisher)
+		if err != nil {
+			return InvalidPathPublisherError
+		}
+		p.publishers = append(p.publishers, ipNet)
+	}
+	switch strings.ToLower(p.SourceTransType) {
+	case "", "tcp", "udp", "auto":
+	default:
+		return InvalidPathSourceError
+	}
+	switch p.RecordMode {
+	case "", "continuous", "event":
+	default:
+		return InvalidPathRecordModeError
+	}
+	if p.Source == "" && len(p.BackupSources) > 0 {
+		return InvalidPathSourceError
+	}
+	def.SetDefault(&p.SourceIdleTimeout, 10*time.Second)
+	def.SetDefault(&p.FailoverTimeout, 3*time.Second)
+	return nil
+}
+
+// Match reports whether path matched by pattern of entry
+func (p *RtspPath) Match(path string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(path)
+	}
+	return matchPath(p.Path, path)
+}
+
+func (p *RtspPath) apply(policy *PathPolicy) {
+	policy.Pattern = p.Path
+	policy.Publishers = p.publishers
+	if p.EnableAuthorization != nil {
+		policy.EnableAuthorization = *p.EnableAuthorization
+	}
+	if p.CloseOld != nil {
+		policy.CloseOld = *p.CloseOld
+	}
+	if p.DisableGopCache != nil {
+		policy.DisableGopCache = *p.DisableGopCache
+	}
+	if p.GopCacheSize > 0 {
+		policy.GopCacheSize = p.GopCacheSize.Int64()
+	}
+	if p.QueueLimit > 0 {
+		policy.QueueLimit = p.QueueLimit
+	}
+	policy.MaxPlayers = p.MaxPlayers
+	if p.Source != "" {
+		policy.Sources = append([]string{p.Source}, p.BackupSources...)
+	}
+	policy.SourceTransType = strings.ToLower(p.SourceTransType)
+	policy.SourceIdleTimeout = p.SourceIdleTimeout
+	policy.SourceProfile = p.SourceProfile
+	policy.FailoverTimeout = p.FailoverTimeout
+	policy.Record = p.Record
+	policy.RecordMode = p.RecordMode
+}
+
+// PathPolicy is the effective policy of a path
+type PathPolicy struct {
+	// pattern of the paths entry matched, empty if none matched
+	Pattern    string
+	Publishers []*net.IPNet
+
+	EnableAuthorization bool
+	CloseOld            bool
+	DisableGopCache     bool
+	GopCacheSize        int64
+	QueueLimit          uint
+	MaxPlayers          int
+
+	// source and backup sources in order of priority
+	Sources           []string
+	SourceTransType   string
+	SourceIdleTimeout time.Duration
+	SourceProfile     string
+	FailoverTimeout   time.Duration
+
+	Record     bool
+	RecordMode string
+}
+
+// AllowPublisher reports whether host of ip allowed to push to path
+func (p *PathPolicy) AllowPublisher(ip net.IP) bool {
+	if len(p.Publishers) == 0 {
+		return true
+	}
+	for _, ipNet := range p.Publishers {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RtspEdge is the edge mode of MDU. Paths played without pusher are pulled
+// from the first origin serving it, the stream is shared by players of path
+// and stopped after idle, so origins see edge as one player
+type RtspEdge struct {
+	Enable bool `yaml:"enable" json:"enable"`
+	// origin rtsp servers asked in order, such as rtsp://10.0.0.1:554
+	Origins []string `yaml:"origins" json:"origins"`
+	// origins of paths by prefix, the longest prefix matched applies over
+	// origins
+	Routes []RtspEdgeRoute `yaml:"routes" json:"routes"`
+	// transport of pulling from origins, tcp, udp or auto, default tcp
+	TransType string `yaml:"trans-type" json:"trans-type"`
+	// stream stopped after no player for this long, default 10s
+	IdleTimeout time.Duration `yaml:"idle-timeout" json:"idle-timeout"`
+}
+
+type RtspEdgeRoute struct {
+	Prefix  string   `yaml:"prefix" json:"prefix"`
+	Origins []string `yaml:"origins" json:"origins"`
+}
+
+func (e *RtspEdge) compile() error {
+	origins := append([]string{}, e.Origins...)
+	for _, route := range e.Routes {
+		origins = append(origins, route.Origins...)
+	}
+	for _, origin := range origins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme != "rtsp" || u.Host == "" {
+			return InvalidEdgeOriginError
+		}
+	}
+	e.TransType = strings.ToLower(e.TransType)
+	switch e.TransType {
+	case "", "tcp", "udp", "auto":
+	default:
+		return InvalidEdgeTransTypeError
+	}
+	def.SetDefault(&e.IdleTimeout, 10*time.Second)
+	return nil
+}
+
+// OriginsOf returns origins asked for path, nil if edge mode disabled
+func (e *RtspEdge) OriginsOf(path string) []string {
+	if !e.Enable {
+		return nil
+	}
+	origins, prefix := e.Origins, ""
+	for _, route := range e.Routes {
+		if strings.HasPrefix(path, route.Prefix) && len(route.Prefix) > len(prefix) {
+			origins, prefix = route.Origins, route.Prefix
+		}
+	}
+	return origins
+}
+
+// RtspCluster shares load and paths of MDU nodes by gossip. Players of paths
+// not local, or above local limits, are redirected to the least loaded peer
+// serving the path
+type RtspCluster struct {
+	Enable bool `yaml:"enable" json:"enable"`
+	// gossip listening address, default :8191
+	Listen string `yaml:"listen" json:"listen"`
+	// gossip addresses of peers, such as 10.0.0.2:8191
+	Peers []string `yaml:"peers" json:"peers"`
+	// rtsp url of node advertised to peers, default url of rtsp server
+	// address, which should be set if host unspecified
+	Advertise string `yaml:"advertise" json:"advertise"`
+	// interval of gossip, peers not heard for 3 intervals are removed,
+	// default 1s
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// players are redirected above limits, 0 means no limit
+	MaxPlayers int `yaml:"max-players" json:"max-players"`
+	// max output bytes per second
+	MaxOutputRate unit.Size `yaml:"max-output-rate" json:"max-output-rate"`
+	// status of redirect, 301 or 302, default 302
+	RedirectStatus int `yaml:"redirect-status" json:"redirect-status"`
+	// secret shared by nodes, gossip is signed by HMAC-SHA256 of secret and
+	// gossip not signed by it dropped. Gossip is not signed if empty, and
+	// only addresses of peers are trusted
+	Secret string `yaml:"secret" json:"secret"`
+}
+
+func (c *RtspCluster) compile() error {
+	if !c.Enable {
+		return nil
+	}
+	def.SetDefault(&c.Listen, ":8191")
+	def.SetDefault(&c.Interval, time.Second)
+	def.SetDefault(&c.RedirectStatus, 302)
+	for _, addr := range append([]string{c.Listen}, c.Peers...) {
+		if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+			return InvalidClusterAddressError
+		}
+	}
+	if c.Advertise != "" {
+		if u, err := url.Parse(c.Advertise); err != nil || u.Scheme != "rtsp" || u.Host == "" {
+			return InvalidClusterAddressError
+		}
+	}
+	if c.RedirectStatus != 301 && c.RedirectStatus != 302 {
+		return InvalidClusterRedirectStatusError
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRtspPathPolicy(t *testing.T) {
+	disable, enable := true, false
+	r := &Rtsp{Paths: []RtspPath{
+		{Path: "/live/*", DisableGopCache: &disable, MaxPlayers: 2, Publishers: []string{"10.0.0.0/8", "192.168.1.64"}},
+		{Path: "~^/cam[0-9]+$", GopCacheSize: 1 << 20, QueueLimit: 100, Source: "rtsp://192.168.1.64/stream", BackupSources: []string{"rtsp://192.168.1.65/stream"}, Record: true},
+		{Path: "/onvif/**", EnableAuthorization: &enable},
+	}}
+	r.EnableAuthorization = true
+	r.Player.QueueLimit = 10
+	if _, err := r.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := r.PathPolicy("/live/a")
+	if policy.Pattern != "/live/*" || !policy.DisableGopCache || policy.MaxPlayers != 2 || !policy.EnableAuthorization || policy.QueueLimit != 10 {
+		t.Fatalf("unexpected policy of /live/a: %+v", policy)
+	}
+	for ip, allow := range map[string]bool{"10.1.2.3": true, "192.168.1.64": true, "192.168.1.65": false} {
+		if policy.AllowPublisher(net.ParseIP(ip)) != allow {
+			t.Errorf("AllowPublisher(%s) expect %v", ip, allow)
+		}
+	}
+	if policy.AllowPublisher(nil) {
+		t.Error("expect unknown publisher not allowed")
+	}
+
+	policy = r.PathPolicy("/cam12")
+	if policy.DisableGopCache || policy.GopCacheSize != 1<<20 || policy.QueueLimit != 100 || !policy.Record ||
+		len(policy.Sources) != 2 || policy.Sources[0] != "rtsp://192.168.1.64/stream" || policy.FailoverTimeout != 3*time.Second ||
+		policy.SourceIdleTimeout != 10*time.Second || !policy.AllowPublisher(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("unexpected policy of /cam12: %+v", policy)
+	}
+	if policy = r.PathPolicy("/onvif/dev/profile"); policy.EnableAuthorization {
+		t.Fatal("expect authorization disabled of /onvif/**")
+	}
+	if policy = r.PathPolicy("/live/a/b"); policy.Pattern != "" || policy.MaxPlayers != 0 || !policy.EnableAuthorization {
+		t.Fatalf("expect global policy of unmatched path, got %+v", policy)
+	}
+
+	for _, path := range []RtspPath{
+		{Path: ""},
+		{Path: "~^/cam(["},
+		{Path: "/live/[a-"},
+		{Path: "/live/*", Publishers: []string{"not an ip"}},
+		{Path: "/live/*", SourceTransType: "sctp"},
+		{Path: "/live/*", RecordMode: "sometimes"},
+		{Path: "/live/*", BackupSources: []string{"rtsp://192.168.1.65/stream"}},
+	} {
+		if _, err := (&Rtsp{Paths: []RtspPath{path}}).PostHandle(); err == nil {
+			t.Errorf("expect invalid path entry %+v", path)
+		}
+	}
+}
+
+func TestRtspEdge(t *testing.T) {
+	r := &Rtsp{Edge: RtspEdge{
+		Enable:  true,
+		Origins: []string{"rtsp://10.0.0.1:554"},
+		Routes: []RtspEdgeRoute{
+			{Prefix: "/site", Origins: []string{"rtsp://10.0.1.1"}},
+			{Prefix: "/site/b/", Origins: []string{"rtsp://10.0.2.1", "rtsp://10.0.2.2"}},
+		},
+		TransType: "UDP",
+	}}
+	if _, err := r.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Edge.TransType != "udp" || r.Edge.IdleTimeout != 10*time.Second {
+		t.Fatalf("unexpected edge config %+v", r.Edge)
+	}
+	for path, origin := range map[string]string{
+		"/live/a":     "rtsp://10.0.0.1:554",
+		"/site/a/cam": "rtsp://10.0.1.1",
+		"/site/b/cam": "rtsp://10.0.2.1",
+	} {
+		if origins := r.Edge.OriginsOf(path); len(origins) == 0 || origins[0] != origin {
+			t.Errorf("expect origin %s of %s, got %v", origin, path, origins)
+		}
+	}
+	r.Edge.Enable = false
+	if r.Edge.OriginsOf("/live/a") != nil {
+		t.Error("expect no origins if edge disabled")
+	}
+
+	for _, edge := range []RtspEdge{
+		{Origins: []string{"http://10.0.0.1"}},
+		{Routes: []RtspEdgeRoute{{Prefix: "/site", Origins: []string{"10.0.0.1:554"}}}},
+		{TransType: "sctp"},
+	} {
+		if _, err := (&Rtsp{Edge: edge}).PostHandle(); err == nil {
+			t.Errorf("expect invalid edge config %+v", edge)
+		}
+	}
+}
+
+func TestRtspCluster(t *testing.T) {
+	r := &Rtsp{Cluster: RtspCluster{Enable: true, Peers: []string{"127.0.0.1:8191"}}}
+	if _, err := r.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Cluster.Listen != ":8191" || r.Cluster.Interval != time.Second || r.Cluster.RedirectStatus != 302 {
+		t.Fatalf("unexpected cluster config %+v", r.Cluster)
+	}
+	for _, cluster := range []RtspCluster{
+		{Enable: true, Listen: "not an address"},
+		{Enable: true, Peers: []string{"10.0.0.2"}},
+		{Enable: true, Advertise: "http://10.0.0.1"},
+		{Enable: true, RedirectStatus: 303},
+	} {
+		if _, err := (&Rtsp{Cluster: cluster}).PostHandle(); err == nil {
+			t.Errorf("expect invalid cluster config %+v", cluster)
+		}
+	}
+}
+
+func TestRtspAuth(t *testing.T) {
+	r := &Rtsp{}
+	if _, err := r.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Auth.Realm != "CVDS" || len(r.Auth.Schemes) != 2 || r.Auth.Schemes[0] != AuthSchemeDigestSHA256 || r.Auth.NonceExpiry != 5*time.Minute {
+		t.Fatalf("unexpected default auth: %+v", r.Auth)
+	}
+	r = &Rtsp{}
+	r.Auth.Schemes = []string{AuthSchemeBasic, "digest-sha512"}
+	if _, err := r.PostHandle(); err == nil {
+		t.Fatal("expect invalid auth scheme")
+	}
+}
+
+func TestRtspClientProfile(t *testing.T) {
+	r := &Rtsp{}
+	r.Client.Profiles = []RtspClientProfile{
+		{Name: "hikvision", Keepalive: KeepaliveGetParameter},
+		{Name: "dvr", Hosts: []string{"192.168.1.10"}, IgnoreContentBase: true},
+	}
+	r.Paths = []RtspPath{{Path: "/cam1", Source: "rtsp://192.168.1.64/Streaming/Channels/101", SourceProfile: "hikvision"}}
+	if _, err := r.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+	if p := r.ClientProfile(r.PathPolicy("/cam1").SourceProfile, ""); p == nil || p.Name != "hikvision" {
+		t.Fatalf("expect profile of path, got %+v", p)
+	}
+	if p := r.ClientProfile("", "192.168.1.10"); p == nil || p.Name != "dvr" {
+		t.Fatalf("expect profile of host, got %+v", p)
+	}
+	if p := r.ClientProfile("", "192.168.1.11"); p != nil {
+		t.Fatalf("expect no profile of host, got %+v", p)
+	}
+
+	if _, err := (&Rtsp{Paths: []RtspPath{{Path: "/cam1", SourceProfile: "unknown"}}}).PostHandle(); err == nil {
+		t.Error("expect unknown source profile invalid")
+	}
+	for _, profiles := range [][]RtspClientProfile{
+		{{Name: "dvr"}, {Name: "dvr"}},
+		{{Name: ""}},
+		{{Name: "dvr", Keepalive: "ping"}},
+	} {
+		r = &Rtsp{}
+		r.Client.Profiles = profiles
+		if _, err := r.PostHandle(); err == nil {
+			t.Errorf("expect invalid client profiles %+v", profiles)
+		}
+	}
+}
+
+func TestRtspAutoTransport(t *testing.T) {
+	r := &Rtsp{}
+	if _, err := r.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+	if a := r.Client.AutoTransport; a.Prefer != "udp" || a.Timeout != 3*time.Second || a.LossThreshold != 0.2 {
+		t.Fatalf("unexpected defaults: %+v", a)
+	}
+	r = &Rtsp{}
+	r.Client.AutoTransport.Prefer = "TCP"
+	r.Paths = []RtspPath{{Path: "/cam1", Source: "rtsp://192.168.1.64/live", SourceTransType: "auto"}}
+	if _, err := r.PostHandle(); err != nil || r.Client.AutoTransport.Prefer != "tcp" {
+		t.Fatalf("expect tcp preferred, got %s %v", r.Client.AutoTransport.Prefer, err)
+	}
+	if policy := r.PathPolicy("/cam1"); policy.SourceTransType != "auto" {
+		t.Fatalf("expect auto trans type of path, got %s", policy.SourceTransType)
+	}
+	r = &Rtsp{}
+	r.Client.AutoTransport.Prefer = "http"
+	if _, err := r.PostHandle(); !errors.Is(err, InvalidAutoTransportError) {
+		t.Errorf("expect invalid preferred transport, got %v", err)
+	}
+}
+
+func TestRtspSrtp(t *testing.T) {
+	r := &Rtsp{}
+	r.Srtp.Require = true
+	if _, err := r.PostHandle(); err != nil || !r.Srtp.Enable || r.Srtp.Suite != SRTPSuiteAES128SHA1_80 {
+		t.Fatalf("unexpected srtp %+v %v", r.Srtp, err)
+	}
+	r = &Rtsp{}
+	r.Srtp.Suite = "aes_cm_128_hmac_sha1_32"
+	if _, err := r.PostHandle(); err != nil || r.Srtp.Suite != SRTPSuiteAES128SHA1_32 {
+		t.Fatalf("expect suite normalized, got %s %v", r.Srtp.Suite, err)
+	}
+	r = &Rtsp{}
+	r.Srtp.Suite = "AEAD_AES_256_GCM"
+	if _, err := r.PostHandle(); !errors.Is(err, InvalidSRTPSuiteError) {
+		t.Errorf("expect invalid suite, got %v", err)
+	}
+}
+
+func TestRtspLagPolicy(t *testing.T) {
+	r := &Rtsp{}
+	if _, err := r.PostHandle(); err != nil || r.Player.LagPolicy != LagPolicyDropOldest {
+		t.Fatalf("expect drop-oldest by default, got %s %v", r.Player.LagPolicy, err)
+	}
+	r = &Rtsp{}
+	r.Player.LagPolicy = "drop-newest"
+	if _, err := r.PostHandle(); !errors.Is(err, InvalidLagPolicyError) {
+		t.Errorf("expect invalid lag policy, got %v", err)
+	}
+}
+
+func TestRtspNack(t *testing.T) {
+	r := &Rtsp{}
+	if _, err := r.PostHandle(); err != nil || r.Nack.History != 512 {
+		t.Fatalf("expect history of 512 by default, got %d %v", r.Nack.History, err)
+	}
+	r = &Rtsp{}
+	r.Nack.History = -1
+	if _, err := r.PostHandle(); !errors.Is(err, InvalidNackHistoryError) {
+		t.Errorf("expect invalid history, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"path"
+	"strings"
+)
+
+type User struct {
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// pusher paths the user is allowed to control PTZ of camera, a pattern is
+	// matched by path.Match, "*" matches all paths and a pattern ends with
+	// "/**" matches all paths under the prefix
+	PTZ []string `yaml:"ptz" json:"ptz"`
+	// pusher paths the user is allowed to talk to camera by backchannel,
+	// patterns are matched as PTZ
+	Talk []string `yaml:"talk" json:"talk"`
+}
+
+func matchPath(pattern string, p string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "/**"):
+		return strings.HasPrefix(p, strings.TrimSuffix(pattern, "**"))
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// AllowPTZ reports whether the user is allowed to control PTZ of the pusher path
+func (u *User) AllowPTZ(p string) bool {
+	for _, pattern := range u.PTZ {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowTalk reports whether the user is allowed to talk to camera of the
+// pusher path
+func (u *User) AllowTalk(p string) bool {
+	for _, pattern := range u.Talk {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindUser returns the user with username, nil if not exist
+func FindUser(username string) *User {
+	users := UsersConfig()
+	for i := range users {
+		if users[i].Username == username {
+			return &users[i]
+		}
+	}
+	return nil
+}
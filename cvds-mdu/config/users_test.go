@@ -0,0 +1,29 @@
+package config
+
+import "testing"
+
+func TestUserAllowPTZ(t *testing.T) {
+	user := User{PTZ: []string{"/onvif/**", "/gb28181/3402000000132000000?/*", "/cam1"}}
+	for p, allow := range map[string]bool{
+		"/onvif/192.168.1.64/Profile_1": true,
+		"/onvif":                        false,
+		"/gb28181/34020000001320000001/34020000001310000001": true,
+		"/gb28181/34020000001320000011/34020000001310000001": false,
+		"/cam1": true,
+		"/cam2": false,
+	} {
+		if user.AllowPTZ(p) != allow {
+			t.Errorf("AllowPTZ(%s) expect %v", p, allow)
+		}
+	}
+	if !(&User{PTZ: []string{"*"}}).AllowPTZ("/any/path") {
+		t.Errorf("expect * matches all paths")
+	}
+}
+
+func TestUserAllowTalk(t *testing.T) {
+	user := User{PTZ: []string{"*"}, Talk: []string{"/door/**"}}
+	if !user.AllowTalk("/door/1") || user.AllowTalk("/cam1") {
+		t.Errorf("expect talk allowed of paths of talk only")
+	}
+}
@@ -0,0 +1,73 @@
+package gb28181
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Device struct {
+	ID           string
+	Name         string
+	Manufacturer string
+	Model        string
+	Firmware     string
+	Transport    string
+	Contact      string
+	Expires      int
+	RegisterAt   time.Time
+	KeepaliveAt  time.Time
+	Online       bool
+
+	addr         *net.UDPAddr
+	channels     map[string]*Channel
+	channelsLock sync.RWMutex
+}
+
+type Channel struct {
+	CatalogItem
+	UpdateAt time.Time
+}
+
+func newDevice(id string) *Device {
+	return &Device{
+		ID:       id,
+		channels: make(map[string]*Channel),
+	}
+}
+
+func (d *Device) Addr() *net.UDPAddr {
+	return d.addr
+}
+
+func (d *Device) updateChannel(item CatalogItem) {
+	d.channelsLock.Lock()
+	d.channels[item.DeviceID] = &Channel{CatalogItem: item, UpdateAt: time.Now()}
+	d.channelsLock.Unlock()
+}
+
+func (d *Device) GetChannel(id string) *Channel {
+	d.channelsLock.RLock()
+	defer d.channelsLock.RUnlock()
+	return d.channels[id]
+}
+
+// GetChannels returns channels of device ordered by channel id
+func (d *Device) GetChannels() []*Channel {
+	d.channelsLock.RLock()
+	channels := make([]*Channel, 0, len(d.channels))
+	for _, ch := range d.channels {
+		channels = append(channels, ch)
+	}
+	d.channelsLock.RUnlock()
+	sort.Slice(channels, func(i, j int) bool { return channels[i].DeviceID < channels[j].DeviceID })
+	return channels
+}
+
+func (d *Device) ChannelSize() (size int) {
+	d.channelsLock.RLock()
+	size = len(d.channels)
+	d.channelsLock.RUnlock()
+	return
+}
@@ -0,0 +1,105 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MANSCDP (GB/T 28181 annex A) command types
+const (
+	CmdTypeKeepalive  = "Keepalive"
+	CmdTypeCatalog    = "Catalog"
+	CmdTypeDeviceInfo = "DeviceInfo"
+)
+
+const MANSCDPContentType = "Application/MANSCDP+xml"
+
+// ManscdpHeader holds the fields common to all MANSCDP messages, it is used
+// to dispatch a message body before parsing it as a concrete type
+type ManscdpHeader struct {
+	XMLName  xml.Name
+	CmdType  string `xml:"CmdType"`
+	SN       int    `xml:"SN"`
+	DeviceID string `xml:"DeviceID"`
+}
+
+type Keepalive struct {
+	ManscdpHeader
+	Status string `xml:"Status"`
+}
+
+type CatalogItem struct {
+	DeviceID     string  `xml:"DeviceID" json:"deviceId"`
+	Name         string  `xml:"Name" json:"name"`
+	Manufacturer string  `xml:"Manufacturer" json:"manufacturer"`
+	Model        string  `xml:"Model" json:"model"`
+	Owner        string  `xml:"Owner" json:"owner"`
+	CivilCode    string  `xml:"CivilCode" json:"civilCode"`
+	Address      string  `xml:"Address" json:"address"`
+	Parental     int     `xml:"Parental" json:"parental"`
+	ParentID     string  `xml:"ParentID" json:"parentId"`
+	RegisterWay  int     `xml:"RegisterWay" json:"registerWay"`
+	Secrecy      int     `xml:"Secrecy" json:"secrecy"`
+	Status       string  `xml:"Status" json:"status"`
+	Longitude    float64 `xml:"Longitude" json:"longitude"`
+	Latitude     float64 `xml:"Latitude" json:"latitude"`
+}
+
+type CatalogResponse struct {
+	ManscdpHeader
+	SumNum     int `xml:"SumNum"`
+	DeviceList struct {
+		Num   int           `xml:"Num,attr"`
+		Items []CatalogItem `xml:"Item"`
+	} `xml:"DeviceList"`
+}
+
+type DeviceInfoResponse struct {
+	ManscdpHeader
+	DeviceName   string `xml:"DeviceName"`
+	Result       string `xml:"Result"`
+	Manufacturer string `xml:"Manufacturer"`
+	Model        string `xml:"Model"`
+	Firmware     string `xml:"Firmware"`
+	Channel      int    `xml:"Channel"`
+}
+
+// charsetReader accepts the GB2312/GBK declaration most devices put in XML
+// prolog. The fields this module depends on are ASCII, so the bytes are
+// passed through without transcoding
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "gb2312", "gbk", "gb18030", "utf-8", "utf8", "":
+		return input, nil
+	}
+	return nil, fmt.Errorf("unsupported xml charset %s", charset)
+}
+
+func unmarshalManscdp(body []byte, v any) error {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.CharsetReader = charsetReader
+	return decoder.Decode(v)
+}
+
+func catalogQuery(sn int, deviceID string) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="GB2312"?>
+<Query>
+<CmdType>%s</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+</Query>
+`, CmdTypeCatalog, sn, deviceID))
+}
+
+func deviceInfoQuery(sn int, deviceID string) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="GB2312"?>
+<Query>
+<CmdType>%s</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+</Query>
+`, CmdTypeDeviceInfo, sn, deviceID))
+}
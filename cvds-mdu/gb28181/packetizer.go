@@ -0,0 +1,190 @@
+package gb28181
+
+import (
+	"encoding/binary"
+)
+
+const defaultRTPPayloadSize = 1400
+
+// packetizer packs elementary stream frames demuxed from PS into RTP packets
+// that RTSP players understand: RFC 6184 for H.264, RFC 7798 for H.265,
+// RFC 3640 for AAC and RFC 3551 for G.711
+type packetizer struct {
+	payloadType byte
+	ssrc        uint32
+	seq         uint16
+	maxPayload  int
+}
+
+func newPacketizer(payloadType byte, ssrc uint32) *packetizer {
+	return &packetizer{
+		payloadType: payloadType,
+		ssrc:        ssrc,
+		maxPayload:  defaultRTPPayloadSize,
+	}
+}
+
+func (p *packetizer) packet(timestamp uint32, marker bool, payloads ...[]byte) []byte {
+	size := 12
+	for _, payload := range payloads {
+		size += len(payload)
+	}
+	pkt := make([]byte, 12, size)
+	pkt[0] = 0x80
+	pkt[1] = p.payloadType
+	if marker {
+		pkt[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(pkt[2:], p.seq)
+	binary.BigEndian.PutUint32(pkt[4:], timestamp)
+	binary.BigEndian.PutUint32(pkt[8:], p.ssrc)
+	for _, payload := range payloads {
+		pkt = append(pkt, payload...)
+	}
+	p.seq++
+	return pkt
+}
+
+// H264 packs an Annex B access unit, NAL units larger than the payload limit
+// are split into FU-A fragments
+func (p *packetizer) H264(frame []byte, timestamp uint32) (packets [][]byte) {
+	nalus := SplitAnnexB(frame)
+	for i, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		last := i == len(nalus)-1
+		if len(nalu) <= p.maxPayload {
+			packets = append(packets, p.packet(timestamp, last, nalu))
+			continue
+		}
+		indicator := nalu[0]&0xE0 | 28
+		nalType := nalu[0] & 0x1F
+		data := nalu[1:]
+		for start := true; len(data) > 0; start = false {
+			n := p.maxPayload - 2
+			header := nalType
+			if start {
+				header |= 0x80
+			}
+			if n >= len(data) {
+				n = len(data)
+				header |= 0x40
+			}
+			packets = append(packets, p.packet(timestamp, last && header&0x40 != 0, []byte{indicator, header}, data[:n]))
+			data = data[n:]
+		}
+	}
+	return
+}
+
+// H265 packs an Annex B access unit, NAL units larger than the payload limit
+// are split into fragmentation units (type 49)
+func (p *packetizer) H265(frame []byte, timestamp uint32) (packets [][]byte) {
+	nalus := SplitAnnexB(frame)
+	for i, nalu := range nalus {
+		if len(nalu) < 2 {
+			continue
+		}
+		last := i == len(nalus)-1
+		if len(nalu) <= p.maxPayload {
+			packets = append(packets, p.packet(timestamp, last, nalu))
+			continue
+		}
+		nalType := nalu[0] >> 1 & 0x3F
+		payloadHeader := []byte{nalu[0]&0x81 | 49<<1, nalu[1]}
+		data := nalu[2:]
+		for start := true; len(data) > 0; start = false {
+			n := p.maxPayload - 3
+			header := nalType
+			if start {
+				header |= 0x80
+			}
+			if n >= len(data) {
+				n = len(data)
+				header |= 0x40
+			}
+			packets = append(packets, p.packet(timestamp, last && header&0x40 != 0, payloadHeader, []byte{header}, data[:n]))
+			data = data[n:]
+		}
+	}
+	return
+}
+
+// G711 packs G.711 samples, a frame is split into packets of at most payload
+// limit samples. timestamp is in 8kHz clock
+func (p *packetizer) G711(frame []byte, timestamp uint32) (packets [][]byte) {
+	for len(frame) > 0 {
+		n := len(frame)
+		if n > p.maxPayload {
+			n = p.maxPayload
+		}
+		packets = append(packets, p.packet(timestamp, true, frame[:n]))
+		frame = frame[n:]
+		timestamp += uint32(n)
+	}
+	return
+}
+
+// AAC packs ADTS frames with RFC 3640 AAC-hbr mode, one access unit per
+// packet. timestamp is in sample rate clock
+func (p *packetizer) AAC(frame []byte, timestamp uint32) (packets [][]byte) {
+	for len(frame) >= 7 {
+		header, ok := parseADTS(frame)
+		if !ok || header.frameLength > len(frame) {
+			return
+		}
+		au := frame[header.headerLength:header.frameLength]
+		auHeader := []byte{0x00, 0x10, byte(len(au) >> 5), byte(len(au) << 3)}
+		packets = append(packets, p.packet(timestamp, true, auHeader, au))
+		frame = frame[header.frameLength:]
+		timestamp += 1024
+	}
+	return
+}
+
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+type adtsHeader struct {
+	profile         int
+	sampleRateIndex int
+	channels        int
+	headerLength    int
+	frameLength     int
+}
+
+func (h adtsHeader) sampleRate() int {
+	if h.sampleRateIndex < len(aacSampleRates) {
+		return aacSampleRates[h.sampleRateIndex]
+	}
+	return 0
+}
+
+// audioSpecificConfig returns the MPEG-4 AudioSpecificConfig for SDP config
+// parameter
+func (h adtsHeader) audioSpecificConfig() []byte {
+	objectType := h.profile + 1
+	return []byte{
+		byte(objectType<<3 | h.sampleRateIndex>>1),
+		byte(h.sampleRateIndex<<7 | h.channels<<3),
+	}
+}
+
+func parseADTS(data []byte) (h adtsHeader, ok bool) {
+	if len(data) < 7 || data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+		return
+	}
+	h.profile = int(data[2] >> 6)
+	h.sampleRateIndex = int(data[2] >> 2 & 0x0F)
+	h.channels = int(data[2]&0x01)<<2 | int(data[3]>>6)
+	h.headerLength = 7
+	if data[1]&0x01 == 0 {
+		// crc present
+		h.headerLength = 9
+	}
+	h.frameLength = int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+	if h.frameLength < h.headerLength {
+		return
+	}
+	return h, true
+}
@@ -0,0 +1,262 @@
+package gb28181
+
+import (
+	"encoding/binary"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+)
+
+// stream_type values used by GB/T 28181 in program stream map
+const (
+	StreamTypeMPEG4 = 0x10
+	StreamTypeAAC   = 0x0F
+	StreamTypeH264  = 0x1B
+	StreamTypeH265  = 0x24
+	StreamTypeSVAC  = 0x80
+	StreamTypeG711A = 0x90
+	StreamTypeG711U = 0x91
+	StreamTypeG7221 = 0x92
+	StreamTypeG7231 = 0x93
+	StreamTypeG729  = 0x99
+)
+
+// MPEG-PS start codes
+const (
+	psPackStartCode    = 0xBA
+	psSystemHeader     = 0xBB
+	psProgramStreamMap = 0xBC
+	psPaddingStream    = 0xBE
+)
+
+var (
+	PSPacketTooShortError    = errors.New("ps packet too short")
+	InvalidPSPackHeaderError = errors.New("invalid ps pack header")
+)
+
+// PSFrame is a elementary stream access unit demuxed from program stream
+type PSFrame struct {
+	Video      bool
+	StreamType byte
+	// PTS in 90kHz clock
+	PTS  uint64
+	Data []byte
+}
+
+// PSDemuxer splits MPEG-PS (ISO/IEC 13818-1) data carried by GB28181 RTP
+// stream into elementary stream frames. Demux must be called with all PS data
+// of a RTP timestamp, the video PES payloads it contains are joined as one
+// frame, because devices split a big frame into several PES packets
+type PSDemuxer struct {
+	VideoType byte
+	AudioType byte
+	// HasPSM is set after a program stream map has been parsed
+	HasPSM bool
+
+	OnFrame func(frame *PSFrame)
+
+	video    []byte
+	videoPTS uint64
+}
+
+func isStartCode(data []byte, i int) bool {
+	return data[i] == 0 && data[i+1] == 0 && data[i+2] == 1
+}
+
+func (d *PSDemuxer) Demux(data []byte) error {
+	d.video = d.video[:0]
+	i := 0
+loop:
+	for i+4 <= len(data) {
+		if !isStartCode(data, i) {
+			i++
+			continue
+		}
+		code := data[i+3]
+		var (
+			n   int
+			err error
+		)
+		switch {
+		case code == psPackStartCode:
+			n, err = d.parsePackHeader(data[i:])
+		case code == psProgramStreamMap:
+			n, err = d.parsePSM(data[i:])
+		case code >= 0xE0 && code <= 0xEF, code >= 0xC0 && code <= 0xDF:
+			n, err = d.parsePES(data[i:], code)
+		case code >= psSystemHeader:
+			n, err = skipPacket(data[i:])
+		default:
+			// start code of video elementary stream in PES payload, not PS
+			// layer, skip it
+			n = 4
+		}
+		if err != nil {
+			break loop
+		}
+		i += n
+	}
+	if len(d.video) > 0 && d.OnFrame != nil {
+		frame := &PSFrame{
+			Video:      true,
+			StreamType: d.videoType(d.video),
+			PTS:        d.videoPTS,
+			Data:       append([]byte(nil), d.video...),
+		}
+		d.OnFrame(frame)
+	}
+	return nil
+}
+
+func skipPacket(data []byte) (int, error) {
+	if len(data) < 6 {
+		return 0, PSPacketTooShortError
+	}
+	n := 6 + int(binary.BigEndian.Uint16(data[4:]))
+	if n > len(data) {
+		return 0, PSPacketTooShortError
+	}
+	return n, nil
+}
+
+func (d *PSDemuxer) parsePackHeader(data []byte) (int, error) {
+	if len(data) < 14 {
+		return 0, PSPacketTooShortError
+	}
+	if data[4]&0xC0 != 0x40 {
+		// MPEG-1 pack header is fixed 12 bytes
+		if data[4]&0xF0 == 0x20 {
+			return 12, nil
+		}
+		return 0, InvalidPSPackHeaderError
+	}
+	n := 14 + int(data[13]&0x07)
+	if n > len(data) {
+		return 0, PSPacketTooShortError
+	}
+	return n, nil
+}
+
+func (d *PSDemuxer) parsePSM(data []byte) (int, error) {
+	n, err := skipPacket(data)
+	if err != nil {
+		return 0, err
+	}
+	if n < 16 {
+		return n, nil
+	}
+	infoLen := int(binary.BigEndian.Uint16(data[8:]))
+	off := 10 + infoLen
+	if off+2 > n {
+		return n, nil
+	}
+	mapLen := int(binary.BigEndian.Uint16(data[off:]))
+	off += 2
+	end := off + mapLen
+	if end > n-4 {
+		end = n - 4
+	}
+	for off+4 <= end {
+		streamType, streamID := data[off], data[off+1]
+		esInfoLen := int(binary.BigEndian.Uint16(data[off+2:]))
+		switch {
+		case streamID >= 0xE0 && streamID <= 0xEF:
+			d.VideoType = streamType
+		case streamID >= 0xC0 && streamID <= 0xDF:
+			d.AudioType = streamType
+		}
+		off += 4 + esInfoLen
+	}
+	d.HasPSM = true
+	return n, nil
+}
+
+func parsePTS(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+func (d *PSDemuxer) parsePES(data []byte, code byte) (int, error) {
+	if len(data) < 9 {
+		return 0, PSPacketTooShortError
+	}
+	pesLen := int(binary.BigEndian.Uint16(data[4:]))
+	n := 6 + pesLen
+	if pesLen == 0 || n > len(data) {
+		// unbounded or truncated PES, take the rest of data
+		n = len(data)
+	}
+	headerLen := int(data[8])
+	payloadOff := 9 + headerLen
+	if payloadOff > n {
+		return n, nil
+	}
+	var pts uint64
+	hasPTS := data[7]&0x80 != 0 && headerLen >= 5
+	if hasPTS {
+		pts = parsePTS(data[9:])
+	}
+	payload := data[payloadOff:n]
+	if code >= 0xE0 {
+		if len(d.video) == 0 && hasPTS {
+			d.videoPTS = pts
+		}
+		d.video = append(d.video, payload...)
+	} else if len(payload) > 0 && d.OnFrame != nil {
+		d.OnFrame(&PSFrame{
+			Video:      false,
+			StreamType: d.AudioType,
+			PTS:        pts,
+			Data:       append([]byte(nil), payload...),
+		})
+	}
+	return n, nil
+}
+
+// videoType returns video stream type from program stream map, if no map has
+// been received, the codec is guessed from the first NAL unit
+func (d *PSDemuxer) videoType(frame []byte) byte {
+	if d.VideoType != 0 {
+		return d.VideoType
+	}
+	for _, nalu := range SplitAnnexB(frame) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch {
+		case nalu[0]&0x1F == 7 || nalu[0]&0x1F == 5:
+			return StreamTypeH264
+		case nalu[0]>>1&0x3F == 32 || nalu[0]>>1&0x3F == 33:
+			return StreamTypeH265
+		}
+	}
+	return 0
+}
+
+// SplitAnnexB splits H.264/H.265 Annex B byte stream into NAL units without
+// start codes
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 {
+			continue
+		}
+		scLen := 0
+		if data[i+2] == 1 {
+			scLen = 3
+		} else if data[i+2] == 0 && i+4 <= len(data) && data[i+3] == 1 {
+			scLen = 4
+		} else {
+			continue
+		}
+		if start >= 0 {
+			nalus = append(nalus, data[start:i])
+		}
+		i += scLen - 1
+		start = i + 1
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	} else if start < 0 && len(data) > 0 {
+		nalus = append(nalus, data)
+	}
+	return nalus
+}
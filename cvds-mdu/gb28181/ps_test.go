@@ -0,0 +1,141 @@
+package gb28181
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// muxPS builds a PS pack with pack header, program stream map and a PES
+// packet per elementary stream, like GB28181 devices do for a key frame
+func muxPS(videoType byte, audioType byte, video []byte, audio []byte, pts uint64) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0x00, 0x00, 0x01, psPackStartCode, 0x44, 0x00, 0x04, 0x00, 0x04, 0x01, 0x01, 0x89, 0xC3, 0xF8})
+
+	psm := []byte{0x00, 0x00, 0x01, psProgramStreamMap, 0x00, 0x12, 0xE0, 0xFF, 0x00, 0x00, 0x00, 0x08,
+		videoType, 0xE0, 0x00, 0x00, audioType, 0xC0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	buf.Write(psm)
+
+	writePES := func(streamID byte, payload []byte) {
+		for len(payload) > 0 {
+			n := len(payload)
+			if n > 60000 {
+				n = 60000
+			}
+			header := []byte{0x00, 0x00, 0x01, streamID, 0, 0, 0x80, 0x80, 0x05,
+				0x21 | byte(pts>>29)&0x0E, byte(pts >> 22), byte(pts>>14) | 0x01, byte(pts >> 7), byte(pts<<1) | 0x01}
+			binary.BigEndian.PutUint16(header[4:], uint16(8+n))
+			buf.Write(header)
+			buf.Write(payload[:n])
+			payload = payload[n:]
+		}
+	}
+	writePES(0xE0, video)
+	if audio != nil {
+		writePES(0xC0, audio)
+	}
+	return buf.Bytes()
+}
+
+func testH264Frame(size int) []byte {
+	frame := []byte{0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x1E, 0x95, 0xA8, 0x28,
+		0x00, 0x00, 0x00, 0x01, 0x68, 0xCE, 0x3C, 0x80,
+		0x00, 0x00, 0x00, 0x01, 0x65}
+	return append(frame, bytes.Repeat([]byte{0xAB}, size)...)
+}
+
+func TestPSDemuxer(t *testing.T) {
+	video := testH264Frame(100000)
+	audio := bytes.Repeat([]byte{0xD5}, 320)
+	var frames []*PSFrame
+	demuxer := PSDemuxer{OnFrame: func(frame *PSFrame) { frames = append(frames, frame) }}
+	if err := demuxer.Demux(muxPS(StreamTypeH264, StreamTypeG711A, video, audio, 3600)); err != nil {
+		t.Fatal(err)
+	}
+	if !demuxer.HasPSM || demuxer.VideoType != StreamTypeH264 || demuxer.AudioType != StreamTypeG711A {
+		t.Fatalf("unexpected stream map: video=%#x audio=%#x", demuxer.VideoType, demuxer.AudioType)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expect 2 frames, got %d", len(frames))
+	}
+	audioFrame, videoFrame := frames[0], frames[1]
+	if audioFrame.Video || audioFrame.StreamType != StreamTypeG711A || !bytes.Equal(audioFrame.Data, audio) {
+		t.Fatalf("unexpected audio frame")
+	}
+	if !videoFrame.Video || videoFrame.StreamType != StreamTypeH264 || videoFrame.PTS != 3600 {
+		t.Fatalf("unexpected video frame: type=%#x pts=%d", videoFrame.StreamType, videoFrame.PTS)
+	}
+	if !bytes.Equal(videoFrame.Data, video) {
+		t.Fatalf("video frame payload mismatch")
+	}
+}
+
+func TestPSDemuxerGuessVideoType(t *testing.T) {
+	data := muxPS(0, 0, testH264Frame(10), nil, 0)
+	// drop program stream map
+	data = append(data[:14:14], data[14+24:]...)
+	var frame *PSFrame
+	demuxer := PSDemuxer{OnFrame: func(f *PSFrame) { frame = f }}
+	demuxer.Demux(data)
+	if frame == nil || frame.StreamType != StreamTypeH264 {
+		t.Fatalf("expect h264 frame guessed from nal unit")
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	nalus := SplitAnnexB(testH264Frame(4))
+	if len(nalus) != 3 {
+		t.Fatalf("expect 3 nal units, got %d", len(nalus))
+	}
+	if nalus[0][0] != 0x67 || nalus[1][0] != 0x68 || nalus[2][0] != 0x65 || len(nalus[2]) != 5 {
+		t.Fatalf("unexpected nal units: %x", nalus)
+	}
+}
+
+func TestPacketizerH264(t *testing.T) {
+	p := newPacketizer(videoPayloadType, 1)
+	packets := p.H264(testH264Frame(3000), 9000)
+	// sps, pps and three FU-A fragments of idr
+	if len(packets) != 5 {
+		t.Fatalf("expect 5 packets, got %d", len(packets))
+	}
+	var idr []byte
+	for i, pkt := range packets {
+		marker := pkt[1]&0x80 != 0
+		if marker != (i == len(packets)-1) {
+			t.Fatalf("unexpected marker of packet %d", i)
+		}
+		if binary.BigEndian.Uint16(pkt[2:]) != uint16(i) || binary.BigEndian.Uint32(pkt[4:]) != 9000 {
+			t.Fatalf("unexpected header of packet %d", i)
+		}
+		if i >= 2 {
+			if pkt[12]&0x1F != 28 || pkt[13]&0x1F != 5 {
+				t.Fatalf("packet %d is not FU-A of idr", i)
+			}
+			idr = append(idr, pkt[14:]...)
+		}
+	}
+	if packets[2][13]&0x80 == 0 || packets[4][13]&0x40 == 0 {
+		t.Fatalf("missing start or end bit of FU-A")
+	}
+	if len(idr) != 3000 {
+		t.Fatalf("expect 3000 bytes idr payload, got %d", len(idr))
+	}
+}
+
+func TestBuildSDPShortSPS(t *testing.T) {
+	s := &Stream{DeviceID: "34020000001320000001", ChannelID: "34020000001310000001", videoType: StreamTypeH264}
+	sdp := s.buildSDP(&PSFrame{Video: true, StreamType: StreamTypeH264, Data: testH264Frame(16)})
+	if !strings.Contains(sdp, "profile-level-id=42001e") {
+		t.Fatalf("expect profile-level-id of SPS, got %q", sdp)
+	}
+	// SPS truncated of hostile device
+	frame := []byte{0x00, 0x00, 0x00, 0x01, 0x67, 0x42,
+		0x00, 0x00, 0x00, 0x01, 0x68, 0xCE, 0x3C, 0x80,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0xAB}
+	sdp = s.buildSDP(&PSFrame{Video: true, StreamType: StreamTypeH264, Data: frame})
+	if strings.Contains(sdp, "profile-level-id") || !strings.Contains(sdp, "sprop-parameter-sets=Z0I=,") {
+		t.Fatalf("expect profile-level-id skipped of SPS truncated, got %q", sdp)
+	}
+}
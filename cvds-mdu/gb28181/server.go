@@ -0,0 +1,699 @@
+package gb28181
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teris-io/shortid"
+)
+
+var (
+	DeviceNotFoundError       = errors.New("device not found")
+	DeviceOfflineError        = errors.New("device offline")
+	StreamNotFoundError       = errors.New("stream not found")
+	TransactionTimeoutError   = errors.New("sip transaction timeout")
+	ServerNotStartedError     = errors.New("gb28181 server not started")
+	InvalidAuthorizationError = errors.New("invalid authorization")
+)
+
+const sipBufSize = 65535
+
+type Server struct {
+	// socket and address bound while started, guarded by lock
+	conn   *net.UDPConn
+	addr   *net.UDPAddr
+	stopCh chan struct{}
+	lock   sync.RWMutex
+	// 1 if stopped
+	stopped uint32
+
+	devices     map[string]*Device // DeviceID <-> Device
+	devicesLock sync.RWMutex
+
+	streams     map[string]*Stream // DeviceID/ChannelID <-> Stream
+	streamsLock sync.RWMutex
+
+	transactions     map[string]chan *Message // TransactionKey <-> response chan
+	transactionsLock sync.Mutex
+
+	nonces     map[string]string // DeviceID <-> register nonce
+	noncesLock sync.Mutex
+
+	sn      int64
+	cseq    int64
+	ssrcSeq int64
+
+	logger *log.Logger
+}
+
+// Start listens address of config, which is resolved on every start since
+// config may be reloaded between restarts, and handles sip messages until
+// stopped
+func (s *Server) Start() error {
+	listen := config.GB28181Config().GetAddr()
+	conn, err := net.ListenUDP("udp", listen)
+	if err != nil {
+		return s.logger.ErrorWith("gb28181 server listen error", err, log.String("addr", listen.String()))
+	}
+	stopCh := make(chan struct{})
+	s.lock.Lock()
+	s.conn = conn
+	s.addr = conn.LocalAddr().(*net.UDPAddr)
+	s.stopCh = stopCh
+	s.lock.Unlock()
+	atomic.StoreUint32(&s.stopped, 0)
+	s.logger.Info("gb28181 server start", log.String("addr", conn.LocalAddr().String()))
+	go s.checkKeepalive(stopCh)
+	buf := make([]byte, sipBufSize)
+	// messages are read until socket closed by Stop, so that responses of
+	// BYEs sent when stopping are received
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.Stopped() {
+				return nil
+			}
+			return s.logger.ErrorWith("gb28181 server read udp error", err)
+		}
+		msg, err := ParseMessage(buf[:n])
+		if err != nil {
+			s.logger.Warn("gb28181 server receive invalid sip message", log.String("from", addr.String()), log.Error(err))
+			continue
+		}
+		s.logger.Debug("<<<\n" + msg.String())
+		if msg.IsRequest() {
+			s.handleRequest(msg, addr)
+		} else {
+			s.handleResponse(msg)
+		}
+	}
+}
+
+// Stopped reports whether server stopped
+func (s *Server) Stopped() bool {
+	return atomic.LoadUint32(&s.stopped) == 1
+}
+
+// Stop hangs up streams and closes socket. BYEs of streams are sent together
+// before socket closed, so that stopping waits for one transaction timeout
+// at most
+func (s *Server) Stop() {
+	if atomic.SwapUint32(&s.stopped, 1) == 1 {
+		return
+	}
+	s.logger.Info("gb28181 server stop", log.String("addr", s.Addr().String()))
+	var wg sync.WaitGroup
+	for _, stream := range s.GetStreams() {
+		wg.Add(1)
+		go func(stream *Stream) {
+			defer wg.Done()
+			stream.Stop()
+		}(stream)
+	}
+	wg.Wait()
+	s.lock.Lock()
+	if s.stopCh != nil {
+		close(s.stopCh)
+		s.stopCh = nil
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.addr = nil
+	s.lock.Unlock()
+	s.devicesLock.Lock()
+	s.devices = make(map[string]*Device)
+	s.devicesLock.Unlock()
+}
+
+// Addr returns address bound, nil if not started
+func (s *Server) Addr() *net.UDPAddr {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.addr
+}
+
+func (s *Server) send(msg *Message, addr *net.UDPAddr) error {
+	s.lock.RLock()
+	conn := s.conn
+	s.lock.RUnlock()
+	if conn == nil {
+		return ServerNotStartedError
+	}
+	s.logger.Debug(">>>\n" + msg.String())
+	_, err := conn.WriteToUDP(msg.Bytes(), addr)
+	return err
+}
+
+// request sends a request and waits for its final response
+func (s *Server) request(msg *Message, addr *net.UDPAddr) (*Message, error) {
+	key := msg.TransactionKey()
+	ch := make(chan *Message, 4)
+	s.transactionsLock.Lock()
+	s.transactions[key] = ch
+	s.transactionsLock.Unlock()
+	defer func() {
+		s.transactionsLock.Lock()
+		delete(s.transactions, key)
+		s.transactionsLock.Unlock()
+	}()
+	if err := s.send(msg, addr); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(config.GB28181Config().TransactionTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-ch:
+			if res.StatusCode < 200 {
+				continue
+			}
+			return res, nil
+		case <-timer.C:
+			return nil, TransactionTimeoutError
+		}
+	}
+}
+
+func (s *Server) handleResponse(res *Message) {
+	s.transactionsLock.Lock()
+	ch, ok := s.transactions[res.TransactionKey()]
+	s.transactionsLock.Unlock()
+	if !ok {
+		s.logger.Debug("gb28181 server receive response of unknown transaction", log.String("transaction", res.TransactionKey()))
+		return
+	}
+	select {
+	case ch <- res:
+	default:
+	}
+}
+
+func (s *Server) handleRequest(req *Message, addr *net.UDPAddr) {
+	switch req.Method {
+	case REGISTER:
+		s.handleRegister(req, addr)
+	case MESSAGE:
+		s.handleMessage(req, addr)
+	case BYE:
+		s.handleBye(req, addr)
+	case ACK:
+	case OPTIONS:
+		s.send(NewResponse(req, 200, "OK"), addr)
+	default:
+		s.send(NewResponse(req, 405, "Method Not Allowed"), addr)
+	}
+}
+
+func (s *Server) nextSN() int {
+	return int(atomic.AddInt64(&s.sn, 1))
+}
+
+func (s *Server) nextCSeq() int {
+	return int(atomic.AddInt64(&s.cseq, 1))
+}
+
+func userAgent() string {
+	return fmt.Sprintf("MDU/%s", config.GlobalConfig().Version)
+}
+
+func (s *Server) newRequest(method string, device *Device, user string) *Message {
+	cfg := config.GB28181Config()
+	req := &Message{Method: method, RequestURI: fmt.Sprintf("sip:%s@%s", user, device.addr.String())}
+	req.Add("Via", fmt.Sprintf("SIP/2.0/UDP %s:%d;rport;branch=%s", cfg.ExternalIP, cfg.Port, newBranch()))
+	req.Add("From", fmt.Sprintf("<sip:%s@%s>;tag=%s", cfg.ID, cfg.Domain, newTag()))
+	req.Add("To", fmt.Sprintf("<sip:%s@%s>", user, cfg.Domain))
+	req.Add("Call-ID", newCallID())
+	req.Add("CSeq", fmt.Sprintf("%d %s", s.nextCSeq(), method))
+	req.Add("Max-Forwards", "70")
+	req.Add("User-Agent", userAgent())
+	return req
+}
+
+var digestParamRex = regexp.MustCompile(`(\w+)="?([^",]*)"?`)
+
+func md5Hex(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+// checkDigest verifies Authorization header of REGISTER request by RFC 2617
+// digest scheme
+func checkDigest(authLine string, method string, password string, nonce string) error {
+	if !strings.HasPrefix(strings.TrimSpace(authLine), "Digest") {
+		return InvalidAuthorizationError
+	}
+	params := make(map[string]string)
+	for _, m := range digestParamRex.FindAllStringSubmatch(authLine, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	if params["nonce"] != nonce {
+		return InvalidAuthorizationError
+	}
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", params["username"], params["realm"], password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, params["uri"]))
+	var response string
+	if qop := params["qop"]; qop != "" {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, nonce, params["nc"], params["cnonce"], qop, ha2))
+	} else {
+		response = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
+	}
+	if response != params["response"] {
+		return InvalidAuthorizationError
+	}
+	return nil
+}
+
+func (s *Server) handleRegister(req *Message, addr *net.UDPAddr) {
+	cfg := config.GB28181Config()
+	deviceID := uriUser(req.Get("From"))
+	if cfg.Password != "" {
+		s.noncesLock.Lock()
+		nonce := s.nonces[deviceID]
+		s.noncesLock.Unlock()
+		authLine := req.Get("Authorization")
+		if authLine == "" || nonce == "" || checkDigest(authLine, req.Method, cfg.Password, nonce) != nil {
+			if authLine != "" {
+				s.logger.Info("gb28181 device register authentication failed", log.String("device", deviceID))
+			}
+			nonce = md5Hex(shortid.MustGenerate())
+			s.noncesLock.Lock()
+			s.nonces[deviceID] = nonce
+			s.noncesLock.Unlock()
+			res := NewResponse(req, 401, "Unauthorized")
+			res.Add("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s",nonce="%s",algorithm=MD5`, cfg.Domain, nonce))
+			s.send(res, addr)
+			return
+		}
+		s.noncesLock.Lock()
+		delete(s.nonces, deviceID)
+		s.noncesLock.Unlock()
+	}
+
+	expires := cfg.RegisterExpires
+	if e := req.Get("Expires"); e != "" {
+		expires, _ = strconv.Atoi(e)
+	} else if e := headerParam(req.Get("Contact"), "expires"); e != "" {
+		expires, _ = strconv.Atoi(e)
+	}
+
+	res := NewResponse(req, 200, "OK")
+	if contact := req.Get("Contact"); contact != "" {
+		res.Add("Contact", contact)
+	}
+	res.Add("Expires", strconv.Itoa(expires))
+	res.Add("Date", time.Now().Format("2006-01-02T15:04:05.000"))
+	s.send(res, addr)
+
+	if expires == 0 {
+		s.logger.Info("gb28181 device unregister", log.String("device", deviceID))
+		s.offline(deviceID)
+		return
+	}
+
+	s.devicesLock.Lock()
+	device, ok := s.devices[deviceID]
+	if !ok {
+		device = newDevice(deviceID)
+		s.devices[deviceID] = device
+	}
+	wasOnline := device.Online
+	device.addr = addr
+	device.Contact = req.Get("Contact")
+	device.Transport = "UDP"
+	device.Expires = expires
+	device.RegisterAt = time.Now()
+	device.KeepaliveAt = device.RegisterAt
+	device.Online = true
+	s.devicesLock.Unlock()
+
+	if !wasOnline {
+		s.logger.Info("gb28181 device online", log.String("device", deviceID), log.String("addr", addr.String()))
+		go func() {
+			if err := s.QueryDeviceInfo(deviceID); err != nil {
+				s.logger.ErrorWith("gb28181 query device info error", err, log.String("device", deviceID))
+			}
+			if err := s.QueryCatalog(deviceID); err != nil {
+				s.logger.ErrorWith("gb28181 query catalog error", err, log.String("device", deviceID))
+			}
+		}()
+	}
+}
+
+func (s *Server) handleMessage(req *Message, addr *net.UDPAddr) {
+	var header ManscdpHeader
+	if err := unmarshalManscdp(req.Body, &header); err != nil {
+		s.logger.ErrorWith("gb28181 server parse manscdp error", err)
+		s.send(NewResponse(req, 400, "Bad Request"), addr)
+		return
+	}
+	deviceID := uriUser(req.Get("From"))
+	device := s.GetDevice(deviceID)
+	if device == nil {
+		// let device register again
+		s.send(NewResponse(req, 404, "Not Found"), addr)
+		return
+	}
+	s.send(NewResponse(req, 200, "OK"), addr)
+
+	switch header.CmdType {
+	case CmdTypeKeepalive:
+		s.devicesLock.Lock()
+		device.KeepaliveAt = time.Now()
+		device.addr = addr
+		device.Online = true
+		s.devicesLock.Unlock()
+	case CmdTypeCatalog:
+		var catalog CatalogResponse
+		if err := unmarshalManscdp(req.Body, &catalog); err != nil {
+			s.logger.ErrorWith("gb28181 server parse catalog error", err, log.String("device", deviceID))
+			return
+		}
+		for _, item := range catalog.DeviceList.Items {
+			device.updateChannel(item)
+		}
+		s.logger.Info("gb28181 device catalog updated", log.String("device", deviceID),
+			log.Int("sum", catalog.SumNum), log.Int("channels", device.ChannelSize()))
+	case CmdTypeDeviceInfo:
+		var info DeviceInfoResponse
+		if err := unmarshalManscdp(req.Body, &info); err != nil {
+			s.logger.ErrorWith("gb28181 server parse device info error", err, log.String("device", deviceID))
+			return
+		}
+		s.devicesLock.Lock()
+		device.Name = info.DeviceName
+		device.Manufacturer = info.Manufacturer
+		device.Model = info.Model
+		device.Firmware = info.Firmware
+		s.devicesLock.Unlock()
+	default:
+		s.logger.Debug("gb28181 server ignore manscdp message", log.String("cmd type", header.CmdType))
+	}
+}
+
+func (s *Server) handleBye(req *Message, addr *net.UDPAddr) {
+	callID := req.CallID()
+	var stream *Stream
+	s.streamsLock.RLock()
+	for _, st := range s.streams {
+		if st.callID == callID {
+			stream = st
+			break
+		}
+	}
+	s.streamsLock.RUnlock()
+	if stream == nil {
+		s.send(NewResponse(req, 481, "Call/Transaction Does Not Exist"), addr)
+		return
+	}
+	s.send(NewResponse(req, 200, "OK"), addr)
+	// dialog terminated by device, no need to send bye
+	stream.toTag = ""
+	go stream.Stop()
+}
+
+func (s *Server) checkKeepalive(stopCh <-chan struct{}) {
+	timeout := config.GB28181Config().KeepaliveTimeout
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var expired []string
+			s.devicesLock.RLock()
+			for id, device := range s.devices {
+				if device.Online && time.Since(device.KeepaliveAt) > timeout {
+					expired = append(expired, id)
+				}
+			}
+			s.devicesLock.RUnlock()
+			for _, id := range expired {
+				s.logger.Warn("gb28181 device keepalive timeout", log.String("device", id))
+				s.offline(id)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// offline marks device offline and stops all of its streams
+func (s *Server) offline(deviceID string) {
+	s.devicesLock.Lock()
+	if device, ok := s.devices[deviceID]; ok {
+		device.Online = false
+	}
+	s.devicesLock.Unlock()
+	for _, stream := range s.GetStreams() {
+		if stream.DeviceID == deviceID {
+			stream.toTag = ""
+			stream.Stop()
+		}
+	}
+}
+
+func (s *Server) onlineDevice(deviceID string) (*Device, error) {
+	device := s.GetDevice(deviceID)
+	if device == nil {
+		return nil, DeviceNotFoundError
+	}
+	if !device.Online {
+		return nil, DeviceOfflineError
+	}
+	return device, nil
+}
+
+func (s *Server) sendQuery(deviceID string, body []byte) error {
+	device, err := s.onlineDevice(deviceID)
+	if err != nil {
+		return err
+	}
+	req := s.newRequest(MESSAGE, device, deviceID)
+	req.SetBody(MANSCDPContentType, body)
+	res, err := s.request(req, device.addr)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("device response %d %s", res.StatusCode, res.Reason)
+	}
+	return nil
+}
+
+// QueryCatalog asks device to report its channels, the channels are updated
+// when device sends catalog response message
+func (s *Server) QueryCatalog(deviceID string) error {
+	return s.sendQuery(deviceID, catalogQuery(s.nextSN(), deviceID))
+}
+
+func (s *Server) QueryDeviceInfo(deviceID string) error {
+	return s.sendQuery(deviceID, deviceInfoQuery(s.nextSN(), deviceID))
+}
+
+// newSSRC generates ssrc of realtime stream, first digit is 0 for realtime,
+// then 5 digits from domain and a 4 digits sequence
+func (s *Server) newSSRC() string {
+	domain := config.GB28181Config().Domain
+	mid := "00000"
+	if len(domain) >= 8 {
+		mid = domain[3:8]
+	}
+	return fmt.Sprintf("0%s%04d", mid, atomic.AddInt64(&s.ssrcSeq, 1)%10000)
+}
+
+func (s *Server) StreamPath(deviceID string, channelID string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(config.GB28181Config().PathPrefix, "/"), deviceID, channelID)
+}
+
+// Play invites device channel to send live stream, returns the existing stream
+// if channel is already playing
+func (s *Server) Play(deviceID string, channelID string) (*Stream, error) {
+	if stream := s.GetStream(deviceID, channelID); stream != nil {
+		return stream, nil
+	}
+	device, err := s.onlineDevice(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	cfg := config.GB28181Config()
+	stream := &Stream{
+		server:    s,
+		DeviceID:  deviceID,
+		ChannelID: channelID,
+		SSRC:      s.newSSRC(),
+		Path:      s.StreamPath(deviceID, channelID),
+		StartAt:   time.Now(),
+		readyChan: make(chan struct{}),
+		logger:    s.logger,
+	}
+	if err := stream.listen(); err != nil {
+		return nil, s.logger.ErrorWith("gb28181 stream listen error", err)
+	}
+
+	sdp := strings.Builder{}
+	sdp.WriteString("v=0\r\n")
+	sdp.WriteString(fmt.Sprintf("o=%s 0 0 IN IP4 %s\r\n", channelID, cfg.ExternalIP))
+	sdp.WriteString("s=Play\r\n")
+	sdp.WriteString(fmt.Sprintf("c=IN IP4 %s\r\n", cfg.ExternalIP))
+	sdp.WriteString("t=0 0\r\n")
+	sdp.WriteString(fmt.Sprintf("m=video %d RTP/AVP 96 98 97\r\n", stream.Port))
+	sdp.WriteString("a=recvonly\r\n")
+	sdp.WriteString("a=rtpmap:96 PS/90000\r\n")
+	sdp.WriteString("a=rtpmap:98 H264/90000\r\n")
+	sdp.WriteString("a=rtpmap:97 MPEG4/90000\r\n")
+	sdp.WriteString(fmt.Sprintf("y=%s\r\n", stream.SSRC))
+
+	req := s.newRequest(INVITE, device, channelID)
+	req.Add("Contact", fmt.Sprintf("<sip:%s@%s:%d>", cfg.ID, cfg.ExternalIP, cfg.Port))
+	req.Add("Subject", fmt.Sprintf("%s:%s,%s:0", channelID, stream.SSRC, cfg.ID))
+	req.SetBody("APPLICATION/SDP", []byte(sdp.String()))
+	res, err := s.request(req, device.addr)
+	if err != nil {
+		stream.conn.Close()
+		return nil, s.logger.ErrorWith("gb28181 invite error", err, log.String("stream", stream.String()))
+	}
+	if res.StatusCode != 200 {
+		stream.conn.Close()
+		return nil, fmt.Errorf("device response %d %s", res.StatusCode, res.Reason)
+	}
+
+	stream.callID = req.CallID()
+	stream.fromTag = headerParam(req.Get("From"), "tag")
+	stream.toTag = headerParam(res.Get("To"), "tag")
+	stream.remoteTarget = req.RequestURI
+	if contact := res.Get("Contact"); contact != "" {
+		stream.remoteTarget = "sip:" + uriUser(contact) + "@" + uriHost(contact)
+	}
+	stream.cseq, _ = req.CSeq()
+
+	ack := &Message{Method: ACK, RequestURI: stream.remoteTarget}
+	ack.Add("Via", fmt.Sprintf("SIP/2.0/UDP %s:%d;rport;branch=%s", cfg.ExternalIP, cfg.Port, newBranch()))
+	ack.Add("From", req.Get("From"))
+	ack.Add("To", res.Get("To"))
+	ack.Add("Call-ID", stream.callID)
+	ack.Add("CSeq", fmt.Sprintf("%d %s", stream.cseq, ACK))
+	ack.Add("Max-Forwards", "70")
+	ack.Add("User-Agent", userAgent())
+	if err := s.send(ack, device.addr); err != nil {
+		s.logger.ErrorWith("gb28181 send ack error", err, log.String("stream", stream.String()))
+	}
+
+	s.streamsLock.Lock()
+	if exist, ok := s.streams[stream.Key()]; ok {
+		s.streamsLock.Unlock()
+		stream.Stop()
+		return exist, nil
+	}
+	s.streams[stream.Key()] = stream
+	s.streamsLock.Unlock()
+	go stream.receive()
+	s.logger.Info("gb28181 stream start", log.String("stream", stream.String()), log.String("path", stream.Path))
+	return stream, nil
+}
+
+// bye hangs up the dialog of stream
+func (s *Server) bye(stream *Stream) error {
+	device := s.GetDevice(stream.DeviceID)
+	if device == nil || device.addr == nil {
+		return DeviceNotFoundError
+	}
+	cfg := config.GB28181Config()
+	stream.cseq++
+	req := &Message{Method: BYE, RequestURI: stream.remoteTarget}
+	req.Add("Via", fmt.Sprintf("SIP/2.0/UDP %s:%d;rport;branch=%s", cfg.ExternalIP, cfg.Port, newBranch()))
+	req.Add("From", fmt.Sprintf("<sip:%s@%s>;tag=%s", cfg.ID, cfg.Domain, stream.fromTag))
+	req.Add("To", fmt.Sprintf("<sip:%s@%s>;tag=%s", stream.ChannelID, cfg.Domain, stream.toTag))
+	req.Add("Call-ID", stream.callID)
+	req.Add("CSeq", fmt.Sprintf("%d %s", stream.cseq, BYE))
+	req.Add("Max-Forwards", "70")
+	req.Add("User-Agent", userAgent())
+	_, err := s.request(req, device.addr)
+	return err
+}
+
+// StopPlay hangs up the live stream of device channel
+func (s *Server) StopPlay(deviceID string, channelID string) error {
+	stream := s.GetStream(deviceID, channelID)
+	if stream == nil {
+		return StreamNotFoundError
+	}
+	stream.Stop()
+	return nil
+}
+
+func (s *Server) removeStream(stream *Stream) {
+	s.streamsLock.Lock()
+	if exist, ok := s.streams[stream.Key()]; ok && exist == stream {
+		delete(s.streams, stream.Key())
+	}
+	s.streamsLock.Unlock()
+}
+
+func (s *Server) GetStream(deviceID string, channelID string) (stream *Stream) {
+	s.streamsLock.RLock()
+	stream = s.streams[streamKey(deviceID, channelID)]
+	s.streamsLock.RUnlock()
+	return
+}
+
+func (s *Server) GetStreams() (streams []*Stream) {
+	s.streamsLock.RLock()
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.streamsLock.RUnlock()
+	return
+}
+
+func (s *Server) GetDevice(id string) (device *Device) {
+	s.devicesLock.RLock()
+	device = s.devices[id]
+	s.devicesLock.RUnlock()
+	return
+}
+
+// GetDevices returns all registered devices ordered by device id
+func (s *Server) GetDevices() (devices []*Device) {
+	s.devicesLock.RLock()
+	for _, device := range s.devices {
+		devices = append(devices, device)
+	}
+	s.devicesLock.RUnlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return
+}
+
+var server *Server
+var serverInitializer sync.Once
+
+func GetServer() *Server {
+	if server != nil {
+		return server
+	}
+	serverInitializer.Do(func() {
+		server = &Server{
+			stopped:      1,
+			devices:      make(map[string]*Device),
+			streams:      make(map[string]*Stream),
+			transactions: make(map[string]chan *Message),
+			nonces:       make(map[string]string),
+			logger:       assert.Must(config.LogConfig().Build("gb28181.server")),
+		}
+	})
+	return server
+}
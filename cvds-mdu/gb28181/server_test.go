@@ -0,0 +1,345 @@
+package gb28181
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/rtsp"
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testDeviceID  = "34020000001320000001"
+	testChannelID = "34020000001310000001"
+	testPassword  = "12345678"
+)
+
+// simDevice simulates a GB28181 IPC, it registers to the server, answers
+// queries and INVITE, and sends PS-over-RTP to the port offered in INVITE
+type simDevice struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	cseq   int
+
+	registered chan *Message
+	invited    chan int
+	bye        chan struct{}
+	done       chan struct{}
+}
+
+func newSimDevice(t *testing.T, server *net.UDPAddr) *simDevice {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &simDevice{
+		t:          t,
+		conn:       conn,
+		server:     server,
+		registered: make(chan *Message, 4),
+		invited:    make(chan int, 1),
+		bye:        make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *simDevice) close() {
+	d.conn.Close()
+	<-d.done
+}
+
+func (d *simDevice) send(msg *Message) {
+	if _, err := d.conn.WriteToUDP(msg.Bytes(), d.server); err != nil {
+		d.t.Error(err)
+	}
+}
+
+func (d *simDevice) newRequest(method string, body string) *Message {
+	d.cseq++
+	req := &Message{Method: method, RequestURI: "sip:34020000002000000001@3402000000"}
+	req.Add("Via", fmt.Sprintf("SIP/2.0/UDP %s;rport;branch=%s", d.conn.LocalAddr(), newBranch()))
+	req.Add("From", fmt.Sprintf("<sip:%s@3402000000>;tag=%s", testDeviceID, newTag()))
+	req.Add("To", fmt.Sprintf("<sip:%s@3402000000>", testDeviceID))
+	req.Add("Call-ID", newCallID())
+	req.Add("CSeq", fmt.Sprintf("%d %s", d.cseq, method))
+	req.Add("Max-Forwards", "70")
+	if body != "" {
+		req.SetBody(MANSCDPContentType, []byte(body))
+	}
+	return req
+}
+
+func (d *simDevice) register(auth string) {
+	req := d.newRequest(REGISTER, "")
+	req.Add("Contact", fmt.Sprintf("<sip:%s@%s>", testDeviceID, d.conn.LocalAddr()))
+	req.Add("Expires", "3600")
+	if auth != "" {
+		req.Add("Authorization", auth)
+	}
+	d.send(req)
+}
+
+var rtpPortRex = regexp.MustCompile(`m=video (\d+) `)
+
+func (d *simDevice) run() {
+	defer close(d.done)
+	buf := make([]byte, sipBufSize)
+	for {
+		n, _, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg, err := ParseMessage(buf[:n])
+		if err != nil {
+			d.t.Error(err)
+			continue
+		}
+		if !msg.IsRequest() {
+			if _, method := msg.CSeq(); method == REGISTER {
+				d.registered <- msg
+			}
+			continue
+		}
+		switch msg.Method {
+		case MESSAGE:
+			d.send(NewResponse(msg, 200, "OK"))
+			var query ManscdpHeader
+			unmarshalManscdp(msg.Body, &query)
+			switch query.CmdType {
+			case CmdTypeCatalog:
+				d.send(d.newRequest(MESSAGE, fmt.Sprintf(`<?xml version="1.0" encoding="GB2312"?>
+<Response>
+<CmdType>Catalog</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<SumNum>1</SumNum>
+<DeviceList Num="1">
+<Item>
+<DeviceID>%s</DeviceID>
+<Name>Camera 01</Name>
+<Manufacturer>Sim</Manufacturer>
+<Status>ON</Status>
+</Item>
+</DeviceList>
+</Response>
+`, query.SN, testDeviceID, testChannelID)))
+			case CmdTypeDeviceInfo:
+				d.send(d.newRequest(MESSAGE, fmt.Sprintf(`<?xml version="1.0" encoding="GB2312"?>
+<Response>
+<CmdType>DeviceInfo</CmdType>
+<SN>%d</SN>
+<DeviceID>%s</DeviceID>
+<DeviceName>Sim IPC</DeviceName>
+<Manufacturer>Sim</Manufacturer>
+<Model>SIM-1</Model>
+<Firmware>V1.0</Firmware>
+<Result>OK</Result>
+</Response>
+`, query.SN, testDeviceID)))
+			}
+		case INVITE:
+			m := rtpPortRex.FindStringSubmatch(string(msg.Body))
+			if m == nil {
+				d.send(NewResponse(msg, 488, "Not Acceptable Here"))
+				continue
+			}
+			port, _ := strconv.Atoi(m[1])
+			res := NewResponse(msg, 200, "OK")
+			res.Add("Contact", fmt.Sprintf("<sip:%s@%s>", testChannelID, d.conn.LocalAddr()))
+			res.SetBody("APPLICATION/SDP", []byte(fmt.Sprintf("v=0\r\no=%s 0 0 IN IP4 127.0.0.1\r\ns=Play\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n"+
+				"m=video 15060 RTP/AVP 96\r\na=sendonly\r\na=rtpmap:96 PS/90000\r\ny=0100000001\r\n", testChannelID)))
+			d.send(res)
+			d.invited <- port
+		case ACK:
+		case BYE:
+			d.send(NewResponse(msg, 200, "OK"))
+			d.bye <- struct{}{}
+		}
+	}
+}
+
+// sendPS sends frames of PS-over-RTP to the stream port until stop closed
+func (d *simDevice) sendPS(port int, stop chan struct{}) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		d.t.Error(err)
+		return
+	}
+	defer conn.Close()
+	p := newPacketizer(96, 100000001)
+	audio := bytes.Repeat([]byte{0xD5}, 320)
+	for pts := uint64(0); ; pts += 3600 {
+		ps := muxPS(StreamTypeH264, StreamTypeG711A, testH264Frame(5000), audio, pts)
+		for len(ps) > 0 {
+			n := len(ps)
+			if n > 1400 {
+				n = 1400
+			}
+			conn.Write(p.packet(uint32(pts), n == len(ps), ps[:n]))
+			ps = ps[n:]
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(40 * time.Millisecond):
+		}
+	}
+}
+
+func startTestServer(t *testing.T) *Server {
+	cfg := config.GB28181Config()
+	cfg.Password = testPassword
+	cfg.Host, cfg.Port = "127.0.0.1", 0
+	if _, err := cfg.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+	s := GetServer()
+	go s.Start()
+	for i := 0; s.Addr() == nil; i++ {
+		if i > 100 {
+			t.Fatal("gb28181 server not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(3 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer(t *testing.T) {
+	s := startTestServer(t)
+	defer s.Stop()
+	device := newSimDevice(t, s.Addr())
+	defer device.close()
+
+	// register with digest authentication
+	device.register("")
+	res := <-device.registered
+	if res.StatusCode != 401 {
+		t.Fatalf("expect 401, got %d", res.StatusCode)
+	}
+	challenge := res.Get("WWW-Authenticate")
+	nonce := digestParamRex.FindAllStringSubmatch(challenge, -1)[1][2]
+	uri := "sip:34020000002000000001@3402000000"
+	ha1 := md5Hex(testDeviceID + ":3402000000:" + testPassword)
+	response := md5Hex(ha1 + ":" + nonce + ":" + md5Hex(REGISTER+":"+uri))
+	device.register(fmt.Sprintf(`Digest username="%s",realm="3402000000",nonce="%s",uri="%s",response="%s",algorithm=MD5`,
+		testDeviceID, nonce, uri, response))
+	if res = <-device.registered; res.StatusCode != 200 {
+		t.Fatalf("expect 200, got %d", res.StatusCode)
+	}
+
+	// catalog and device info are queried after register
+	waitFor(t, "catalog", func() bool {
+		d := s.GetDevice(testDeviceID)
+		return d != nil && d.GetChannel(testChannelID) != nil && d.Model != ""
+	})
+	dev := s.GetDevice(testDeviceID)
+	if !dev.Online || dev.Name != "Sim IPC" || dev.GetChannel(testChannelID).Name != "Camera 01" {
+		t.Fatalf("unexpected device: %+v", dev)
+	}
+
+	// live stream
+	stream, err := s.Play(testDeviceID, testChannelID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go device.sendPS(<-device.invited, stop)
+	defer close(stop)
+	select {
+	case <-stream.Ready():
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for stream ready")
+	}
+	if stream.Path != "/gb28181/"+testDeviceID+"/"+testChannelID {
+		t.Fatalf("unexpected stream path: %s", stream.Path)
+	}
+	pusher := rtsp.GetServer().GetPusher(stream.Path)
+	if pusher == nil {
+		t.Fatal("pusher not found")
+	}
+	if pusher.VCodec() != "h264" || pusher.AControl() != "streamid=1" || pusher.ACodec() != rtsp.CodecPCMA {
+		t.Fatalf("unexpected pusher: %s %s %s", pusher.VCodec(), pusher.AControl(), pusher.ACodec())
+	}
+	waitFor(t, "rtp", func() bool { return pusher.InBytes() > 10000 })
+
+	if again, _ := s.Play(testDeviceID, testChannelID); again != stream {
+		t.Fatalf("expect the playing stream")
+	}
+
+	if err := s.StopPlay(testDeviceID, testChannelID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-device.bye:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for bye")
+	}
+	if rtsp.GetServer().GetPusher(stream.Path) != nil || s.GetStream(testDeviceID, testChannelID) != nil {
+		t.Fatal("stream not removed")
+	}
+
+	// streams of offline device can not be played
+	s.offline(testDeviceID)
+	if _, err := s.Play(testDeviceID, testChannelID); err != DeviceOfflineError {
+		t.Fatalf("expect device offline error, got %v", err)
+	}
+}
+
+func TestServerRestart(t *testing.T) {
+	cfg := config.GB28181Config()
+	timeout := cfg.TransactionTimeout
+	t.Cleanup(func() { cfg.TransactionTimeout = timeout })
+	cfg.TransactionTimeout = 3 * time.Second
+	s := startTestServer(t)
+	device := newSimDevice(t, s.Addr())
+	defer device.close()
+	cfg.Password = ""
+	device.register("")
+	if res := <-device.registered; res.StatusCode != 200 {
+		t.Fatalf("expect 200, got %d", res.StatusCode)
+	}
+	waitFor(t, "register", func() bool { return s.GetDevice(testDeviceID) != nil })
+	if _, err := s.Play(testDeviceID, testChannelID); err != nil {
+		t.Fatal(err)
+	}
+
+	// streams hung up without waiting for transaction timeout
+	start := time.Now()
+	s.Stop()
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("expect BYE answered when stopping, stopped in %v", elapsed)
+	}
+	select {
+	case <-device.bye:
+	default:
+		t.Fatal("expect BYE sent when stopping")
+	}
+
+	// address of config reloaded listened on restart
+	cfg.Host = "127.0.0.2"
+	if _, err := cfg.PostHandle(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	defer s.Stop()
+	waitFor(t, "restart", func() bool { return s.Addr() != nil })
+	if !s.Addr().IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("expect address of config listened, got %v", s.Addr())
+	}
+}
@@ -0,0 +1,304 @@
+package gb28181
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"strconv"
+	"strings"
+
+	"github.com/teris-io/shortid"
+)
+
+const SIP_VERSION = "SIP/2.0"
+
+const (
+	REGISTER = "REGISTER"
+	MESSAGE  = "MESSAGE"
+	INVITE   = "INVITE"
+	ACK      = "ACK"
+	BYE      = "BYE"
+	CANCEL   = "CANCEL"
+	OPTIONS  = "OPTIONS"
+)
+
+var (
+	InvalidSIPMessageError   = errors.New("invalid sip message")
+	InvalidSIPStartLineError = errors.New("invalid sip start line")
+)
+
+// compactHeaders maps the compact form of SIP header names (RFC 3261 7.3.3)
+// to their full form
+var compactHeaders = map[string]string{
+	"v": "Via",
+	"f": "From",
+	"t": "To",
+	"i": "Call-ID",
+	"m": "Contact",
+	"l": "Content-Length",
+	"c": "Content-Type",
+	"s": "Subject",
+	"k": "Supported",
+}
+
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Message is a SIP request or response. Method is empty for responses
+type Message struct {
+	Method     string
+	RequestURI string
+	StatusCode int
+	Reason     string
+	Headers    []Header
+	Body       []byte
+}
+
+func canonicalHeaderName(name string) string {
+	if full, ok := compactHeaders[strings.ToLower(name)]; ok {
+		return full
+	}
+	return name
+}
+
+func ParseMessage(data []byte) (*Message, error) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	sepLen := 4
+	if headerEnd < 0 {
+		if headerEnd = bytes.Index(data, []byte("\n\n")); headerEnd < 0 {
+			return nil, InvalidSIPMessageError
+		}
+		sepLen = 2
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data[:headerEnd]), "\r\n", "\n"), "\n")
+	msg := new(Message)
+	items := strings.SplitN(strings.TrimSpace(lines[0]), " ", 3)
+	if len(items) < 3 {
+		return nil, InvalidSIPStartLineError
+	}
+	if items[0] == SIP_VERSION {
+		code, err := strconv.Atoi(items[1])
+		if err != nil {
+			return nil, InvalidSIPStartLineError
+		}
+		msg.StatusCode, msg.Reason = code, items[2]
+	} else {
+		if items[2] != SIP_VERSION {
+			return nil, InvalidSIPStartLineError
+		}
+		msg.Method, msg.RequestURI = items[0], items[1]
+	}
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		// header folding
+		if (line[0] == ' ' || line[0] == '\t') && len(msg.Headers) > 0 {
+			msg.Headers[len(msg.Headers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		msg.Add(canonicalHeaderName(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:]))
+	}
+	body := data[headerEnd+sepLen:]
+	if l := msg.Get("Content-Length"); l != "" {
+		if n, err := strconv.Atoi(l); err == nil && n >= 0 && n <= len(body) {
+			body = body[:n]
+		}
+	}
+	if len(body) > 0 {
+		msg.Body = append([]byte(nil), body...)
+	}
+	return msg, nil
+}
+
+func (m *Message) IsRequest() bool {
+	return m.Method != ""
+}
+
+// Get returns the first value of the header with the given name, header names
+// are case-insensitive
+func (m *Message) Get(name string) string {
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+func (m *Message) GetAll(name string) (values []string) {
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return
+}
+
+func (m *Message) Add(name string, value string) *Message {
+	m.Headers = append(m.Headers, Header{Name: name, Value: value})
+	return m
+}
+
+// Set replaces all values of the header with the given name
+func (m *Message) Set(name string, value string) *Message {
+	m.Del(name)
+	return m.Add(name, value)
+}
+
+func (m *Message) Del(name string) *Message {
+	headers := m.Headers[:0]
+	for _, h := range m.Headers {
+		if !strings.EqualFold(h.Name, name) {
+			headers = append(headers, h)
+		}
+	}
+	m.Headers = headers
+	return m
+}
+
+func (m *Message) SetBody(contentType string, body []byte) *Message {
+	m.Body = body
+	if len(body) > 0 {
+		m.Set("Content-Type", contentType)
+	} else {
+		m.Del("Content-Type")
+	}
+	return m
+}
+
+// CSeq returns the sequence number and method of CSeq header
+func (m *Message) CSeq() (int, string) {
+	fields := strings.Fields(m.Get("CSeq"))
+	if len(fields) != 2 {
+		return 0, ""
+	}
+	seq, _ := strconv.Atoi(fields[0])
+	return seq, fields[1]
+}
+
+func (m *Message) CallID() string {
+	return m.Get("Call-ID")
+}
+
+// TransactionKey identifies the client transaction a response belongs to
+func (m *Message) TransactionKey() string {
+	seq, method := m.CSeq()
+	return fmt.Sprintf("%s:%d:%s", m.CallID(), seq, method)
+}
+
+func (m *Message) Bytes() []byte {
+	buf := bytes.Buffer{}
+	if m.IsRequest() {
+		buf.WriteString(fmt.Sprintf("%s %s %s\r\n", m.Method, m.RequestURI, SIP_VERSION))
+	} else {
+		buf.WriteString(fmt.Sprintf("%s %d %s\r\n", SIP_VERSION, m.StatusCode, m.Reason))
+	}
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, "Content-Length") {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%s: %s\r\n", h.Name, h.Value))
+	}
+	buf.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(m.Body)))
+	buf.Write(m.Body)
+	return buf.Bytes()
+}
+
+func (m *Message) String() string {
+	return string(m.Bytes())
+}
+
+// NewResponse creates a response of request, the Via, From, To, Call-ID and
+// CSeq headers are copied from request, and a tag is added to To header if
+// it is absent
+func NewResponse(req *Message, statusCode int, reason string) *Message {
+	res := &Message{StatusCode: statusCode, Reason: reason}
+	for _, via := range req.GetAll("Via") {
+		res.Add("Via", via)
+	}
+	res.Add("From", req.Get("From"))
+	to := req.Get("To")
+	if headerParam(to, "tag") == "" && statusCode > 100 {
+		to = fmt.Sprintf("%s;tag=%s", to, newTag())
+	}
+	res.Add("To", to)
+	res.Add("Call-ID", req.Get("Call-ID"))
+	res.Add("CSeq", req.Get("CSeq"))
+	return res
+}
+
+// headerParam returns the value of the named parameter of a header value,
+// such as tag of From header or branch of Via header
+func headerParam(value string, name string) string {
+	// skip the uri part enclosed in angle brackets, which may contain ';'
+	if i := strings.LastIndexByte(value, '>'); i >= 0 {
+		value = value[i+1:]
+	}
+	for _, param := range strings.Split(value, ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if strings.EqualFold(kv[0], name) {
+			if len(kv) == 2 {
+				return strings.Trim(kv[1], `"`)
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// uriUser returns the user part of the sip uri in header value, such as
+// 34020000001320000001 in `<sip:34020000001320000001@3402000000>;tag=1`
+func uriUser(value string) string {
+	if i := strings.IndexByte(value, '<'); i >= 0 {
+		value = value[i+1:]
+		if j := strings.IndexByte(value, '>'); j >= 0 {
+			value = value[:j]
+		}
+	}
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "sips:"), "sip:")
+	if i := strings.IndexByte(value, '@'); i >= 0 {
+		return value[:i]
+	}
+	if i := strings.IndexAny(value, ";:"); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
+
+// uriHost returns the host[:port] part of sip uri in header value
+func uriHost(value string) string {
+	if i := strings.IndexByte(value, '<'); i >= 0 {
+		value = value[i+1:]
+		if j := strings.IndexByte(value, '>'); j >= 0 {
+			value = value[:j]
+		}
+	}
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "sips:"), "sip:")
+	if i := strings.IndexByte(value, '@'); i >= 0 {
+		value = value[i+1:]
+	}
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	return value
+}
+
+func newTag() string {
+	return shortid.MustGenerate()
+}
+
+// newBranch generates Via branch parameter with RFC 3261 magic cookie
+func newBranch() string {
+	return "z9hG4bK" + shortid.MustGenerate()
+}
+
+func newCallID() string {
+	return shortid.MustGenerate() + shortid.MustGenerate()
+}
@@ -0,0 +1,107 @@
+package gb28181
+
+import (
+	"fmt"
+	"testing"
+)
+
+const testRegister = "REGISTER sip:34020000002000000001@3402000000 SIP/2.0\r\n" +
+	"Via: SIP/2.0/UDP 192.168.1.64:5060;rport;branch=z9hG4bK1371463273\r\n" +
+	"From: <sip:34020000001320000001@3402000000>;tag=2043466181\r\n" +
+	"To: <sip:34020000001320000001@3402000000>\r\n" +
+	"Call-ID: 1011047669\r\n" +
+	"CSeq: 1 REGISTER\r\n" +
+	"Contact: <sip:34020000001320000001@192.168.1.64:5060>\r\n" +
+	"Max-Forwards: 70\r\n" +
+	"User-Agent: IP Camera\r\n" +
+	"Expires: 3600\r\n" +
+	"Content-Length: 0\r\n\r\n"
+
+func TestParseMessage(t *testing.T) {
+	msg, err := ParseMessage([]byte(testRegister))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.IsRequest() || msg.Method != REGISTER || msg.RequestURI != "sip:34020000002000000001@3402000000" {
+		t.Fatalf("unexpected start line: %s %s", msg.Method, msg.RequestURI)
+	}
+	if seq, method := msg.CSeq(); seq != 1 || method != REGISTER {
+		t.Fatalf("unexpected cseq: %d %s", seq, method)
+	}
+	if user := uriUser(msg.Get("from")); user != "34020000001320000001" {
+		t.Fatalf("unexpected from user: %s", user)
+	}
+	if host := uriHost(msg.Get("Contact")); host != "192.168.1.64:5060" {
+		t.Fatalf("unexpected contact host: %s", host)
+	}
+	if tag := headerParam(msg.Get("From"), "tag"); tag != "2043466181" {
+		t.Fatalf("unexpected from tag: %s", tag)
+	}
+
+	// compact form headers and body
+	body := "<?xml version=\"1.0\"?>\r\n<Notify></Notify>\r\n"
+	data := fmt.Sprintf("SIP/2.0 200 OK\r\ni: abc\r\nCSeq: 2 MESSAGE\r\nl: %d\r\n\r\n%s", len(body), body)
+	res, err := ParseMessage([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.IsRequest() || res.StatusCode != 200 || res.CallID() != "abc" || string(res.Body) != body {
+		t.Fatalf("unexpected response: %s", res)
+	}
+	if res.TransactionKey() != "abc:2:MESSAGE" {
+		t.Fatalf("unexpected transaction key: %s", res.TransactionKey())
+	}
+
+	if _, err := ParseMessage([]byte("INVALID\r\n\r\n")); err == nil {
+		t.Fatalf("expect error of invalid start line")
+	}
+}
+
+func TestNewResponse(t *testing.T) {
+	req, _ := ParseMessage([]byte(testRegister))
+	res := NewResponse(req, 200, "OK")
+	parsed, err := ParseMessage(res.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.TransactionKey() != req.TransactionKey() {
+		t.Fatalf("transaction key mismatch: %s", parsed.TransactionKey())
+	}
+	if headerParam(parsed.Get("To"), "tag") == "" {
+		t.Fatalf("expect to tag in response")
+	}
+	if parsed.Get("Via") != req.Get("Via") || parsed.Get("Content-Length") != "0" {
+		t.Fatalf("unexpected response headers: %s", parsed)
+	}
+}
+
+func TestCheckDigest(t *testing.T) {
+	const (
+		user     = "34020000001320000001"
+		realm    = "3402000000"
+		password = "12345678"
+		nonce    = "44fd5b4f6ac2a4b3"
+		uri      = "sip:34020000002000000001@3402000000"
+	)
+	ha1 := md5Hex(user + ":" + realm + ":" + password)
+	ha2 := md5Hex(REGISTER + ":" + uri)
+	response := md5Hex(ha1 + ":" + nonce + ":" + ha2)
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=MD5`,
+		user, realm, nonce, uri, response)
+	if err := checkDigest(auth, REGISTER, password, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDigest(auth, REGISTER, "wrong", nonce); err == nil {
+		t.Fatalf("expect error of wrong password")
+	}
+	if err := checkDigest(auth, REGISTER, password, "stale"); err == nil {
+		t.Fatalf("expect error of mismatched nonce")
+	}
+
+	response = md5Hex(ha1 + ":" + nonce + ":00000001:0a4f113b:auth:" + ha2)
+	auth = fmt.Sprintf(`Digest username="%s",realm="%s",nonce="%s",uri="%s",response="%s",qop=auth,nc=00000001,cnonce="0a4f113b"`,
+		user, realm, nonce, uri, response)
+	if err := checkDigest(auth, REGISTER, password, nonce); err != nil {
+		t.Fatal(err)
+	}
+}
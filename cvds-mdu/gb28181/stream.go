@@ -0,0 +1,345 @@
+package gb28181
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/rtsp"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	videoPayloadType = 96
+	aacPayloadType   = 97
+	pcmaPayloadType  = 8
+	pcmuPayloadType  = 0
+)
+
+// tracks of stream in the order of media in SDP
+const (
+	videoTrack = 0
+	audioTrack = 1
+)
+
+// Stream is a live view session of a device channel. The device sends
+// PS-over-RTP to the receiver port allocated by Stream, PS is demuxed into
+// elementary streams which are packed again as standard RTP and fed to a
+// rtsp.Pusher at Path
+type Stream struct {
+	server    *Server
+	DeviceID  string
+	ChannelID string
+	SSRC      string
+	Path      string
+	Port      int
+	StartAt   time.Time
+
+	// dialog of INVITE
+	callID       string
+	fromTag      string
+	toTag        string
+	remoteTarget string
+	cseq         int
+
+	conn    *net.UDPConn
+	demuxer PSDemuxer
+	rtpTS   uint32
+
+	feeder          *rtsp.Feeder
+	pusher          *rtsp.Pusher
+	videoType       byte
+	audioType       byte
+	videoPacketizer *packetizer
+	audioPacketizer *packetizer
+	aac             *adtsHeader
+
+	InBytes int
+	// 1 if stopped, read by receiving goroutine
+	stopped   uint32
+	readyChan chan struct{}
+	logger    *log.Logger
+}
+
+func (s *Stream) String() string {
+	return fmt.Sprintf("gb28181 stream[%s][%s][%s]", s.DeviceID, s.ChannelID, s.SSRC)
+}
+
+func (s *Stream) Key() string {
+	return streamKey(s.DeviceID, s.ChannelID)
+}
+
+func streamKey(deviceID string, channelID string) string {
+	return deviceID + "/" + channelID
+}
+
+// Pusher returns the rtsp pusher of stream, it is nil until the first video
+// frame arrived
+func (s *Stream) Pusher() *rtsp.Pusher {
+	return s.pusher
+}
+
+// Ready returns a channel closed when the pusher of stream has been created
+func (s *Stream) Ready() <-chan struct{} {
+	return s.readyChan
+}
+
+// listen opens the rtp receiver port, if a port range is configured the
+// first free port in range is used
+func (s *Stream) listen() (err error) {
+	cfg := config.GB28181Config()
+	ip := net.ParseIP(cfg.Host)
+	if cfg.RTP.PortMin == 0 {
+		s.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	} else {
+		for port := cfg.RTP.PortMin; port <= cfg.RTP.PortMax; port++ {
+			if s.conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port}); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.conn.SetReadBuffer(cfg.RTP.ReadBuffer); err != nil {
+		s.logger.ErrorWith("gb28181 rtp conn set read buffer error", err)
+	}
+	s.Port = s.conn.LocalAddr().(*net.UDPAddr).Port
+	return nil
+}
+
+func (s *Stream) receive() {
+	defer s.Stop()
+	logger := s.logger
+	timeout := config.GB28181Config().RTP.Timeout
+	buf := make([]byte, rtsp.UdpBufSize)
+	frame := make([]byte, 0, 64*1024)
+	s.demuxer.OnFrame = s.handleFrame
+	logger.Info("gb28181 stream start receive", log.String("stream", s.String()), log.Int("port", s.Port))
+	defer logger.Info("gb28181 stream stop receive", log.String("stream", s.String()), log.Int("port", s.Port))
+	for !s.Stopped() {
+		if timeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		n, _, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !s.Stopped() {
+				logger.ErrorWith("gb28181 stream read rtp error", err, log.String("stream", s.String()))
+			}
+			return
+		}
+		s.InBytes += n
+		rtp := rtsp.ParseRTP(buf[:n])
+		if rtp == nil {
+			continue
+		}
+		ts := uint32(rtp.Timestamp)
+		if len(frame) > 0 && ts != s.rtpTS {
+			s.demuxer.Demux(frame)
+			frame = frame[:0]
+		}
+		s.rtpTS = ts
+		frame = append(frame, rtp.Payload...)
+		if rtp.Marker {
+			s.demuxer.Demux(frame)
+			frame = frame[:0]
+		}
+	}
+}
+
+func (s *Stream) handleFrame(frame *PSFrame) {
+	if frame.Video {
+		if s.feeder == nil {
+			if frame.StreamType != StreamTypeH264 && frame.StreamType != StreamTypeH265 {
+				return
+			}
+			s.videoType = frame.StreamType
+			s.audioType = s.demuxer.AudioType
+			if err := s.publish(frame); err != nil {
+				s.logger.ErrorWith("gb28181 stream publish error", err, log.String("stream", s.String()))
+				go s.Stop()
+				return
+			}
+		}
+		ts := uint32(frame.PTS)
+		if frame.PTS == 0 {
+			ts = s.rtpTS
+		}
+		var packets [][]byte
+		switch s.videoType {
+		case StreamTypeH264:
+			packets = s.videoPacketizer.H264(frame.Data, ts)
+		case StreamTypeH265:
+			packets = s.videoPacketizer.H265(frame.Data, ts)
+		}
+		s.feed(videoTrack, rtsp.RtpTypeVideo, packets)
+		return
+	}
+
+	if frame.StreamType == StreamTypeAAC && s.aac == nil {
+		if header, ok := parseADTS(frame.Data); ok {
+			s.aac = &header
+		}
+	}
+	if s.feeder == nil || s.audioPacketizer == nil {
+		return
+	}
+	pts := frame.PTS
+	if pts == 0 {
+		pts = uint64(s.rtpTS)
+	}
+	switch s.audioType {
+	case StreamTypeG711A, StreamTypeG711U:
+		s.feed(audioTrack, rtsp.RtpTypeAudio, s.audioPacketizer.G711(frame.Data, uint32(pts*8000/90000)))
+	case StreamTypeAAC:
+		s.feed(audioTrack, rtsp.RtpTypeAudio, s.audioPacketizer.AAC(frame.Data, uint32(pts*uint64(s.aac.sampleRate())/90000)))
+	}
+}
+
+func (s *Stream) feed(track int, typ rtsp.RTPType, packets [][]byte) {
+	for _, pkt := range packets {
+		pack := rtsp.NewRTPPack(track, typ, pkt, nil)
+		s.feeder.Feed(pack)
+		pack.Release()
+	}
+}
+
+// publish creates the rtsp pusher of stream with the codec of first video
+// frame and the audio codec announced in program stream map
+func (s *Stream) publish(frame *PSFrame) error {
+	ssrc := uint32(0)
+	fmt.Sscanf(s.SSRC, "%d", &ssrc)
+	sdp := s.buildSDP(frame)
+	s.videoPacketizer = newPacketizer(videoPayloadType, ssrc)
+	switch s.audioType {
+	case StreamTypeG711A:
+		s.audioPacketizer = newPacketizer(pcmaPayloadType, ssrc+1)
+	case StreamTypeG711U:
+		s.audioPacketizer = newPacketizer(pcmuPayloadType, ssrc+1)
+	case StreamTypeAAC:
+		if s.aac != nil {
+			s.audioPacketizer = newPacketizer(aacPayloadType, ssrc+1)
+		}
+	}
+	server := rtsp.GetServer()
+	if !server.Memory().Admit("gb28181 stream") {
+		return fmt.Errorf("not enough memory for rtsp path %s", s.Path)
+	}
+	feeder, err := rtsp.NewFeeder(server, s.Path, fmt.Sprintf("gb28181://%s/%s", s.DeviceID, s.ChannelID), sdp)
+	if err != nil {
+		return err
+	}
+	pusher := rtsp.NewFeederPusher(feeder)
+	feeder.StopHandles = append(feeder.StopHandles, func() {
+		go s.Stop()
+	})
+	if !server.AddPusher(pusher) {
+		return fmt.Errorf("rtsp path %s already exists", s.Path)
+	}
+	s.feeder, s.pusher = feeder, pusher
+	close(s.readyChan)
+	return nil
+}
+
+func (s *Stream) buildSDP(frame *PSFrame) string {
+	sb := strings.Builder{}
+	sb.WriteString("v=0\r\n")
+	sb.WriteString(fmt.Sprintf("o=%s 0 0 IN IP4 %s\r\n", s.DeviceID, config.GB28181Config().ExternalIP))
+	sb.WriteString(fmt.Sprintf("s=GB28181 %s/%s\r\n", s.DeviceID, s.ChannelID))
+	sb.WriteString("t=0 0\r\n")
+	sb.WriteString("a=control:*\r\n")
+	sb.WriteString(fmt.Sprintf("m=video 0 RTP/AVP %d\r\n", videoPayloadType))
+	switch s.videoType {
+	case StreamTypeH264:
+		sb.WriteString(fmt.Sprintf("a=rtpmap:%d H264/90000\r\n", videoPayloadType))
+		fmtp := fmt.Sprintf("a=fmtp:%d packetization-mode=1", videoPayloadType)
+		var sps, pps []byte
+		for _, nalu := range SplitAnnexB(frame.Data) {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch nalu[0] & 0x1F {
+			case 7:
+				sps = nalu
+			case 8:
+				pps = nalu
+			}
+		}
+		if sps != nil && pps != nil {
+			// skip profile-level-id if the SPS from the device is truncated
+			if len(sps) >= 4 {
+				fmtp += fmt.Sprintf(";profile-level-id=%s", hex.EncodeToString(sps[1:4]))
+			}
+			fmtp += fmt.Sprintf(";sprop-parameter-sets=%s,%s", base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(pps))
+		}
+		sb.WriteString(fmtp + "\r\n")
+	case StreamTypeH265:
+		sb.WriteString(fmt.Sprintf("a=rtpmap:%d H265/90000\r\n", videoPayloadType))
+		var params []string
+		for _, nalu := range SplitAnnexB(frame.Data) {
+			if len(nalu) == 0 {
+				continue
+			}
+			switch nalu[0] >> 1 & 0x3F {
+			case 32:
+				params = append(params, "sprop-vps="+base64.StdEncoding.EncodeToString(nalu))
+			case 33:
+				params = append(params, "sprop-sps="+base64.StdEncoding.EncodeToString(nalu))
+			case 34:
+				params = append(params, "sprop-pps="+base64.StdEncoding.EncodeToString(nalu))
+			}
+		}
+		if len(params) > 0 {
+			sb.WriteString(fmt.Sprintf("a=fmtp:%d %s\r\n", videoPayloadType, strings.Join(params, ";")))
+		}
+	}
+	sb.WriteString("a=control:streamid=0\r\n")
+	switch s.audioType {
+	case StreamTypeG711A:
+		sb.WriteString(fmt.Sprintf("m=audio 0 RTP/AVP %d\r\n", pcmaPayloadType))
+		sb.WriteString(fmt.Sprintf("a=rtpmap:%d PCMA/8000\r\n", pcmaPayloadType))
+		sb.WriteString("a=control:streamid=1\r\n")
+	case StreamTypeG711U:
+		sb.WriteString(fmt.Sprintf("m=audio 0 RTP/AVP %d\r\n", pcmuPayloadType))
+		sb.WriteString(fmt.Sprintf("a=rtpmap:%d PCMU/8000\r\n", pcmuPayloadType))
+		sb.WriteString("a=control:streamid=1\r\n")
+	case StreamTypeAAC:
+		if s.aac != nil {
+			sb.WriteString(fmt.Sprintf("m=audio 0 RTP/AVP %d\r\n", aacPayloadType))
+			sb.WriteString(fmt.Sprintf("a=rtpmap:%d MPEG4-GENERIC/%d/%d\r\n", aacPayloadType, s.aac.sampleRate(), s.aac.channels))
+			sb.WriteString(fmt.Sprintf("a=fmtp:%d streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s\r\n",
+				aacPayloadType, hex.EncodeToString(s.aac.audioSpecificConfig())))
+			sb.WriteString("a=control:streamid=1\r\n")
+		}
+	}
+	return sb.String()
+}
+
+// Stop closes the receiver and the pusher of stream, and hangs up the call
+// if it is still established
+func (s *Stream) Stop() {
+	if atomic.SwapUint32(&s.stopped, 1) == 1 {
+		return
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.feeder != nil {
+		s.feeder.Stop()
+	}
+	s.server.removeStream(s)
+	if s.toTag != "" {
+		if err := s.server.bye(s); err != nil {
+			s.logger.ErrorWith("gb28181 stream send bye error", err, log.String("stream", s.String()))
+		}
+	}
+	s.logger.Info("gb28181 stream stopped", log.String("stream", s.String()))
+}
+
+func (s *Stream) Stopped() bool {
+	return atomic.LoadUint32(&s.stopped) == 1
+}
@@ -8,7 +8,6 @@ require (
 	github.com/eiannone/keyboard v0.0.0-20200508000154-caf4b762e807
 	github.com/gin-contrib/pprof v1.3.0
 	github.com/gin-gonic/gin v1.7.4
-	github.com/pixelbender/go-sdp v1.1.0
 	github.com/spf13/cobra v1.5.0
 	github.com/teris-io/shortid v0.0.0-20201117134242-e59966efd125
 	golang.org/x/sys v0.0.0-20210915083310-ed5796bab164
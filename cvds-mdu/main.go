@@ -7,6 +7,8 @@ import (
 	"github.com/CVDS2020/CVDS2020/common/log"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/args"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/gb28181"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/onvif"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/routers"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/rtsp"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/system/service"
@@ -22,6 +24,7 @@ var Logger = assert.Must(config.LogConfig().Build("main"))
 type program struct {
 	httpServer *http.Server
 	rtspServer *rtsp.Server
+	gbServer   *gb28181.Server
 }
 
 func (p *program) StopHTTP() (err error) {
@@ -79,6 +82,40 @@ func (p *program) StopRTSP() (err error) {
 	return
 }
 
+func (p *program) StartGB28181() {
+	if !config.GB28181Config().Enable {
+		return
+	}
+	if p.gbServer == nil {
+		Logger.Fatal("GB28181 Server Not Found")
+	}
+	Logger.Info(fmt.Sprintf("gb28181 server start --> sip:%s@%s", config.GB28181Config().ID, config.GB28181Config().GetAddr()))
+	go func() {
+		if err := p.gbServer.Start(); err != nil {
+			Logger.ErrorWith("start gb28181 server error", err)
+		}
+		Logger.Info("gb28181 server end")
+	}()
+}
+
+func (p *program) StopGB28181() {
+	if p.gbServer == nil {
+		Logger.Fatal("GB28181 Server Not Found")
+	}
+	p.gbServer.Stop()
+}
+
+func (p *program) StartOnvif() {
+	if len(config.OnvifConfig().Cameras) > 0 {
+		Logger.Info(fmt.Sprintf("onvif event subscription start --> %d cameras", len(config.OnvifConfig().Cameras)))
+	}
+	onvif.GetManager().StartSubscriptions()
+}
+
+func (p *program) StopOnvif() {
+	onvif.GetManager().StopSubscriptions()
+}
+
 func (p *program) Start(s service.Service) (err error) {
 	Logger.Info("********** START **********")
 	err = routers.Init()
@@ -86,14 +123,20 @@ func (p *program) Start(s service.Service) (err error) {
 		return
 	}
 	p.StartRTSP()
+	p.StartGB28181()
+	p.StartOnvif()
 	p.StartHTTP()
 
 	go func() {
 		for range routers.API.RestartChan {
 			p.StopHTTP()
+			p.StopOnvif()
+			p.StopGB28181()
 			p.StopRTSP()
 			config.ReloadConfig()
 			p.StartRTSP()
+			p.StartGB28181()
+			p.StartOnvif()
 			p.StartHTTP()
 		}
 	}()
@@ -104,6 +147,8 @@ func (p *program) Start(s service.Service) (err error) {
 func (p *program) Stop(s service.Service) (err error) {
 	defer Logger.Info("********** STOP **********")
 	p.StopHTTP()
+	p.StopOnvif()
+	p.StopGB28181()
 	p.StopRTSP()
 	return
 }
@@ -136,6 +181,7 @@ func main() {
 	rtspServer := rtsp.GetServer()
 	p := &program{
 		rtspServer: rtspServer,
+		gbServer:   gb28181.GetServer(),
 	}
 	s, err := service.New(p, svcConfig)
 	if err != nil {
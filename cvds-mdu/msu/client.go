@@ -0,0 +1,117 @@
+package msu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net/http"
+	urlpkg "net/url"
+	"time"
+)
+
+// Client calls channel api of MSU to manage record channels
+type Client struct {
+	Addr   string
+	client *http.Client
+}
+
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:   addr,
+		client: &http.Client{Timeout: config.MsuConfig().Timeout},
+	}
+}
+
+// GetClient returns client of the MSU configured
+func GetClient() *Client {
+	return NewClient(config.MsuConfig().Addr)
+}
+
+type result struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Channel struct {
+		UUID string `json:"uuid"`
+	} `json:"channel"`
+}
+
+func (c *Client) do(req *http.Request) (*result, error) {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	r := new(result)
+	if err := json.NewDecoder(res.Body).Decode(r); err != nil {
+		return nil, fmt.Errorf("msu response status %d: %w", res.StatusCode, err)
+	}
+	if r.Code != http.StatusOK {
+		return nil, fmt.Errorf("msu response code %d: %s", r.Code, r.Msg)
+	}
+	return r, nil
+}
+
+func (c *Client) postJSON(path string, v any) (*result, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
+// StartChannel creates and starts a record channel, returns uuid of channel.
+// mode is continuous or event, empty means continuous
+func (c *Client) StartChannel(name string, url string, transport string, mode string, fields map[string]any) (string, error) {
+	r, err := c.postJSON("/api/v1/channel/start", map[string]any{
+		"name":      name,
+		"url":       url,
+		"transport": transport,
+		"mode":      mode,
+		"fields":    fields,
+	})
+	if err != nil {
+		return "", err
+	}
+	return r.Channel.UUID, nil
+}
+
+func (c *Client) StopChannel(uuid string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.Addr+"/api/v1/channel/stop?uuid="+urlpkg.QueryEscape(uuid), nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req)
+	return err
+}
+
+// Mark marks recordings of channel at time t with event type, source and
+// message
+func (c *Client) Mark(uuid string, t time.Time, typ string, source string, message string) error {
+	_, err := c.postJSON("/api/v1/channel/mark", map[string]any{
+		"uuid":    uuid,
+		"time":    t,
+		"type":    typ,
+		"source":  source,
+		"message": message,
+	})
+	return err
+}
+
+// Trigger starts recording of event mode channel for duration
+func (c *Client) Trigger(uuid string, duration time.Duration) error {
+	seconds := uint(duration.Seconds())
+	if seconds == 0 {
+		seconds = 1
+	}
+	_, err := c.postJSON("/api/v1/channel/trigger", map[string]any{
+		"uuid":     uuid,
+		"duration": seconds,
+	})
+	return err
+}
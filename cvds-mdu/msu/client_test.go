@@ -0,0 +1,63 @@
+package msu
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	var started, marked, triggered map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/channel/start":
+			json.NewDecoder(r.Body).Decode(&started)
+			w.Write([]byte(`{"code":200,"msg":"success","channel":{"uuid":"c1"}}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/v1/channel/stop":
+			if r.URL.Query().Get("uuid") != "c1" {
+				w.Write([]byte(`{"code":400,"msg":"channel not found"}`))
+				return
+			}
+			w.Write([]byte(`{"code":200,"msg":"success"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/channel/mark":
+			json.NewDecoder(r.Body).Decode(&marked)
+			w.Write([]byte(`{"code":200,"msg":"success"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/channel/trigger":
+			json.NewDecoder(r.Body).Decode(&triggered)
+			w.Write([]byte(`{"code":200,"msg":"success"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	uuid, err := client.StartChannel("cam1", "rtsp://127.0.0.1:554/cam1", "tcp", "event", map[string]any{"k": "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uuid != "c1" || started["name"] != "cam1" || started["url"] != "rtsp://127.0.0.1:554/cam1" || started["mode"] != "event" {
+		t.Fatalf("unexpected start channel: %s %v", uuid, started)
+	}
+	at := time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC)
+	if err := client.Mark("c1", at, "motion", "onvif", "cell motion"); err != nil {
+		t.Fatal(err)
+	}
+	if marked["uuid"] != "c1" || marked["type"] != "motion" || marked["time"] != "2022-03-01T08:00:00Z" {
+		t.Fatalf("unexpected mark: %v", marked)
+	}
+	if err := client.Trigger("c1", 45*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if triggered["uuid"] != "c1" || triggered["duration"] != float64(45) {
+		t.Fatalf("unexpected trigger: %v", triggered)
+	}
+	if err := client.StopChannel("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StopChannel("c2"); err == nil {
+		t.Fatal("expect error of unknown channel")
+	}
+}
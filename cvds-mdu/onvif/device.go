@@ -0,0 +1,208 @@
+package onvif
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type DeviceInformation struct {
+	Manufacturer    string `xml:"Manufacturer" json:"manufacturer"`
+	Model           string `xml:"Model" json:"model"`
+	FirmwareVersion string `xml:"FirmwareVersion" json:"firmwareVersion"`
+	SerialNumber    string `xml:"SerialNumber" json:"serialNumber"`
+	HardwareID      string `xml:"HardwareId" json:"hardwareId"`
+}
+
+type VideoEncoderConfiguration struct {
+	Token     string `xml:"token,attr" json:"token"`
+	Encoding  string `xml:"Encoding" json:"encoding"`
+	Width     int    `xml:"Resolution>Width" json:"width"`
+	Height    int    `xml:"Resolution>Height" json:"height"`
+	FrameRate int    `xml:"RateControl>FrameRateLimit" json:"frameRate"`
+	Bitrate   int    `xml:"RateControl>BitrateLimit" json:"bitrate"`
+}
+
+type AudioEncoderConfiguration struct {
+	Token      string `xml:"token,attr" json:"token"`
+	Encoding   string `xml:"Encoding" json:"encoding"`
+	Bitrate    int    `xml:"Bitrate" json:"bitrate"`
+	SampleRate int    `xml:"SampleRate" json:"sampleRate"`
+}
+
+type PTZConfiguration struct {
+	Token     string `xml:"token,attr" json:"token"`
+	NodeToken string `xml:"NodeToken" json:"nodeToken"`
+}
+
+type Profile struct {
+	Token string                     `xml:"token,attr" json:"token"`
+	Name  string                     `xml:"Name" json:"name"`
+	Video *VideoEncoderConfiguration `xml:"VideoEncoderConfiguration" json:"video,omitempty"`
+	Audio *AudioEncoderConfiguration `xml:"AudioEncoderConfiguration" json:"audio,omitempty"`
+	PTZ   *PTZConfiguration          `xml:"PTZConfiguration" json:"ptz,omitempty"`
+}
+
+// Device is a onvif device client. The device service address XAddr is
+// required, addresses of other services are queried by Connect
+type Device struct {
+	ID       string
+	XAddr    string
+	Username string
+	Password string
+
+	Info       DeviceInformation
+	MediaXAddr string
+	PTZXAddr   string
+	EventXAddr string
+
+	// difference between device clock and local clock, used by UsernameToken
+	// created time because devices reject tokens out of their clock window
+	timeOffset time.Duration
+	timeout    time.Duration
+	client     *http.Client
+	lock       sync.Mutex
+}
+
+func NewDevice(xaddr string, username string, password string, timeout time.Duration) *Device {
+	return &Device{
+		ID:       xaddr,
+		XAddr:    xaddr,
+		Username: username,
+		Password: password,
+		timeout:  timeout,
+		// timeout of requests is controlled by context, so that long polling
+		// of PullMessages is not limited by request timeout
+		client: &http.Client{},
+	}
+}
+
+func (d *Device) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), d.timeout)
+}
+
+// SetCredential replaces username and password used by requests to device
+func (d *Device) SetCredential(username string, password string) {
+	d.lock.Lock()
+	d.Username, d.Password = username, password
+	d.lock.Unlock()
+}
+
+// Connect synchronizes clock with device, queries addresses of services and
+// device information
+func (d *Device) Connect() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if t, err := d.getSystemDateAndTime(); err == nil {
+		d.timeOffset = time.Until(t)
+	}
+	if err := d.getCapabilities(); err != nil {
+		return err
+	}
+	return d.getDeviceInformation()
+}
+
+func (d *Device) getSystemDateAndTime() (time.Time, error) {
+	ctx, cancel := d.context()
+	defer cancel()
+	var res struct {
+		Date struct {
+			Year  int `xml:"Year"`
+			Month int `xml:"Month"`
+			Day   int `xml:"Day"`
+		} `xml:"SystemDateAndTime>UTCDateTime>Date"`
+		Time struct {
+			Hour   int `xml:"Hour"`
+			Minute int `xml:"Minute"`
+			Second int `xml:"Second"`
+		} `xml:"SystemDateAndTime>UTCDateTime>Time"`
+	}
+	// GetSystemDateAndTime must be callable without authentication
+	if err := d.post(ctx, d.XAddr, NamespaceDevice+"/GetSystemDateAndTime", "", "<tds:GetSystemDateAndTime/>", &res); err != nil {
+		return time.Time{}, err
+	}
+	if res.Date.Year == 0 {
+		return time.Time{}, EmptySOAPBodyError
+	}
+	return time.Date(res.Date.Year, time.Month(res.Date.Month), res.Date.Day,
+		res.Time.Hour, res.Time.Minute, res.Time.Second, 0, time.UTC), nil
+}
+
+func (d *Device) getCapabilities() error {
+	ctx, cancel := d.context()
+	defer cancel()
+	var res struct {
+		Media  string `xml:"Capabilities>Media>XAddr"`
+		PTZ    string `xml:"Capabilities>PTZ>XAddr"`
+		Events string `xml:"Capabilities>Events>XAddr"`
+	}
+	if err := d.call(ctx, d.XAddr, NamespaceDevice+"/GetCapabilities",
+		"<tds:GetCapabilities><tds:Category>All</tds:Category></tds:GetCapabilities>", &res); err != nil {
+		return err
+	}
+	d.MediaXAddr, d.PTZXAddr, d.EventXAddr = res.Media, res.PTZ, res.Events
+	return nil
+}
+
+func (d *Device) getDeviceInformation() error {
+	ctx, cancel := d.context()
+	defer cancel()
+	return d.call(ctx, d.XAddr, NamespaceDevice+"/GetDeviceInformation", "<tds:GetDeviceInformation/>", &d.Info)
+}
+
+func (d *Device) mediaXAddr() (string, error) {
+	if d.MediaXAddr == "" {
+		if err := d.Connect(); err != nil {
+			return "", err
+		}
+		if d.MediaXAddr == "" {
+			return "", ServiceNotFoundError
+		}
+	}
+	return d.MediaXAddr, nil
+}
+
+func (d *Device) GetProfiles() ([]Profile, error) {
+	xaddr, err := d.mediaXAddr()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := d.context()
+	defer cancel()
+	var res struct {
+		Profiles []Profile `xml:"Profiles"`
+	}
+	if err := d.call(ctx, xaddr, NamespaceMedia+"/GetProfiles", "<trt:GetProfiles/>", &res); err != nil {
+		return nil, err
+	}
+	return res.Profiles, nil
+}
+
+// GetStreamUri returns RTSP unicast uri of the media profile
+func (d *Device) GetStreamUri(profileToken string) (string, error) {
+	xaddr, err := d.mediaXAddr()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := d.context()
+	defer cancel()
+	var res struct {
+		URI string `xml:"MediaUri>Uri"`
+	}
+	body := fmt.Sprintf("<trt:GetStreamUri><trt:StreamSetup><tt:Stream>RTP-Unicast</tt:Stream>"+
+		"<tt:Transport><tt:Protocol>RTSP</tt:Protocol></tt:Transport></trt:StreamSetup>"+
+		"<trt:ProfileToken>%s</trt:ProfileToken></trt:GetStreamUri>", xmlEscape(profileToken))
+	if err := d.call(ctx, xaddr, NamespaceMedia+"/GetStreamUri", body, &res); err != nil {
+		return "", err
+	}
+	if res.URI == "" {
+		return "", EmptySOAPBodyError
+	}
+	return res.URI, nil
+}
+
+func (d *Device) String() string {
+	return fmt.Sprintf("onvif device[%s]", d.XAddr)
+}
@@ -0,0 +1,190 @@
+package onvif
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testUsername = "admin"
+	testPassword = "a12345678"
+)
+
+// testCamera is a SOAP stand-in of onvif camera. Handlers are registered by
+// action name, all actions except GetSystemDateAndTime require UsernameToken
+type testCamera struct {
+	*httptest.Server
+	handlers map[string]func(body string) string
+	requests []string
+	lock     sync.Mutex
+}
+
+var actionRex = regexp.MustCompile(`action="[^"]*/([^/"]+)"`)
+
+func newTestCamera(t *testing.T) *testCamera {
+	c := &testCamera{handlers: make(map[string]func(body string) string)}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serve))
+	c.handle("GetSystemDateAndTime", func(string) string {
+		now := time.Now().UTC()
+		return fmt.Sprintf(`<tds:GetSystemDateAndTimeResponse><tds:SystemDateAndTime><tt:UTCDateTime>`+
+			`<tt:Time><tt:Hour>%d</tt:Hour><tt:Minute>%d</tt:Minute><tt:Second>%d</tt:Second></tt:Time>`+
+			`<tt:Date><tt:Year>%d</tt:Year><tt:Month>%d</tt:Month><tt:Day>%d</tt:Day></tt:Date>`+
+			`</tt:UTCDateTime></tds:SystemDateAndTime></tds:GetSystemDateAndTimeResponse>`,
+			now.Hour(), now.Minute(), now.Second(), now.Year(), now.Month(), now.Day())
+	})
+	c.handle("GetCapabilities", func(string) string {
+		return fmt.Sprintf(`<tds:GetCapabilitiesResponse><tds:Capabilities>`+
+			`<tt:Events><tt:XAddr>%[1]s/onvif/events</tt:XAddr></tt:Events>`+
+			`<tt:Media><tt:XAddr>%[1]s/onvif/media</tt:XAddr></tt:Media>`+
+			`<tt:PTZ><tt:XAddr>%[1]s/onvif/ptz</tt:XAddr></tt:PTZ>`+
+			`</tds:Capabilities></tds:GetCapabilitiesResponse>`, c.URL)
+	})
+	c.handle("GetDeviceInformation", func(string) string {
+		return `<tds:GetDeviceInformationResponse><tds:Manufacturer>Sim</tds:Manufacturer><tds:Model>SIM-IPC</tds:Model>` +
+			`<tds:FirmwareVersion>V1.0</tds:FirmwareVersion><tds:SerialNumber>0001</tds:SerialNumber>` +
+			`<tds:HardwareId>1419</tds:HardwareId></tds:GetDeviceInformationResponse>`
+	})
+	c.handle("GetProfiles", func(string) string {
+		return `<trt:GetProfilesResponse>` +
+			`<trt:Profiles token="Profile_1" fixed="true"><tt:Name>mainStream</tt:Name>` +
+			`<tt:VideoEncoderConfiguration token="VideoEncoderToken_1"><tt:Name>VideoEncoder_1</tt:Name><tt:Encoding>H264</tt:Encoding>` +
+			`<tt:Resolution><tt:Width>1920</tt:Width><tt:Height>1080</tt:Height></tt:Resolution>` +
+			`<tt:RateControl><tt:FrameRateLimit>25</tt:FrameRateLimit><tt:BitrateLimit>4096</tt:BitrateLimit></tt:RateControl>` +
+			`</tt:VideoEncoderConfiguration>` +
+			`<tt:AudioEncoderConfiguration token="AudioEncoderToken_1"><tt:Encoding>G711</tt:Encoding><tt:Bitrate>64</tt:Bitrate><tt:SampleRate>8</tt:SampleRate></tt:AudioEncoderConfiguration>` +
+			`<tt:PTZConfiguration token="PTZToken"><tt:NodeToken>PTZNODETOKEN</tt:NodeToken></tt:PTZConfiguration>` +
+			`</trt:Profiles>` +
+			`<trt:Profiles token="Profile_2" fixed="true"><tt:Name>subStream</tt:Name>` +
+			`<tt:VideoEncoderConfiguration token="VideoEncoderToken_2"><tt:Encoding>H264</tt:Encoding>` +
+			`<tt:Resolution><tt:Width>640</tt:Width><tt:Height>360</tt:Height></tt:Resolution></tt:VideoEncoderConfiguration>` +
+			`</trt:Profiles></trt:GetProfilesResponse>`
+	})
+	c.handle("GetStreamUri", func(body string) string {
+		token := regexp.MustCompile(`<trt:ProfileToken>([^<]*)<`).FindStringSubmatch(body)[1]
+		return fmt.Sprintf(`<trt:GetStreamUriResponse><trt:MediaUri><tt:Uri>rtsp://127.0.0.1:554/Streaming/%s</tt:Uri>`+
+			`<tt:InvalidAfterConnect>false</tt:InvalidAfterConnect></trt:MediaUri></trt:GetStreamUriResponse>`, token)
+	})
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *testCamera) handle(action string, handler func(body string) string) {
+	c.lock.Lock()
+	c.handlers[action] = handler
+	c.lock.Unlock()
+}
+
+func (c *testCamera) actions() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.requests...)
+}
+
+func (c *testCamera) fault(w http.ResponseWriter, status int, subcode string, reason string) {
+	w.WriteHeader(status)
+	io.WriteString(w, string(buildEnvelope("", fmt.Sprintf(`<s:Fault><s:Code><s:Value>s:Sender</s:Value>`+
+		`<s:Subcode><s:Value>%s</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en">%s</s:Text></s:Reason></s:Fault>`,
+		subcode, reason))))
+}
+
+// authorized verifies UsernameToken password digest of request
+func authorized(data []byte) bool {
+	var env struct {
+		Username string `xml:"Header>Security>UsernameToken>Username"`
+		Password string `xml:"Header>Security>UsernameToken>Password"`
+		Nonce    string `xml:"Header>Security>UsernameToken>Nonce"`
+		Created  string `xml:"Header>Security>UsernameToken>Created"`
+	}
+	if err := xml.Unmarshal(data, &env); err != nil || env.Username != testUsername {
+		return false
+	}
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return false
+	}
+	return passwordDigest(nonce, env.Created, testPassword) == env.Password
+}
+
+func (c *testCamera) serve(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	m := actionRex.FindStringSubmatch(r.Header.Get("Content-Type"))
+	if m == nil {
+		c.fault(w, http.StatusBadRequest, "ter:InvalidArgVal", "no action")
+		return
+	}
+	action := m[1]
+	c.lock.Lock()
+	handler := c.handlers[action]
+	c.requests = append(c.requests, action)
+	c.lock.Unlock()
+	if handler == nil {
+		c.fault(w, http.StatusBadRequest, "ter:ActionNotSupported", action)
+		return
+	}
+	if action != "GetSystemDateAndTime" && !authorized(data) {
+		c.fault(w, http.StatusBadRequest, "ter:NotAuthorized", "Sender not Authorized")
+		return
+	}
+	body := string(data)
+	if i := strings.Index(body, "<s:Body>"); i >= 0 {
+		body = body[i:]
+	}
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.Write(buildEnvelope("", handler(body)))
+}
+
+func TestDevice(t *testing.T) {
+	camera := newTestCamera(t)
+	device := NewDevice(camera.URL+"/onvif/device_service", testUsername, testPassword, time.Second)
+	if err := device.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if device.Info.Model != "SIM-IPC" || device.MediaXAddr != camera.URL+"/onvif/media" || device.PTZXAddr != camera.URL+"/onvif/ptz" {
+		t.Fatalf("unexpected device: %+v", device)
+	}
+
+	profiles, err := device.GetProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("expect 2 profiles, got %d", len(profiles))
+	}
+	main := profiles[0]
+	if main.Token != "Profile_1" || main.Video == nil || main.Video.Encoding != "H264" || main.Video.Width != 1920 ||
+		main.Video.FrameRate != 25 || main.Audio == nil || main.Audio.Encoding != "G711" || main.PTZ == nil {
+		t.Fatalf("unexpected profile: %+v", main)
+	}
+	if profiles[1].Audio != nil || profiles[1].Video.Height != 360 {
+		t.Fatalf("unexpected profile: %+v", profiles[1])
+	}
+
+	uri, err := device.GetStreamUri("Profile_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != "rtsp://127.0.0.1:554/Streaming/Profile_2" {
+		t.Fatalf("unexpected stream uri: %s", uri)
+	}
+}
+
+func TestDeviceNotAuthorized(t *testing.T) {
+	camera := newTestCamera(t)
+	device := NewDevice(camera.URL+"/onvif/device_service", testUsername, "wrong", time.Second)
+	if err := device.Connect(); err != NotAuthorizedError {
+		t.Fatalf("expect not authorized error, got %v", err)
+	}
+	// clock is synchronized without credential
+	if actions := camera.actions(); len(actions) != 2 || actions[0] != "GetSystemDateAndTime" {
+		t.Fatalf("unexpected requests: %v", actions)
+	}
+}
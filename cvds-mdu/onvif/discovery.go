@@ -0,0 +1,134 @@
+package onvif
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"net"
+	urlpkg "net/url"
+	"strings"
+	"time"
+)
+
+const probeTemplate = `<?xml version="1.0" encoding="UTF-8"?>` +
+	`<e:Envelope xmlns:e="http://www.w3.org/2003/05/soap-envelope" xmlns:w="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+	`xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">` +
+	`<e:Header><w:MessageID>%s</w:MessageID>` +
+	`<w:To e:mustUnderstand="true">urn:schemas-xmlsoap-org:ws:2005:04:discovery</w:To>` +
+	`<w:Action e:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</w:Action></e:Header>` +
+	`<e:Body><d:Probe><d:Types>dn:NetworkVideoTransmitter</d:Types></d:Probe></e:Body></e:Envelope>`
+
+// Discovered is a device answered WS-Discovery probe
+type Discovered struct {
+	// endpoint reference address, usually urn:uuid:xxx
+	Endpoint string   `json:"endpoint"`
+	XAddrs   []string `json:"xaddrs"`
+	Types    []string `json:"types"`
+	Scopes   []string `json:"scopes"`
+	Name     string   `json:"name"`
+	Hardware string   `json:"hardware"`
+	Location string   `json:"location"`
+}
+
+type probeMatches struct {
+	RelatesTo string `xml:"Header>RelatesTo"`
+	Matches   []struct {
+		Endpoint string `xml:"EndpointReference>Address"`
+		Types    string `xml:"Types"`
+		Scopes   string `xml:"Scopes"`
+		XAddrs   string `xml:"XAddrs"`
+	} `xml:"Body>ProbeMatches>ProbeMatch"`
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0F | 0x40
+	b[8] = b[8]&0x3F | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// scopeValue returns the url decoded value of onvif scope such as
+// onvif://www.onvif.org/name/IPC
+func scopeValue(scopes []string, name string) string {
+	prefix := "onvif://www.onvif.org/" + name + "/"
+	for _, scope := range scopes {
+		if strings.HasPrefix(scope, prefix) {
+			value, err := urlpkg.PathUnescape(scope[len(prefix):])
+			if err != nil {
+				return scope[len(prefix):]
+			}
+			return value
+		}
+	}
+	return ""
+}
+
+func parseProbeMatches(data []byte, messageID string) ([]*Discovered, error) {
+	var res probeMatches
+	if err := xml.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	if res.RelatesTo != "" && res.RelatesTo != messageID {
+		return nil, nil
+	}
+	var devices []*Discovered
+	for _, m := range res.Matches {
+		d := &Discovered{
+			Endpoint: strings.TrimSpace(m.Endpoint),
+			XAddrs:   strings.Fields(m.XAddrs),
+			Types:    strings.Fields(m.Types),
+			Scopes:   strings.Fields(m.Scopes),
+		}
+		d.Name = scopeValue(d.Scopes, "name")
+		d.Hardware = scopeValue(d.Scopes, "hardware")
+		d.Location = scopeValue(d.Scopes, "location")
+		if d.Endpoint == "" && len(d.XAddrs) > 0 {
+			d.Endpoint = d.XAddrs[0]
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// Discover sends WS-Discovery probe for NetworkVideoTransmitter to addr, which
+// is usually the multicast address 239.255.255.250:3702, and collects probe
+// matches until timeout. Devices answered more than once are merged
+func Discover(addr string, timeout time.Duration) ([]*Discovered, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	messageID := "uuid:" + newUUID()
+	if _, err := conn.WriteToUDP([]byte(fmt.Sprintf(probeTemplate, messageID)), raddr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	devices := make([]*Discovered, 0)
+	endpoints := make(map[string]bool)
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return devices, nil
+			}
+			return devices, err
+		}
+		matches, err := parseProbeMatches(buf[:n], messageID)
+		if err != nil {
+			continue
+		}
+		for _, d := range matches {
+			if !endpoints[d.Endpoint] {
+				endpoints[d.Endpoint] = true
+				devices = append(devices, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package onvif
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const probeMatchTemplate = `<?xml version="1.0" encoding="UTF-8"?>` +
+	`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" ` +
+	`xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl">` +
+	`<SOAP-ENV:Header><wsa:MessageID>uuid:%s</wsa:MessageID><wsa:RelatesTo>%s</wsa:RelatesTo>` +
+	`<wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</wsa:Action></SOAP-ENV:Header>` +
+	`<SOAP-ENV:Body><d:ProbeMatches><d:ProbeMatch>` +
+	`<wsa:EndpointReference><wsa:Address>urn:uuid:%s</wsa:Address></wsa:EndpointReference>` +
+	`<d:Types>dn:NetworkVideoTransmitter tds:Device</d:Types>` +
+	`<d:Scopes>onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/name/Front%%20Door onvif://www.onvif.org/hardware/SIM-IPC</d:Scopes>` +
+	`<d:XAddrs>http://%s/onvif/device_service</d:XAddrs><d:MetadataVersion>10</d:MetadataVersion>` +
+	`</d:ProbeMatch></d:ProbeMatches></SOAP-ENV:Body></SOAP-ENV:Envelope>`
+
+// startTestResponder answers every probe with the given endpoints, each
+// endpoint answers twice like devices with multiple interfaces do
+func startTestResponder(t *testing.T, endpoints ...string) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	messageIDRex := regexp.MustCompile(`<w:MessageID>([^<]+)<`)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			m := messageIDRex.FindSubmatch(buf[:n])
+			if m == nil {
+				continue
+			}
+			// match of other probe is ignored
+			conn.WriteToUDP([]byte(fmt.Sprintf(probeMatchTemplate, newUUID(), "uuid:other", newUUID(), "127.0.0.1")), addr)
+			for i, endpoint := range endpoints {
+				for j := 0; j < 2; j++ {
+					xaddr := fmt.Sprintf("192.168.1.%d", 64+i)
+					conn.WriteToUDP([]byte(fmt.Sprintf(probeMatchTemplate, newUUID(), m[1], endpoint, xaddr)), addr)
+				}
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestDiscover(t *testing.T) {
+	endpoints := []string{newUUID(), newUUID()}
+	addr := startTestResponder(t, endpoints...)
+	start := time.Now()
+	devices, err := Discover(addr.String(), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("discover returned before timeout")
+	}
+	if len(devices) != 2 {
+		t.Fatalf("expect 2 devices, got %d", len(devices))
+	}
+	d := devices[0]
+	if d.Endpoint != "urn:uuid:"+endpoints[0] || len(d.XAddrs) != 1 || d.XAddrs[0] != "http://192.168.1.64/onvif/device_service" {
+		t.Fatalf("unexpected device: %+v", d)
+	}
+	if d.Name != "Front Door" || d.Hardware != "SIM-IPC" || len(d.Types) != 2 {
+		t.Fatalf("unexpected scopes: %+v", d)
+	}
+}
@@ -0,0 +1,236 @@
+package onvif
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// normalized event types
+const (
+	EventMotion       = "motion"
+	EventTamper       = "tamper"
+	EventLineCrossing = "line-crossing"
+	EventIntrusion    = "intrusion"
+	EventOther        = "other"
+)
+
+// property operations of notification message
+const (
+	OperationInitialized = "Initialized"
+	OperationChanged     = "Changed"
+	OperationDeleted     = "Deleted"
+)
+
+const (
+	createPullPointSubscriptionAction = NamespaceEvents + "/EventPortType/CreatePullPointSubscriptionRequest"
+	pullMessagesAction                = NamespaceEvents + "/PullPointSubscription/PullMessagesRequest"
+	renewAction                       = "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/RenewRequest"
+	unsubscribeAction                 = "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/UnsubscribeRequest"
+)
+
+// Subscription is a PullPoint subscription created on device
+type Subscription struct {
+	Address         string
+	TerminationTime time.Time
+}
+
+type SimpleItem struct {
+	Name  string `xml:"Name,attr"`
+	Value string `xml:"Value,attr"`
+}
+
+// NotificationMessage is a raw event message pulled from device
+type NotificationMessage struct {
+	Topic   string `xml:"Topic"`
+	Message struct {
+		UtcTime           string       `xml:"UtcTime,attr"`
+		PropertyOperation string       `xml:"PropertyOperation,attr"`
+		Source            []SimpleItem `xml:"Source>SimpleItem"`
+		Data              []SimpleItem `xml:"Data>SimpleItem"`
+	} `xml:"Message>Message"`
+}
+
+// Event is a normalized event of device. State is true when the event is
+// active, e.g. motion detected, and false when it is cleared
+type Event struct {
+	ID        int64             `json:"id"`
+	DeviceID  string            `json:"deviceId"`
+	Type      string            `json:"type"`
+	State     bool              `json:"state"`
+	Topic     string            `json:"topic"`
+	Operation string            `json:"operation"`
+	Source    map[string]string `json:"source,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+// Rising reports whether event is a new activation, which should trigger
+// actions. Initialized messages report the state at subscribing, so they are
+// not counted
+func (e *Event) Rising() bool {
+	return e.State && e.Operation != OperationInitialized && e.Operation != OperationDeleted
+}
+
+func onvifDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%gS", d.Seconds())
+}
+
+// trimTopic removes namespace prefixes of topic segments, e.g.
+// tns1:RuleEngine/CellMotionDetector/Motion -> RuleEngine/CellMotionDetector/Motion
+func trimTopic(topic string) string {
+	segments := strings.Split(strings.TrimSpace(topic), "/")
+	for i, segment := range segments {
+		if j := strings.IndexByte(segment, ':'); j >= 0 {
+			segments[i] = segment[j+1:]
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func itemsMap(items []SimpleItem) map[string]string {
+	if len(items) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(items))
+	for _, item := range items {
+		m[item.Name] = item.Value
+	}
+	return m
+}
+
+// eventState finds state of event in data items, keys are checked in order,
+// then any boolean item. Event without boolean item is a pulse, such as line
+// crossed, and is always active
+func eventState(data map[string]string, keys ...string) bool {
+	for _, key := range keys {
+		if v, ok := data[key]; ok {
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		}
+	}
+	for _, v := range data {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return true
+}
+
+// NewEvent normalizes notification message into event. Topics of vendors are
+// matched by keywords of the standard topics
+func NewEvent(deviceID string, msg *NotificationMessage) *Event {
+	e := &Event{
+		DeviceID:  deviceID,
+		Topic:     trimTopic(msg.Topic),
+		Operation: msg.Message.PropertyOperation,
+		Source:    itemsMap(msg.Message.Source),
+		Data:      itemsMap(msg.Message.Data),
+	}
+	if t, err := time.Parse(time.RFC3339, msg.Message.UtcTime); err == nil {
+		e.Time = t.Local()
+	} else {
+		e.Time = time.Now()
+	}
+	topic := strings.ToLower(e.Topic)
+	switch {
+	case strings.Contains(topic, "motion"):
+		e.Type = EventMotion
+		e.State = eventState(e.Data, "IsMotion", "State")
+	case strings.Contains(topic, "tamper"), strings.Contains(topic, "globalscenechange"), strings.Contains(topic, "imagetoo"):
+		e.Type = EventTamper
+		e.State = eventState(e.Data, "IsTamper", "State")
+	case strings.Contains(topic, "linedetector"), strings.Contains(topic, "linecross"):
+		e.Type = EventLineCrossing
+		e.State = eventState(e.Data, "State")
+	case strings.Contains(topic, "fielddetector"), strings.Contains(topic, "intrusion"):
+		e.Type = EventIntrusion
+		e.State = eventState(e.Data, "IsInside", "State")
+	default:
+		e.Type = EventOther
+		e.State = eventState(e.Data, "State")
+	}
+	return e
+}
+
+func (d *Device) eventXAddr() (string, error) {
+	if d.EventXAddr == "" {
+		if err := d.Connect(); err != nil {
+			return "", err
+		}
+		if d.EventXAddr == "" {
+			return "", ServiceNotFoundError
+		}
+	}
+	return d.EventXAddr, nil
+}
+
+// CreatePullPointSubscription subscribes all events of device, the
+// subscription expires after termination unless renewed
+func (d *Device) CreatePullPointSubscription(termination time.Duration) (*Subscription, error) {
+	xaddr, err := d.eventXAddr()
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Address         string `xml:"SubscriptionReference>Address"`
+		TerminationTime string `xml:"TerminationTime"`
+	}
+	ctx, cancel := d.context()
+	defer cancel()
+	body := "<tev:CreatePullPointSubscription><tev:InitialTerminationTime>" + onvifDuration(termination) +
+		"</tev:InitialTerminationTime></tev:CreatePullPointSubscription>"
+	if err := d.call(ctx, xaddr, createPullPointSubscriptionAction, body, &res); err != nil {
+		return nil, err
+	}
+	sub := &Subscription{Address: strings.TrimSpace(res.Address)}
+	if sub.Address == "" {
+		// some devices use event service address as subscription address
+		sub.Address = xaddr
+	}
+	sub.TerminationTime, _ = time.Parse(time.RFC3339, strings.TrimSpace(res.TerminationTime))
+	return sub, nil
+}
+
+// PullMessages waits at most timeout for messages of subscription
+func (d *Device) PullMessages(sub *Subscription, timeout time.Duration, limit int) ([]NotificationMessage, error) {
+	return d.pullMessages(context.Background(), sub, timeout, limit)
+}
+
+func (d *Device) pullMessages(ctx context.Context, sub *Subscription, timeout time.Duration, limit int) ([]NotificationMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout+d.timeout)
+	defer cancel()
+	var res struct {
+		Messages []NotificationMessage `xml:"NotificationMessage"`
+	}
+	body := fmt.Sprintf("<tev:PullMessages><tev:Timeout>%s</tev:Timeout><tev:MessageLimit>%d</tev:MessageLimit></tev:PullMessages>",
+		onvifDuration(timeout), limit)
+	if err := d.callTo(ctx, sub.Address, pullMessagesAction, body, &res); err != nil {
+		return nil, err
+	}
+	return res.Messages, nil
+}
+
+// Renew extends subscription to expire after termination
+func (d *Device) Renew(sub *Subscription, termination time.Duration) error {
+	ctx, cancel := d.context()
+	defer cancel()
+	var res struct {
+		TerminationTime string `xml:"TerminationTime"`
+	}
+	body := "<wsnt:Renew><wsnt:TerminationTime>" + onvifDuration(termination) + "</wsnt:TerminationTime></wsnt:Renew>"
+	if err := d.callTo(ctx, sub.Address, renewAction, body, &res); err != nil {
+		return err
+	}
+	sub.TerminationTime, _ = time.Parse(time.RFC3339, strings.TrimSpace(res.TerminationTime))
+	return nil
+}
+
+func (d *Device) Unsubscribe(sub *Subscription) error {
+	ctx, cancel := d.context()
+	defer cancel()
+	return d.callTo(ctx, sub.Address, unsubscribeAction, "<wsnt:Unsubscribe/>", nil)
+}
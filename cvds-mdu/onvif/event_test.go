@@ -0,0 +1,180 @@
+package onvif
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/msu"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func notificationMessage(topic string, operation string, data string) string {
+	return `<wsnt:NotificationMessage><wsnt:Topic Dialect="http://www.onvif.org/ver10/tev/topicExpression/ConcreteSet">` + topic + `</wsnt:Topic>` +
+		`<wsnt:Message><tt:Message UtcTime="2022-03-01T08:00:00Z" PropertyOperation="` + operation + `">` +
+		`<tt:Source><tt:SimpleItem Name="VideoSourceConfigurationToken" Value="VideoSource_1"/></tt:Source>` +
+		`<tt:Data>` + data + `</tt:Data></tt:Message></wsnt:Message></wsnt:NotificationMessage>`
+}
+
+func TestNewEvent(t *testing.T) {
+	tests := []struct {
+		topic     string
+		operation string
+		data      string
+		typ       string
+		state     bool
+		rising    bool
+	}{
+		{"tns1:RuleEngine/CellMotionDetector/Motion", "Initialized", `<tt:SimpleItem Name="IsMotion" Value="true"/>`, EventMotion, true, false},
+		{"tns1:RuleEngine/CellMotionDetector/Motion", "Changed", `<tt:SimpleItem Name="IsMotion" Value="true"/>`, EventMotion, true, true},
+		{"tns1:VideoSource/MotionAlarm", "Changed", `<tt:SimpleItem Name="State" Value="false"/>`, EventMotion, false, false},
+		{"tns1:RuleEngine/TamperDetector/Tamper", "Changed", `<tt:SimpleItem Name="IsTamper" Value="true"/>`, EventTamper, true, true},
+		{"tns1:VideoSource/GlobalSceneChange/ImagingService", "Changed", `<tt:SimpleItem Name="State" Value="true"/>`, EventTamper, true, true},
+		{"tns1:RuleEngine/LineDetector/Crossed", "", `<tt:SimpleItem Name="ObjectId" Value="3"/>`, EventLineCrossing, true, true},
+		{"tns1:RuleEngine/FieldDetector/ObjectsInside", "Changed", `<tt:SimpleItem Name="IsInside" Value="false"/>`, EventIntrusion, false, false},
+		{"tns1:Device/Trigger/DigitalInput", "Changed", `<tt:SimpleItem Name="LogicalState" Value="true"/>`, EventOther, true, true},
+	}
+	for _, test := range tests {
+		var res struct {
+			Messages []NotificationMessage `xml:"NotificationMessage"`
+		}
+		content := `<tev:PullMessagesResponse>` + notificationMessage(test.topic, test.operation, test.data) + `</tev:PullMessagesResponse>`
+		if err := xml.Unmarshal([]byte(content), &res); err != nil || len(res.Messages) != 1 {
+			t.Fatalf("parse message error: %v", err)
+		}
+		e := NewEvent("cam1", &res.Messages[0])
+		if e.Type != test.typ || e.State != test.state || e.Rising() != test.rising {
+			t.Errorf("%s: unexpected event %s state %t rising %t", test.topic, e.Type, e.State, e.Rising())
+		}
+		if strings.Contains(e.Topic, "tns1:") || e.Source["VideoSourceConfigurationToken"] != "VideoSource_1" {
+			t.Errorf("%s: unexpected topic or source: %+v", test.topic, e)
+		}
+		if !e.Time.Equal(time.Date(2022, 3, 1, 8, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: unexpected time %v", test.topic, e.Time)
+		}
+	}
+}
+
+func TestSubscriber(t *testing.T) {
+	cfg := &config.OnvifConfig().Event
+	termination, retry := cfg.Termination, cfg.RetryInterval
+	cfg.Termination, cfg.RetryInterval = 200*time.Millisecond, 50*time.Millisecond
+	defer func() { cfg.Termination, cfg.RetryInterval = termination, retry }()
+
+	var lock sync.Mutex
+	var marks, triggers []map[string]any
+	msuServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		lock.Lock()
+		switch r.URL.Path {
+		case "/api/v1/channel/mark":
+			marks = append(marks, body)
+		case "/api/v1/channel/trigger":
+			triggers = append(triggers, body)
+		}
+		lock.Unlock()
+		w.Write([]byte(`{"code":200,"msg":"success"}`))
+	}))
+	defer msuServer.Close()
+
+	camera := newTestCamera(t)
+	camera.handle("CreatePullPointSubscriptionRequest", func(body string) string {
+		return `<tev:CreatePullPointSubscriptionResponse><tev:SubscriptionReference><wsa:Address>` + camera.URL +
+			`/onvif/subscription?id=1</wsa:Address></tev:SubscriptionReference>` +
+			`<wsnt:CurrentTime>2022-03-01T08:00:00Z</wsnt:CurrentTime><wsnt:TerminationTime>2022-03-01T08:01:00Z</wsnt:TerminationTime>` +
+			`</tev:CreatePullPointSubscriptionResponse>`
+	})
+	pulls := 0
+	camera.handle("PullMessagesRequest", func(body string) string {
+		lock.Lock()
+		pulls++
+		first := pulls == 1
+		lock.Unlock()
+		if !first {
+			time.Sleep(20 * time.Millisecond)
+			return `<tev:PullMessagesResponse><tev:CurrentTime>2022-03-01T08:00:01Z</tev:CurrentTime></tev:PullMessagesResponse>`
+		}
+		return `<tev:PullMessagesResponse><tev:CurrentTime>2022-03-01T08:00:00Z</tev:CurrentTime>` +
+			notificationMessage("tns1:RuleEngine/CellMotionDetector/Motion", "Initialized", `<tt:SimpleItem Name="IsMotion" Value="false"/>`) +
+			notificationMessage("tns1:RuleEngine/CellMotionDetector/Motion", "Changed", `<tt:SimpleItem Name="IsMotion" Value="true"/>`) +
+			notificationMessage("tns1:RuleEngine/LineDetector/Crossed", "", `<tt:SimpleItem Name="ObjectId" Value="3"/>`) +
+			`</tev:PullMessagesResponse>`
+	})
+	camera.handle("RenewRequest", func(body string) string {
+		return `<wsnt:RenewResponse><wsnt:TerminationTime>2022-03-01T08:02:00Z</wsnt:TerminationTime></wsnt:RenewResponse>`
+	})
+	camera.handle("UnsubscribeRequest", func(body string) string {
+		return `<wsnt:UnsubscribeResponse/>`
+	})
+
+	m := &Manager{
+		entries:     make(map[string]*Entry),
+		bindings:    make(map[string]*Binding),
+		subscribers: make(map[string]*Subscriber),
+		msu:         msu.NewClient(msuServer.URL),
+		logger:      assert.Must(config.LogConfig().Build("onvif.manager")),
+	}
+	xaddr := camera.URL + "/onvif/device_service"
+	m.Bind(&Binding{Path: "/onvif/cam1/Profile_1", DeviceID: xaddr, ProfileToken: "Profile_1", ChannelUUID: "c1"})
+	subscriber := newSubscriber(m, config.OnvifCamera{
+		XAddr:    xaddr,
+		Username: testUsername,
+		Password: testPassword,
+		Actions: []config.OnvifEventAction{
+			{Event: EventMotion, Action: "mark"},
+			{Event: "*", Action: "record", Duration: 45 * time.Second},
+		},
+	})
+	m.subscribers[xaddr] = subscriber
+	go subscriber.run()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		lock.Lock()
+		done := len(marks) == 1 && len(triggers) == 2
+		lock.Unlock()
+		renewed := false
+		for _, action := range camera.actions() {
+			renewed = renewed || action == "RenewRequest"
+		}
+		if done && renewed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("actions not triggered, marks %v triggers %v requests %v", marks, triggers, camera.actions())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	m.StopSubscriptions()
+
+	if marks[0]["uuid"] != "c1" || marks[0]["type"] != EventMotion || marks[0]["source"] != "onvif:"+xaddr {
+		t.Fatalf("unexpected mark: %v", marks[0])
+	}
+	if triggers[0]["uuid"] != "c1" || triggers[0]["duration"] != float64(45) {
+		t.Fatalf("unexpected trigger: %v", triggers[0])
+	}
+	actions := camera.actions()
+	if actions[len(actions)-1] != "UnsubscribeRequest" {
+		t.Fatalf("expect unsubscribed after stop, got %v", actions)
+	}
+	if m.GetDevice(xaddr) == nil {
+		t.Fatal("expect subscribed device known by manager")
+	}
+
+	events := m.GetEvents("", "")
+	if len(events) != 3 || events[0].Type != EventLineCrossing || events[0].ID != 3 {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	if events := m.GetEvents(xaddr, EventMotion); len(events) != 2 || events[0].State != true {
+		t.Fatalf("unexpected motion events: %+v", events)
+	}
+	if status := subscriber.Status(); status.Events != 3 || status.Subscribed || status.Address != camera.URL+"/onvif/subscription?id=1" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
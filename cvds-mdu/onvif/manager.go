@@ -0,0 +1,313 @@
+package onvif
+
+import (
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/msu"
+	"sort"
+	"sync"
+	"time"
+)
+
+var DeviceNotFoundError = errors.New("onvif device not found")
+
+// Binding associates a rtsp pusher path with the device and media profile it
+// is relayed from
+type Binding struct {
+	Path         string `json:"path"`
+	DeviceID     string `json:"deviceId"`
+	ProfileToken string `json:"profileToken"`
+	ChannelUUID  string `json:"channelUuid,omitempty"`
+}
+
+// Entry is a known device, discovered by probe or added manually
+type Entry struct {
+	*Device
+	Discovered *Discovered
+	UpdateAt   time.Time
+}
+
+type Manager struct {
+	entries     map[string]*Entry // ID <-> Entry
+	entriesLock sync.RWMutex
+
+	bindings     map[string]*Binding // Path <-> Binding
+	bindingsLock sync.RWMutex
+
+	subscribers     map[string]*Subscriber // XAddr <-> Subscriber
+	subscribersLock sync.Mutex
+
+	// recent events, the oldest is dropped when history limit reached
+	events     []*Event
+	eventSeq   int64
+	eventsLock sync.RWMutex
+
+	// client of MSU event actions call, nil means the configured MSU
+	msu    *msu.Client
+	logger *log.Logger
+}
+
+// Discover probes devices on the LAN and merges them into known devices. The
+// first XAddr answered is used as device service address, and default
+// credential from config is used for new devices
+func (m *Manager) Discover() ([]*Entry, error) {
+	cfg := config.OnvifConfig()
+	discovered, err := Discover(cfg.Discovery.Addr, cfg.Discovery.Timeout)
+	if err != nil {
+		return nil, m.logger.ErrorWith("onvif discover error", err)
+	}
+	entries := make([]*Entry, 0, len(discovered))
+	m.entriesLock.Lock()
+	for _, d := range discovered {
+		if len(d.XAddrs) == 0 {
+			continue
+		}
+		entry, ok := m.entries[d.Endpoint]
+		if !ok {
+			device := NewDevice(d.XAddrs[0], cfg.Username, cfg.Password, cfg.Timeout)
+			device.ID = d.Endpoint
+			entry = &Entry{Device: device}
+			m.entries[d.Endpoint] = entry
+			m.logger.Info("onvif device discovered", log.String("device", d.Endpoint), log.String("xaddr", device.XAddr))
+		}
+		entry.Discovered = d
+		entry.UpdateAt = time.Now()
+		entries = append(entries, entry)
+	}
+	m.entriesLock.Unlock()
+	return entries, nil
+}
+
+// AddDevice adds a device by its device service address, the device is
+// connected to verify address and credential
+func (m *Manager) AddDevice(xaddr string, username string, password string) (*Entry, error) {
+	cfg := config.OnvifConfig()
+	if username == "" {
+		username, password = cfg.Username, cfg.Password
+	}
+	device := NewDevice(xaddr, username, password, cfg.Timeout)
+	if err := device.Connect(); err != nil {
+		return nil, err
+	}
+	entry := &Entry{Device: device, UpdateAt: time.Now()}
+	m.entriesLock.Lock()
+	m.entries[device.ID] = entry
+	m.entriesLock.Unlock()
+	return entry, nil
+}
+
+// addDevice adds device connected by subscriber if it is not known yet
+func (m *Manager) addDevice(device *Device) {
+	m.entriesLock.Lock()
+	if _, ok := m.entries[device.ID]; !ok {
+		m.entries[device.ID] = &Entry{Device: device, UpdateAt: time.Now()}
+	}
+	m.entriesLock.Unlock()
+}
+
+func (m *Manager) RemoveDevice(id string) bool {
+	m.entriesLock.Lock()
+	_, ok := m.entries[id]
+	delete(m.entries, id)
+	m.entriesLock.Unlock()
+	return ok
+}
+
+func (m *Manager) GetDevice(id string) *Entry {
+	m.entriesLock.RLock()
+	defer m.entriesLock.RUnlock()
+	return m.entries[id]
+}
+
+// GetDevices returns known devices ordered by id
+func (m *Manager) GetDevices() []*Entry {
+	m.entriesLock.RLock()
+	entries := make([]*Entry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	m.entriesLock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+func (m *Manager) Bind(binding *Binding) {
+	m.bindingsLock.Lock()
+	m.bindings[binding.Path] = binding
+	m.bindingsLock.Unlock()
+}
+
+func (m *Manager) Unbind(path string) {
+	m.bindingsLock.Lock()
+	delete(m.bindings, path)
+	m.bindingsLock.Unlock()
+}
+
+func (m *Manager) GetBinding(path string) *Binding {
+	m.bindingsLock.RLock()
+	defer m.bindingsLock.RUnlock()
+	return m.bindings[path]
+}
+
+func (m *Manager) GetBindings() []*Binding {
+	m.bindingsLock.RLock()
+	bindings := make([]*Binding, 0, len(m.bindings))
+	for _, binding := range m.bindings {
+		bindings = append(bindings, binding)
+	}
+	m.bindingsLock.RUnlock()
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].Path < bindings[j].Path })
+	return bindings
+}
+
+// StartSubscriptions subscribes events of configured cameras, subscriptions
+// of cameras no longer configured are stopped
+func (m *Manager) StartSubscriptions() {
+	cameras := config.OnvifConfig().Cameras
+	configured := make(map[string]bool, len(cameras))
+	var stopped []*Subscriber
+	m.subscribersLock.Lock()
+	for _, camera := range cameras {
+		configured[camera.XAddr] = true
+		if _, ok := m.subscribers[camera.XAddr]; ok {
+			continue
+		}
+		subscriber := newSubscriber(m, camera)
+		m.subscribers[camera.XAddr] = subscriber
+		go subscriber.run()
+	}
+	for xaddr, subscriber := range m.subscribers {
+		if !configured[xaddr] {
+			delete(m.subscribers, xaddr)
+			stopped = append(stopped, subscriber)
+		}
+	}
+	m.subscribersLock.Unlock()
+	for _, subscriber := range stopped {
+		subscriber.stop()
+	}
+}
+
+// StopSubscriptions stops all subscriptions and waits for them unsubscribed
+func (m *Manager) StopSubscriptions() {
+	m.subscribersLock.Lock()
+	subscribers := m.subscribers
+	m.subscribers = make(map[string]*Subscriber)
+	m.subscribersLock.Unlock()
+	for _, subscriber := range subscribers {
+		subscriber.stop()
+	}
+}
+
+// GetSubscriptions returns status of subscriptions ordered by xaddr
+func (m *Manager) GetSubscriptions() []SubscriberStatus {
+	m.subscribersLock.Lock()
+	statuses := make([]SubscriberStatus, 0, len(m.subscribers))
+	for _, subscriber := range m.subscribers {
+		statuses = append(statuses, subscriber.Status())
+	}
+	m.subscribersLock.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].XAddr < statuses[j].XAddr })
+	return statuses
+}
+
+// GetEvents returns recent events newest first, filtered by device id and
+// event type if not empty
+func (m *Manager) GetEvents(deviceID string, typ string) []*Event {
+	m.eventsLock.RLock()
+	defer m.eventsLock.RUnlock()
+	events := make([]*Event, 0)
+	for i := len(m.events) - 1; i >= 0; i-- {
+		e := m.events[i]
+		if (deviceID != "" && e.DeviceID != deviceID) || (typ != "" && e.Type != typ) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func (m *Manager) handleEvent(camera config.OnvifCamera, e *Event) {
+	history := config.OnvifConfig().Event.History
+	m.eventsLock.Lock()
+	m.eventSeq++
+	e.ID = m.eventSeq
+	m.events = append(m.events, e)
+	if len(m.events) > history {
+		m.events = append(m.events[:0], m.events[len(m.events)-history:]...)
+	}
+	m.eventsLock.Unlock()
+	m.logger.Debug("onvif event", log.String("device", e.DeviceID), log.String("type", e.Type),
+		log.String("topic", e.Topic), log.Any("state", e.State))
+	if e.Rising() && len(camera.Actions) > 0 {
+		go m.runActions(camera, e)
+	}
+}
+
+// channelOf returns uuid of the MSU record channel of camera, the configured
+// one or the channel provisioned from the device
+func (m *Manager) channelOf(camera config.OnvifCamera, deviceID string) string {
+	if camera.Channel != "" {
+		return camera.Channel
+	}
+	for _, binding := range m.GetBindings() {
+		if binding.ChannelUUID == "" {
+			continue
+		}
+		if binding.DeviceID == deviceID {
+			return binding.ChannelUUID
+		}
+		if entry := m.GetDevice(binding.DeviceID); entry != nil && entry.XAddr == camera.XAddr {
+			return binding.ChannelUUID
+		}
+	}
+	return ""
+}
+
+func (m *Manager) runActions(camera config.OnvifCamera, e *Event) {
+	channel := m.channelOf(camera, e.DeviceID)
+	client := m.msu
+	if client == nil {
+		client = msu.GetClient()
+	}
+	for _, action := range camera.Actions {
+		if action.Event != "*" && action.Event != e.Type {
+			continue
+		}
+		if channel == "" {
+			m.logger.Warn("no record channel of onvif event action", log.String("device", e.DeviceID), log.String("action", action.Action))
+			return
+		}
+		var err error
+		switch action.Action {
+		case "mark":
+			err = client.Mark(channel, e.Time, e.Type, "onvif:"+e.DeviceID, e.Topic)
+		case "record":
+			err = client.Trigger(channel, action.Duration)
+		}
+		if err != nil {
+			m.logger.ErrorWith("onvif event action error", err, log.String("device", e.DeviceID),
+				log.String("action", action.Action), log.String("channel", channel))
+		}
+	}
+}
+
+var manager *Manager
+var managerInitializer sync.Once
+
+func GetManager() *Manager {
+	if manager != nil {
+		return manager
+	}
+	managerInitializer.Do(func() {
+		manager = &Manager{
+			entries:     make(map[string]*Entry),
+			bindings:    make(map[string]*Binding),
+			subscribers: make(map[string]*Subscriber),
+			logger:      assert.Must(config.LogConfig().Build("onvif.manager")),
+		}
+	})
+	return manager
+}
@@ -0,0 +1,139 @@
+package onvif
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PTZVector is a pan/tilt/zoom position or velocity in the generic spaces of
+// onvif, pan and tilt range in [-1, 1], zoom ranges in [0, 1] for position
+// and [-1, 1] for velocity. A nil field is omitted from the request
+type PTZVector struct {
+	Pan  *float64 `json:"pan,omitempty"`
+	Tilt *float64 `json:"tilt,omitempty"`
+	Zoom *float64 `json:"zoom,omitempty"`
+}
+
+type Preset struct {
+	Token string `xml:"token,attr" json:"token"`
+	Name  string `xml:"Name" json:"name"`
+}
+
+func (v PTZVector) xml(tag string) string {
+	sb := strings.Builder{}
+	sb.WriteString("<tptz:" + tag + ">")
+	if v.Pan != nil || v.Tilt != nil {
+		var pan, tilt float64
+		if v.Pan != nil {
+			pan = *v.Pan
+		}
+		if v.Tilt != nil {
+			tilt = *v.Tilt
+		}
+		sb.WriteString(fmt.Sprintf(`<tt:PanTilt x="%g" y="%g"/>`, pan, tilt))
+	}
+	if v.Zoom != nil {
+		sb.WriteString(fmt.Sprintf(`<tt:Zoom x="%g"/>`, *v.Zoom))
+	}
+	sb.WriteString("</tptz:" + tag + ">")
+	return sb.String()
+}
+
+func (d *Device) ptzXAddr() (string, error) {
+	if d.PTZXAddr == "" {
+		if err := d.Connect(); err != nil {
+			return "", err
+		}
+		if d.PTZXAddr == "" {
+			return "", ServiceNotFoundError
+		}
+	}
+	return d.PTZXAddr, nil
+}
+
+func (d *Device) ptzCall(action string, body string, response any) error {
+	xaddr, err := d.ptzXAddr()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := d.context()
+	defer cancel()
+	return d.call(ctx, xaddr, NamespacePTZ+"/"+action, body, response)
+}
+
+func profileTokenXML(profileToken string) string {
+	return "<tptz:ProfileToken>" + xmlEscape(profileToken) + "</tptz:ProfileToken>"
+}
+
+// ContinuousMove moves camera with velocity until Stop called or timeout
+// elapsed, zero timeout means the default timeout of device
+func (d *Device) ContinuousMove(profileToken string, velocity PTZVector, timeout time.Duration) error {
+	body := "<tptz:ContinuousMove>" + profileTokenXML(profileToken) + velocity.xml("Velocity")
+	if timeout > 0 {
+		body += fmt.Sprintf("<tptz:Timeout>PT%gS</tptz:Timeout>", timeout.Seconds())
+	}
+	body += "</tptz:ContinuousMove>"
+	return d.ptzCall("ContinuousMove", body, nil)
+}
+
+func (d *Device) Stop(profileToken string, panTilt bool, zoom bool) error {
+	return d.ptzCall("Stop", fmt.Sprintf("<tptz:Stop>%s<tptz:PanTilt>%t</tptz:PanTilt><tptz:Zoom>%t</tptz:Zoom></tptz:Stop>",
+		profileTokenXML(profileToken), panTilt, zoom), nil)
+}
+
+// AbsoluteMove moves camera to position, speed is optional
+func (d *Device) AbsoluteMove(profileToken string, position PTZVector, speed *PTZVector) error {
+	body := "<tptz:AbsoluteMove>" + profileTokenXML(profileToken) + position.xml("Position")
+	if speed != nil {
+		body += speed.xml("Speed")
+	}
+	body += "</tptz:AbsoluteMove>"
+	return d.ptzCall("AbsoluteMove", body, nil)
+}
+
+// RelativeMove moves camera by translation from current position, speed is
+// optional
+func (d *Device) RelativeMove(profileToken string, translation PTZVector, speed *PTZVector) error {
+	body := "<tptz:RelativeMove>" + profileTokenXML(profileToken) + translation.xml("Translation")
+	if speed != nil {
+		body += speed.xml("Speed")
+	}
+	body += "</tptz:RelativeMove>"
+	return d.ptzCall("RelativeMove", body, nil)
+}
+
+func (d *Device) GetPresets(profileToken string) ([]Preset, error) {
+	var res struct {
+		Presets []Preset `xml:"Preset"`
+	}
+	if err := d.ptzCall("GetPresets", "<tptz:GetPresets>"+profileTokenXML(profileToken)+"</tptz:GetPresets>", &res); err != nil {
+		return nil, err
+	}
+	return res.Presets, nil
+}
+
+func (d *Device) GotoPreset(profileToken string, presetToken string) error {
+	return d.ptzCall("GotoPreset", fmt.Sprintf("<tptz:GotoPreset>%s<tptz:PresetToken>%s</tptz:PresetToken></tptz:GotoPreset>",
+		profileTokenXML(profileToken), xmlEscape(presetToken)), nil)
+}
+
+// SetPreset saves current position as preset, a new preset is created if
+// presetToken is empty. Returns token of the preset
+func (d *Device) SetPreset(profileToken string, name string, presetToken string) (string, error) {
+	body := "<tptz:SetPreset>" + profileTokenXML(profileToken)
+	if name != "" {
+		body += "<tptz:PresetName>" + xmlEscape(name) + "</tptz:PresetName>"
+	}
+	if presetToken != "" {
+		body += "<tptz:PresetToken>" + xmlEscape(presetToken) + "</tptz:PresetToken>"
+	}
+	body += "</tptz:SetPreset>"
+	var res struct {
+		PresetToken string `xml:"PresetToken"`
+	}
+	if err := d.ptzCall("SetPreset", body, &res); err != nil {
+		return "", err
+	}
+	return res.PresetToken, nil
+}
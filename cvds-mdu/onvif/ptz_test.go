@@ -0,0 +1,88 @@
+package onvif
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPTZ(t *testing.T) {
+	camera := newTestCamera(t)
+	bodies := make(map[string]string)
+	for _, action := range []string{"ContinuousMove", "Stop", "AbsoluteMove", "RelativeMove", "GotoPreset"} {
+		action := action
+		camera.handle(action, func(body string) string {
+			bodies[action] = body
+			return "<tptz:" + action + "Response/>"
+		})
+	}
+	camera.handle("GetPresets", func(body string) string {
+		bodies["GetPresets"] = body
+		return `<tptz:GetPresetsResponse><tptz:Preset token="1"><tt:Name>Gate</tt:Name></tptz:Preset>` +
+			`<tptz:Preset token="2"><tt:Name>Lobby</tt:Name></tptz:Preset></tptz:GetPresetsResponse>`
+	})
+	camera.handle("SetPreset", func(body string) string {
+		bodies["SetPreset"] = body
+		return `<tptz:SetPresetResponse><tptz:PresetToken>3</tptz:PresetToken></tptz:SetPresetResponse>`
+	})
+	device := NewDevice(camera.URL+"/onvif/device_service", testUsername, testPassword, time.Second)
+
+	pan, tilt, zoom := 0.5, -0.25, 1.0
+	if err := device.ContinuousMove("Profile_1", PTZVector{Pan: &pan, Tilt: &tilt}, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	body := bodies["ContinuousMove"]
+	for _, s := range []string{"<tptz:ProfileToken>Profile_1</tptz:ProfileToken>", `<tt:PanTilt x="0.5" y="-0.25"/>`, "<tptz:Timeout>PT1.5S</tptz:Timeout>"} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("continuous move request missing %s: %s", s, body)
+		}
+	}
+	if strings.Contains(body, "Zoom") {
+		t.Fatalf("unexpected zoom in continuous move: %s", body)
+	}
+
+	if err := device.Stop("Profile_1", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bodies["Stop"], "<tptz:PanTilt>true</tptz:PanTilt><tptz:Zoom>false</tptz:Zoom>") {
+		t.Fatalf("unexpected stop request: %s", bodies["Stop"])
+	}
+
+	if err := device.AbsoluteMove("Profile_1", PTZVector{Pan: &pan, Tilt: &tilt, Zoom: &zoom}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bodies["AbsoluteMove"], `<tptz:Position><tt:PanTilt x="0.5" y="-0.25"/><tt:Zoom x="1"/></tptz:Position>`) {
+		t.Fatalf("unexpected absolute move request: %s", bodies["AbsoluteMove"])
+	}
+
+	if err := device.RelativeMove("Profile_1", PTZVector{Zoom: &zoom}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bodies["RelativeMove"], `<tptz:Translation><tt:Zoom x="1"/></tptz:Translation>`) {
+		t.Fatalf("unexpected relative move request: %s", bodies["RelativeMove"])
+	}
+
+	presets, err := device.GetPresets("Profile_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != 2 || presets[1].Token != "2" || presets[1].Name != "Lobby" {
+		t.Fatalf("unexpected presets: %+v", presets)
+	}
+
+	if err := device.GotoPreset("Profile_1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bodies["GotoPreset"], "<tptz:PresetToken>2</tptz:PresetToken>") {
+		t.Fatalf("unexpected goto preset request: %s", bodies["GotoPreset"])
+	}
+
+	token, err := device.SetPreset("Profile_1", "Door & Yard", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "3" || !strings.Contains(bodies["SetPreset"], "<tptz:PresetName>Door &amp; Yard</tptz:PresetName>") ||
+		strings.Contains(bodies["SetPreset"], "PresetToken") {
+		t.Fatalf("unexpected set preset: %s %s", token, bodies["SetPreset"])
+	}
+}
@@ -0,0 +1,153 @@
+package onvif
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// xml namespaces of onvif services
+const (
+	NamespaceSOAP   = "http://www.w3.org/2003/05/soap-envelope"
+	NamespaceDevice = "http://www.onvif.org/ver10/device/wsdl"
+	NamespaceMedia  = "http://www.onvif.org/ver10/media/wsdl"
+	NamespaceSchema = "http://www.onvif.org/ver10/schema"
+	NamespacePTZ    = "http://www.onvif.org/ver20/ptz/wsdl"
+	NamespaceEvents = "http://www.onvif.org/ver10/events/wsdl"
+	NamespaceWSNT   = "http://docs.oasis-open.org/wsn/b-2"
+	NamespaceWSA    = "http://www.w3.org/2005/08/addressing"
+	NamespaceWSSE   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"
+	NamespaceWSU    = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+)
+
+const (
+	passwordDigestType = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest"
+	base64BinaryType   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
+)
+
+var (
+	EmptySOAPBodyError   = errors.New("empty soap body")
+	NotAuthorizedError   = errors.New("onvif not authorized")
+	ServiceNotFoundError = errors.New("onvif service not supported by device")
+)
+
+// Fault is a SOAP 1.2 fault returned by device
+type Fault struct {
+	Code    string `xml:"Code>Value"`
+	Subcode string `xml:"Code>Subcode>Value"`
+	Reason  string `xml:"Reason>Text"`
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("soap fault %s %s: %s", f.Code, f.Subcode, f.Reason)
+}
+
+type envelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Fault   *Fault `xml:"Fault"`
+		Content []byte `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// usernameToken builds WS-Security header with UsernameToken of password
+// digest profile: Base64(SHA1(nonce + created + password))
+func usernameToken(username string, password string, now time.Time) string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	created := now.UTC().Format("2006-01-02T15:04:05.000Z")
+	return fmt.Sprintf(`<wsse:Security s:mustUnderstand="1" xmlns:wsse="%s" xmlns:wsu="%s">`+
+		`<wsse:UsernameToken><wsse:Username>%s</wsse:Username>`+
+		`<wsse:Password Type="%s">%s</wsse:Password>`+
+		`<wsse:Nonce EncodingType="%s">%s</wsse:Nonce>`+
+		`<wsu:Created>%s</wsu:Created></wsse:UsernameToken></wsse:Security>`,
+		NamespaceWSSE, NamespaceWSU, xmlEscape(username), passwordDigestType, passwordDigest(nonce, created, password),
+		base64BinaryType, base64.StdEncoding.EncodeToString(nonce), created)
+}
+
+func passwordDigest(nonce []byte, created string, password string) string {
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(created))
+	h.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func xmlEscape(s string) string {
+	buf := strings.Builder{}
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func buildEnvelope(header string, body string) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>`+
+		`<s:Envelope xmlns:s="%s" xmlns:tds="%s" xmlns:trt="%s" xmlns:tt="%s" xmlns:tptz="%s" xmlns:tev="%s" xmlns:wsnt="%s" xmlns:wsa="%s">`+
+		`<s:Header>%s</s:Header><s:Body>%s</s:Body></s:Envelope>`,
+		NamespaceSOAP, NamespaceDevice, NamespaceMedia, NamespaceSchema, NamespacePTZ, NamespaceEvents, NamespaceWSNT, NamespaceWSA, header, body))
+}
+
+// call posts a SOAP request with WS-Security header to the service address
+// and decodes the content of response body into response
+func (d *Device) call(ctx context.Context, xaddr string, action string, body string, response any) error {
+	var header string
+	if d.Username != "" {
+		header = usernameToken(d.Username, d.Password, time.Now().Add(d.timeOffset))
+	}
+	return d.post(ctx, xaddr, action, header, body, response)
+}
+
+// callTo is call with WS-Addressing headers, subscription managers need them
+// to route request to the subscription
+func (d *Device) callTo(ctx context.Context, address string, action string, body string, response any) error {
+	header := fmt.Sprintf("<wsa:Action>%s</wsa:Action><wsa:To>%s</wsa:To>", xmlEscape(action), xmlEscape(address))
+	if d.Username != "" {
+		header = usernameToken(d.Username, d.Password, time.Now().Add(d.timeOffset)) + header
+	}
+	return d.post(ctx, address, action, header, body, response)
+}
+
+func (d *Device) post(ctx context.Context, xaddr string, action string, header string, body string, response any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, xaddr, bytes.NewReader(buildEnvelope(header, body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf(`application/soap+xml; charset=utf-8; action="%s"`, action))
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var env envelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		if res.StatusCode == http.StatusUnauthorized {
+			return NotAuthorizedError
+		}
+		return fmt.Errorf("invalid soap response, status %d: %w", res.StatusCode, err)
+	}
+	if env.Body.Fault != nil {
+		if strings.Contains(env.Body.Fault.Subcode, "NotAuthorized") || res.StatusCode == http.StatusUnauthorized {
+			return NotAuthorizedError
+		}
+		return env.Body.Fault
+	}
+	if response == nil {
+		return nil
+	}
+	if len(bytes.TrimSpace(env.Body.Content)) == 0 {
+		return EmptySOAPBodyError
+	}
+	return xml.Unmarshal(env.Body.Content, response)
+}
@@ -0,0 +1,133 @@
+package onvif
+
+import (
+	"context"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sync"
+	"time"
+)
+
+// SubscriberStatus is the state of event subscription of a camera
+type SubscriberStatus struct {
+	XAddr      string    `json:"xaddr"`
+	DeviceID   string    `json:"deviceId"`
+	Subscribed bool      `json:"subscribed"`
+	Address    string    `json:"address,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Events     int64     `json:"events"`
+	UpdateAt   time.Time `json:"updateAt"`
+}
+
+// Subscriber keeps a PullPoint subscription of configured camera alive, the
+// subscription is renewed before terminated and recreated after failure
+type Subscriber struct {
+	camera  config.OnvifCamera
+	device  *Device
+	manager *Manager
+
+	status     SubscriberStatus
+	statusLock sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	logger *log.Logger
+}
+
+func newSubscriber(manager *Manager, camera config.OnvifCamera) *Subscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Subscriber{
+		camera:  camera,
+		device:  NewDevice(camera.XAddr, camera.Username, camera.Password, config.OnvifConfig().Timeout),
+		manager: manager,
+		status:  SubscriberStatus{XAddr: camera.XAddr, DeviceID: camera.XAddr},
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		logger:  manager.logger.With(log.String("xaddr", camera.XAddr)),
+	}
+}
+
+func (s *Subscriber) Status() SubscriberStatus {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	return s.status
+}
+
+func (s *Subscriber) updateStatus(fn func(status *SubscriberStatus)) {
+	s.statusLock.Lock()
+	fn(&s.status)
+	s.status.UpdateAt = time.Now()
+	s.statusLock.Unlock()
+}
+
+func (s *Subscriber) run() {
+	defer close(s.done)
+	for {
+		if err := s.subscribe(); err != nil && s.ctx.Err() == nil {
+			s.logger.ErrorWith("onvif event subscription error", err)
+			s.updateStatus(func(status *SubscriberStatus) {
+				status.Subscribed, status.Address, status.Error = false, "", err.Error()
+			})
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(config.OnvifConfig().Event.RetryInterval):
+		}
+	}
+}
+
+func (s *Subscriber) subscribe() error {
+	cfg := config.OnvifConfig().Event
+	if s.device.EventXAddr == "" {
+		if err := s.device.Connect(); err != nil {
+			return err
+		}
+		s.manager.addDevice(s.device)
+		s.updateStatus(func(status *SubscriberStatus) { status.DeviceID = s.device.ID })
+	}
+	sub, err := s.device.CreatePullPointSubscription(cfg.Termination)
+	if err != nil {
+		// the event service address may be changed, query it again next time
+		s.device.EventXAddr = ""
+		return err
+	}
+	defer func() {
+		s.updateStatus(func(status *SubscriberStatus) { status.Subscribed = false })
+		if err := s.device.Unsubscribe(sub); err != nil {
+			s.logger.Debug("onvif unsubscribe error", log.Error(err))
+		}
+	}()
+	s.logger.Info("onvif event subscribed", log.String("address", sub.Address))
+	s.updateStatus(func(status *SubscriberStatus) {
+		status.Subscribed, status.Address, status.Error = true, sub.Address, ""
+	})
+
+	renewAt := time.Now().Add(cfg.Termination / 2)
+	for s.ctx.Err() == nil {
+		messages, err := s.device.pullMessages(s.ctx, sub, cfg.PullTimeout, cfg.MessageLimit)
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			s.manager.handleEvent(s.camera, NewEvent(s.device.ID, &messages[i]))
+		}
+		if len(messages) > 0 {
+			s.updateStatus(func(status *SubscriberStatus) { status.Events += int64(len(messages)) })
+		}
+		if time.Now().After(renewAt) {
+			if err := s.device.Renew(sub, cfg.Termination); err != nil {
+				return err
+			}
+			renewAt = time.Now().Add(cfg.Termination / 2)
+		}
+	}
+	return nil
+}
+
+func (s *Subscriber) stop() {
+	s.cancel()
+	<-s.done
+}
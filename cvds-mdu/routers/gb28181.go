@@ -0,0 +1,218 @@
+package routers
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/gb28181"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/rtsp"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/utils"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * @apiDefine gb28181 GB28181设备管理
+ */
+
+// GBDevices
+/* @api {get} /api/v1/gb28181/devices 获取GB28181设备列表
+ * @apiGroup gb28181
+ * @apiName GBDevices
+ * @apiUse pageParam
+ * @apiUse pageSuccess
+ * @apiSuccess (200) {String} rows.id 设备国标编码
+ * @apiSuccess (200) {String} rows.name 设备名称
+ * @apiSuccess (200) {String} rows.manufacturer 设备厂商
+ * @apiSuccess (200) {String} rows.model 设备型号
+ * @apiSuccess (200) {String} rows.addr 设备信令地址
+ * @apiSuccess (200) {Boolean} rows.online 是否在线
+ * @apiSuccess (200) {Number} rows.channels 通道数
+ * @apiSuccess (200) {String} rows.registerAt 注册时间
+ * @apiSuccess (200) {String} rows.keepaliveAt 最后心跳时间
+ */
+func (h *APIHandler) GBDevices(c *gin.Context) {
+	form := utils.NewPageForm()
+	if err := c.Bind(form); err != nil {
+		return
+	}
+	devices := make([]interface{}, 0)
+	for _, device := range gb28181.GetServer().GetDevices() {
+		if form.Q != "" && !strings.Contains(device.ID, form.Q) && !strings.Contains(strings.ToLower(device.Name), strings.ToLower(form.Q)) {
+			continue
+		}
+		var addr string
+		if device.Addr() != nil {
+			addr = device.Addr().String()
+		}
+		devices = append(devices, map[string]interface{}{
+			"id":           device.ID,
+			"name":         device.Name,
+			"manufacturer": device.Manufacturer,
+			"model":        device.Model,
+			"addr":         addr,
+			"online":       device.Online,
+			"channels":     device.ChannelSize(),
+			"registerAt":   utils.DateTime(device.RegisterAt),
+			"keepaliveAt":  utils.DateTime(device.KeepaliveAt),
+		})
+	}
+	pr := utils.NewPageResult(devices)
+	if form.Sort != "" {
+		pr.Sort(form.Sort, form.Order)
+	}
+	pr.Slice(form.Start, form.Limit)
+	c.IndentedJSON(200, pr)
+}
+
+// GBChannels
+/* @api {get} /api/v1/gb28181/channels 获取GB28181设备通道列表
+ * @apiGroup gb28181
+ * @apiName GBChannels
+ * @apiParam {String} deviceId 设备国标编码
+ * @apiUse pageParam
+ * @apiUse pageSuccess
+ * @apiSuccess (200) {String} rows.id 通道国标编码
+ * @apiSuccess (200) {String} rows.name 通道名称
+ * @apiSuccess (200) {String} rows.status 通道状态
+ * @apiSuccess (200) {String} rows.path 通道转发的RTSP路径
+ * @apiSuccess (200) {Boolean} rows.playing 是否正在拉流
+ */
+func (h *APIHandler) GBChannels(c *gin.Context) {
+	type Form struct {
+		utils.PageForm
+		DeviceID string `form:"deviceId" binding:"required"`
+	}
+	form := Form{PageForm: *utils.NewPageForm()}
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	server := gb28181.GetServer()
+	device := server.GetDevice(form.DeviceID)
+	if device == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Device[%s] not found", form.DeviceID))
+		return
+	}
+	channels := make([]interface{}, 0)
+	for _, channel := range device.GetChannels() {
+		if form.Q != "" && !strings.Contains(channel.DeviceID, form.Q) && !strings.Contains(strings.ToLower(channel.Name), strings.ToLower(form.Q)) {
+			continue
+		}
+		channels = append(channels, map[string]interface{}{
+			"id":           channel.DeviceID,
+			"name":         channel.Name,
+			"manufacturer": channel.Manufacturer,
+			"model":        channel.Model,
+			"status":       channel.Status,
+			"path":         server.StreamPath(device.ID, channel.DeviceID),
+			"playing":      server.GetStream(device.ID, channel.DeviceID) != nil,
+			"updateAt":     utils.DateTime(channel.UpdateAt),
+		})
+	}
+	pr := utils.NewPageResult(channels)
+	if form.Sort != "" {
+		pr.Sort(form.Sort, form.Order)
+	}
+	pr.Slice(form.Start, form.Limit)
+	c.IndentedJSON(200, pr)
+}
+
+// GBCatalog
+/* @api {get} /api/v1/gb28181/catalog 查询GB28181设备目录
+ * @apiGroup gb28181
+ * @apiName GBCatalog
+ * @apiParam {String} deviceId 设备国标编码
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) GBCatalog(c *gin.Context) {
+	type Form struct {
+		DeviceID string `form:"deviceId" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if err := gb28181.GetServer().QueryCatalog(form.DeviceID); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Query catalog err: %v", err))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+// GBPlay
+/* @api {get} /api/v1/gb28181/play 开始GB28181通道实时流转发
+ * @apiGroup gb28181
+ * @apiName GBPlay
+ * @apiParam {String} deviceId 设备国标编码
+ * @apiParam {String} channelId 通道国标编码
+ * @apiParam {Number} [timeout=5] 等待首帧的超时时间，秒为单位
+ * @apiSuccess (200) {String} path 转发的RTSP路径
+ * @apiSuccess (200) {String} url 转发的RTSP地址
+ * @apiSuccess (200) {String} ssrc 媒体流SSRC
+ */
+func (h *APIHandler) GBPlay(c *gin.Context) {
+	type Form struct {
+		DeviceID  string `form:"deviceId" binding:"required"`
+		ChannelID string `form:"channelId" binding:"required"`
+		Timeout   int    `form:"timeout"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if form.Timeout <= 0 {
+		form.Timeout = 5
+	}
+	stream, err := gb28181.GetServer().Play(form.DeviceID, form.ChannelID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Play err: %v", err))
+		return
+	}
+	select {
+	case <-stream.Ready():
+	case <-time.After(time.Duration(form.Timeout) * time.Second):
+		stream.Stop()
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Play err: wait stream timeout")
+		return
+	}
+	Logger.Info("GB28181 play success", log.String("stream", stream.String()))
+	hostname := utils.GetRequestHostname(c.Request)
+	addr := rtsp.GetServer().Addr()
+	var url string
+	if addr.Port == 554 {
+		url = fmt.Sprintf("rtsp://%s%s", hostname, stream.Path)
+	} else {
+		url = fmt.Sprintf("rtsp://%s:%d%s", hostname, addr.Port, stream.Path)
+	}
+	c.IndentedJSON(200, map[string]interface{}{
+		"path": stream.Path,
+		"url":  url,
+		"ssrc": stream.SSRC,
+	})
+}
+
+// GBStop
+/* @api {get} /api/v1/gb28181/stop 停止GB28181通道实时流转发
+ * @apiGroup gb28181
+ * @apiName GBStop
+ * @apiParam {String} deviceId 设备国标编码
+ * @apiParam {String} channelId 通道国标编码
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) GBStop(c *gin.Context) {
+	type Form struct {
+		DeviceID  string `form:"deviceId" binding:"required"`
+		ChannelID string `form:"channelId" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if err := gb28181.GetServer().StopPlay(form.DeviceID, form.ChannelID); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Stop err: %v", err))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
@@ -0,0 +1,377 @@
+package routers
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/msu"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/onvif"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/utils"
+	"net"
+	"net/http"
+	urlpkg "net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * @apiDefine onvif ONVIF设备管理
+ */
+
+/**
+ * @apiDefine onvifDeviceInfo
+ * @apiSuccess (200) {String} rows.id 设备ID
+ * @apiSuccess (200) {String} rows.xaddr 设备服务地址
+ * @apiSuccess (200) {String} rows.name 设备名称
+ * @apiSuccess (200) {String} rows.hardware 设备硬件型号
+ * @apiSuccess (200) {String} rows.manufacturer 设备厂商
+ * @apiSuccess (200) {String} rows.model 设备型号
+ * @apiSuccess (200) {String} rows.updateAt 更新时间
+ */
+
+func onvifDeviceInfo(entry *onvif.Entry) map[string]interface{} {
+	info := map[string]interface{}{
+		"id":           entry.ID,
+		"xaddr":        entry.XAddr,
+		"manufacturer": entry.Info.Manufacturer,
+		"model":        entry.Info.Model,
+		"firmware":     entry.Info.FirmwareVersion,
+		"updateAt":     utils.DateTime(entry.UpdateAt),
+	}
+	if entry.Discovered != nil {
+		info["name"] = entry.Discovered.Name
+		info["hardware"] = entry.Discovered.Hardware
+		info["location"] = entry.Discovered.Location
+	}
+	return info
+}
+
+func onvifDevicesResult(c *gin.Context, entries []*onvif.Entry) {
+	form := utils.NewPageForm()
+	if err := c.Bind(form); err != nil {
+		return
+	}
+	devices := make([]interface{}, 0)
+	for _, entry := range entries {
+		if form.Q != "" && !strings.Contains(strings.ToLower(entry.XAddr), strings.ToLower(form.Q)) {
+			continue
+		}
+		devices = append(devices, onvifDeviceInfo(entry))
+	}
+	pr := utils.NewPageResult(devices)
+	if form.Sort != "" {
+		pr.Sort(form.Sort, form.Order)
+	}
+	pr.Slice(form.Start, form.Limit)
+	c.IndentedJSON(200, pr)
+}
+
+// OnvifDiscover
+/* @api {get} /api/v1/onvif/discover 搜索局域网ONVIF设备
+ * @apiGroup onvif
+ * @apiName OnvifDiscover
+ * @apiUse pageParam
+ * @apiUse pageSuccess
+ * @apiUse onvifDeviceInfo
+ */
+func (h *APIHandler) OnvifDiscover(c *gin.Context) {
+	entries, err := onvif.GetManager().Discover()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Discover err: %v", err))
+		return
+	}
+	onvifDevicesResult(c, entries)
+}
+
+// OnvifDevices
+/* @api {get} /api/v1/onvif/devices 获取ONVIF设备列表
+ * @apiGroup onvif
+ * @apiName OnvifDevices
+ * @apiUse pageParam
+ * @apiUse pageSuccess
+ * @apiUse onvifDeviceInfo
+ */
+func (h *APIHandler) OnvifDevices(c *gin.Context) {
+	onvifDevicesResult(c, onvif.GetManager().GetDevices())
+}
+
+// OnvifDeviceAdd
+/* @api {get} /api/v1/onvif/device/add 添加ONVIF设备
+ * @apiGroup onvif
+ * @apiName OnvifDeviceAdd
+ * @apiParam {String} xaddr 设备服务地址，如 http://192.168.1.64/onvif/device_service
+ * @apiParam {String} [username] 用户名，为空时使用配置的默认用户名
+ * @apiParam {String} [password] 密码
+ * @apiSuccess (200) {String} id 设备ID
+ */
+func (h *APIHandler) OnvifDeviceAdd(c *gin.Context) {
+	type Form struct {
+		XAddr    string `form:"xaddr" binding:"required"`
+		Username string `form:"username"`
+		Password string `form:"password"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, err := onvif.GetManager().AddDevice(form.XAddr, form.Username, form.Password)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Add device err: %v", err))
+		return
+	}
+	c.IndentedJSON(200, entry.ID)
+}
+
+// OnvifDeviceRemove
+/* @api {get} /api/v1/onvif/device/remove 移除ONVIF设备
+ * @apiGroup onvif
+ * @apiName OnvifDeviceRemove
+ * @apiParam {String} id 设备ID
+ * @apiUse simpleSuccess
+ */
+func (h *APIHandler) OnvifDeviceRemove(c *gin.Context) {
+	type Form struct {
+		ID string `form:"id" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if !onvif.GetManager().RemoveDevice(form.ID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Device[%s] not found", form.ID))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+// onvifDevice finds the device by id and updates its credential if given
+func onvifDevice(c *gin.Context, id string, username string, password string) *onvif.Entry {
+	entry := onvif.GetManager().GetDevice(id)
+	if entry == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Device[%s] not found", id))
+		return nil
+	}
+	if username != "" {
+		entry.SetCredential(username, password)
+	}
+	return entry
+}
+
+// OnvifProfiles
+/* @api {get} /api/v1/onvif/profiles 获取ONVIF设备媒体配置
+ * @apiGroup onvif
+ * @apiName OnvifProfiles
+ * @apiParam {String} id 设备ID
+ * @apiParam {String} [username] 用户名，不为空时更新设备的认证信息
+ * @apiParam {String} [password] 密码
+ * @apiSuccess (200) {Array} profiles 媒体配置列表
+ * @apiSuccess (200) {String} profiles.token 媒体配置标识
+ * @apiSuccess (200) {String} profiles.name 媒体配置名称
+ * @apiSuccess (200) {Object} profiles.video 视频编码配置
+ * @apiSuccess (200) {Object} profiles.audio 音频编码配置
+ */
+func (h *APIHandler) OnvifProfiles(c *gin.Context) {
+	type Form struct {
+		ID       string `form:"id" binding:"required"`
+		Username string `form:"username"`
+		Password string `form:"password"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry := onvifDevice(c, form.ID, form.Username, form.Password)
+	if entry == nil {
+		return
+	}
+	profiles, err := entry.GetProfiles()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Get profiles err: %v", err))
+		return
+	}
+	c.IndentedJSON(200, profiles)
+}
+
+// rtspURL returns url of the path on local rtsp server, which is reachable
+// from MSU deployed on the same host
+func rtspURL(path string) string {
+	addr := config.RtspConfig().GetAddr()
+	host := "127.0.0.1"
+	if addr.IP != nil && !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	return fmt.Sprintf("rtsp://%s%s", net.JoinHostPort(host, strconv.Itoa(addr.Port)), path)
+}
+
+// OnvifProvision
+/* @api {get} /api/v1/onvif/provision 一键创建ONVIF设备转发及录像通道
+ * @apiGroup onvif
+ * @apiName OnvifProvision
+ * @apiParam {String} id 设备ID
+ * @apiParam {String} profile 媒体配置标识
+ * @apiParam {String} [username] 用户名，不为空时更新设备的认证信息
+ * @apiParam {String} [password] 密码
+ * @apiParam {Boolean} [relay=true] 是否创建MDU拉转推
+ * @apiParam {Boolean} [record=false] 是否创建MSU录像通道，开启转发时MSU从MDU拉流
+ * @apiParam {String} [name] MSU录像通道名称，默认为转发PATH
+ * @apiParam {String=continuous,event} [mode=continuous] MSU录像模式，event模式仅在事件触发时录像
+ * @apiParam {String} [customPath] 转推时的推送PATH，默认为 /onvif/{设备}/{媒体配置}
+ * @apiParam {String=TCP,UDP} [transType=TCP] 拉流传输模式
+ * @apiSuccess (200) {String} url 设备RTSP地址
+ * @apiSuccess (200) {String} pusherId 拉流的ID
+ * @apiSuccess (200) {String} path 转发的PATH
+ * @apiSuccess (200) {String} channel MSU录像通道UUID
+ */
+func (h *APIHandler) OnvifProvision(c *gin.Context) {
+	type Form struct {
+		ID         string `form:"id" binding:"required"`
+		Profile    string `form:"profile" binding:"required"`
+		Username   string `form:"username"`
+		Password   string `form:"password"`
+		Relay      *bool  `form:"relay"`
+		Record     bool   `form:"record"`
+		Name       string `form:"name"`
+		Mode       string `form:"mode"`
+		CustomPath string `form:"customPath"`
+		TransType  string `form:"transType"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry := onvifDevice(c, form.ID, form.Username, form.Password)
+	if entry == nil {
+		return
+	}
+	uri, err := entry.GetStreamUri(form.Profile)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Get stream uri err: %v", err))
+		return
+	}
+	sourceURL := uri
+	if u, err := urlpkg.Parse(uri); err == nil && u.User == nil && entry.Username != "" {
+		u.User = urlpkg.UserPassword(entry.Username, entry.Password)
+		sourceURL = u.String()
+	}
+	binding := &onvif.Binding{DeviceID: entry.ID, ProfileToken: form.Profile}
+	result := map[string]interface{}{"url": uri}
+
+	recordURL := sourceURL
+	if form.Relay == nil || *form.Relay {
+		path := form.CustomPath
+		if path == "" {
+			host := entry.XAddr
+			if u, err := urlpkg.Parse(entry.XAddr); err == nil {
+				host = u.Hostname()
+			}
+			path = fmt.Sprintf("%s/%s/%s", strings.TrimRight(config.OnvifConfig().PathPrefix, "/"), host, form.Profile)
+		}
+		pusher, err := startRelay(sourceURL, path, form.TransType, 0, 0, "")
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		binding.Path = pusher.Path()
+		if pusher.Client != nil {
+			pusher.Client.StopHandles = append(pusher.Client.StopHandles, func() {
+				onvif.GetManager().Unbind(binding.Path)
+			})
+		}
+		recordURL = rtspURL(pusher.Path())
+		result["pusherId"] = pusher.ID()
+		result["path"] = pusher.Path()
+	}
+
+	if form.Record {
+		name := form.Name
+		if name == "" {
+			name = strings.TrimPrefix(binding.Path, "/")
+			if name == "" {
+				name = entry.ID + "/" + form.Profile
+			}
+		}
+		uuid, err := msu.GetClient().StartChannel(name, recordURL, form.TransType, form.Mode, map[string]any{
+			"onvif-device":  entry.ID,
+			"onvif-profile": form.Profile,
+		})
+		if err != nil {
+			Logger.ErrorWith("create msu channel error", err, log.String("device", entry.ID))
+			c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Create record channel err: %v", err))
+			return
+		}
+		binding.ChannelUUID = uuid
+		result["channel"] = uuid
+	}
+	if binding.Path != "" {
+		onvif.GetManager().Bind(binding)
+	}
+	Logger.Info("onvif provision success", log.String("device", entry.ID), log.String("profile", form.Profile))
+	c.IndentedJSON(200, result)
+}
+
+// OnvifEvents
+/* @api {get} /api/v1/onvif/events 获取ONVIF设备事件
+ * @apiGroup onvif
+ * @apiName OnvifEvents
+ * @apiParam {String} [id] 设备ID
+ * @apiParam {String=motion,tamper,line-crossing,intrusion,other} [type] 事件类型
+ * @apiUse pageParam
+ * @apiUse pageSuccess
+ * @apiSuccess (200) {Number} rows.id 事件序号
+ * @apiSuccess (200) {String} rows.deviceId 设备ID
+ * @apiSuccess (200) {String} rows.type 事件类型
+ * @apiSuccess (200) {Boolean} rows.state 事件状态，true为触发，false为消除
+ * @apiSuccess (200) {String} rows.topic 设备上报的事件主题
+ * @apiSuccess (200) {String} rows.time 事件时间
+ */
+func (h *APIHandler) OnvifEvents(c *gin.Context) {
+	type Form struct {
+		utils.PageForm
+		ID   string `form:"id"`
+		Type string `form:"type"`
+	}
+	form := Form{PageForm: *utils.NewPageForm()}
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	events := make([]interface{}, 0)
+	for _, e := range onvif.GetManager().GetEvents(form.ID, form.Type) {
+		if form.Q != "" && !strings.Contains(strings.ToLower(e.Topic), strings.ToLower(form.Q)) {
+			continue
+		}
+		events = append(events, map[string]interface{}{
+			"id":        e.ID,
+			"deviceId":  e.DeviceID,
+			"type":      e.Type,
+			"state":     e.State,
+			"topic":     e.Topic,
+			"operation": e.Operation,
+			"source":    e.Source,
+			"data":      e.Data,
+			"time":      utils.DateTime(e.Time),
+		})
+	}
+	pr := utils.NewPageResult(events)
+	if form.Sort != "" {
+		pr.Sort(form.Sort, form.Order)
+	}
+	pr.Slice(form.Start, form.Limit)
+	c.IndentedJSON(200, pr)
+}
+
+// OnvifSubscriptions
+/* @api {get} /api/v1/onvif/subscriptions 获取ONVIF事件订阅状态
+ * @apiGroup onvif
+ * @apiName OnvifSubscriptions
+ * @apiSuccess (200) {String} xaddr 设备服务地址
+ * @apiSuccess (200) {String} deviceId 设备ID
+ * @apiSuccess (200) {Boolean} subscribed 是否已订阅
+ * @apiSuccess (200) {String} address 订阅地址
+ * @apiSuccess (200) {String} error 订阅失败原因
+ * @apiSuccess (200) {Number} events 收到的事件数
+ */
+func (h *APIHandler) OnvifSubscriptions(c *gin.Context) {
+	c.IndentedJSON(200, onvif.GetManager().GetSubscriptions())
+}
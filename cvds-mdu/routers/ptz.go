@@ -0,0 +1,284 @@
+package routers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/onvif"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * @apiDefine ptz 云台控制
+ */
+
+/**
+ * @apiDefine ptzParam
+ * @apiParam {String} path 转发的PATH，该PATH需由ONVIF一键创建转发生成
+ * @apiHeader {String} [Authorization] 配置了用户时需要Basic认证，且用户需要拥有该PATH的云台控制权限
+ */
+
+/**
+ * @apiDefine ptzVector
+ * @apiParam {Number} [pan] 水平方向，范围[-1, 1]
+ * @apiParam {Number} [tilt] 垂直方向，范围[-1, 1]
+ * @apiParam {Number} [zoom] 变倍
+ */
+
+// authorizeUser checks permission of request user of op on the path by
+// allow, and aborts request if denied. If no user configured, permission
+// check is disabled
+func authorizeUser(c *gin.Context, op string, path string, allow func(user *config.User) bool) bool {
+	if len(config.UsersConfig()) == 0 {
+		return true
+	}
+	username, password, ok := c.Request.BasicAuth()
+	user := config.FindUser(username)
+	if !ok || user == nil || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		c.Header("WWW-Authenticate", `Basic realm="MDU"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, "access denied")
+		return false
+	}
+	if !allow(user) {
+		Logger.Warn(op+" permission denied", log.String("user", username), log.String("path", path))
+		c.AbortWithStatusJSON(http.StatusForbidden, fmt.Sprintf("User %s is not allowed to %s %s", username, op, path))
+		return false
+	}
+	return true
+}
+
+// ptzDevice checks PTZ permission of request user on the path, and returns
+// the onvif device and media profile the path is relayed from. If no user
+// configured, permission check is disabled
+func ptzDevice(c *gin.Context, path string) (*onvif.Entry, string) {
+	if !authorizeUser(c, "control", path, func(user *config.User) bool { return user.AllowPTZ(path) }) {
+		return nil, ""
+	}
+	binding := onvif.GetManager().GetBinding(path)
+	if binding == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Path %s is not associated with onvif device", path))
+		return nil, ""
+	}
+	entry := onvif.GetManager().GetDevice(binding.DeviceID)
+	if entry == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Device[%s] not found", binding.DeviceID))
+		return nil, ""
+	}
+	return entry, binding.ProfileToken
+}
+
+func ptzResult(c *gin.Context, op string, path string, err error) {
+	if err != nil {
+		Logger.ErrorWith("ptz error", err, log.String("op", op), log.String("path", path))
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("PTZ %s err: %v", op, err))
+		return
+	}
+	c.IndentedJSON(200, "OK")
+}
+
+type ptzVectorForm struct {
+	Pan  *float64 `form:"pan"`
+	Tilt *float64 `form:"tilt"`
+	Zoom *float64 `form:"zoom"`
+}
+
+func (f ptzVectorForm) vector() onvif.PTZVector {
+	return onvif.PTZVector{Pan: f.Pan, Tilt: f.Tilt, Zoom: f.Zoom}
+}
+
+// PTZContinuousMove
+/* @api {get} /api/v1/ptz/continuous-move 云台持续转动
+ * @apiGroup ptz
+ * @apiName PTZContinuousMove
+ * @apiUse ptzParam
+ * @apiUse ptzVector
+ * @apiParam {Number} [timeout] 转动超时时间，毫秒为单位，超时后自动停止
+ * @apiUse simpleSuccess
+ * @apiUse authError
+ */
+func (h *APIHandler) PTZContinuousMove(c *gin.Context) {
+	type Form struct {
+		ptzVectorForm
+		Path    string `form:"path" binding:"required"`
+		Timeout int    `form:"timeout"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, profile := ptzDevice(c, form.Path)
+	if entry == nil {
+		return
+	}
+	err := entry.ContinuousMove(profile, form.vector(), time.Duration(form.Timeout)*time.Millisecond)
+	ptzResult(c, "continuous move", form.Path, err)
+}
+
+// PTZStop
+/* @api {get} /api/v1/ptz/stop 云台停止
+ * @apiGroup ptz
+ * @apiName PTZStop
+ * @apiUse ptzParam
+ * @apiParam {Boolean} [panTilt=true] 停止水平垂直转动
+ * @apiParam {Boolean} [zoom=true] 停止变倍
+ * @apiUse simpleSuccess
+ * @apiUse authError
+ */
+func (h *APIHandler) PTZStop(c *gin.Context) {
+	type Form struct {
+		Path    string `form:"path" binding:"required"`
+		PanTilt *bool  `form:"panTilt"`
+		Zoom    *bool  `form:"zoom"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, profile := ptzDevice(c, form.Path)
+	if entry == nil {
+		return
+	}
+	err := entry.Stop(profile, form.PanTilt == nil || *form.PanTilt, form.Zoom == nil || *form.Zoom)
+	ptzResult(c, "stop", form.Path, err)
+}
+
+// PTZAbsoluteMove
+/* @api {get} /api/v1/ptz/absolute-move 云台转动到绝对位置
+ * @apiGroup ptz
+ * @apiName PTZAbsoluteMove
+ * @apiUse ptzParam
+ * @apiUse ptzVector
+ * @apiUse simpleSuccess
+ * @apiUse authError
+ */
+func (h *APIHandler) PTZAbsoluteMove(c *gin.Context) {
+	type Form struct {
+		ptzVectorForm
+		Path string `form:"path" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, profile := ptzDevice(c, form.Path)
+	if entry == nil {
+		return
+	}
+	ptzResult(c, "absolute move", form.Path, entry.AbsoluteMove(profile, form.vector(), nil))
+}
+
+// PTZRelativeMove
+/* @api {get} /api/v1/ptz/relative-move 云台相对当前位置转动
+ * @apiGroup ptz
+ * @apiName PTZRelativeMove
+ * @apiUse ptzParam
+ * @apiUse ptzVector
+ * @apiUse simpleSuccess
+ * @apiUse authError
+ */
+func (h *APIHandler) PTZRelativeMove(c *gin.Context) {
+	type Form struct {
+		ptzVectorForm
+		Path string `form:"path" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, profile := ptzDevice(c, form.Path)
+	if entry == nil {
+		return
+	}
+	ptzResult(c, "relative move", form.Path, entry.RelativeMove(profile, form.vector(), nil))
+}
+
+// PTZPresets
+/* @api {get} /api/v1/ptz/presets 获取云台预置位列表
+ * @apiGroup ptz
+ * @apiName PTZPresets
+ * @apiUse ptzParam
+ * @apiSuccess (200) {Array} presets 预置位列表
+ * @apiSuccess (200) {String} presets.token 预置位标识
+ * @apiSuccess (200) {String} presets.name 预置位名称
+ * @apiUse authError
+ */
+func (h *APIHandler) PTZPresets(c *gin.Context) {
+	type Form struct {
+		Path string `form:"path" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, profile := ptzDevice(c, form.Path)
+	if entry == nil {
+		return
+	}
+	presets, err := entry.GetPresets(profile)
+	if err != nil {
+		ptzResult(c, "get presets", form.Path, err)
+		return
+	}
+	c.IndentedJSON(200, presets)
+}
+
+// PTZGotoPreset
+/* @api {get} /api/v1/ptz/preset/goto 云台转到预置位
+ * @apiGroup ptz
+ * @apiName PTZGotoPreset
+ * @apiUse ptzParam
+ * @apiParam {String} preset 预置位标识
+ * @apiUse simpleSuccess
+ * @apiUse authError
+ */
+func (h *APIHandler) PTZGotoPreset(c *gin.Context) {
+	type Form struct {
+		Path   string `form:"path" binding:"required"`
+		Preset string `form:"preset" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, profile := ptzDevice(c, form.Path)
+	if entry == nil {
+		return
+	}
+	ptzResult(c, "goto preset", form.Path, entry.GotoPreset(profile, form.Preset))
+}
+
+// PTZSetPreset
+/* @api {get} /api/v1/ptz/preset/set 设置云台预置位
+ * @apiGroup ptz
+ * @apiName PTZSetPreset
+ * @apiUse ptzParam
+ * @apiParam {String} [name] 预置位名称
+ * @apiParam {String} [preset] 预置位标识，为空时新建预置位
+ * @apiSuccess (200) {String} token 预置位标识
+ * @apiUse authError
+ */
+func (h *APIHandler) PTZSetPreset(c *gin.Context) {
+	type Form struct {
+		Path   string `form:"path" binding:"required"`
+		Name   string `form:"name"`
+		Preset string `form:"preset"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	entry, profile := ptzDevice(c, form.Path)
+	if entry == nil {
+		return
+	}
+	token, err := entry.SetPreset(profile, form.Name, form.Preset)
+	if err != nil {
+		ptzResult(c, "set preset", form.Path, err)
+		return
+	}
+	c.IndentedJSON(200, token)
+}
@@ -119,10 +119,37 @@ func Init() (err error) {
 		api.GET("/restart", API.Restart)
 
 		api.GET("/pushers", API.Pushers)
+		api.GET("/pusher", API.Pusher)
 		api.GET("/players", API.Players)
+		api.GET("/memory", API.Memory)
+		api.GET("/cluster", API.Cluster)
 
 		api.GET("/stream/start", API.StreamStart)
 		api.GET("/stream/stop", API.StreamStop)
+		api.POST("/talk", API.Talk)
+
+		api.GET("/gb28181/devices", API.GBDevices)
+		api.GET("/gb28181/channels", API.GBChannels)
+		api.GET("/gb28181/catalog", API.GBCatalog)
+		api.GET("/gb28181/play", API.GBPlay)
+		api.GET("/gb28181/stop", API.GBStop)
+
+		api.GET("/onvif/discover", API.OnvifDiscover)
+		api.GET("/onvif/devices", API.OnvifDevices)
+		api.GET("/onvif/device/add", API.OnvifDeviceAdd)
+		api.GET("/onvif/device/remove", API.OnvifDeviceRemove)
+		api.GET("/onvif/profiles", API.OnvifProfiles)
+		api.GET("/onvif/provision", API.OnvifProvision)
+		api.GET("/onvif/events", API.OnvifEvents)
+		api.GET("/onvif/subscriptions", API.OnvifSubscriptions)
+
+		api.GET("/ptz/continuous-move", API.PTZContinuousMove)
+		api.GET("/ptz/stop", API.PTZStop)
+		api.GET("/ptz/absolute-move", API.PTZAbsoluteMove)
+		api.GET("/ptz/relative-move", API.PTZRelativeMove)
+		api.GET("/ptz/presets", API.PTZPresets)
+		api.GET("/ptz/preset/goto", API.PTZGotoPreset)
+		api.GET("/ptz/preset/set", API.PTZSetPreset)
 	}
 
 	return
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/rtsp"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/utils"
+	"net/http"
 	"strings"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 )
@@ -36,11 +38,39 @@ import (
  * @apiSuccess (200) {Array} rows 推流列表
  * @apiSuccess (200) {String} rows.id
  * @apiSuccess (200) {String} rows.path
- * @apiSuccess (200) {String} rows.transType 传输模式
+ * @apiSuccess (200) {String} rows.transType 传输模式，自动选择时为选中的传输模式
+ * @apiSuccess (200) {Boolean} rows.autoTransType 传输模式是否自动选择
  * @apiSuccess (200) {Number} rows.inBytes 入口流量
  * @apiSuccess (200) {Number} rows.outBytes 出口流量
  * @apiSuccess (200) {String} rows.startAt 开始时间
  * @apiSuccess (200) {Number} rows.onlines 在线人数
+ * @apiSuccess (200) {Number} rows.gopCacheBytes GOP缓存字节数
+ * @apiSuccess (200) {Number} rows.queueBytes 推流队列字节数
+ * @apiSuccess (200) {Array} rows.jitter UDP源抖动缓冲的各轨道统计,未启用为null
+ * @apiSuccess (200) {Number} rows.jitter.track 轨道
+ * @apiSuccess (200) {Number} rows.jitter.received 收到的包数
+ * @apiSuccess (200) {Number} rows.jitter.reordered 乱序到达的包数
+ * @apiSuccess (200) {Number} rows.jitter.dropped 丢弃的重复或迟到包数
+ * @apiSuccess (200) {Number} rows.jitter.lost 丢失的包数
+ * @apiSuccess (200) {Number} rows.jitter.gaps 丢包或序号重置的次数
+ * @apiSuccess (200) {Boolean} rows.backchannel 拉流源是否协商了ONVIF回传通道
+ * @apiSuccess (200) {String} rows.talker 当前对讲者,无对讲为空
+ * @apiSuccess (200) {Object} rows.video 视频信息,无视频为null
+ * @apiSuccess (200) {String} rows.video.codec 编码
+ * @apiSuccess (200) {String} rows.video.profile 档次
+ * @apiSuccess (200) {String} rows.video.level 级别
+ * @apiSuccess (200) {Number} rows.video.width 宽度
+ * @apiSuccess (200) {Number} rows.video.height 高度
+ * @apiSuccess (200) {Number} rows.video.frameRate 参数集声明的帧率,未声明为0
+ * @apiSuccess (200) {Number} rows.video.fps 实测帧率
+ * @apiSuccess (200) {Number} rows.video.gop 最近一个GOP的帧数
+ * @apiSuccess (200) {Number} rows.video.keyframeInterval 关键帧间隔(秒)
+ * @apiSuccess (200) {Number} rows.video.bitrate 码率(bit/s)
+ * @apiSuccess (200) {Object} rows.audio 音频信息,无音频为null
+ * @apiSuccess (200) {String} rows.audio.codec 编码
+ * @apiSuccess (200) {Number} rows.audio.sampleRate 采样率
+ * @apiSuccess (200) {Number} rows.audio.channels 声道数
+ * @apiSuccess (200) {Number} rows.audio.bitrate 码率(bit/s)
  */
 func (h *APIHandler) Pushers(c *gin.Context) {
 	form := utils.NewPageForm()
@@ -50,27 +80,11 @@ func (h *APIHandler) Pushers(c *gin.Context) {
 	hostname := utils.GetRequestHostname(c.Request)
 	pushers := make([]interface{}, 0)
 	for _, pusher := range rtsp.GetServer().GetPushers() {
-		addr := pusher.Server().Addr()
-		var url string
-		if addr.Port == 554 {
-			url = fmt.Sprintf("rtsp://%s%s", hostname, pusher.Path())
-		} else {
-			url = fmt.Sprintf("rtsp://%s:%d%s", hostname, addr.Port, pusher.Path())
-		}
+		url := pusherURL(hostname, pusher)
 		if form.Q != "" && !strings.Contains(strings.ToLower(url), strings.ToLower(form.Q)) {
 			continue
 		}
-		pushers = append(pushers, map[string]interface{}{
-			"id":        pusher.ID(),
-			"url":       url,
-			"path":      pusher.Path(),
-			"source":    pusher.Source(),
-			"transType": pusher.TransType(),
-			"inBytes":   pusher.InBytes(),
-			"outBytes":  pusher.OutBytes(),
-			"startAt":   utils.DateTime(pusher.StartAt()),
-			"onlines":   len(pusher.GetPlayers()),
-		})
+		pushers = append(pushers, pusherInfo(pusher, url))
 	}
 	pr := utils.NewPageResult(pushers)
 	if form.Sort != "" {
@@ -80,6 +94,80 @@ func (h *APIHandler) Pushers(c *gin.Context) {
 	c.IndentedJSON(200, pr)
 }
 
+// Pusher
+/* @api {get} /api/v1/pusher 获取推流详情
+ * @apiGroup stats
+ * @apiName Pusher
+ * @apiParam {String} path 推流路径
+ * @apiSuccess (200) {String} id
+ * @apiSuccess (200) {String} path
+ * @apiSuccess (200) {String} transType 传输模式，自动选择时为选中的传输模式
+ * @apiSuccess (200) {Boolean} autoTransType 传输模式是否自动选择
+ * @apiSuccess (200) {Object} video 视频信息,同推流列表
+ * @apiSuccess (200) {Number} video.bitDepth 位深
+ * @apiSuccess (200) {Boolean} video.interlaced 是否隔行
+ * @apiSuccess (200) {Number} video.frames 帧数
+ * @apiSuccess (200) {Number} video.keyframes 关键帧数
+ * @apiSuccess (200) {Object} audio 音频信息,同推流列表
+ * @apiSuccess (200) {Object} parameterSets 解析的参数集
+ * @apiSuccess (200) {Object} [parameterSets.vps] H.265 VPS
+ * @apiSuccess (200) {Object} [parameterSets.sps] SPS
+ * @apiSuccess (200) {Object} [parameterSets.pps] PPS
+ * @apiSuccess (200) {Object} [parameterSets.audioConfig] AAC AudioSpecificConfig
+ * @apiSuccess (200) {String} sdp SDP
+ */
+func (h *APIHandler) Pusher(c *gin.Context) {
+	type Form struct {
+		Path string `form:"path" binding:"required"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	pusher := rtsp.GetServer().GetPusher(form.Path)
+	if pusher == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Pusher[%s] not found", form.Path))
+		return
+	}
+	info := pusherInfo(pusher, pusherURL(utils.GetRequestHostname(c.Request), pusher))
+	info["parameterSets"] = pusher.ParameterSets()
+	info["sdp"] = pusher.SDPRaw()
+	c.IndentedJSON(200, info)
+}
+
+// pusherURL returns rtsp url of pusher on hostname requested
+func pusherURL(hostname string, pusher *rtsp.Pusher) string {
+	addr := pusher.Server().Addr()
+	if addr.Port == 554 {
+		return fmt.Sprintf("rtsp://%s%s", hostname, pusher.Path())
+	}
+	return fmt.Sprintf("rtsp://%s:%d%s", hostname, addr.Port, pusher.Path())
+}
+
+// pusherInfo returns statistics and stream info of pusher
+func pusherInfo(pusher *rtsp.Pusher, url string) map[string]interface{} {
+	stream := pusher.StreamInfo()
+	return map[string]interface{}{
+		"id":            pusher.ID(),
+		"url":           url,
+		"path":          pusher.Path(),
+		"source":        pusher.Source(),
+		"transType":     pusher.TransType(),
+		"autoTransType": pusher.AutoTransType(),
+		"inBytes":       pusher.InBytes(),
+		"outBytes":      pusher.OutBytes(),
+		"startAt":       utils.DateTime(pusher.StartAt()),
+		"onlines":       len(pusher.GetPlayers()),
+		"gopCacheBytes": pusher.GopCacheBytes(),
+		"queueBytes":    pusher.QueueBytes(),
+		"jitter":        pusher.JitterStats(),
+		"backchannel":   pusher.BackchannelTrack() >= 0,
+		"talker":        pusher.Talker(),
+		"video":         stream.Video,
+		"audio":         stream.Audio,
+	}
+}
+
 // Players
 /* @api {get} /api/v1/players 获取拉流列表
  * @apiGroup stats
@@ -96,6 +184,10 @@ func (h *APIHandler) Pushers(c *gin.Context) {
  * @apiSuccess (200) {String} rows.transType 传输模式
  * @apiSuccess (200) {Number} rows.inBytes 入口流量
  * @apiSuccess (200) {Number} rows.outBytes 出口流量
+ * @apiSuccess (200) {Number} rows.lostPackets 播放滞后丢失的包数
+ * @apiSuccess (200) {Number} rows.droppedPackets 滞后策略丢弃的包数
+ * @apiSuccess (200) {Number} rows.retransmittedPackets 按NACK重传的包数
+ * @apiSuccess (200) {Number} rows.queuedBytes 待发送字节数(估算)
  * @apiSuccess (200) {String} rows.startAt 开始时间
  */
 func (h *APIHandler) Players(c *gin.Context) {
@@ -122,12 +214,16 @@ func (h *APIHandler) Players(c *gin.Context) {
 
 		}
 		_players = append(_players, map[string]interface{}{
-			"id":        player.ID,
-			"path":      url,
-			"transType": player.TransType.String(),
-			"inBytes":   player.InBytes,
-			"outBytes":  player.OutBytes,
-			"startAt":   utils.DateTime(player.StartAt),
+			"id":                   player.ID,
+			"path":                 url,
+			"transType":            player.TransType.String(),
+			"inBytes":              atomic.LoadInt64(&player.InBytes),
+			"outBytes":             atomic.LoadInt64(&player.OutBytes),
+			"lostPackets":          player.LostPackets(),
+			"droppedPackets":       player.DroppedPackets(),
+			"retransmittedPackets": player.RetransmittedPackets(),
+			"queuedBytes":          player.QueuedBytes(),
+			"startAt":              utils.DateTime(player.StartAt),
 		})
 	}
 	pr := utils.NewPageResult(_players)
@@ -137,3 +233,43 @@ func (h *APIHandler) Players(c *gin.Context) {
 	pr.Slice(form.Start, form.Limit)
 	c.IndentedJSON(200, pr)
 }
+
+// Memory
+/* @api {get} /api/v1/memory 获取内存使用
+ * @apiGroup stats
+ * @apiName Memory
+ * @apiSuccess (200) {Number} buffered 缓存的RTP包字节数
+ * @apiSuccess (200) {Number} gopCache GOP缓存引用的字节数
+ * @apiSuccess (200) {Number} pusherQueues 推流队列引用的字节数
+ * @apiSuccess (200) {Number} playerQueues 拉流待发送字节数(估算)
+ * @apiSuccess (200) {Number} limit 内存上限,0为不限制
+ * @apiSuccess (200) {Number} admissionLimit 超过后拒绝新的推流和拉流
+ * @apiSuccess (200) {Number} rejected 拒绝的推流和拉流数
+ * @apiSuccess (200) {Number} trimmedBytes 裁剪缓存释放的字节数
+ * @apiSuccess (200) {Number} disconnected 断开的拉流数
+ */
+func (h *APIHandler) Memory(c *gin.Context) {
+	c.IndentedJSON(200, rtsp.GetServer().Memory().Usage())
+}
+
+// Cluster
+/* @api {get} /api/v1/cluster 获取集群节点
+ * @apiGroup stats
+ * @apiName Cluster
+ * @apiSuccess (200) {Object[]} nodes 节点列表,第一个为本节点
+ * @apiSuccess (200) {String} nodes.id 节点ID
+ * @apiSuccess (200) {String} nodes.url 节点RTSP地址
+ * @apiSuccess (200) {Number} nodes.players 拉流数
+ * @apiSuccess (200) {Number} nodes.outputRate 输出字节每秒
+ * @apiSuccess (200) {Number} nodes.load 负载
+ * @apiSuccess (200) {Boolean} nodes.full 是否达到上限
+ * @apiSuccess (200) {String[]} nodes.paths 推流路径
+ */
+func (h *APIHandler) Cluster(c *gin.Context) {
+	cluster := rtsp.GetServer().Cluster()
+	if cluster == nil {
+		c.IndentedJSON(200, []rtsp.NodeState{})
+		return
+	}
+	c.IndentedJSON(200, cluster.Nodes())
+}
@@ -22,9 +22,10 @@ import (
  * @apiName StreamStart
  * @apiParam {String} url RTSP源地址
  * @apiParam {String} [customPath] 转推时的推送PATH
- * @apiParam {String=TCP,UDP} [transType=TCP] 拉流传输模式
+ * @apiParam {String=TCP,UDP,AUTO} [transType=TCP] 拉流传输模式。AUTO时优先使用配置的传输方式，收不到RTP或丢包严重时自动切换到另一种
  * @apiParam {Number} [idleTimeout] 拉流时的超时时间
- * @apiParam {Number} [heartbeatInterval] 拉流时的心跳间隔，毫秒为单位。如果心跳间隔不为0，那拉流时会向源地址以该间隔发送OPTION请求用来心跳保活
+ * @apiParam {Number} [heartbeatInterval] 拉流时的心跳间隔，毫秒为单位。如果心跳间隔不为0，那拉流时会向源地址以该间隔发送保活请求，默认为会话超时时间的一半。源地址支持时保活请求为GET_PARAMETER，否则为OPTIONS
+ * @apiParam {String} [profile] 拉流的摄像机兼容配置名称，默认为主机匹配的配置
  * @apiSuccess (200) {String} ID	拉流的ID。后续可以通过该ID来停止拉流
  */
 func (h *APIHandler) StreamStart(c *gin.Context) {
@@ -34,6 +35,7 @@ func (h *APIHandler) StreamStart(c *gin.Context) {
 		TransType         string `form:"transType"`
 		IdleTimeout       int    `form:"idleTimeout"`
 		HeartbeatInterval int    `form:"heartbeatInterval"`
+		Profile           string `form:"profile"`
 	}
 	var form Form
 	err := c.Bind(&form)
@@ -41,39 +43,49 @@ func (h *APIHandler) StreamStart(c *gin.Context) {
 		Logger.ErrorWith("Pull to push err:%v", err)
 		return
 	}
-	agent := fmt.Sprintf("MDU/%s", config.GlobalConfig().Version)
-	client, err := rtsp.NewRTSPClient(rtsp.GetServer(), form.URL, int64(form.HeartbeatInterval)*1000, agent)
+	pusher, err := startRelay(form.URL, form.CustomPath, form.TransType, form.IdleTimeout, form.HeartbeatInterval, form.Profile)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, err.Error())
 		return
 	}
-	if form.CustomPath != "" && !strings.HasPrefix(form.CustomPath, "/") {
-		form.CustomPath = "/" + form.CustomPath
+	Logger.Info("Pull to pusher success", log.String("pusher", pusher.String()))
+	c.IndentedJSON(200, pusher.ID())
+}
+
+// startRelay pulls the rtsp url and pushes it to the local rtsp server,
+// profile is the name of client profile of camera, default the profile of
+// host matched
+func startRelay(url string, customPath string, transType string, idleTimeout int, heartbeatInterval int, profile string) (*rtsp.Pusher, error) {
+	agent := fmt.Sprintf("MDU/%s", config.GlobalConfig().Version)
+	client, err := rtsp.NewRTSPClient(rtsp.GetServer(), url, int64(heartbeatInterval)*1000, agent)
+	if err != nil {
+		return nil, err
+	}
+	if customPath != "" && !strings.HasPrefix(customPath, "/") {
+		customPath = "/" + customPath
 	}
-	client.CustomPath = form.CustomPath
-	switch strings.ToLower(form.TransType) {
-	case "udp":
-		client.TransType = rtsp.TransTypeUdp
-	case "tcp":
-		fallthrough
-	default:
-		client.TransType = rtsp.TransTypeTcp
+	client.CustomPath = customPath
+	if profile != "" {
+		if client.Profile = config.RtspConfig().ClientProfile(profile, ""); client.Profile == nil {
+			return nil, fmt.Errorf("Client profile %s not found", profile)
+		}
 	}
+	client.TransType = rtsp.ParseTransType(transType)
 
 	pusher := rtsp.NewClientPusher(client)
 	if rtsp.GetServer().GetPusher(pusher.Path()) != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Path %s already exists", client.Path))
-		return
+		return nil, fmt.Errorf("Path %s already exists", client.Path)
+	}
+	if !rtsp.GetServer().Memory().Admit("pull stream") {
+		return nil, fmt.Errorf("Not enough memory to pull stream")
 	}
-	err = client.Start(time.Duration(form.IdleTimeout) * time.Second)
+	err = client.Start(time.Duration(idleTimeout) * time.Second)
 	if err != nil {
 		Logger.ErrorWith("Pull stream error", err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Pull stream err: %v", err))
-		return
+		return nil, fmt.Errorf("Pull stream err: %v", err)
 	}
 	rtsp.GetServer().AddPusher(pusher)
-	Logger.Info("Pull to pusher success", log.String("pusher", pusher.String()))
-	c.IndentedJSON(200, pusher.ID())
+	return pusher, nil
 }
 
 // StreamStop
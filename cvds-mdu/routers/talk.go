@@ -0,0 +1,64 @@
+package routers
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/rtsp"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Talk
+/**
+ * @api {post} /api/v1/talk 对讲
+ * @apiGroup stream
+ * @apiName Talk
+ * @apiDescription 请求体为G.711音频裸数据，按实时速率转发至拉流源的ONVIF回传通道(backchannel)，需开启rtsp.backchannel.enable
+ * @apiParam {String} path 拉流转发的PATH
+ * @apiParam {String=pcma,pcmu} [codec=pcma] 音频编码，需与回传通道编码一致
+ * @apiParam {String} [talker] 对讲者标识，默认为请求IP，同一时间只允许一个对讲者
+ * @apiHeader {String} [Authorization] 配置了用户时需要Basic认证，且用户需要拥有该PATH的对讲权限
+ * @apiSuccess (200) {Number} bytes 转发的音频字节数
+ * @apiErrorExample 回传通道被占用
+ * HTTP/1.1 409 backchannel talked by another
+ * @apiUse authError
+ */
+func (h *APIHandler) Talk(c *gin.Context) {
+	type Form struct {
+		Path   string `form:"path" binding:"required"`
+		Codec  string `form:"codec"`
+		Talker string `form:"talker"`
+	}
+	var form Form
+	if err := c.Bind(&form); err != nil {
+		return
+	}
+	if !authorizeUser(c, "talk", form.Path, func(user *config.User) bool { return user.AllowTalk(form.Path) }) {
+		return
+	}
+	pusher := rtsp.GetServer().GetPusher(form.Path)
+	if pusher == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("Pusher[%s] not found", form.Path))
+		return
+	}
+	if form.Codec == "" {
+		form.Codec = rtsp.CodecPCMA
+	}
+	if form.Talker == "" {
+		form.Talker = c.ClientIP()
+	}
+	n, err := pusher.TalkAudio(form.Talker, form.Codec, c.Request.Body)
+	if err != nil {
+		Logger.Warn("talk error", log.String("path", form.Path), log.String("talker", form.Talker), log.Error(err))
+		status := http.StatusBadRequest
+		if errors.Is(err, rtsp.BackchannelBusyError) {
+			status = http.StatusConflict
+		}
+		c.AbortWithStatusJSON(status, fmt.Sprintf("Talk err: %v", err))
+		return
+	}
+	c.IndentedJSON(200, gin.H{"bytes": n})
+}
@@ -0,0 +1,462 @@
+package rtsp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var UnsupportedAuthError = errors.New("unsupported rtsp authentication")
+var AuthFailedError = errors.New("rtsp authentication failed")
+
+// StaleNonceError is credentials correct of a nonce expired, which are
+// challenged again with stale not to prompt for credentials
+var StaleNonceError = errors.New("rtsp authentication nonce stale")
+
+// authChallenge is a challenge of WWW-Authenticate, or credentials of
+// Authorization, names of params are in lower case
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// splitAuthList splits s by commas out of quoted strings
+func splitAuthList(s string) []string {
+	var items []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// parseAuthParam parses auth-param of name=value or name="quoted value"
+func parseAuthParam(s string) (name string, value string, ok bool) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+	name, value = strings.ToLower(strings.TrimSpace(s[:i])), strings.TrimSpace(s[i+1:])
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+		if strings.IndexByte(value, '\\') >= 0 {
+			b := make([]byte, 0, len(value))
+			for i := 0; i < len(value); i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b = append(b, value[i])
+			}
+			value = string(b)
+		}
+	}
+	return name, value, true
+}
+
+// parseAuthChallenges parses challenges of WWW-Authenticate headers, each of
+// which may hold several challenges separated by commas, see RFC 7235 4.1.
+// Credentials of Authorization are parsed as well
+func parseAuthChallenges(values ...string) []authChallenge {
+	var challenges []authChallenge
+	for _, value := range values {
+		for _, item := range splitAuthList(value) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			// a challenge starts with scheme followed by space or nothing
+			scheme := item
+			if i := strings.IndexAny(item, " \t"); i >= 0 {
+				scheme = item[:i]
+			}
+			if !strings.Contains(scheme, "=") {
+				challenges = append(challenges, authChallenge{Scheme: scheme, Params: make(map[string]string)})
+				item = strings.TrimSpace(item[len(scheme):])
+				if item == "" {
+					continue
+				}
+			}
+			if len(challenges) == 0 {
+				continue
+			}
+			c := &challenges[len(challenges)-1]
+			if name, value, ok := parseAuthParam(item); ok && strings.Contains(strings.TrimRight(item, "="), "=") {
+				c.Params[name] = value
+			} else {
+				// token68, such as Basic credentials, may end with '='
+				c.Params[""] = item
+			}
+		}
+	}
+	return challenges
+}
+
+// digestAlgorithm returns hash of algorithm of Digest, and whether it is a
+// session variant. MD5 is the default of algorithm not specified
+func digestAlgorithm(algorithm string) (h func() hash.Hash, sess bool, err error) {
+	name := strings.ToUpper(algorithm)
+	if strings.HasSuffix(name, "-SESS") {
+		name, sess = strings.TrimSuffix(name, "-SESS"), true
+	}
+	switch name {
+	case "", "MD5":
+		return md5.New, sess, nil
+	case "SHA-256":
+		return sha256.New, sess, nil
+	}
+	return nil, false, fmt.Errorf("%w: digest algorithm %s", UnsupportedAuthError, algorithm)
+}
+
+func digestHash(h func() hash.Hash, s string) string {
+	d := h()
+	d.Write([]byte(s))
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// digestResponse calculates response of Digest, see RFC 7616 3.4.1. Response
+// of RFC 2069 is calculated without qop
+func digestResponse(params map[string]string, method string, password string) (string, error) {
+	h, sess, err := digestAlgorithm(params["algorithm"])
+	if err != nil {
+		return "", err
+	}
+	ha1 := digestHash(h, params["username"]+":"+params["realm"]+":"+password)
+	if sess {
+		ha1 = digestHash(h, ha1+":"+params["nonce"]+":"+params["cnonce"])
+	}
+	ha2 := digestHash(h, method+":"+params["uri"])
+	switch params["qop"] {
+	case "":
+		return digestHash(h, ha1+":"+params["nonce"]+":"+ha2), nil
+	case "auth":
+		return digestHash(h, strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":")), nil
+	}
+	return "", fmt.Errorf("%w: qop %s", UnsupportedAuthError, params["qop"])
+}
+
+// digestQopAuth reports whether qop of challenge offers auth, and whether
+// the challenge is supported by qop
+func digestQopAuth(qop string) (auth bool, supported bool) {
+	if qop == "" {
+		return false, true
+	}
+	for _, q := range strings.Split(qop, ",") {
+		if strings.EqualFold(strings.TrimSpace(q), "auth") {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// authStrength ranks challenges supported, Digest of SHA-256 over MD5 over
+// Basic, 0 if not supported
+func authStrength(c *authChallenge) int {
+	switch {
+	case strings.EqualFold(c.Scheme, "Basic"):
+		return 1
+	case strings.EqualFold(c.Scheme, "Digest"):
+		h, _, err := digestAlgorithm(c.Params["algorithm"])
+		if _, ok := digestQopAuth(c.Params["qop"]); err != nil || !ok || c.Params["nonce"] == "" {
+			return 0
+		}
+		if h().Size() == sha256.Size {
+			return 3
+		}
+		return 2
+	}
+	return 0
+}
+
+func quoteAuthParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func newCnonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientAuth answers challenges of server with credentials of client, which
+// are user info of URL
+type clientAuth struct {
+	lock     sync.Mutex
+	username string
+	password string
+	// challenge answered, nil before challenged
+	challenge *authChallenge
+	// nonce count of the nonce of challenge
+	nc     int
+	cnonce string
+}
+
+// answer chooses the strongest challenge supported of WWW-Authenticate
+// values to answer requests with. Credentials rejected are not retried but
+// of a stale nonce, rejected reports whether credentials have been sent
+func (a *clientAuth) answer(values []string, rejected bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var best *authChallenge
+	challenges := parseAuthChallenges(values...)
+	for i := range challenges {
+		c := &challenges[i]
+		if s := authStrength(c); s > 0 && (best == nil || s > authStrength(best)) {
+			best = c
+		}
+	}
+	if best == nil {
+		return fmt.Errorf("%w: challenges %q", UnsupportedAuthError, values)
+	}
+	if a.username == "" {
+		return fmt.Errorf("%w: no credentials of %s challenge", AuthFailedError, best.Scheme)
+	}
+	if rejected && !strings.EqualFold(best.Params["stale"], "true") {
+		return fmt.Errorf("%w: credentials of user %s rejected", AuthFailedError, a.username)
+	}
+	a.challenge, a.nc, a.cnonce = best, 0, newCnonce()
+	return nil
+}
+
+// authorization returns Authorization of request of method to uri, empty if
+// not challenged
+func (a *clientAuth) authorization(method string, uri string) string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c := a.challenge
+	if c == nil {
+		return ""
+	}
+	if strings.EqualFold(c.Scheme, "Basic") {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password))
+	}
+	h, _, _ := digestAlgorithm(c.Params["algorithm"])
+	params := map[string]string{
+		"username":  a.username,
+		"realm":     c.Params["realm"],
+		"nonce":     c.Params["nonce"],
+		"uri":       uri,
+		"algorithm": c.Params["algorithm"],
+	}
+	if auth, _ := digestQopAuth(c.Params["qop"]); auth {
+		a.nc++
+		params["qop"], params["nc"], params["cnonce"] = "auth", fmt.Sprintf("%08x", a.nc), a.cnonce
+	}
+	response, _ := digestResponse(params, method, a.password)
+	username := a.username
+	if strings.EqualFold(c.Params["userhash"], "true") {
+		username = digestHash(h, a.username+":"+c.Params["realm"])
+	}
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "Digest username=%s, realm=%s, nonce=%s, uri=%s, response=%s",
+		quoteAuthParam(username), quoteAuthParam(params["realm"]), quoteAuthParam(params["nonce"]), quoteAuthParam(uri), quoteAuthParam(response))
+	if params["algorithm"] != "" {
+		b.WriteString(", algorithm=" + params["algorithm"])
+	}
+	if params["qop"] != "" {
+		fmt.Fprintf(&b, ", qop=auth, nc=%s, cnonce=%s", params["nc"], quoteAuthParam(params["cnonce"]))
+	}
+	if opaque, ok := c.Params["opaque"]; ok {
+		b.WriteString(", opaque=" + quoteAuthParam(opaque))
+	}
+	if c.Params["userhash"] != "" {
+		b.WriteString(", userhash=" + c.Params["userhash"])
+	}
+	return b.String()
+}
+
+// nonceKey signs nonces issued by server, nonces of other processes are
+// not valid
+var nonceKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// newNonce returns nonce issued at now, which is the issued time signed
+func newNonce(now time.Time) string {
+	b := make([]byte, 8, 24)
+	binary.BigEndian.PutUint64(b, uint64(now.UnixNano()))
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(b)[:24])
+}
+
+// checkNonce reports whether nonce is issued by server, and whether it
+// expired at now
+func checkNonce(nonce string, now time.Time, expiry time.Duration) (valid bool, expired bool) {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 24 {
+		return false, false
+	}
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil)[:16], b[8:]) {
+		return false, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	return true, now.Sub(issued) > expiry
+}
+
+// authChallenges returns WWW-Authenticate challenges of schemes configured,
+// with stale of nonce expired
+func authChallenges(stale bool) []string {
+	auth := &config.RtspConfig().Auth
+	nonce := newNonce(time.Now())
+	var challenges []string
+	for _, scheme := range auth.Schemes {
+		switch scheme {
+		case config.AuthSchemeBasic:
+			challenges = append(challenges, "Basic realm="+quoteAuthParam(auth.Realm))
+			continue
+		case config.AuthSchemeDigestSHA256:
+			scheme = "SHA-256"
+		case config.AuthSchemeDigestMD5:
+			scheme = "MD5"
+		}
+		challenge := fmt.Sprintf(`Digest realm=%s, nonce="%s", algorithm=%s, qop="auth"`, quoteAuthParam(auth.Realm), nonce, scheme)
+		if stale {
+			challenge += ", stale=true"
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+// authSchemeAllowed reports whether scheme of credentials is configured
+func authSchemeAllowed(scheme string) bool {
+	for _, s := range config.RtspConfig().Auth.Schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate verifies credentials of Authorization of request of method
+// against users configured. Nonce counts of the session are checked not to
+// be replayed, and StaleNonceError is returned for credentials correct of a
+// nonce expired. The user authenticated is kept for permissions of session
+func (session *Session) authenticate(authLine string, method string) error {
+	credentials := parseAuthChallenges(authLine)
+	if len(credentials) == 0 {
+		return fmt.Errorf("%w: no credentials", AuthFailedError)
+	}
+	c := &credentials[0]
+	if strings.EqualFold(c.Scheme, "Basic") {
+		if !authSchemeAllowed(config.AuthSchemeBasic) {
+			return fmt.Errorf("%w: basic not allowed", UnsupportedAuthError)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(c.Params[""])
+		if err != nil {
+			return fmt.Errorf("%w: invalid basic credentials", AuthFailedError)
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		user := config.FindUser(username)
+		if user == nil || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+			return fmt.Errorf("%w: user %s", AuthFailedError, username)
+		}
+		session.user = user
+		return nil
+	}
+	if !strings.EqualFold(c.Scheme, "Digest") {
+		return fmt.Errorf("%w: scheme %s", UnsupportedAuthError, c.Scheme)
+	}
+
+	auth := &config.RtspConfig().Auth
+	params := c.Params
+	h, _, err := digestAlgorithm(params["algorithm"])
+	if err != nil {
+		return err
+	}
+	scheme := config.AuthSchemeDigestMD5
+	if h().Size() == sha256.Size {
+		scheme = config.AuthSchemeDigestSHA256
+	}
+	if !authSchemeAllowed(scheme) {
+		return fmt.Errorf("%w: %s not allowed", UnsupportedAuthError, scheme)
+	}
+	if params["realm"] != auth.Realm {
+		return fmt.Errorf("%w: realm %s", AuthFailedError, params["realm"])
+	}
+	valid, expired := checkNonce(params["nonce"], time.Now(), auth.NonceExpiry)
+	if !valid {
+		return fmt.Errorf("%w: nonce %s not issued", AuthFailedError, params["nonce"])
+	}
+	// every challenge offers qop of auth, responses of RFC 2069 dropping it
+	// are refused, see RFC 7616 3.4
+	if params["qop"] == "" {
+		return fmt.Errorf("%w: qop missing", AuthFailedError)
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 32)
+	if err != nil || params["cnonce"] == "" {
+		return fmt.Errorf("%w: invalid nc or cnonce", AuthFailedError)
+	}
+
+	var user *config.User
+	if strings.EqualFold(params["userhash"], "true") {
+		for _, u := range config.UsersConfig() {
+			if digestHash(h, u.Username+":"+auth.Realm) == params["username"] {
+				user = &u
+				break
+			}
+		}
+	} else {
+		user = config.FindUser(params["username"])
+	}
+	if user == nil {
+		return fmt.Errorf("%w: user %s", AuthFailedError, params["username"])
+	}
+	hashed := params["username"]
+	params["username"] = user.Username
+	expected, err := digestResponse(params, method, user.Password)
+	params["username"] = hashed
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return fmt.Errorf("%w: response of user %s", AuthFailedError, user.Username)
+	}
+	if expired {
+		return StaleNonceError
+	}
+	// nonce count increases of every request of the nonce
+	if params["nonce"] == session.nonce && nc <= session.nc {
+		return fmt.Errorf("%w: nonce count %s replayed", AuthFailedError, params["nc"])
+	}
+	session.nonce, session.nc = params["nonce"], nc
+	session.user = user
+	return nil
+}
+
+// allowTalk reports whether user authenticated is allowed to talk to camera
+// of path of session by backchannel. If no user configured, permission check
+// is disabled
+func (session *Session) allowTalk() bool {
+	if len(config.UsersConfig()) == 0 {
+		return true
+	}
+	return session.user != nil && session.user.AllowTalk(session.Path)
+}
@@ -0,0 +1,208 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuthConfig enables authorization of user admin of password secret with
+// schemes challenged
+func testAuthConfig(t *testing.T, schemes ...string) {
+	cfg := config.GlobalConfig()
+	users, enable, auth := cfg.Users, cfg.RTSP.EnableAuthorization, cfg.RTSP.Auth
+	t.Cleanup(func() { cfg.Users, cfg.RTSP.EnableAuthorization, cfg.RTSP.Auth = users, enable, auth })
+	cfg.Users = []config.User{{Username: "admin", Password: "secret"}}
+	cfg.RTSP.EnableAuthorization = true
+	cfg.RTSP.Auth.Schemes = schemes
+}
+
+func TestDigestResponse(t *testing.T) {
+	// examples of RFC 7616 3.9.1
+	params := map[string]string{
+		"username": "Mufasa",
+		"realm":    "http-auth@example.org",
+		"uri":      "/dir/index.html",
+		"nonce":    "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		"cnonce":   "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		"nc":       "00000001",
+		"qop":      "auth",
+	}
+	for algorithm, expect := range map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		params["algorithm"] = algorithm
+		if response, err := digestResponse(params, "GET", "Circle of Life"); err != nil || response != expect {
+			t.Errorf("%s: expect %s, got %s %v", algorithm, expect, response, err)
+		}
+	}
+	params["algorithm"] = "SHA-512-256"
+	if _, err := digestResponse(params, "GET", "Circle of Life"); !errors.Is(err, UnsupportedAuthError) {
+		t.Errorf("expect SHA-512-256 unsupported, got %v", err)
+	}
+}
+
+func TestParseAuthChallenges(t *testing.T) {
+	challenges := parseAuthChallenges(
+		`Digest realm="IP Camera(C1234)", nonce="a,b", algorithm=MD5, qop="auth,auth-int", Basic realm="IP Camera(C1234)"`,
+		`Digest realm="cam", nonce="x\"y", algorithm=SHA-256, stale=TRUE`,
+	)
+	if len(challenges) != 3 {
+		t.Fatalf("expect 3 challenges, got %+v", challenges)
+	}
+	if c := challenges[0]; c.Scheme != "Digest" || c.Params["nonce"] != "a,b" || c.Params["qop"] != "auth,auth-int" || c.Params["realm"] != "IP Camera(C1234)" {
+		t.Fatalf("unexpected challenge: %+v", c)
+	}
+	if c := challenges[1]; c.Scheme != "Basic" || c.Params["realm"] != "IP Camera(C1234)" {
+		t.Fatalf("unexpected challenge: %+v", c)
+	}
+	if c := challenges[2]; c.Params["nonce"] != `x"y` || c.Params["stale"] != "TRUE" {
+		t.Fatalf("unexpected challenge: %+v", c)
+	}
+	if c := parseAuthChallenges("Basic YWRtaW46c2VjcmV0=="); len(c) != 1 || c[0].Params[""] != "YWRtaW46c2VjcmV0==" {
+		t.Fatalf("expect token68 parsed, got %+v", c)
+	}
+
+	// the strongest challenge answered
+	a := &clientAuth{username: "admin", password: "secret"}
+	if err := a.answer([]string{`Basic realm="cam"`, `Digest realm="cam", nonce="1", qop="auth-int"`, `Digest realm="cam", nonce="2", qop="auth"`}, false); err != nil {
+		t.Fatal(err)
+	}
+	if authorization := a.authorization("DESCRIBE", "rtsp://cam/live"); !strings.HasPrefix(authorization, `Digest username="admin", realm="cam", nonce="2"`) ||
+		!strings.Contains(authorization, "qop=auth, nc=00000001") {
+		t.Fatalf("unexpected authorization: %s", authorization)
+	}
+	if err := a.answer([]string{`Basic realm="cam"`}, false); err != nil || a.authorization("DESCRIBE", "rtsp://cam/live") != "Basic YWRtaW46c2VjcmV0" {
+		t.Fatalf("unexpected basic authorization: %v", err)
+	}
+	if err := a.answer([]string{`Bearer realm="cam"`}, false); !errors.Is(err, UnsupportedAuthError) {
+		t.Fatalf("expect bearer unsupported, got %v", err)
+	}
+	if err := a.answer([]string{`Basic realm="cam"`}, true); !errors.Is(err, AuthFailedError) {
+		t.Fatalf("expect credentials rejected, got %v", err)
+	}
+}
+
+func TestSessionAuthenticate(t *testing.T) {
+	testAuthConfig(t, config.AuthSchemeDigestSHA256, config.AuthSchemeDigestMD5)
+	session := &Session{}
+	a := &clientAuth{username: "admin", password: "secret"}
+	if err := a.answer(authChallenges(false), false); err != nil {
+		t.Fatal(err)
+	}
+	if a.challenge.Params["algorithm"] != "SHA-256" {
+		t.Fatalf("expect SHA-256 preferred, got %+v", a.challenge)
+	}
+	uri := "rtsp://127.0.0.1/live/auth"
+	authorization := a.authorization("DESCRIBE", uri)
+	if err := session.authenticate(authorization, "DESCRIBE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.authenticate(authorization, "DESCRIBE"); !errors.Is(err, AuthFailedError) {
+		t.Fatalf("expect nonce count replayed rejected, got %v", err)
+	}
+	if err := session.authenticate(a.authorization("DESCRIBE", uri), "SETUP"); !errors.Is(err, AuthFailedError) {
+		t.Fatalf("expect response of other method rejected, got %v", err)
+	}
+	if err := session.authenticate(strings.Replace(a.authorization("DESCRIBE", uri), `username="admin"`, `username="guest"`, 1), "DESCRIBE"); !errors.Is(err, AuthFailedError) {
+		t.Fatalf("expect unknown user rejected, got %v", err)
+	}
+	if err := session.authenticate(`Basic YWRtaW46c2VjcmV0`, "DESCRIBE"); !errors.Is(err, UnsupportedAuthError) {
+		t.Fatalf("expect basic not configured rejected, got %v", err)
+	}
+	delete(a.challenge.Params, "qop")
+	if err := session.authenticate(a.authorization("DESCRIBE", uri), "DESCRIBE"); !errors.Is(err, AuthFailedError) {
+		t.Fatalf("expect response without qop rejected, got %v", err)
+	}
+	a.challenge.Params["qop"] = "auth"
+
+	// nonce expired, challenged again with stale
+	a.challenge.Params["nonce"] = newNonce(time.Now().Add(-time.Hour))
+	if err := session.authenticate(a.authorization("DESCRIBE", uri), "DESCRIBE"); !errors.Is(err, StaleNonceError) {
+		t.Fatalf("expect stale nonce, got %v", err)
+	}
+	if err := a.answer(authChallenges(true), true); err != nil {
+		t.Fatalf("expect stale nonce answered again, got %v", err)
+	}
+	if err := session.authenticate(a.authorization("DESCRIBE", uri), "DESCRIBE"); err != nil {
+		t.Fatal(err)
+	}
+	a.challenge.Params["nonce"] = "0123456789abcdef0123456789abcdef0123456789abcdef"
+	if err := session.authenticate(a.authorization("DESCRIBE", uri), "DESCRIBE"); !errors.Is(err, AuthFailedError) {
+		t.Fatalf("expect nonce not issued rejected, got %v", err)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	for _, test := range []struct {
+		schemes   []string
+		algorithm string
+	}{
+		{[]string{config.AuthSchemeDigestSHA256, config.AuthSchemeDigestMD5}, "SHA-256"},
+		{[]string{config.AuthSchemeDigestMD5, config.AuthSchemeBasic}, "MD5"},
+		{[]string{config.AuthSchemeBasic}, ""},
+	} {
+		testAuthConfig(t, test.schemes...)
+		s := newTestServer(t)
+		url := fmt.Sprintf("rtsp://%s/live/auth", s.Addr())
+
+		// pusher answers the last challenge
+		push := dialTestConn(t, s)
+		a := &clientAuth{username: "admin", password: "secret"}
+		request := func(method string, url string, headers map[string]string, body string) {
+			code, header := push.request(method, url, headers, body)
+			if code == 401 {
+				if err := a.answer([]string{header["WWW-Authenticate"]}, false); err != nil {
+					t.Fatal(err)
+				}
+				if headers == nil {
+					headers = make(map[string]string)
+				}
+				headers["Authorization"] = a.authorization(method, url)
+				code, _ = push.request(method, url, headers, body)
+			}
+			if code != 200 {
+				t.Fatalf("%v: %s failed: %d", test.schemes, method, code)
+			}
+		}
+		request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, testPushSDP)
+		request("SETUP", url+"/streamid=0", map[string]string{
+			"Transport":     "RTP/AVP/TCP;unicast;interleaved=0-1",
+			"Authorization": a.authorization("SETUP", url+"/streamid=0"),
+		}, "")
+		request("RECORD", url, map[string]string{"Authorization": a.authorization("RECORD", url)}, "")
+		pusher := s.GetPusher("/live/auth")
+
+		// player of credentials of URL answers the strongest challenge
+		var packets testPackets
+		client, err := NewRTSPClient(s, strings.Replace(url, "rtsp://", "rtsp://admin:secret@", 1), 0, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.RTPHandles = append(client.RTPHandles, packets.handle)
+		if err := client.Start(3 * time.Second); err != nil {
+			t.Fatalf("%v: %v", test.schemes, err)
+		}
+		if c := client.auth.challenge; c.Params["algorithm"] != test.algorithm {
+			t.Fatalf("%v: expect %s answered, got %+v", test.schemes, test.algorithm, c)
+		}
+		waitFor(t, "player", func() bool { return len(pusher.GetPlayers()) == 1 })
+		push.writeInterleaved(0, testRTP(96, 1, 0x65))
+		waitFor(t, "packets", func() bool { return packets.count(0) == 1 })
+		client.Stop()
+
+		// credentials rejected are not retried
+		client, err = NewRTSPClient(s, strings.Replace(url, "rtsp://", "rtsp://admin:wrong@", 1), 0, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Start(3 * time.Second); !errors.Is(err, AuthFailedError) {
+			t.Fatalf("%v: expect credentials rejected, got %v", test.schemes, err)
+		}
+		client.Stop()
+	}
+}
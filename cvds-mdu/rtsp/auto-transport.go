@@ -0,0 +1,233 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sync"
+	"time"
+)
+
+var UnsupportedTransportError = errors.New("rtsp transport unsupported")
+
+// autoMinExpected is the min RTP packets expected in a window to measure
+// loss, fewer are too few to tell
+const autoMinExpected = 50
+
+// teardownWait is how long TEARDOWN of transport switched is waited for
+// response before connection closed
+const teardownWait = time.Second
+
+// seqCounter counts RTP packets of a track received and expected by sequence
+// numbers, see RFC 3550 A.3
+type seqCounter struct {
+	started  bool
+	first    uint32
+	max      uint32
+	received int
+
+	// expected and received at the start of window
+	windowExpected int
+	windowReceived int
+}
+
+func (c *seqCounter) update(seq uint16) {
+	c.received++
+	if !c.started {
+		c.started = true
+		c.first, c.max = uint32(seq), uint32(seq)
+		return
+	}
+	// packets out of order or duplicated do not move max back
+	if delta := int16(seq - uint16(c.max)); delta > 0 {
+		c.max += uint32(delta)
+	}
+}
+
+func (c *seqCounter) expected() int {
+	if !c.started {
+		return 0
+	}
+	return int(c.max - c.first + 1)
+}
+
+// autoTransport is the state of client of trans type auto
+type autoTransport struct {
+	// timeout of requests of client started
+	timeout time.Duration
+	// window of RTP watched and loss threshold of config
+	window        time.Duration
+	lossThreshold float64
+
+	lock sync.Mutex
+	// transport being switched, the connection closed is not an error
+	switching bool
+	tracks    map[int]*seqCounter
+}
+
+// count counts RTP packet of track
+func (a *autoTransport) count(track int, seq uint16) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c := a.tracks[track]
+	if c == nil {
+		c = &seqCounter{}
+		a.tracks[track] = c
+	}
+	c.update(seq)
+}
+
+// next returns RTP packets of tracks received and expected since the last
+// window
+func (a *autoTransport) next() (received int, expected int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, c := range a.tracks {
+		e := c.expected()
+		received += c.received - c.windowReceived
+		expected += e - c.windowExpected
+		c.windowReceived, c.windowExpected = c.received, e
+	}
+	return
+}
+
+func (a *autoTransport) isSwitching() bool {
+	if a == nil {
+		return false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.switching
+}
+
+// AutoTransType reports whether transport of client is selected by trans
+// type auto, TransType is the one selected after started
+func (client *Client) AutoTransType() bool {
+	return client.auto != nil
+}
+
+// otherTransType returns the transport switched to from the current one
+func (client *Client) otherTransType() TransType {
+	if client.TransType == TransTypeTcp {
+		return TransTypeUdp
+	}
+	return TransTypeTcp
+}
+
+// countRTP counts RTP packet for loss of transport selected automatically
+func (client *Client) countRTP(pack *RTPPack) {
+	if client.auto == nil || pack.Type.IsControl() {
+		return
+	}
+	if b := pack.Bytes(); len(b) >= RTP_FIXED_HEADER_LENGTH {
+		client.auto.count(pack.Track, binary.BigEndian.Uint16(b[2:]))
+	}
+}
+
+// startAuto starts client of trans type auto with the transport preferred.
+// The other transport is set up instead if server refuses the preferred one
+// by SETUP, and switched to if no RTP received within auto transport timeout
+// after PLAY, or if RTP of UDP lost heavily
+func (client *Client) startAuto(timeout time.Duration) error {
+	cfg := config.RtspConfig().Client.AutoTransport
+	client.auto = &autoTransport{
+		timeout:       timeout,
+		window:        cfg.Timeout,
+		lossThreshold: cfg.LossThreshold,
+		tracks:        make(map[int]*seqCounter),
+	}
+	client.TransType = TransTypeUdp
+	if cfg.Prefer == "tcp" {
+		client.TransType = TransTypeTcp
+	}
+	if err := client.requestStream(timeout); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go client.startStream(done)
+	go client.watchTransport(done)
+	return nil
+}
+
+// watchTransport watches RTP received by stream of done in windows of auto
+// transport timeout until transport switched or stream stopped
+func (client *Client) watchTransport(done chan struct{}) {
+	a := client.auto
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		received, expected := a.next()
+		switch {
+		case first && received == 0:
+			client.switchTransport(done, "no RTP received")
+			return
+		case client.TransType != TransTypeUdp:
+			// loss of TCP is not measured
+			return
+		case a.lossThreshold >= 0 && expected >= autoMinExpected && received < expected &&
+			float64(expected-received)/float64(expected) > a.lossThreshold:
+			client.switchTransport(done, fmt.Sprintf("%d of %d RTP lost", expected-received, expected))
+			return
+		}
+	}
+}
+
+// switchTransport tears down stream of done and sets up the other transport
+// on a new connection. Handles of client are kept, so pusher of client is
+// not aware of it except packets lost during switching
+func (client *Client) switchTransport(done chan struct{}, reason string) {
+	to := client.otherTransType()
+	client.logger.Warn("client transport switched",
+		log.String("client", client.String()),
+		log.String("from", client.TransType.String()),
+		log.String("to", to.String()),
+		log.String("reason", reason),
+	)
+	client.auto.lock.Lock()
+	client.auto.switching = true
+	client.auto.lock.Unlock()
+	// stream stops on response of TEARDOWN or connection closed by server
+	client.RequestWithPath(TEARDOWN, client.controlURL, make(map[string]string), false)
+	select {
+	case <-done:
+	case <-time.After(teardownWait):
+	}
+	client.resetStream()
+	<-done
+
+	client.TransType = to
+	client.Session = ""
+	client.auto.lock.Lock()
+	client.auto.tracks = make(map[int]*seqCounter)
+	client.auto.lock.Unlock()
+	err := client.requestStream(client.auto.timeout)
+	client.auto.lock.Lock()
+	client.auto.switching = false
+	client.auto.lock.Unlock()
+	if client.Stopped() {
+		client.resetStream()
+		return
+	}
+	if err != nil {
+		client.logger.ErrorWith("client transport switch error", err, log.String("client", client.String()))
+		client.Stop()
+		return
+	}
+	go client.startStream(make(chan struct{}))
+}
+
+// resetStream closes connection and UDP server of stream
+func (client *Client) resetStream() {
+	client.closeConn()
+	if client.UDPServer != nil {
+		client.UDPServer.Stop()
+		client.UDPServer = nil
+	}
+}
@@ -0,0 +1,185 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"io"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// RequireBackchannel is the feature tag of Require header requiring ONVIF
+// backchannel, see ONVIF streaming specification 5.3.1
+const RequireBackchannel = "www.onvif.org/ver20/backchannel"
+
+var BackchannelUnavailableError = errors.New("backchannel unavailable")
+var BackchannelBusyError = errors.New("backchannel talked by another")
+
+// talkFrame is the duration of RTP of G.711 talked by HTTP
+const talkFrame = 20 * time.Millisecond
+
+// requiresBackchannel reports whether Require header requires backchannel
+func requiresBackchannel(require string) bool {
+	for _, tag := range strings.Split(require, ",") {
+		if strings.EqualFold(strings.TrimSpace(tag), RequireBackchannel) {
+			return true
+		}
+	}
+	return false
+}
+
+// BackchannelTrack returns track of backchannel of SDP of source required
+// backchannel, which is audio media of sendonly, -1 if none
+func (s *SDP) BackchannelTrack() int {
+	for track, media := range s.Media {
+		if media.Type == "audio" && media.Direction() == DirectionSendOnly {
+			return track
+		}
+	}
+	return -1
+}
+
+// withoutTrack returns SDP of raw without media section of track
+func withoutTrack(raw string, track int) string {
+	return rewriteMedia(raw, func(t int, lines []string) []string {
+		if t == track {
+			return nil
+		}
+		return lines
+	})
+}
+
+// BackchannelTrack returns track of backchannel of source pulled, -1 if
+// backchannel not negotiated
+func (client *Client) BackchannelTrack() int {
+	if !client.Backchannel || client.SDP == nil {
+		return -1
+	}
+	return client.SDP.BackchannelTrack()
+}
+
+// sendBackchannel sends RTP of pack to backchannel track of source by
+// transport set up
+func (client *Client) sendBackchannel(track int, pack *RTPPack) error {
+	if client.TransType == TransTypeUdp {
+		s := client.UDPServer
+		if s == nil {
+			return fmt.Errorf("%w: udp server stopped", BackchannelUnavailableError)
+		}
+		return s.sendSource(track, pack)
+	}
+	channel, ok := client.channels.channel(track, pack.Type.IsControl())
+	if !ok {
+		return fmt.Errorf("%w: track %d not set up", BackchannelUnavailableError, track)
+	}
+	b := make([]byte, 4+pack.Len())
+	b[0], b[1] = '$', byte(channel)
+	binary.BigEndian.PutUint16(b[2:], uint16(pack.Len()))
+	copy(b[4:], pack.Bytes())
+	if err := client.write(b); err != nil {
+		return err
+	}
+	atomic.AddInt64(&client.OutBytes, int64(len(b)))
+	return nil
+}
+
+// BackchannelTrack returns track of backchannel of source of pusher, -1 if
+// pusher is not a source pulled with backchannel
+func (pusher *Pusher) BackchannelTrack() int {
+	if pusher.Client == nil {
+		return -1
+	}
+	return pusher.Client.BackchannelTrack()
+}
+
+// Talker returns talker holding backchannel of pusher, empty if none
+func (pusher *Pusher) Talker() string {
+	pusher.talkLock.Lock()
+	defer pusher.talkLock.Unlock()
+	if time.Since(pusher.talkAt) >= config.RtspConfig().Backchannel.TalkTimeout {
+		return ""
+	}
+	return pusher.talker
+}
+
+// Talk forwards RTP of pack of talker to backchannel of source. Backchannel
+// is held by a talker at a time, BackchannelBusyError returned if held by
+// another talker talking within talk timeout
+func (pusher *Pusher) Talk(talker string, pack *RTPPack) error {
+	track := pusher.BackchannelTrack()
+	if track < 0 {
+		return BackchannelUnavailableError
+	}
+	now := time.Now()
+	pusher.talkLock.Lock()
+	if pusher.talker != talker && now.Sub(pusher.talkAt) < config.RtspConfig().Backchannel.TalkTimeout {
+		pusher.talkLock.Unlock()
+		return fmt.Errorf("%w: %s", BackchannelBusyError, pusher.talker)
+	}
+	if pusher.talker != talker {
+		pusher.Logger().Info("backchannel talker changed", log.String("pusher", pusher.String()), log.String("talker", talker))
+	}
+	pusher.talker, pusher.talkAt = talker, now
+	pusher.talkLock.Unlock()
+	return pusher.Client.sendBackchannel(track, pack)
+}
+
+// TalkAudio reads G.711 of codec of talker from r, and talks it by RTP of 20
+// milliseconds in real time until r ends. Bytes of audio talked are returned
+func (pusher *Pusher) TalkAudio(talker string, codec string, r io.Reader) (n int, err error) {
+	track := pusher.BackchannelTrack()
+	if track < 0 {
+		return 0, BackchannelUnavailableError
+	}
+	media := pusher.Client.SDP.Media[track]
+	if c := media.Codec(); c != strings.ToLower(codec) || c != CodecPCMA && c != CodecPCMU {
+		return 0, fmt.Errorf("%w: codec %s of backchannel is %s", BackchannelUnavailableError, codec, c)
+	}
+	samples := media.ClockRate() * int(talkFrame/time.Millisecond) / 1000
+	rtp := make([]byte, RTP_FIXED_HEADER_LENGTH+samples)
+	rtp[0] = 0x80
+	rtp[1] = byte(media.PayloadType()) | 0x80
+	seq, timestamp := uint16(rand.Uint32()), rand.Uint32()
+	binary.BigEndian.PutUint32(rtp[8:], rand.Uint32())
+	ticker := time.NewTicker(talkFrame)
+	defer ticker.Stop()
+	for {
+		c, readErr := io.ReadFull(r, rtp[RTP_FIXED_HEADER_LENGTH:])
+		if c > 0 {
+			binary.BigEndian.PutUint16(rtp[2:], seq)
+			binary.BigEndian.PutUint32(rtp[4:], timestamp)
+			pack := copyRTPPack(track, media.rtpType(false), rtp[:RTP_FIXED_HEADER_LENGTH+c])
+			err = pusher.Talk(talker, pack)
+			pack.Release()
+			if err != nil {
+				return
+			}
+			n += c
+			// marker of the first packet of talk spurt only
+			rtp[1] &^= 0x80
+			seq, timestamp = seq+1, timestamp+uint32(c)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+		<-ticker.C
+	}
+}
+
+// talk forwards RTP of backchannel track of player to source
+func (player *Player) talk(pack *RTPPack) {
+	if pack.Type.IsControl() || pack.Track != player.Pusher.BackchannelTrack() {
+		return
+	}
+	if err := player.Pusher.Talk(player.ID, pack); err != nil {
+		player.logger.Debug("player talk error", log.String("player", player.String()), log.Error(err))
+	}
+}
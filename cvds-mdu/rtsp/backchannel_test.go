@@ -0,0 +1,313 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBackchannelSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=Door Station\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=control:trackID=0\r\n" +
+	"a=recvonly\r\n" +
+	"m=audio 0 RTP/AVP 0\r\n" +
+	"a=control:trackID=1\r\n" +
+	"a=sendonly\r\n" +
+	"m=audio 0 RTP/AVP 8\r\n" +
+	"a=control:trackID=2\r\n" +
+	"a=recvonly\r\n"
+
+func TestBackchannelSDP(t *testing.T) {
+	for require, expect := range map[string]bool{
+		RequireBackchannel: true,
+		"play.basic, WWW.ONVIF.ORG/ver20/backchannel": true,
+		"www.onvif.org/ver20/replay":                  false,
+		"":                                            false,
+	} {
+		if requiresBackchannel(require) != expect {
+			t.Errorf("requiresBackchannel(%q) expect %v", require, expect)
+		}
+	}
+
+	sdp, _ := ParseSDP(testBackchannelSDP)
+	if track := sdp.BackchannelTrack(); track != 1 {
+		t.Fatalf("expect backchannel of track 1, got %d", track)
+	}
+	if sdp, _ := ParseSDP(testPushSDP); sdp.BackchannelTrack() != -1 {
+		t.Fatalf("expect no backchannel of push SDP")
+	}
+	raw := withoutTrack(testBackchannelSDP, 1)
+	if strings.Contains(raw, "sendonly") || !strings.Contains(raw, "a=control:trackID=2") {
+		t.Fatalf("expect backchannel removed only, got %q", raw)
+	}
+}
+
+func TestBackchannel(t *testing.T) {
+	cfg := config.GlobalConfig()
+	backchannel := cfg.RTSP.Backchannel
+	t.Cleanup(func() { cfg.RTSP.Backchannel = backchannel })
+	cfg.RTSP.Backchannel.Enable = true
+	cfg.RTSP.Backchannel.TalkTimeout = time.Second
+
+	s := newTestServer(t)
+	r := replayCamera(t, "door-station.rtsp")
+	client, err := NewRTSPClient(s, fmt.Sprintf("rtsp://%s/onvif/media", r.addr()), 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher := NewClientPusher(client)
+	if err := client.Start(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPusher(pusher)
+	defer client.Stop()
+	select {
+	case <-r.done:
+	case <-time.After(3 * time.Second):
+	}
+	r.lock.Lock()
+	for _, e := range r.errors {
+		t.Error(e)
+	}
+	if r.next != len(r.exchanges) {
+		t.Fatalf("conversation stopped at exchange %d: %s", r.next, r.exchanges[r.next].request)
+	}
+	r.lock.Unlock()
+	if track := pusher.BackchannelTrack(); track != 2 {
+		t.Fatalf("expect backchannel of track 2, got %d", track)
+	}
+	url := fmt.Sprintf("rtsp://%s/onvif/media", s.Addr())
+
+	// backchannel described to players requiring it only
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, nil, ""); code != 200 || strings.Contains(play.body, "sendonly") {
+		t.Fatalf("expect backchannel not described, got %d %q", code, play.body)
+	}
+	if code, _ := play.request("SETUP", url+"/trackID=2", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 404 {
+		t.Fatalf("expect backchannel not set up, got %d", code)
+	}
+	play = dialTestConn(t, s)
+	require := map[string]string{"Require": RequireBackchannel}
+	if code, _ := play.request("DESCRIBE", url, require, ""); code != 200 || !strings.Contains(play.body, "sendonly") {
+		t.Fatalf("expect backchannel described, got %d %q", code, play.body)
+	}
+	if code, _ := play.request("SETUP", url+"/trackID=2", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1", "Require": RequireBackchannel}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := play.request("PLAY", url, require, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+
+	// RTP of player forwarded to backchannel, and talk of another talker
+	// refused until talk timeout
+	play.writeInterleaved(0, testRTP(0, 1, 0xd5))
+	waitFor(t, "talk of player", func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return len(r.received) == 1
+	})
+	if _, err := pusher.TalkAudio("http", CodecPCMU, bytes.NewReader(make([]byte, 160))); !errors.Is(err, BackchannelBusyError) {
+		t.Fatalf("expect backchannel busy, got %v", err)
+	}
+	if talker := pusher.Talker(); talker == "" || talker == "http" {
+		t.Fatalf("expect player talking, got %q", talker)
+	}
+	r.lock.Lock()
+	if expect := fmt.Sprintf("$ 4 %x", testRTP(0, 1, 0xd5)); r.received[0] != expect {
+		t.Fatalf("expect %s, got %s", expect, r.received[0])
+	}
+	r.lock.Unlock()
+
+	// G.711 of HTTP packetized by 20 milliseconds
+	cfg.RTSP.Backchannel.TalkTimeout = 0
+	if _, err := pusher.TalkAudio("http", CodecPCMA, bytes.NewReader(make([]byte, 160))); !errors.Is(err, BackchannelUnavailableError) {
+		t.Fatalf("expect codec mismatched, got %v", err)
+	}
+	if n, err := pusher.TalkAudio("http", CodecPCMU, bytes.NewReader(make([]byte, 400))); err != nil || n != 400 {
+		t.Fatalf("talk failed: %d %v", n, err)
+	}
+	waitFor(t, "talk of http", func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return len(r.received) == 4
+	})
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, expect := range []int{160, 160, 80} {
+		fields := strings.Fields(r.received[i+1])
+		if fields[1] != "4" || len(fields[2]) != 2*(RTP_FIXED_HEADER_LENGTH+expect) {
+			t.Fatalf("expect talk of %d bytes, got %s", expect, r.received[i+1])
+		}
+	}
+}
+
+func TestBackchannelUnsupported(t *testing.T) {
+	cfg := config.GlobalConfig()
+	backchannel := cfg.RTSP.Backchannel
+	t.Cleanup(func() { cfg.RTSP.Backchannel = backchannel })
+	cfg.RTSP.Backchannel.Enable = true
+
+	r := replayCamera(t, "backchannel-unsupported.rtsp")
+	client, err := NewRTSPClient(nil, fmt.Sprintf("rtsp://%s/live", r.addr()), 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	select {
+	case <-r.done:
+	case <-time.After(3 * time.Second):
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, e := range r.errors {
+		t.Error(e)
+	}
+	if r.next != len(r.exchanges) {
+		t.Fatalf("conversation stopped at exchange %d: %s", r.next, r.exchanges[r.next].request)
+	}
+	if client.Backchannel || client.BackchannelTrack() != -1 {
+		t.Fatalf("expect backchannel disabled")
+	}
+}
+
+func TestBackchannelPermission(t *testing.T) {
+	cfg := config.GlobalConfig()
+	backchannel := cfg.RTSP.Backchannel
+	t.Cleanup(func() { cfg.RTSP.Backchannel = backchannel })
+	cfg.RTSP.Backchannel.Enable = true
+	testAuthConfig(t, config.AuthSchemeBasic)
+	cfg.Users = append(cfg.Users, config.User{Username: "talker", Password: "secret", Talk: []string{"/onvif/**"}})
+
+	s := newTestServer(t)
+	r := replayCamera(t, "door-station.rtsp")
+	client, err := NewRTSPClient(s, fmt.Sprintf("rtsp://%s/onvif/media", r.addr()), 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher := NewClientPusher(client)
+	if err := client.Start(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPusher(pusher)
+	defer client.Stop()
+	url := fmt.Sprintf("rtsp://%s/onvif/media", s.Addr())
+
+	// players not allowed to talk play without backchannel only
+	admin := map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))}
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, admin, ""); code != 200 || strings.Contains(play.body, "sendonly") {
+		t.Fatalf("expect played without backchannel, got %d %q", code, play.body)
+	}
+	admin["Require"] = RequireBackchannel
+	if code, _ := dialTestConn(t, s).request("DESCRIBE", url, admin, ""); code != 403 {
+		t.Fatalf("expect talk of admin forbidden, got %d", code)
+	}
+	talker := map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("talker:secret")),
+		"Require":       RequireBackchannel,
+	}
+	play = dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, talker, ""); code != 200 || !strings.Contains(play.body, "sendonly") {
+		t.Fatalf("expect backchannel described to talker, got %d %q", code, play.body)
+	}
+	talker["Transport"] = "RTP/AVP/TCP;unicast;interleaved=0-1"
+	if code, _ := play.request("SETUP", url+"/trackID=2", talker, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+}
+
+func TestBackchannelSRTP(t *testing.T) {
+	cfg := config.GlobalConfig()
+	backchannel, srtp := cfg.RTSP.Backchannel, cfg.RTSP.Srtp
+	t.Cleanup(func() { cfg.RTSP.Backchannel, cfg.RTSP.Srtp = backchannel, srtp })
+	cfg.RTSP.Backchannel.Enable = true
+	cfg.RTSP.Srtp.Enable = true
+	cfg.RTSP.Srtp.Suite = config.SRTPSuiteAES128SHA1_80
+
+	s := newTestServer(t)
+	r := replayCamera(t, "door-station.rtsp")
+	client, err := NewRTSPClient(s, fmt.Sprintf("rtsp://%s/onvif/media", r.addr()), 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher := NewClientPusher(client)
+	if err := client.Start(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	s.AddPusher(pusher)
+	defer client.Stop()
+	url := fmt.Sprintf("rtsp://%s/onvif/media", s.Addr())
+
+	// player of RTP/SAVP talks with key offered for backchannel
+	require := map[string]string{"Require": RequireBackchannel}
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, require, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	described, err := ParseSDP(play.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key *srtpKey
+	for _, media := range described.Media {
+		if _, ok := attribute(media.Attributes, "sendonly"); ok {
+			key, err = media.srtpKey()
+		}
+	}
+	if key == nil || err != nil {
+		t.Fatalf("expect key of backchannel offered, got %q %v", play.body, err)
+	}
+	playRTP, playRTCP := listenTestUDP(t), listenTestUDP(t)
+	transport := fmt.Sprintf("RTP/SAVP;unicast;client_port=%d-%d", playRTP.LocalAddr().(*net.UDPAddr).Port, playRTCP.LocalAddr().(*net.UDPAddr).Port)
+	code, header := play.request("SETUP", url+"/trackID=2", map[string]string{"Transport": transport, "Require": RequireBackchannel}, "")
+	matches := regexp.MustCompile(`server_port=(\d+)-(\d+)`).FindStringSubmatch(header["Transport"])
+	if code != 200 || matches == nil {
+		t.Fatalf("setup failed: %d %v", code, header)
+	}
+	if code, _ := play.request("PLAY", url, require, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	port, _ := strconv.Atoi(matches[1])
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+
+	// SRTP of player unprotected for camera, packets unauthenticated dropped
+	encrypt, _ := newSRTPContext(key)
+	for _, seq := range []int{1, 2} {
+		pack := copyRTPPack(2, RtpTypeAudio, testRTP(0, seq, 0xd5))
+		protected, _ := encrypt.protect(pack)
+		pack.Release()
+		data := append([]byte{}, protected.Bytes()...)
+		protected.Release()
+		if seq == 1 {
+			data[12] ^= 1
+		}
+		if _, err := playRTP.WriteToUDP(data, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "talk of player", func() bool {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return len(r.received) == 1
+	})
+	time.Sleep(100 * time.Millisecond)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if expect := fmt.Sprintf("$ 4 %x", testRTP(0, 2, 0xd5)); len(r.received) != 1 || r.received[0] != expect {
+		t.Fatalf("expect %s, got %v", expect, r.received)
+	}
+}
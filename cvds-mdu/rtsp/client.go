@@ -3,29 +3,28 @@ package rtsp
 import (
 	"bufio"
 	"bytes"
-	"crypto/md5"
-	"encoding/binary"
 	"fmt"
 	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/common/errors"
 	"github.com/CVDS2020/CVDS2020/common/log"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
-	"io"
 	"net"
 	urlpkg "net/url"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teris-io/shortid"
-
-	"github.com/pixelbender/go-sdp/sdp"
 )
 
+// maxClientRedirects is the max redirects followed by client
+const maxClientRedirects = 5
+
 type Client struct {
 	Server               *Server
 	logger               *log.Logger
-	Stopped              bool
 	Status               string
 	URL                  string
 	Path                 string
@@ -35,32 +34,53 @@ type Client struct {
 	Session              string
 	Seq                  int
 	connRW               *bufio.ReadWriter
-	InBytes              int
-	OutBytes             int
+	connWLock            sync.Mutex
+	InBytes              int64
+	OutBytes             int64
 	TransType            TransType
 	StartAt              time.Time
-	Sdp                  *sdp.Session
-	AControl             string
-	VControl             string
-	ACodec               string
-	VCodec               string
+	SDP                  *SDP
 	OptionIntervalMillis int64
 	SDPRaw               string
 
 	lastRtpSN uint16
-
-	Agent    string
-	authLine string
+	// 1 if stopped, stopped once by keepalives, transport switching and
+	// players of backchannel
+	stopped uint32
+	// writes queued to write together, guarded by connWLock
+	writes *clientWrites
+
+	Agent string
+	// credentials of user info of URL answering challenges of server
+	auth clientAuth
+	// extra headers of requests
+	Headers map[string]string
+	// ONVIF backchannel required by DESCRIBE, SETUP and PLAY, cleared if
+	// server does not support
+	Backchannel bool
+	// quirks of camera pulled, nil if none
+	Profile *config.RtspClientProfile
+
+	// aggregate control URL of session requested by PLAY and keepalives
+	controlURL string
+	// request keeping session alive, OPTIONS or GET_PARAMETER if server
+	// supports
+	keepaliveMethod string
+	// reader of responses and interleaved packets
+	reader *FrameReader
+	// state of transport selected automatically, nil if TransType is not
+	// TransTypeAuto at start
+	auto *autoTransport
 
 	//tcp channels
-	aRTPChannel        int
-	aRTPControlChannel int
-	vRTPChannel        int
-	vRTPControlChannel int
+	channels interleavedChannels
 
 	UDPServer   *UDPServer
 	RTPHandles  []func(*RTPPack)
 	StopHandles []func()
+	// called with track of RTP lost by jitter buffer, before packets after
+	// the gap handled
+	GapHandles []func(track int)
 }
 
 func (client *Client) String() string {
@@ -74,429 +94,471 @@ func NewRTSPClient(server *Server, rawUrl string, sendOptionMillis int64, agent
 	}
 	client = &Client{
 		Server:               server,
-		Stopped:              false,
 		URL:                  rawUrl,
 		ID:                   shortid.MustGenerate(),
 		Path:                 url.Path,
 		TransType:            TransTypeTcp,
-		vRTPChannel:          0,
-		vRTPControlChannel:   1,
-		aRTPChannel:          2,
-		aRTPControlChannel:   3,
 		OptionIntervalMillis: sendOptionMillis,
 		StartAt:              time.Now(),
 		Agent:                agent,
 	}
+	if url.User != nil {
+		client.auth.username = url.User.Username()
+		client.auth.password, _ = url.User.Password()
+	}
+	client.Profile = config.RtspConfig().ClientProfile("", url.Hostname())
+	client.Backchannel = config.RtspConfig().Backchannel.Enable
 	client.logger = assert.Must(config.LogConfig().Build("rtsp.client"))
 	return
 }
 
-func DigestAuth(authLine string, method string, URL string) (string, error) {
-	l, err := urlpkg.Parse(URL)
+// requestURL returns URL of client without user info
+func (client *Client) requestURL() string {
+	l, err := urlpkg.Parse(client.URL)
 	if err != nil {
-		return "", fmt.Errorf("url parse error:%s,%v", URL, err)
-	}
-	realm := ""
-	nonce := ""
-	realmRex := regexp.MustCompile(`realm="(.*?)"`)
-	result1 := realmRex.FindStringSubmatch(authLine)
-
-	nonceRex := regexp.MustCompile(`nonce="(.*?)"`)
-	result2 := nonceRex.FindStringSubmatch(authLine)
-
-	if len(result1) == 2 {
-		realm = result1[1]
-	} else {
-		return "", fmt.Errorf("auth error : no realm found")
-	}
-	if len(result2) == 2 {
-		nonce = result2[1]
-	} else {
-		return "", fmt.Errorf("auth error : no nonce found")
+		return client.URL
 	}
-	// response= md5(md5(username:realm:password):nonce:md5(public_method:url));
-	username := l.User.Username()
-	password, _ := l.User.Password()
 	l.User = nil
-	if l.Port() == "" {
-		l.Host = fmt.Sprintf("%s:%s", l.Host, "554")
-	}
-	md5UserRealmPwd := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, password))))
-	md5MethodURL := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s", method, l.String()))))
-
-	response := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", md5UserRealmPwd, nonce, md5MethodURL))))
-	Authorization := fmt.Sprintf("Digest username=\"%s\", realm=\"%s\", nonce=\"%s\", uri=\"%s\", response=\"%s\"", username, realm, nonce, l.String(), response)
-	return Authorization, nil
+	return l.String()
 }
 
-func (client *Client) checkAuth(method string, resp *Response) (string, error) {
-	if resp.StatusCode == 401 {
-
-		// need auth.
-		AuthHeaders := resp.Header["WWW-Authenticate"]
-		auths, ok := AuthHeaders.([]string)
-
-		if ok {
-			for _, authLine := range auths {
-
-				if strings.IndexAny(authLine, "Digest") == 0 {
-					// 					realm="HipcamRealServer",
-					// nonce="3b27a446bfa49b0c48c3edb83139543d"
-					client.authLine = authLine
-					return DigestAuth(authLine, method, client.URL)
-				} else if strings.IndexAny(authLine, "Basic") == 0 {
-					// not support yet
-					// TODO..
-				}
-
-			}
-			return "", fmt.Errorf("auth error")
-		} else {
-			authLine, _ := AuthHeaders.(string)
-			if strings.IndexAny(authLine, "Digest") == 0 {
-				client.authLine = authLine
-				return DigestAuth(authLine, method, client.URL)
-			} else if strings.IndexAny(authLine, "Basic") == 0 {
-				// not support yet
-				// TODO..
-				return "", fmt.Errorf("not support Basic auth yet")
-			}
-		}
-	}
-	return "", nil
-}
-
-func (client *Client) requestStream(timeout time.Duration) (err error) {
-	defer func() {
-		if err != nil {
-			client.Status = "Error"
-		} else {
-			client.Status = "OK"
-		}
-	}()
+// connect connects server of URL, and requests OPTIONS and DESCRIBE. The
+// response of DESCRIBE, or redirecting response of OPTIONS is returned
+func (client *Client) connect(timeout time.Duration) (*Response, error) {
 	l, err := urlpkg.Parse(client.URL)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if strings.ToLower(l.Scheme) != "rtsp" {
-		err = fmt.Errorf("RTSP url is invalid")
-		return err
+		return nil, fmt.Errorf("RTSP url is invalid")
 	}
 	if strings.ToLower(l.Hostname()) == "" {
-		err = fmt.Errorf("RTSP url is invalid")
-		return err
+		return nil, fmt.Errorf("RTSP url is invalid")
 	}
 	port := l.Port()
 	if len(port) == 0 {
 		port = "554"
 	}
-	conn, err := net.DialTimeout("tcp", l.Hostname()+":"+port, timeout)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(l.Hostname(), port), timeout)
 	if err != nil {
 		// handle error
-		return err
+		return nil, err
 	}
 
-	timeoutConn := RichConn{
-		conn,
-		timeout,
-	}
-	client.Conn = &timeoutConn
+	timeoutConn := NewRichConn(conn, timeout, config.RtspConfig().WriteTimeout)
+	client.connWLock.Lock()
+	client.Conn = timeoutConn
+	client.connWLock.Unlock()
 	client.connRW = bufio.NewReadWriter(
-		bufio.NewReaderSize(&timeoutConn, config.RtspConfig().Client.ReaderSize),
-		bufio.NewWriterSize(&timeoutConn, config.RtspConfig().Client.WriterSize),
+		bufio.NewReaderSize(timeoutConn, config.RtspConfig().Client.ReaderSize),
+		bufio.NewWriterSize(timeoutConn, config.RtspConfig().Client.WriterSize),
 	)
-
-	headers := make(map[string]string)
-	headers["Require"] = "implicit-play"
-	// An OPTIONS request returns the request types the server will accept.
-	resp, err := client.Request("OPTIONS", headers)
-	if err != nil {
-		if resp != nil {
-			Authorization, _ := client.checkAuth("OPTIONS", resp)
-			if len(Authorization) > 0 {
-				headers := make(map[string]string)
-				headers["Require"] = "implicit-play"
-				headers["Authorization"] = Authorization
-				// An OPTIONS request returns the request types the server will accept.
-				resp, err = client.Request("OPTIONS", headers)
-			}
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
+	client.reader = NewFrameReader(client.connRW)
+
+	client.keepaliveMethod = OPTIONS
+	if p := client.Profile; p == nil || !p.SkipOptions {
+		headers := make(map[string]string)
+		headers["Require"] = "implicit-play"
+		// An OPTIONS request returns the request types the server will accept.
+		resp, err := client.Request("OPTIONS", headers)
+		switch {
+		case resp == nil || resp.StatusCode >= 300 && resp.StatusCode < 400:
+			return resp, err
+		case errors.Is(err, AuthFailedError) || errors.Is(err, UnsupportedAuthError):
+			return resp, err
+		case err != nil:
+			// OPTIONS is not required by some cameras, such as those not
+			// supporting Require
+			client.logger.Warn("OPTIONS failed", log.String("client", client.String()), log.Error(err))
+		case strings.Contains(strings.ToUpper(resp.Get("Public")), GET_PARAMETER):
+			client.keepaliveMethod = GET_PARAMETER
 		}
 	}
 
 	// A DESCRIBE request includes an RTSP URL (rtsp://...), and the type of reply data that can be handled. This reply includes the presentation description,
 	// typically in Session Description Protocol (SDP) format. Among other things, the presentation description lists the media streams controlled with the aggregate URL.
 	// In the typical case, there is one media stream each for audio and video.
-	headers = make(map[string]string)
+	headers := make(map[string]string)
 	headers["Accept"] = "application/sdp"
-	resp, err = client.Request("DESCRIBE", headers)
+	resp, err := client.Request("DESCRIBE", headers)
+	if client.Backchannel && resp != nil && resp.StatusCode == 551 {
+		// option not supported, described again without backchannel
+		client.logger.Warn("backchannel unsupported", log.String("client", client.String()))
+		client.Backchannel = false
+		return client.Request("DESCRIBE", map[string]string{"Accept": "application/sdp"})
+	}
+	return resp, err
+}
+
+// redirect closes connection and redirects client to location, credentials
+// are kept of the same host
+func (client *Client) redirect(location string) error {
+	l, err := urlpkg.Parse(location)
 	if err != nil {
-		if resp != nil {
-			authorization, _ := client.checkAuth("DESCRIBE", resp)
-			if len(authorization) > 0 {
-				headers := make(map[string]string)
-				headers["Authorization"] = authorization
-				headers["Accept"] = "application/sdp"
-				resp, err = client.Request("DESCRIBE", headers)
+		return fmt.Errorf("invalid redirect location %s: %v", location, err)
+	}
+	if u, err := urlpkg.Parse(client.URL); err == nil && l.User == nil && strings.EqualFold(u.Hostname(), l.Hostname()) {
+		l.User = u.User
+	}
+	client.logger.Info("client redirected", log.String("client", client.String()), log.String("location", location))
+	client.closeConn()
+	client.URL = l.String()
+	client.auth.lock.Lock()
+	client.auth.challenge = nil
+	client.auth.lock.Unlock()
+	return nil
+}
+
+// closeConn closes connection to server
+func (client *Client) closeConn() {
+	client.connWLock.Lock()
+	if client.Conn != nil {
+		client.Conn.Close()
+		client.Conn = nil
+	}
+	client.connWLock.Unlock()
+	if client.reader != nil {
+		client.reader.Close()
+	}
+}
+
+// baseURL returns base URL of control URLs of DESCRIBE response, which is
+// Content-Base, Content-Location or the URL requested, see RFC 2326 C.1.1
+func (client *Client) baseURL(resp *Response) string {
+	request := client.requestURL()
+	if p := client.Profile; p != nil && p.IgnoreContentBase {
+		return request
+	}
+	for _, key := range []string{"Content-Base", "Content-Location"} {
+		base := resp.Get(key)
+		if base == "" {
+			continue
+		}
+		// Content-Location may be relative
+		if r, err := urlpkg.Parse(request); err == nil {
+			if b, err := r.Parse(base); err == nil {
+				return b.String()
 			}
+		}
+		return base
+	}
+	return request
+}
+
+// controlURL resolves control of session or media against base. Controls
+// relative are appended to base as most cameras expect, even base of query,
+// and absolute ones are of host of URL requested if Content-Base ignored
+func (client *Client) resolveControl(base string, control string) string {
+	lower := strings.ToLower(control)
+	switch {
+	case control == "" || control == "*":
+		return base
+	case strings.HasPrefix(lower, "rtsp://") || strings.HasPrefix(lower, "rtsps://"):
+		if p := client.Profile; p != nil && p.IgnoreContentBase {
+			c, err1 := urlpkg.Parse(control)
+			r, err2 := urlpkg.Parse(client.requestURL())
+			if err1 == nil && err2 == nil {
+				c.Host = r.Host
+				return c.String()
+			}
+		}
+		return control
+	case strings.HasSuffix(base, "/"):
+		return base + strings.TrimLeft(control, "/")
+	}
+	return base + "/" + strings.TrimLeft(control, "/")
+}
+
+func (client *Client) requestStream(timeout time.Duration) (err error) {
+	defer func() {
+		if err != nil {
+			client.Status = "Error"
+		} else {
+			client.Status = "OK"
+		}
+	}()
+	var resp *Response
+	for redirects := 0; ; redirects++ {
+		resp, err = client.connect(timeout)
+		location := ""
+		if resp != nil && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			location = resp.Get("Location")
+		}
+		if location == "" {
 			if err != nil {
 				return err
 			}
-		} else {
+			break
+		}
+		if redirects == maxClientRedirects {
+			return fmt.Errorf("rtsp redirected more than %d times", maxClientRedirects)
+		}
+		if err = client.redirect(location); err != nil {
 			return err
 		}
 	}
-	_sdp, err := sdp.ParseString(resp.Body)
+	_sdp, err := ParseSDP(resp.Body)
 	if err != nil {
 		return err
 	}
-	client.Sdp = _sdp
+	client.SDP = _sdp
 	client.SDPRaw = resp.Body
+	base := client.baseURL(resp)
+	client.controlURL = client.resolveControl(base, _sdp.Control())
 	session := ""
-	for _, media := range _sdp.Media {
-		switch media.Type {
-		case "video":
-			client.VControl = media.Attributes.Get("control")
-			client.VCodec = media.Format[0].Name
-			var _url = ""
-			if strings.Index(strings.ToLower(client.VControl), "rtsp://") == 0 {
-				_url = client.VControl
-			} else {
-				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.VControl, "/")
-			}
-			headers = make(map[string]string)
-			if client.TransType == TransTypeTcp {
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", client.vRTPChannel, client.vRTPControlChannel)
-			} else {
-				if client.UDPServer == nil {
-					client.UDPServer = &UDPServer{Client: client}
-				}
-				//RTP/AVP;unicast;client_port=64864-64865
-				err = client.UDPServer.SetupVideo()
-				if err != nil {
-					client.logger.ErrorWith("Setup video error", err)
-					return err
-				}
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", client.UDPServer.VPort, client.UDPServer.VControlPort)
-				client.Conn.timeout = 0 //	UDP ignore timeout
-			}
-			if session != "" {
-				headers["Session"] = session
-			}
-			client.logger.Debug("Parse DESCRIBE response[VIDEO]",
-				log.String("VControl", client.VControl),
-				log.String("VCodec", client.VCodec),
-				log.String("url", _url),
-				log.String("session", session),
-				log.Int("vRTPChannel", client.vRTPChannel),
-				log.Int("vRTPControlChannel", client.vRTPControlChannel),
+	var sessionTimeout time.Duration
+	for track, media := range _sdp.Media {
+		if media.Direction() == DirectionInactive {
+			continue
+		}
+		control := media.Control()
+		_url := client.resolveControl(base, control)
+		client.logger.Debug("Parse DESCRIBE response",
+			log.Int("track", track),
+			log.String("media", media.Type),
+			log.String("control", control),
+			log.String("codec", media.Codec()),
+			log.String("url", _url),
+			log.String("session", session),
+		)
+		resp, err = client.setup(track, media, _url, session)
+		if errors.Is(err, UnsupportedTransportError) && client.auto != nil && session == "" {
+			// transport preferred refused before any track set up
+			client.logger.Warn("client transport refused",
+				log.String("client", client.String()),
+				log.String("transport", client.TransType.String()),
 			)
-			resp, err = client.RequestWithPath("SETUP", _url, headers, true)
-			if err != nil {
-				return err
-			}
-			session, _ = resp.Header["Session"].(string)
-		case "audio":
-			client.AControl = media.Attributes.Get("control")
-			client.ACodec = media.Format[0].Name
-			var _url = ""
-			if strings.Index(strings.ToLower(client.AControl), "rtsp://") == 0 {
-				_url = client.AControl
-			} else {
-				_url = strings.TrimRight(client.URL, "/") + "/" + strings.TrimLeft(client.AControl, "/")
-			}
-			headers = make(map[string]string)
-			if client.TransType == TransTypeTcp {
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", client.aRTPChannel, client.aRTPControlChannel)
-			} else {
-				if client.UDPServer == nil {
-					client.UDPServer = &UDPServer{Client: client}
-				}
-				err = client.UDPServer.SetupAudio()
-				if err != nil {
-					client.logger.ErrorWith("Setup audio error", err)
-					return err
-				}
-				headers["Transport"] = fmt.Sprintf("RTP/AVP/UDP;unicast;client_port=%d-%d", client.UDPServer.APort, client.UDPServer.AControlPort)
-				client.Conn.timeout = 0 //	UDP ignore timeout
-			}
-			if session != "" {
-				headers["Session"] = session
+			if client.UDPServer != nil {
+				client.UDPServer.Stop()
+				client.UDPServer = nil
 			}
-			client.logger.Debug("Parse DESCRIBE response[AUDIO]",
-				log.String("AControl", client.AControl),
-				log.String("ACodec", client.ACodec),
-				log.String("url", _url),
-				log.String("session", session),
-				log.Int("aRTPChannel", client.aRTPChannel),
-				log.Int("aRTPControlChannel", client.aRTPControlChannel),
-			)
-			resp, err = client.RequestWithPath("SETUP", _url, headers, true)
-			if err != nil {
-				return err
-			}
-			session, _ = resp.Header["Session"].(string)
+			client.TransType = client.otherTransType()
+			resp, err = client.setup(track, media, _url, session)
+		}
+		if err != nil {
+			return err
+		}
+		session, sessionTimeout = parseSession(resp.Get("Session"))
+	}
+	client.Session = session
+	if client.OptionIntervalMillis == 0 {
+		switch p := client.Profile; {
+		case p != nil && p.KeepaliveInterval > 0:
+			client.OptionIntervalMillis = p.KeepaliveInterval.Milliseconds()
+		case sessionTimeout > 0:
+			// keep session alive in half of the timeout advertised
+			client.OptionIntervalMillis = sessionTimeout.Milliseconds() / 2
+		default:
+			// half of the default timeout of RFC 2326 12.37
+			client.OptionIntervalMillis = 30 * 1000
 		}
 	}
-	headers = make(map[string]string)
+	headers := make(map[string]string)
 	if session != "" {
 		headers["Session"] = session
 	}
-	resp, err = client.Request("PLAY", headers)
-	if err != nil {
+	if p := client.Profile; p != nil && p.PlayRange {
+		headers["Range"] = "npt=0.000-"
+	}
+	// tracks are played together by aggregate control URL
+	if _, err = client.RequestWithPath("PLAY", client.controlURL, headers, true); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (client *Client) startStream() {
-	startTime := time.Now()
-	loggerTime := time.Now().Add(-10 * time.Second)
-	defer client.Stop()
-	for !client.Stopped {
-		if client.OptionIntervalMillis > 0 {
-			if time.Since(startTime) > time.Duration(client.OptionIntervalMillis)*time.Millisecond {
-				startTime = time.Now()
-				headers := make(map[string]string)
-				headers["Require"] = "implicit-play"
-				// An OPTIONS request returns the request types the server will accept.
-				if err := client.RequestNoResp("OPTIONS", headers); err != nil {
-					// ignore...
-				}
+// setup requests SETUP of track with transport of client, error of
+// UnsupportedTransportError returned if server refuses the transport
+func (client *Client) setup(track int, media *SDPMedia, url string, session string) (*Response, error) {
+	headers := make(map[string]string)
+	rtpChannel, rtcpChannel := 2*track, 2*track+1
+	if client.TransType == TransTypeTcp {
+		headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", rtpChannel, rtcpChannel)
+	} else {
+		if client.UDPServer == nil {
+			client.UDPServer = &UDPServer{Client: client}
+		}
+		// RTP/SAVP set up for media secured by key of a=crypto
+		profile, key := "RTP/AVP", (*srtpKey)(nil)
+		if media.Secured() {
+			if k, err := media.srtpKey(); k != nil {
+				profile, key = "RTP/SAVP", k
+			} else if err != nil {
+				client.logger.Warn("srtp of media unsupported", log.Int("track", track), log.Error(err))
 			}
 		}
-		b, err := client.connRW.ReadByte()
+		//RTP/AVP;unicast;client_port=64864-64865
+		t, err := client.UDPServer.SetupTrack(track, media, key)
 		if err != nil {
-			if !client.Stopped {
-				client.logger.ErrorWith("client connection read byte error", err)
+			client.logger.ErrorWith("Setup track error", err, log.Int("track", track), log.String("media", media.Type))
+			return nil, err
+		}
+		headers["Transport"] = fmt.Sprintf("%s/UDP;unicast;client_port=%d-%d", profile, t.Port, t.ControlPort)
+		client.Conn.timeout = 0 //	UDP ignore timeout
+	}
+	if session != "" {
+		headers["Session"] = session
+	}
+	resp, err := client.RequestWithPath("SETUP", url, headers, true)
+	if err != nil {
+		if resp != nil && resp.StatusCode == 461 {
+			return resp, fmt.Errorf("%w: %s", UnsupportedTransportError, headers["Transport"])
+		}
+		return resp, err
+	}
+	if client.TransType == TransTypeUdp {
+		// NACKs of RTP lost sent to RTCP port of server, and backchannel
+		// audio to RTP port
+		addr, ok := client.Conn.RemoteAddr().(*net.TCPAddr)
+		if matches := serverPortRegexp.FindStringSubmatch(resp.Get("Transport")); ok && matches != nil {
+			port, controlPort := parsePortRange(matches)
+			client.UDPServer.SetSource(track, &net.UDPAddr{IP: addr.IP, Port: port}, &net.UDPAddr{IP: addr.IP, Port: controlPort})
+		}
+	}
+	if client.TransType == TransTypeTcp {
+		// server may choose other channels
+		if matches := interleavedRegexp.FindStringSubmatch(resp.Get("Transport")); matches != nil {
+			rtpChannel, rtcpChannel = parsePortRange(matches)
+		}
+		client.channels.set(track, media, rtpChannel, rtcpChannel)
+	}
+	return resp, nil
+}
+
+// parseSession parses Session header of response, which is session id and
+// optional timeout in seconds, such as "12345678;timeout=60"
+func parseSession(header string) (id string, timeout time.Duration) {
+	params := strings.Split(header, ";")
+	id = strings.TrimSpace(params[0])
+	for _, param := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "timeout") {
+			if seconds, err := strconv.Atoi(strings.TrimSpace(kv[1])); err == nil && seconds > 0 {
+				timeout = time.Duration(seconds) * time.Second
 			}
+		}
+	}
+	return
+}
+
+// keepaliveRequest returns method of keepalive requests, which is of client
+// profile, or GET_PARAMETER if server supports, or OPTIONS
+func (client *Client) keepaliveRequest() string {
+	if p := client.Profile; p != nil {
+		switch p.Keepalive {
+		case config.KeepaliveOptions:
+			return OPTIONS
+		case config.KeepaliveGetParameter:
+			return GET_PARAMETER
+		case config.KeepaliveSetParameter:
+			return SET_PARAMETER
+		}
+	}
+	return client.keepaliveMethod
+}
+
+// keepalive sends keepalive request of method to url every option interval
+// until stream of done stopped, which keeps session of server alive with UDP
+// transport as well
+func (client *Client) keepalive(done chan struct{}, method string, url string) {
+	ticker := time.NewTicker(time.Duration(client.OptionIntervalMillis) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
 			return
+		case <-ticker.C:
 		}
-		switch b {
-		case 0x24: // rtp
-			header := make([]byte, 4)
-			header[0] = b
-			_, err := io.ReadFull(client.connRW, header[1:])
-			if err != nil {
+		if client.Stopped() {
+			return
+		}
+		headers := make(map[string]string)
+		if method == OPTIONS {
+			headers["Require"] = "implicit-play"
+		}
+		// responses are read by startStream
+		if _, err := client.RequestWithPath(method, url, headers, false); err != nil {
+			return
+		}
+	}
+}
 
-				if !client.Stopped {
-					client.logger.ErrorWith("client connection read full error", err)
-				}
-				return
-			}
-			channel := int(header[1])
-			length := binary.BigEndian.Uint16(header[2:])
-			content := make([]byte, length)
-			_, err = io.ReadFull(client.connRW, content)
-			if err != nil {
-				if !client.Stopped {
-					client.logger.ErrorWith("client connection read full error", err)
-				}
-				return
-			}
-			//ch <- append(header, content...)
-			rtpBuf := bytes.NewBuffer(content)
-			var pack *RTPPack
-			switch channel {
-			case client.aRTPChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeAudio,
-					Buffer: rtpBuf,
-				}
-			case client.aRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeAudioControl,
-					Buffer: rtpBuf,
-				}
-			case client.vRTPChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeVideo,
-					Buffer: rtpBuf,
-				}
-			case client.vRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeVideoControl,
-					Buffer: rtpBuf,
-				}
-			default:
-				client.logger.Warn("unknown rtp pack type", log.Int("channel", channel))
-				continue
+// handleFrame handles interleaved packet of tracks played
+func (client *Client) handleFrame(frame *Frame) {
+	tc, ok := client.channels.lookup(frame.Channel)
+	if !ok {
+		frame.Release()
+		client.logger.Warn("unknown rtp pack channel", log.Int("channel", frame.Channel))
+		return
+	}
+	atomic.AddInt64(&client.InBytes, int64(len(frame.Data)+4))
+	pack := frame.Pack(tc.track, tc.typ)
+
+	if config.RtspConfig().EnableDebug {
+		rtp := ParseRTP(pack.Bytes())
+		if rtp != nil {
+			rtpSN := uint16(rtp.SequenceNumber)
+			if client.lastRtpSN != 0 && client.lastRtpSN+1 != rtpSN {
+				client.logger.Debug("packets lost",
+					log.String("client", client.String()),
+					log.Uint16("lost", rtpSN-client.lastRtpSN),
+					log.Uint16("current SN", rtpSN),
+					log.Uint16("last SN", client.lastRtpSN),
+				)
 			}
+			client.lastRtpSN = rtpSN
+		}
+	}
 
-			if config.RtspConfig().EnableDebug {
-				rtp := ParseRTP(pack.Buffer.Bytes())
-				if rtp != nil {
-					rtpSN := uint16(rtp.SequenceNumber)
-					if client.lastRtpSN != 0 && client.lastRtpSN+1 != rtpSN {
-						client.logger.Debug("packets lost",
-							log.String("client", client.String()),
-							log.Uint16("lost", rtpSN-client.lastRtpSN),
-							log.Uint16("current SN", rtpSN),
-							log.Uint16("last SN", client.lastRtpSN),
-						)
-					}
-					client.lastRtpSN = rtpSN
-				}
-
-				elapsed := time.Now().Sub(loggerTime)
-				if elapsed >= 30*time.Second {
-					client.logger.Debug("client read rtp frame.", log.String("client", client.String()))
-					loggerTime = time.Now()
-				}
-			}
+	client.handleRTP(pack)
+	pack.Release()
+}
 
-			client.InBytes += int(length + 4)
-			for _, h := range client.RTPHandles {
-				h(pack)
-			}
+// handleRTP hands packet of tracks played to RTP handles
+func (client *Client) handleRTP(pack *RTPPack) {
+	client.countRTP(pack)
+	for _, h := range client.RTPHandles {
+		h(pack)
+	}
+}
 
-		default: // rtsp
-			builder := bytes.Buffer{}
-			builder.WriteByte(b)
-			contentLen := 0
-			for !client.Stopped {
-				line, prefix, err := client.connRW.ReadLine()
-				if err != nil {
-					if !client.Stopped {
-						client.logger.ErrorWith("client connection read line error", err)
-					}
-					return
-				}
-				if len(line) == 0 {
-					if contentLen != 0 {
-						content := make([]byte, contentLen)
-						_, err = io.ReadFull(client.connRW, content)
-						if err != nil {
-							if !client.Stopped {
-								err = fmt.Errorf("read content err.ContentLength:%d", contentLen)
-							}
-							return
-						}
-						builder.Write(content)
-					}
-					client.logger.Debug("<<<[IN]\n" + builder.String())
-					break
-				}
-				s := string(line)
-				builder.Write(line)
-				if !prefix {
-					builder.WriteString("\r\n")
-				}
-
-				if strings.Index(s, "Content-Length:") == 0 {
-					splits := strings.Split(s, ":")
-					contentLen, err = strconv.Atoi(strings.TrimSpace(splits[1]))
-					if err != nil {
-						if !client.Stopped {
-							client.logger.ErrorWith("parse Content-Length error", err, log.String("src", splits[1]))
-						}
-						return
-					}
-				}
+// startStream reads packets of tracks played until connection closed, and
+// closes done then. Client is stopped unless transport being switched
+func (client *Client) startStream(done chan struct{}) {
+	loggerTime := time.Now().Add(-10 * time.Second)
+	defer close(done)
+	defer func() {
+		if !client.auto.isSwitching() {
+			client.Stop()
+		}
+	}()
+	reader := client.reader
+	defer reader.Close()
+	if client.OptionIntervalMillis > 0 {
+		go client.keepalive(done, client.keepaliveRequest(), client.controlURL)
+	}
+	for !client.Stopped() {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			if !client.Stopped() && !client.auto.isSwitching() {
+				client.logger.ErrorWith("client connection read frame error", err)
+			}
+			return
+		}
+		if frame.Channel < 0 { // rtsp
+			client.logger.Debug("<<<[IN]\n" + frame.Header + frame.Body)
+			if client.auto.isSwitching() {
+				// response of TEARDOWN
+				return
+			}
+			continue
+		}
+		client.handleFrame(&frame)
+		if config.RtspConfig().EnableDebug {
+			elapsed := time.Now().Sub(loggerTime)
+			if elapsed >= 30*time.Second {
+				client.logger.Debug("client read rtp frame.", log.String("client", client.String()))
+				loggerTime = time.Now()
 			}
 		}
 	}
@@ -506,180 +568,194 @@ func (client *Client) Start(timeout time.Duration) (err error) {
 	if timeout == 0 {
 		timeout = config.RtspConfig().Client.Timeout
 	}
+	if client.TransType == TransTypeAuto {
+		return client.startAuto(timeout)
+	}
 	err = client.requestStream(timeout)
 	if err != nil {
 		return
 	}
-	go client.startStream()
+	go client.startStream(make(chan struct{}))
 	return
 }
 
+// Stopped reports whether client stopped
+func (client *Client) Stopped() bool {
+	return atomic.LoadUint32(&client.stopped) == 1
+}
+
 func (client *Client) Stop() {
-	if client.Stopped {
+	if atomic.SwapUint32(&client.stopped, 1) == 1 {
 		return
 	}
-	client.Stopped = true
 	for _, h := range client.StopHandles {
 		h()
 	}
+	client.connWLock.Lock()
 	if client.Conn != nil {
-		client.connRW.Flush()
 		client.Conn.Close()
 		client.Conn = nil
 	}
+	client.connWLock.Unlock()
 	if client.UDPServer != nil {
 		client.UDPServer.Stop()
 		client.UDPServer = nil
 	}
 }
 
+// RequestWithPath sends request of method to path. Requests challenged by
+// server are answered with credentials of URL and sent again, and so are
+// requests of a stale nonce
 func (client *Client) RequestWithPath(method string, path string, headers map[string]string, needResp bool) (resp *Response, err error) {
+	// at most a challenge of the first request and another of stale nonce
+	for i := 0; i < 3; i++ {
+		if authorization := client.auth.authorization(method, path); authorization != "" {
+			headers["Authorization"] = authorization
+		}
+		resp, err = client.request(method, path, headers, needResp)
+		if err == nil || resp == nil || resp.StatusCode != 401 {
+			return
+		}
+		_, rejected := headers["Authorization"]
+		if authErr := client.auth.answer(resp.Values("WWW-Authenticate"), rejected); authErr != nil {
+			client.logger.ErrorWith("rtsp authentication error", authErr, log.String("client", client.String()), log.String("method", method))
+			return resp, authErr
+		}
+	}
+	return
+}
+
+func (client *Client) request(method string, path string, headers map[string]string, needResp bool) (resp *Response, err error) {
 	logger := client.logger
 	headers["User-Agent"] = client.Agent
-	if len(headers["Authorization"]) == 0 {
-		if len(client.authLine) != 0 {
-			Authorization, _ := DigestAuth(client.authLine, method, client.URL)
-			if len(Authorization) > 0 {
-				headers["Authorization"] = Authorization
+	if len(client.Session) > 0 {
+		headers["Session"] = client.Session
+	}
+	for k, v := range client.Headers {
+		if _, ok := headers[k]; !ok {
+			headers[k] = v
+		}
+	}
+	if p := client.Profile; p != nil {
+		if p.UserAgent != "" {
+			headers["User-Agent"] = p.UserAgent
+		}
+		for k, v := range p.Headers {
+			if _, ok := headers[k]; !ok {
+				headers[k] = v
 			}
 		}
 	}
-	if len(client.Session) > 0 {
-		headers["Session"] = client.Session
+	if _, ok := headers["Require"]; !ok && client.Backchannel && (method == "DESCRIBE" || method == "SETUP" || method == "PLAY") {
+		headers["Require"] = RequireBackchannel
 	}
+	client.connWLock.Lock()
 	client.Seq++
 	cseq := client.Seq
+	client.connWLock.Unlock()
 	builder := bytes.Buffer{}
 	builder.WriteString(fmt.Sprintf("%s %s RTSP/1.0\r\n", method, path))
 	builder.WriteString(fmt.Sprintf("CSeq: %d\r\n", cseq))
 	for k, v := range headers {
 		builder.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
 	}
-	builder.WriteString(fmt.Sprintf("\r\n"))
-	s := builder.String()
-	logger.Debug("[OUT]>>>\n" + s)
-	_, err = client.connRW.WriteString(s)
-	if err != nil {
+	builder.WriteString("\r\n")
+	logger.Debug("[OUT]>>>\n" + builder.String())
+	if err = client.write(builder.Bytes()); err != nil {
 		return
 	}
-	client.connRW.Flush()
 
 	if !needResp {
 		return nil, nil
 	}
-	lineCount := 0
-	statusCode := 200
-	status := ""
-	sid := ""
-	contentLen := 0
-	respHeader := make(map[string]interface{})
-	var line []byte
-	builder.Reset()
-	for !client.Stopped {
-		isPrefix := false
-		if line, isPrefix, err = client.connRW.ReadLine(); err != nil {
+	for !client.Stopped() {
+		var frame Frame
+		if frame, err = client.reader.ReadFrame(); err != nil {
 			return
 		}
-		s := string(line)
-		builder.Write(line)
-		if !isPrefix {
-			builder.WriteString("\r\n")
-		}
-		if len(line) == 0 {
-			body := ""
-			if contentLen > 0 {
-				content := make([]byte, contentLen)
-				_, err = io.ReadFull(client.connRW, content)
-				if err != nil {
-					err = fmt.Errorf("Read content err.ContentLength:%d", contentLen)
-					return
-				}
-				body = string(content)
-				builder.Write(content)
-			}
-			resp = NewResponse(statusCode, status, strconv.Itoa(cseq), sid, body)
-			resp.Header = respHeader
-			logger.Debug("<<<[IN]\n" + builder.String())
-
-			if !(statusCode >= 200 && statusCode <= 300) {
-				err = fmt.Errorf("Response StatusCode is :%d", statusCode)
-				return
-			}
+		if frame.Channel >= 0 {
+			// packets of tracks played may arrive before response of PLAY
+			client.handleFrame(&frame)
+			continue
+		}
+		logger.Debug("<<<[IN]\n" + frame.Header + frame.Body)
+		if !strings.HasPrefix(frame.Header, RTSP_VERSION) {
+			// requests of server are not supported
+			continue
+		}
+		if resp, err = ParseResponse(frame.Header, frame.Body); err != nil {
 			return
 		}
-		if lineCount == 0 {
-			splits := strings.Split(s, " ")
-			if len(splits) < 3 {
-				err = fmt.Errorf("StatusCode Line error:%s", s)
-				return
-			}
-			statusCode, err = strconv.Atoi(splits[1])
-			if err != nil {
-				return
-			}
-			status = splits[2]
-		}
-		lineCount++
-		splits := strings.Split(s, ":")
-		if len(splits) == 2 {
-			if val, ok := respHeader[splits[0]]; ok {
-				if slice, ok2 := val.([]string); ok2 {
-					slice = append(slice, strings.TrimSpace(splits[1]))
-					respHeader[splits[0]] = slice
-				} else {
-					str, _ := val.(string)
-					slice := []string{str, strings.TrimSpace(splits[1])}
-					respHeader[splits[0]] = slice
-				}
-			} else {
-				respHeader[splits[0]] = strings.TrimSpace(splits[1])
-			}
+		// responses of requests not waiting for response
+		if seq, err := strconv.Atoi(resp.Get("CSeq")); err == nil && seq < cseq {
+			continue
 		}
-		if strings.Index(s, "Session:") == 0 {
-			splits := strings.Split(s, ":")
-			sid = strings.TrimSpace(splits[1])
-		}
-		//if strings.Index(s, "CSeq:") == 0 {
-		//	splits := strings.Split(s, ":")
-		//	cseq, err = strconv.Atoi(strings.TrimSpace(splits[1]))
-		//	if err != nil {
-		//		err = fmt.Errorf("Atoi CSeq err. line:%s", s)
-		//		return
-		//	}
-		//}
-		if strings.Index(strings.ToLower(s), "content-length:") == 0 {
-			splits := strings.Split(s, ":")
-			contentLen, err = strconv.Atoi(strings.TrimSpace(splits[1]))
-			if err != nil {
-				return
-			}
+		if !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+			err = fmt.Errorf("Response StatusCode is :%d", resp.StatusCode)
 		}
+		return
+	}
+	return nil, fmt.Errorf("Client Stopped.")
+}
+
+// clientWrites is writes of client queued within write latency, written
+// together in one vectored write
+type clientWrites struct {
+	buffers net.Buffers
+	done    chan struct{}
+	err     error
+}
 
+// write writes b to connection with write deadline. Writes of requests,
+// keepalives and backchannel packets of different goroutines within write
+// latency of players are queued and written together in one vectored
+// write, b is written or failed when write returns
+func (client *Client) write(b []byte) error {
+	cfg := config.RtspConfig().Player
+	client.connWLock.Lock()
+	w := client.writes
+	first := w == nil
+	if first {
+		w = &clientWrites{done: make(chan struct{})}
+		client.writes = w
+	}
+	w.buffers = append(w.buffers, b)
+	if cfg.WriteLatency <= 0 || len(w.buffers) >= cfg.WriteBatch {
+		client.flushWrites(w)
+		client.connWLock.Unlock()
+		return w.err
+	}
+	client.connWLock.Unlock()
+	if first {
+		time.Sleep(cfg.WriteLatency)
+		client.connWLock.Lock()
+		// flushed already if batch full
+		if client.writes == w {
+			client.flushWrites(w)
+		}
+		client.connWLock.Unlock()
 	}
-	if client.Stopped {
-		err = fmt.Errorf("Client Stopped.")
+	<-w.done
+	return w.err
+}
+
+// flushWrites writes writes queued w, connWLock must be held
+func (client *Client) flushWrites(w *clientWrites) {
+	client.writes = nil
+	if client.Conn == nil {
+		w.err = fmt.Errorf("client connection closed")
+	} else {
+		_, w.err = client.Conn.WriteBuffers(&w.buffers)
 	}
-	return
+	close(w.done)
 }
 
 func (client *Client) Request(method string, headers map[string]string) (*Response, error) {
-	l, err := urlpkg.Parse(client.URL)
-	if err != nil {
-		return nil, fmt.Errorf("Url parse error:%v", err)
-	}
-	l.User = nil
-	return client.RequestWithPath(method, l.String(), headers, true)
+	return client.RequestWithPath(method, client.requestURL(), headers, true)
 }
 
 func (client *Client) RequestNoResp(method string, headers map[string]string) (err error) {
-	var (
-		l *urlpkg.URL
-	)
-	if l, err = urlpkg.Parse(client.URL); err != nil {
-		return fmt.Errorf("Url parse error:%v", err)
-	}
-	l.User = nil
-	if _, err = client.RequestWithPath(method, l.String(), headers, false); err != nil {
+	if _, err = client.RequestWithPath(method, client.requestURL(), headers, false); err != nil {
 		return err
 	}
 	return nil
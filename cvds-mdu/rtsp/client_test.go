@@ -0,0 +1,371 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cameraExchange is a request expected of conversation fixture and actions
+// replied to it
+type cameraExchange struct {
+	request string
+	// headers the request contains, values are matched by prefix
+	headers []string
+	// responses of lines, interleaved packets of "$ <channel> <hex>", or
+	// "! close"
+	actions []string
+}
+
+// cameraReplay replays conversation fixture of testdata/cameras as camera,
+// see the head of hikvision.rtsp for the format
+type cameraReplay struct {
+	listener  net.Listener
+	exchanges []*cameraExchange
+
+	lock   sync.Mutex
+	next   int
+	errors []string
+	done   chan struct{}
+	// interleaved packets received of "$ <channel> <hex>"
+	received []string
+}
+
+func loadCameraFixture(t *testing.T, name string) []*cameraExchange {
+	data, err := os.ReadFile("testdata/cameras/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exchanges []*cameraExchange
+	var response []string
+	flush := func() {
+		if len(response) > 0 {
+			e := exchanges[len(exchanges)-1]
+			e.actions = append(e.actions, strings.Join(response, "\n"))
+			response = nil
+		}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "> "):
+			if e := len(exchanges); e > 0 && (len(response) > 0 || len(exchanges[e-1].actions) > 0) || e == 0 {
+				flush()
+				exchanges = append(exchanges, &cameraExchange{request: line[2:]})
+				continue
+			}
+			e := exchanges[len(exchanges)-1]
+			e.headers = append(e.headers, line[2:])
+		case line == "<" || strings.HasPrefix(line, "< "):
+			response = append(response, strings.TrimPrefix(strings.TrimPrefix(line, "<"), " "))
+		case strings.HasPrefix(line, "$ ") || line == "! close":
+			flush()
+			e := exchanges[len(exchanges)-1]
+			e.actions = append(e.actions, line)
+		}
+	}
+	flush()
+	return exchanges
+}
+
+func replayCamera(t *testing.T, name string) *cameraReplay {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &cameraReplay{listener: listener, exchanges: loadCameraFixture(t, name), done: make(chan struct{})}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *cameraReplay) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *cameraReplay) errorf(format string, args ...interface{}) {
+	r.lock.Lock()
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+	r.lock.Unlock()
+}
+
+// readRequest reads request line and headers of lower case names
+func readCameraRequest(rw *bufio.ReadWriter) (string, map[string]string, error) {
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	header := make(map[string]string)
+	for {
+		h, err := rw.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		if h = strings.TrimSpace(h); h == "" {
+			break
+		}
+		if kv := strings.SplitN(h, ":", 2); len(kv) == 2 {
+			header[strings.ToLower(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	if n, _ := strconv.Atoi(header["content-length"]); n > 0 {
+		io.ReadFull(rw, make([]byte, n))
+	}
+	return strings.TrimSpace(line), header, nil
+}
+
+func (r *cameraReplay) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	replace := strings.NewReplacer("{addr}", r.addr())
+	for {
+		if b, err := rw.Peek(4); err == nil && b[0] == '$' {
+			pkt := make([]byte, 4+(int(b[2])<<8|int(b[3])))
+			if _, err := io.ReadFull(rw, pkt); err != nil {
+				return
+			}
+			r.lock.Lock()
+			r.received = append(r.received, fmt.Sprintf("$ %d %x", pkt[1], pkt[4:]))
+			r.lock.Unlock()
+			continue
+		}
+		line, header, err := readCameraRequest(rw)
+		if err != nil {
+			return
+		}
+		r.lock.Lock()
+		if r.next == len(r.exchanges) {
+			// requests after conversation are not replied
+			r.lock.Unlock()
+			continue
+		}
+		e := r.exchanges[r.next]
+		r.lock.Unlock()
+		if expect := replace.Replace(e.request) + " RTSP/1.0"; line != expect {
+			r.errorf("exchange %d: expect %s, got %s", r.next, expect, line)
+			return
+		}
+		for _, h := range e.headers {
+			kv := strings.SplitN(replace.Replace(h), ":", 2)
+			if value := header[strings.ToLower(kv[0])]; !strings.HasPrefix(value, strings.TrimSpace(kv[1])) {
+				r.errorf("exchange %d: %s expect %s, got %s", r.next, line, h, value)
+			}
+		}
+		cseq := strings.NewReplacer("{addr}", r.addr(), "{cseq}", header["cseq"])
+		for _, action := range e.actions {
+			switch {
+			case action == "! close":
+				rw.Flush()
+				conn.Close()
+			case strings.HasPrefix(action, "$ "):
+				fields := strings.Fields(action)
+				channel, _ := strconv.Atoi(fields[1])
+				pkt, _ := hex.DecodeString(fields[2])
+				rw.Write([]byte{'$', byte(channel), byte(len(pkt) >> 8), byte(len(pkt))})
+				rw.Write(pkt)
+			default:
+				head, body, _ := strings.Cut(cseq.Replace(action), "\n\n")
+				head = strings.ReplaceAll(head, "\n", "\r\n")
+				if body != "" {
+					body = strings.ReplaceAll(body, "\n", "\r\n") + "\r\n"
+					head += fmt.Sprintf("\r\nContent-Length: %d", len(body))
+				}
+				rw.WriteString(head + "\r\n\r\n" + body)
+			}
+		}
+		rw.Flush()
+		r.lock.Lock()
+		if r.next++; r.next == len(r.exchanges) {
+			close(r.done)
+		}
+		r.lock.Unlock()
+	}
+}
+
+func TestClientCameras(t *testing.T) {
+	for _, test := range []struct {
+		fixture string
+		path    string
+		profile *config.RtspClientProfile
+		// packets of tracks expected
+		packets map[int]int
+	}{
+		{"hikvision.rtsp", "/Streaming/Channels/101", nil, map[int]int{0: 3, 1: 1}},
+		{"dahua.rtsp", "/cam/realmonitor?channel=1&subtype=0", nil, map[int]int{0: 1, 1: 1}},
+		{"nvr-redirect.rtsp", "/live/ch1", nil, map[int]int{0: 1}},
+		{"xiongmai.rtsp", "/user=admin_password=tlJwpbo6_channel=1_stream=0.sdp", &config.RtspClientProfile{
+			Name:              "xiongmai",
+			Keepalive:         config.KeepaliveSetParameter,
+			KeepaliveInterval: 300 * time.Millisecond,
+			SkipOptions:       true,
+			IgnoreContentBase: true,
+			PlayRange:         true,
+			UserAgent:         "LibVLC/3.0.18",
+		}, map[int]int{0: 3}},
+	} {
+		t.Run(test.fixture, func(t *testing.T) {
+			r := replayCamera(t, test.fixture)
+			url := fmt.Sprintf("rtsp://admin:12345@%s%s", r.addr(), test.path)
+			if test.profile != nil {
+				url = fmt.Sprintf("rtsp://%s%s", r.addr(), test.path)
+			}
+			client, err := NewRTSPClient(nil, url, 0, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Profile = test.profile
+			var packets testPackets
+			client.RTPHandles = append(client.RTPHandles, packets.handle)
+			err = client.Start(3 * time.Second)
+			defer client.Stop()
+			select {
+			case <-r.done:
+			case <-time.After(3 * time.Second):
+			}
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			for _, e := range r.errors {
+				t.Error(e)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.next != len(r.exchanges) {
+				t.Fatalf("conversation stopped at exchange %d: %s", r.next, r.exchanges[r.next].request)
+			}
+			for track, n := range test.packets {
+				waitFor(t, "packets", func() bool { return packets.count(track) == n })
+			}
+		})
+	}
+}
+
+func TestClientAutoTransport(t *testing.T) {
+	cfg := config.GlobalConfig()
+	auto := cfg.RTSP.Client.AutoTransport
+	t.Cleanup(func() { cfg.RTSP.Client.AutoTransport = auto })
+	cfg.RTSP.Client.AutoTransport.Prefer = "udp"
+	cfg.RTSP.Client.AutoTransport.Timeout = 300 * time.Millisecond
+	for _, test := range []struct {
+		fixture string
+		packets int
+	}{
+		{"udp-blocked.rtsp", 2},
+		{"udp-refused.rtsp", 1},
+	} {
+		t.Run(test.fixture, func(t *testing.T) {
+			r := replayCamera(t, test.fixture)
+			client, err := NewRTSPClient(nil, fmt.Sprintf("rtsp://%s/live", r.addr()), 0, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.TransType = TransTypeAuto
+			var packets testPackets
+			client.RTPHandles = append(client.RTPHandles, packets.handle)
+			if err := client.Start(3 * time.Second); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Stop()
+			select {
+			case <-r.done:
+			case <-time.After(3 * time.Second):
+			}
+			r.lock.Lock()
+			for _, e := range r.errors {
+				t.Error(e)
+			}
+			if r.next != len(r.exchanges) {
+				t.Fatalf("conversation stopped at exchange %d: %s", r.next, r.exchanges[r.next].request)
+			}
+			r.lock.Unlock()
+			waitFor(t, "packets", func() bool { return packets.count(0) == test.packets })
+			if !client.AutoTransType() || client.TransType != TransTypeTcp || client.Stopped() {
+				t.Fatalf("expect TCP selected and client not stopped, got %v %v", client.TransType, client.Stopped())
+			}
+		})
+	}
+}
+
+func TestAutoTransportLoss(t *testing.T) {
+	a := &autoTransport{tracks: make(map[int]*seqCounter)}
+	// sequence numbers wrapped, 2 lost and 1 reordered
+	for _, seq := range []uint16{65533, 65534, 1, 0, 3, 4} {
+		a.count(0, seq)
+	}
+	a.count(1, 100)
+	if received, expected := a.next(); received != 7 || expected != 9 {
+		t.Fatalf("expect 7 of 9 received, got %d of %d", received, expected)
+	}
+	for seq := uint16(5); seq < 15; seq += 2 {
+		a.count(0, seq)
+	}
+	if received, expected := a.next(); received != 5 || expected != 9 {
+		t.Fatalf("expect 5 of 9 received, got %d of %d", received, expected)
+	}
+	if received, expected := a.next(); received != 0 || expected != 0 {
+		t.Fatalf("expect nothing received, got %d of %d", received, expected)
+	}
+}
+
+func TestClientWrites(t *testing.T) {
+	cfg := config.GlobalConfig()
+	player := cfg.RTSP.Player
+	t.Cleanup(func() { cfg.RTSP.Player = player })
+	cfg.RTSP.Player.WriteLatency = 100 * time.Millisecond
+	cfg.RTSP.Player.WriteBatch = 3
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	client := &Client{Conn: NewRichConn(conn, 0, 0)}
+	received := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(peer)
+		received <- string(b)
+	}()
+
+	// writes within write latency queued together, and written once batch
+	// full
+	errs := make(chan error, 3)
+	for _, b := range []string{"a", "b"} {
+		b := b
+		go func() { errs <- client.write([]byte(b)) }()
+		waitFor(t, "write queued", func() bool {
+			client.connWLock.Lock()
+			defer client.connWLock.Unlock()
+			return client.writes != nil && len(client.writes.buffers) == int(b[0]-'a'+1)
+		})
+	}
+	start := time.Now()
+	if err := client.write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Fatalf("expect batch full written immediately, took %v", elapsed)
+	}
+	conn.Close()
+	if got := <-received; got != "abc" {
+		t.Fatalf("expect writes in order queued, got %q", got)
+	}
+}
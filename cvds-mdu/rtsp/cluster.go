@@ -0,0 +1,333 @@
+package rtsp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NodeState is the load and paths of a MDU node gossiped to peers
+type NodeState struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	Players int `json:"players"`
+	// output bytes per second
+	OutputRate int64 `json:"outputRate"`
+	// ratio of usage to the tightest limit, players if no limits
+	Load float64 `json:"load"`
+	// usage reaches limits, players are redirected
+	Full bool `json:"full"`
+
+	Paths []string `json:"paths"`
+
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (n *NodeState) hasPath(path string) bool {
+	for _, p := range n.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterTagLength is length of HMAC-SHA256 tag appended to gossip signed
+const clusterTagLength = sha256.Size
+
+// Cluster is the view of MDU nodes sharing load and paths by gossip next to
+// pushers of server. Every interval the state of node is sent to all peers
+// in a UDP datagram of JSON, and peers not heard for 3 intervals are removed.
+// Gossip is accepted from addresses of peers only, and signed by HMAC of the
+// secret shared if configured
+type Cluster struct {
+	// config cluster built from, for detecting changes of config reloaded
+	config         config.RtspCluster
+	server         *Server
+	listen         string
+	peers          []*net.UDPAddr
+	advertise      string
+	interval       time.Duration
+	maxPlayers     int
+	maxOutputRate  int64
+	redirectStatus int
+	secret         []byte
+
+	conn *net.UDPConn
+	done chan struct{}
+
+	lock         sync.RWMutex
+	self         NodeState
+	nodes        map[string]*NodeState
+	lastOutBytes int64
+	lastAt       time.Time
+
+	logger *log.Logger
+}
+
+func NewCluster(server *Server, c config.RtspCluster) *Cluster {
+	cluster := &Cluster{
+		config:         c,
+		server:         server,
+		listen:         c.Listen,
+		advertise:      c.Advertise,
+		interval:       c.Interval,
+		maxPlayers:     c.MaxPlayers,
+		maxOutputRate:  c.MaxOutputRate.Int64(),
+		redirectStatus: c.RedirectStatus,
+		nodes:          make(map[string]*NodeState),
+		logger:         assert.Must(config.LogConfig().Build("rtsp.cluster")),
+	}
+	if c.Secret != "" {
+		cluster.secret = []byte(c.Secret)
+	}
+	for _, peer := range c.Peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			cluster.logger.ErrorWith("resolve cluster peer error", err, log.String("peer", peer))
+			continue
+		}
+		cluster.peers = append(cluster.peers, addr)
+	}
+	return cluster
+}
+
+// Start listens gossip of peers and starts gossiping state of node
+func (c *Cluster) Start() error {
+	addr, err := net.ResolveUDPAddr("udp", c.listen)
+	if err != nil {
+		return err
+	}
+	if c.conn, err = net.ListenUDP("udp", addr); err != nil {
+		return err
+	}
+	if c.advertise == "" {
+		c.advertise = c.server.URL("")
+	}
+	c.done = make(chan struct{})
+	c.update()
+	go c.receive()
+	go c.run(c.done)
+	c.logger.Info("cluster start", log.String("listen", c.conn.LocalAddr().String()), log.String("advertise", c.advertise))
+	return nil
+}
+
+func (c *Cluster) Stop() {
+	if c.done == nil {
+		return
+	}
+	close(c.done)
+	c.done = nil
+	c.conn.Close()
+}
+
+// Addr returns gossip listening address
+func (c *Cluster) Addr() *net.UDPAddr {
+	return c.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// run gossips state of node every interval until done closed
+func (c *Cluster) run(done <-chan struct{}) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.gossip()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.update()
+			c.expire()
+		}
+	}
+}
+
+// update calculates state of node from pushers and players of server
+func (c *Cluster) update() {
+	state := NodeState{ID: c.server.ID(), URL: c.advertise, UpdatedAt: time.Now()}
+	var outBytes int64
+	for path, pusher := range c.server.GetPushers() {
+		state.Paths = append(state.Paths, path)
+		state.Players += len(pusher.GetPlayers())
+		outBytes += int64(pusher.OutBytes())
+	}
+	sort.Strings(state.Paths)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.lastAt.IsZero() && outBytes > c.lastOutBytes {
+		state.OutputRate = int64(float64(outBytes-c.lastOutBytes) / state.UpdatedAt.Sub(c.lastAt).Seconds())
+	}
+	c.lastOutBytes, c.lastAt = outBytes, state.UpdatedAt
+	state.Load, state.Full = c.load(state.Players, state.OutputRate)
+	c.self = state
+}
+
+// load returns load of usage and whether it reaches limits
+func (c *Cluster) load(players int, outputRate int64) (load float64, full bool) {
+	if c.maxPlayers <= 0 && c.maxOutputRate <= 0 {
+		return float64(players), false
+	}
+	if c.maxPlayers > 0 {
+		load = float64(players) / float64(c.maxPlayers)
+	}
+	if c.maxOutputRate > 0 {
+		if l := float64(outputRate) / float64(c.maxOutputRate); l > load {
+			load = l
+		}
+	}
+	return load, load >= 1
+}
+
+func (c *Cluster) gossip() {
+	c.lock.RLock()
+	data, err := json.Marshal(&c.self)
+	peers := c.peers
+	c.lock.RUnlock()
+	if err != nil {
+		c.logger.ErrorWith("marshal cluster node state error", err)
+		return
+	}
+	if c.secret != nil {
+		data = append(data, c.sign(data)...)
+	}
+	for _, peer := range peers {
+		if _, err := c.conn.WriteToUDP(data, peer); err != nil {
+			c.logger.Debug("gossip to cluster peer error", log.String("peer", peer.String()), log.Error(err))
+		}
+	}
+}
+
+func (c *Cluster) receive() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !c.isPeer(addr) {
+			c.logger.Warn("cluster node state of unknown peer dropped", log.String("peer", addr.String()))
+			continue
+		}
+		data := buf[:n]
+		if c.secret != nil {
+			if n < clusterTagLength || !hmac.Equal(c.sign(data[:n-clusterTagLength]), data[n-clusterTagLength:]) {
+				c.logger.Warn("cluster node state unauthenticated", log.String("peer", addr.String()))
+				continue
+			}
+			data = data[:n-clusterTagLength]
+		}
+		state := new(NodeState)
+		if err := json.Unmarshal(data, state); err != nil || state.ID == "" {
+			c.logger.Warn("invalid cluster node state", log.String("peer", addr.String()))
+			continue
+		}
+		if state.ID == c.server.ID() {
+			continue
+		}
+		// time of peer heard, clocks of peers may differ
+		state.UpdatedAt = time.Now()
+		c.lock.Lock()
+		if _, ok := c.nodes[state.ID]; !ok {
+			c.logger.Info("cluster peer joined", log.String("id", state.ID), log.String("url", state.URL))
+		}
+		c.nodes[state.ID] = state
+		c.lock.Unlock()
+	}
+}
+
+// isPeer reports whether addr is the address of a peer
+func (c *Cluster) isPeer(addr *net.UDPAddr) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, peer := range c.peers {
+		if peer.Port == addr.Port && peer.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns HMAC-SHA256 tag of data by secret
+func (c *Cluster) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// expire removes peers not heard for 3 intervals
+func (c *Cluster) expire() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, node := range c.nodes {
+		if time.Since(node.UpdatedAt) >= 3*c.interval {
+			delete(c.nodes, id)
+			c.logger.Info("cluster peer left", log.String("id", id), log.String("url", node.URL))
+		}
+	}
+}
+
+// Nodes returns state of node and peers
+func (c *Cluster) Nodes() []NodeState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	nodes := []NodeState{c.self}
+	for _, node := range c.nodes {
+		nodes = append(nodes, *node)
+	}
+	sort.Slice(nodes[1:], func(i, j int) bool {
+		return nodes[i+1].ID < nodes[j+1].ID
+	})
+	return nodes
+}
+
+// Route decides where player of path played. It returns rtsp url of the least
+// loaded peer serving path if path not local or node reaches limits, and
+// whether player should be rejected since node reaches limits and no peer
+// serves path. Players of local paths are counted live against max players
+func (c *Cluster) Route(path string, local bool) (location string, reject bool) {
+	players := 0
+	for _, pusher := range c.server.GetPushers() {
+		players += len(pusher.GetPlayers())
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	_, full := c.load(players, c.self.OutputRate)
+	if local && !full {
+		return "", false
+	}
+	var best *NodeState
+	for _, node := range c.nodes {
+		if node.Full || !node.hasPath(path) {
+			continue
+		}
+		if best == nil || node.Load < best.Load {
+			best = node
+		}
+	}
+	if best == nil {
+		return "", full
+	}
+	return strings.TrimRight(best.URL, "/") + path, false
+}
+
+// RedirectStatus returns status of redirect response
+func (c *Cluster) RedirectStatus() (int, string) {
+	if c.redirectStatus == 301 {
+		return 301, "Moved Permanently"
+	}
+	return 302, "Moved Temporarily"
+}
@@ -0,0 +1,167 @@
+package rtsp
+
+import (
+	"encoding/json"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCluster(t *testing.T) {
+	// three nodes gossiping to each other, path served by the first and the
+	// third, the first limited to one player
+	servers := make([]*Server, 3)
+	for i := range servers {
+		s := newTestServer(t)
+		c := config.RtspCluster{Listen: "127.0.0.1:0", Interval: 50 * time.Millisecond, RedirectStatus: 302}
+		if i == 0 {
+			c.MaxPlayers = 1
+		}
+		s.cluster = NewCluster(s, c)
+		if err := s.cluster.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.cluster.Stop()
+		servers[i] = s
+	}
+	for _, s := range servers {
+		s.cluster.lock.Lock()
+		for _, peer := range servers {
+			if peer != s {
+				s.cluster.peers = append(s.cluster.peers, peer.cluster.Addr())
+			}
+		}
+		s.cluster.lock.Unlock()
+	}
+	for _, i := range []int{0, 2} {
+		url := servers[i].URL("/live/test")
+		push := dialTestConn(t, servers[i])
+		if code, _ := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, testPushSDP); code != 200 {
+			t.Fatalf("announce failed: %d", code)
+		}
+		if code, _ := push.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+			t.Fatalf("setup failed: %d", code)
+		}
+		if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+			t.Fatalf("record failed: %d", code)
+		}
+	}
+	waitFor(t, "gossip", func() bool {
+		for _, s := range servers {
+			if len(s.cluster.Nodes()) != 3 {
+				return false
+			}
+		}
+		return len(servers[1].cluster.Nodes()[1].Paths) == 1
+	})
+
+	describe := func(s *Server) (int, map[string]string) {
+		return dialTestConn(t, s).request("DESCRIBE", s.URL("/live/test"), nil, "")
+	}
+	// path not local redirected to the least loaded node serving it
+	code, header := describe(servers[1])
+	if code != 302 || header["Location"] != servers[0].URL("/live/test") && header["Location"] != servers[2].URL("/live/test") {
+		t.Fatalf("expect redirect to node serving path, got %d %v", code, header)
+	}
+
+	// local players until limits reached
+	play := dialTestConn(t, servers[0])
+	url := servers[0].URL("/live/test")
+	if code, _ := play.request("DESCRIBE", url, nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	if code, _ := play.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := play.request("PLAY", url, nil, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	waitFor(t, "player", func() bool { return len(servers[0].GetPusher("/live/test").GetPlayers()) == 1 })
+	if code, header := describe(servers[0]); code != 302 || header["Location"] != servers[2].URL("/live/test") {
+		t.Fatalf("expect redirect to peer above limits, got %d %v", code, header)
+	}
+	waitFor(t, "load gossiped", func() bool {
+		for _, node := range servers[1].cluster.Nodes() {
+			if node.ID == servers[0].ID() {
+				return node.Full
+			}
+		}
+		return false
+	})
+	if code, header := describe(servers[1]); code != 302 || header["Location"] != servers[2].URL("/live/test") {
+		t.Fatalf("expect node reaching limits skipped, got %d %v", code, header)
+	}
+
+	// rejected if no peer serving path
+	servers[2].cluster.Stop()
+	waitFor(t, "peer left", func() bool { return len(servers[0].cluster.Nodes()) == 2 })
+	if code, _ := describe(servers[0]); code != 453 {
+		t.Fatalf("expect rejected without peers, got %d", code)
+	}
+}
+
+func TestClusterGossipAuthenticated(t *testing.T) {
+	// gossip of peer of the secret accepted, of peer of another secret and
+	// of address not a peer dropped
+	clusters := make([]*Cluster, 3)
+	for i, secret := range []string{"secret", "secret", "other"} {
+		c := NewCluster(newTestServer(t), config.RtspCluster{Listen: "127.0.0.1:0", Interval: 50 * time.Millisecond, Secret: secret})
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Stop()
+		clusters[i] = c
+	}
+	clusters[0].lock.Lock()
+	clusters[0].peers = []*net.UDPAddr{clusters[1].Addr(), clusters[2].Addr()}
+	clusters[0].lock.Unlock()
+	for _, c := range clusters[1:] {
+		c.lock.Lock()
+		c.peers = []*net.UDPAddr{clusters[0].Addr()}
+		c.lock.Unlock()
+	}
+	spoof, err := net.DialUDP("udp", nil, clusters[0].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoof.Close()
+
+	waitFor(t, "gossip", func() bool { return len(clusters[0].Nodes()) == 2 })
+	data, _ := json.Marshal(&NodeState{ID: "spoof", URL: "rtsp://127.0.0.1:1", Paths: []string{"/live/test"}})
+	spoof.Write(append(data, clusters[0].sign(data)...))
+	// within 3 intervals the spoof would be kept
+	time.Sleep(100 * time.Millisecond)
+	nodes := clusters[0].Nodes()
+	if len(nodes) != 2 || nodes[1].ID != clusters[1].server.ID() {
+		t.Fatalf("expect gossip of peer of secret only, got %+v", nodes)
+	}
+}
+
+func TestClusterReload(t *testing.T) {
+	cfg := config.GlobalConfig()
+	cluster := cfg.RTSP.Cluster
+	t.Cleanup(func() { cfg.RTSP.Cluster = cluster })
+	s := newTestServer(t)
+	cfg.RTSP.Cluster = config.RtspCluster{Enable: true, Listen: "127.0.0.1:0", Interval: time.Second, RedirectStatus: 302}
+
+	s.reloadPolicies()
+	c := s.Cluster()
+	if c == nil || c.conn == nil {
+		t.Fatal("expect cluster enabled and started")
+	}
+	s.reloadPolicies()
+	if s.Cluster() != c {
+		t.Fatal("expect cluster kept if config not changed")
+	}
+	cfg.RTSP.Cluster.MaxPlayers = 1
+	s.reloadPolicies()
+	if s.Cluster() == c || s.Cluster().maxPlayers != 1 || c.done != nil {
+		t.Fatal("expect cluster rebuilt of config changed")
+	}
+	cfg.RTSP.Cluster.Enable = false
+	s.reloadPolicies()
+	if s.Cluster() != nil {
+		t.Fatal("expect cluster disabled")
+	}
+}
@@ -0,0 +1,68 @@
+package rtsp
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"strings"
+
+	"github.com/teris-io/shortid"
+)
+
+// ID returns id of server in Via header of requests to origins
+func (s *Server) ID() string {
+	s.idOnce.Do(func() {
+		s.id = "mdu-" + shortid.MustGenerate()
+	})
+	return s.id
+}
+
+// looped reports whether request passed server already by its Via header,
+// which happens if edges and origins cascading in a loop
+func (s *Server) looped(via string) bool {
+	for _, hop := range strings.Split(via, ",") {
+		if fields := strings.Fields(hop); len(fields) >= 2 && fields[1] == s.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// PullOrigin pulls path from the first origin serving it in edge mode, the
+// pusher already started on path is returned if any. The stream is shared by
+// players of path, so origins see edge as one player. via is the Via header
+// of request played path, requests to origins are sent with server appended
+func (s *Server) PullOrigin(path string, origins []string, via string) (*Pusher, error) {
+	// checked before waiting for sources started, which may be waiting for
+	// this request if looped
+	if s.looped(via) {
+		return nil, fmt.Errorf("rtsp path %s looped by origins, via %s", path, via)
+	}
+	return s.pullOnce(path, func() (*Pusher, error) {
+		return s.pullOrigin(path, origins, via)
+	})
+}
+
+func (s *Server) pullOrigin(path string, origins []string, via string) (*Pusher, error) {
+	edge := config.RtspConfig().Edge
+	transType := ParseTransType(edge.TransType)
+	hop := fmt.Sprintf("%s %s", RTSP_VERSION, s.ID())
+	if via != "" {
+		hop = via + ", " + hop
+	}
+	headers := map[string]string{"Via": hop}
+	err := fmt.Errorf("no origins of rtsp path %s", path)
+	for _, origin := range origins {
+		var pusher *Pusher
+		if pusher, err = s.pullClient(path, strings.TrimRight(origin, "/")+path, transType, "", headers); err != nil {
+			s.logger.Warn("pull from origin error", log.String("path", path), log.String("origin", origin), log.Error(err))
+			continue
+		}
+		if err = s.addSourcePusher(pusher, edge.IdleTimeout); err != nil {
+			return nil, err
+		}
+		s.logger.Info("pull from origin", log.String("path", path), log.String("origin", origin))
+		return pusher, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,125 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEdge(t *testing.T) {
+	edge := config.RtspConfig().Edge
+	defer func() { config.RtspConfig().Edge = edge }()
+	origin, s := newTestServer(t), newTestServer(t)
+	config.RtspConfig().Edge = config.RtspEdge{
+		Enable:      true,
+		Origins:     []string{fmt.Sprintf("rtsp://%s", origin.Addr())},
+		IdleTimeout: 100 * time.Millisecond,
+	}
+
+	url := fmt.Sprintf("rtsp://%s/live/test", origin.Addr())
+	push := dialTestConn(t, origin)
+	if code, _ := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, testPushSDP); code != 200 {
+		t.Fatalf("announce failed: %d", code)
+	}
+	if code, _ := push.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+		t.Fatalf("record failed: %d", code)
+	}
+	pusher := origin.GetPusher("/live/test")
+
+	// players of edge share one stream pulled from origin
+	play := func(path string) (*testConn, int) {
+		url := fmt.Sprintf("rtsp://%s%s", s.Addr(), path)
+		conn := dialTestConn(t, s)
+		if code, _ := conn.request("DESCRIBE", url, nil, ""); code != 200 {
+			return conn, code
+		}
+		if code, _ := conn.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+			return conn, code
+		}
+		code, _ := conn.request("PLAY", url, nil, "")
+		return conn, code
+	}
+	players := make([]*testConn, 0)
+	for i := 0; i < 2; i++ {
+		conn, code := play("/live/test")
+		if code != 200 {
+			t.Fatalf("play from edge failed: %d", code)
+		}
+		players = append(players, conn)
+	}
+	pulled := s.GetPusher("/live/test")
+	if pulled == nil || pulled.Client == nil {
+		t.Fatal("expect path pulled from origin")
+	}
+	waitFor(t, "players", func() bool { return len(pulled.GetPlayers()) == 2 && len(pusher.GetPlayers()) == 1 })
+	push.writeInterleaved(0, testRTP(96, 0, 0x65))
+	for _, conn := range players {
+		if channel, pkt := conn.readInterleaved(); channel != 0 || len(pkt) != 13 {
+			t.Fatalf("unexpected packet of channel %d", channel)
+		}
+	}
+
+	// paths served by no origin not found, the origin asking itself stops
+	// by Via header
+	if _, code := play("/live/none"); code != 404 {
+		t.Fatalf("expect path not found, got %d", code)
+	}
+
+	// stream released after idle
+	for _, conn := range players {
+		conn.request("TEARDOWN", fmt.Sprintf("rtsp://%s/live/test", s.Addr()), nil, "")
+	}
+	waitFor(t, "stream released", func() bool { return s.GetPusher("/live/test") == nil && len(pusher.GetPlayers()) == 0 })
+}
+
+func TestPullOnce(t *testing.T) {
+	s := newTestServer(t)
+	unblock := make(chan struct{})
+	pulled := make(chan struct{})
+	var pulls int32
+	failed := errors.New("origin unreachable")
+	results := make(chan error, 2)
+	pull := func() {
+		_, err := s.pullOnce("/live/slow", func() (*Pusher, error) {
+			if atomic.AddInt32(&pulls, 1) == 1 {
+				close(pulled)
+			}
+			<-unblock
+			return nil, failed
+		})
+		results <- err
+	}
+	go pull()
+	<-pulled
+	go pull()
+
+	// pulls of other paths not blocked by the pull in flight
+	done := make(chan struct{})
+	go func() {
+		s.pullOnce("/live/fast", func() (*Pusher, error) { return nil, failed })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expect pull of other path not blocked")
+	}
+
+	// requests of path pulled share the pull in flight
+	time.Sleep(50 * time.Millisecond)
+	close(unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != failed {
+			t.Fatalf("expect result of pull shared, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&pulls); n != 1 {
+		t.Fatalf("expect path pulled once, got %d", n)
+	}
+}
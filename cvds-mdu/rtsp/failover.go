@@ -0,0 +1,399 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sync"
+	"time"
+)
+
+// Failover pulls sources of a path in order of priority and feeds packets of
+// the active one to the pusher of path, so that players are not disconnected
+// when sources switched. The next source is switched to if the active one
+// delivers no packets for failover timeout, and sources of higher priority
+// are retried and switched back to once they deliver packets again. RTP
+// sequence numbers, timestamps and SSRC are rewritten to keep output
+// continuous
+type Failover struct {
+	*Feeder
+	server    *Server
+	sources   []string
+	transType TransType
+	// name of client profile of sources
+	profile string
+	timeout time.Duration
+
+	lock sync.Mutex
+	// clients of sources by priority, nil if not started
+	clients []*Client
+	// tracks of feeder of each track of clients, -1 if no such media
+	tracks [][]int
+	// time of the last packet received, or the client started
+	lastActive []time.Time
+	// time of the client stopped, sources are retried after failover timeout
+	stoppedAt []time.Time
+	active    int
+	rewriters []*rtpRewriter
+	stopped   bool
+	done      chan struct{}
+}
+
+// NewFailover starts pulling the first source available of sources, whose
+// SDP is the SDP of feeder. Sources are pulled with client profile of name
+// profile, default the profile of host matched
+func NewFailover(server *Server, path string, sources []string, transType TransType, profile string, timeout time.Duration) (*Failover, error) {
+	f := &Failover{
+		server:     server,
+		sources:    sources,
+		transType:  transType,
+		profile:    profile,
+		timeout:    timeout,
+		clients:    make([]*Client, len(sources)),
+		tracks:     make([][]int, len(sources)),
+		lastActive: make([]time.Time, len(sources)),
+		stoppedAt:  make([]time.Time, len(sources)),
+		active:     -1,
+		done:       make(chan struct{}),
+	}
+	var err error
+	for i := range sources {
+		if err = f.startSource(i); err == nil {
+			f.active = i
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	client := f.clients[f.active]
+	if f.Feeder, err = NewFeeder(server, path, sources[f.active], client.SDPRaw); err != nil {
+		client.Stop()
+		return nil, err
+	}
+	f.Feeder.TransType = transType
+	for _, media := range f.Feeder.SDP.Media {
+		f.rewriters = append(f.rewriters, newRTPRewriter(media))
+	}
+	f.tracks[f.active] = mapTracks(client.SDP, f.Feeder.SDP)
+	f.Feeder.StopHandles = append(f.Feeder.StopHandles, f.stop)
+	go f.run()
+	return f, nil
+}
+
+// Active returns index of the active source
+func (f *Failover) Active() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.active
+}
+
+// startSource starts pulling source i, packets of it are dropped until it
+// becomes active
+func (f *Failover) startSource(i int) error {
+	f.lock.Lock()
+	stopped := f.stopped
+	f.lock.Unlock()
+	if stopped {
+		return fmt.Errorf("failover stopped")
+	}
+	agent := fmt.Sprintf("MDU/%s", config.GlobalConfig().Version)
+	client, err := NewRTSPClient(f.server, f.sources[i], 0, agent)
+	if err != nil {
+		return err
+	}
+	client.TransType = f.transType
+	if f.profile != "" {
+		client.Profile = config.RtspConfig().ClientProfile(f.profile, "")
+	}
+	client.RTPHandles = append(client.RTPHandles, func(pack *RTPPack) {
+		f.handle(i, client, pack)
+	})
+	if err = client.Start(0); err != nil {
+		f.lock.Lock()
+		f.stoppedAt[i] = time.Now()
+		f.lock.Unlock()
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stopped {
+		client.Stop()
+		return fmt.Errorf("failover stopped")
+	}
+	if f.Feeder != nil {
+		f.tracks[i] = mapTracks(client.SDP, f.Feeder.SDP)
+		for _, media := range f.Feeder.SDP.Media {
+			if _, m := client.SDP.Track(media.Type); m != nil && m.Codec() != media.Codec() {
+				f.Feeder.logger.Warn("codec of source not matched",
+					log.String("source", f.sources[i]),
+					log.String("codec", m.Codec()),
+					log.String("expected", media.Codec()),
+				)
+			}
+		}
+	}
+	f.clients[i] = client
+	f.lastActive[i] = time.Now()
+	return nil
+}
+
+// stopSource stops pulling source i, lock must be held
+func (f *Failover) stopSource(i int) {
+	if client := f.clients[i]; client != nil {
+		go client.Stop()
+		f.clients[i] = nil
+		f.stoppedAt[i] = time.Now()
+	}
+}
+
+// switchTo makes source i active, sources of lower priority are stopped.
+// Lock must be held
+func (f *Failover) switchTo(i int) {
+	f.Feeder.logger.Info("switch source",
+		log.String("path", f.Feeder.Path),
+		log.String("from", f.sources[f.active]),
+		log.String("to", f.sources[i]),
+	)
+	f.active = i
+	f.lastActive[i] = time.Now()
+	f.Feeder.setSource(f.sources[i])
+	for j := i + 1; j < len(f.clients); j++ {
+		f.stopSource(j)
+	}
+	for _, r := range f.rewriters {
+		r.resync()
+	}
+}
+
+// handle feeds pack of source i if it is active. Packets of sources of higher
+// priority switch back to them
+func (f *Failover) handle(i int, client *Client, pack *RTPPack) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stopped || f.Feeder == nil || f.clients[i] != client {
+		return
+	}
+	f.lastActive[i] = time.Now()
+	if i > f.active {
+		return
+	}
+	if i < f.active {
+		f.switchTo(i)
+	}
+	tracks := f.tracks[i]
+	if pack.Track < 0 || pack.Track >= len(tracks) || tracks[pack.Track] < 0 {
+		return
+	}
+	track := tracks[pack.Track]
+	if !f.rewriters[track].rewrite(pack) {
+		return
+	}
+	pack.Track = track
+	f.Feeder.Feed(pack)
+}
+
+// run checks sources every quarter of failover timeout until stopped
+func (f *Failover) run() {
+	ticker := time.NewTicker(f.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			f.check()
+		}
+	}
+}
+
+// check switches to the next source if the active one failed, and retries
+// sources of higher priority
+func (f *Failover) check() {
+	now := time.Now()
+	f.lock.Lock()
+	if f.stopped {
+		f.lock.Unlock()
+		return
+	}
+	for i, client := range f.clients {
+		if client != nil && (client.Stopped() || now.Sub(f.lastActive[i]) >= f.timeout) {
+			f.Feeder.logger.Warn("source delivers no packets",
+				log.String("path", f.Feeder.Path),
+				log.String("source", f.sources[i]),
+				log.Bool("active", i == f.active),
+			)
+			f.stopSource(i)
+		}
+	}
+	active := f.active
+	failed := f.clients[active] == nil
+	retries := make([]int, 0)
+	for i := 0; i < active; i++ {
+		if f.clients[i] == nil && now.Sub(f.stoppedAt[i]) >= f.timeout {
+			retries = append(retries, i)
+		}
+	}
+	f.lock.Unlock()
+
+	// sources of higher priority are switched back to by their packets
+	for _, i := range retries {
+		f.startSource(i)
+	}
+	if !failed {
+		return
+	}
+	for n := 1; n <= len(f.sources); n++ {
+		i := (active + n) % len(f.sources)
+		f.lock.Lock()
+		started := f.clients[i] != nil
+		f.lock.Unlock()
+		if !started && f.startSource(i) != nil {
+			continue
+		}
+		f.lock.Lock()
+		if !f.stopped && f.clients[i] != nil && f.active == active {
+			f.switchTo(i)
+		}
+		f.lock.Unlock()
+		return
+	}
+}
+
+func (f *Failover) stop() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stopped {
+		return
+	}
+	f.stopped = true
+	close(f.done)
+	for i := range f.clients {
+		f.stopSource(i)
+	}
+}
+
+// mapTracks maps tracks of from to tracks of to by order of media types,
+// tracks without media of the type in to are mapped to -1
+func mapTracks(from *SDP, to *SDP) []int {
+	tracks := make([]int, len(from.Media))
+	for i, media := range from.Media {
+		tracks[i] = -1
+		nth := 0
+		for _, m := range from.Media[:i] {
+			if m.Type == media.Type {
+				nth++
+			}
+		}
+		for j, m := range to.Media {
+			if m.Type != media.Type {
+				continue
+			}
+			if nth == 0 {
+				tracks[i] = j
+				break
+			}
+			nth--
+		}
+	}
+	return tracks
+}
+
+// rtpRewriter rewrites packets of a track of sources switched into one stream
+// continuing the sequence numbers, timestamps and SSRC of the first source
+type rtpRewriter struct {
+	payloadType int
+	clockRate   int
+	codec       string
+	video       bool
+
+	ssrc     uint32
+	seqDelta uint16
+	tsDelta  uint32
+	lastSeq  uint16
+	lastTS   uint32
+	lastAt   time.Time
+	started  bool
+	synced   bool
+
+	rtpInfo           RTPInfo
+	spsPpsInSTAPaPack bool
+}
+
+func newRTPRewriter(media *SDPMedia) *rtpRewriter {
+	return &rtpRewriter{
+		payloadType: media.PayloadType(),
+		clockRate:   media.ClockRate(),
+		codec:       media.Codec(),
+		video:       media.Type == "video",
+	}
+}
+
+// resync continues stream from packets of the next source received
+func (r *rtpRewriter) resync() {
+	r.synced = false
+}
+
+// rewrite rewrites pack in place, it reports false if pack should be dropped.
+// Video packets of the source switched to are dropped until a keyframe, and
+// RTCP packets until RTP received
+func (r *rtpRewriter) rewrite(pack *RTPPack) bool {
+	pkt := pack.Bytes()
+	if pack.Type.IsControl() {
+		return r.rewriteControl(pkt)
+	}
+	if len(pkt) < RTP_FIXED_HEADER_LENGTH {
+		return false
+	}
+	seq := binary.BigEndian.Uint16(pkt[2:])
+	ts := binary.BigEndian.Uint32(pkt[4:])
+	if !r.started {
+		r.ssrc = binary.BigEndian.Uint32(pkt[8:])
+		r.started, r.synced = true, true
+	} else if !r.synced {
+		if r.video && !(parseRTP(pkt, &r.rtpInfo) && shouldSequenceStart(r.codec, &r.rtpInfo, &r.spsPpsInSTAPaPack)) {
+			return false
+		}
+		// continue from the last packet, timestamp advanced by time elapsed
+		elapsed := uint32(time.Since(r.lastAt).Seconds() * float64(r.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		r.seqDelta = r.lastSeq + 1 - seq
+		r.tsDelta = r.lastTS + elapsed - ts
+		r.synced = true
+	}
+	seq += r.seqDelta
+	ts += r.tsDelta
+	binary.BigEndian.PutUint16(pkt[2:], seq)
+	binary.BigEndian.PutUint32(pkt[4:], ts)
+	binary.BigEndian.PutUint32(pkt[8:], r.ssrc)
+	if r.payloadType >= 0 {
+		pkt[1] = pkt[1]&0x80 | byte(r.payloadType)
+	}
+	if int16(seq-r.lastSeq) > 0 || r.lastAt.IsZero() {
+		r.lastSeq = seq
+	}
+	if int32(ts-r.lastTS) > 0 || r.lastAt.IsZero() {
+		r.lastTS = ts
+	}
+	r.lastAt = time.Now()
+	return true
+}
+
+// rewriteControl rewrites SSRC of the first RTCP packet of compound packet,
+// and RTP timestamp of sender report
+func (r *rtpRewriter) rewriteControl(pkt []byte) bool {
+	if !r.synced || len(pkt) < 8 {
+		return false
+	}
+	binary.BigEndian.PutUint32(pkt[4:], r.ssrc)
+	// sender report
+	if pkt[1] == 200 && len(pkt) >= 20 {
+		binary.BigEndian.PutUint32(pkt[16:], binary.BigEndian.Uint32(pkt[16:])+r.tsDelta)
+	}
+	return true
+}
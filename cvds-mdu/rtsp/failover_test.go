@@ -0,0 +1,156 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSourceRTP(ssrc uint32, seq int, ts uint32, nalu byte) []byte {
+	pkt := append(testRTP(96, seq, nalu), 0x88)
+	binary.BigEndian.PutUint32(pkt[4:], ts)
+	binary.BigEndian.PutUint32(pkt[8:], ssrc)
+	return pkt
+}
+
+func TestRTPRewriter(t *testing.T) {
+	sdp, err := ParseSDP(testPushSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRTPRewriter(sdp.Media[0])
+	rewrite := func(pkt []byte) (bool, uint16, uint32, uint32) {
+		pack := copyRTPPack(0, RtpTypeVideo, pkt)
+		defer pack.Release()
+		ok := r.rewrite(pack)
+		b := pack.Bytes()
+		return ok, binary.BigEndian.Uint16(b[2:]), binary.BigEndian.Uint32(b[4:]), binary.BigEndian.Uint32(b[8:])
+	}
+	for i := 0; i < 3; i++ {
+		if ok, seq, ts, ssrc := rewrite(testSourceRTP(1, 100+i, 9000, 0x41)); !ok || seq != uint16(100+i) || ts != 9000 || ssrc != 1 {
+			t.Fatalf("expect packets of first source kept, got %d %d %d", seq, ts, ssrc)
+		}
+	}
+
+	// packets of the next source dropped until keyframe, and then continue
+	// the stream of the first source
+	r.resync()
+	if ok, _, _, _ := rewrite(testSourceRTP(2, 5000, 1000, 0x41)); ok {
+		t.Fatal("expect packets before keyframe dropped")
+	}
+	ok, seq, ts, ssrc := rewrite(testSourceRTP(2, 5001, 1000, 0x65))
+	if !ok || seq != 103 || ts <= 9000 || ssrc != 1 {
+		t.Fatalf("expect stream continued, got %d %d %d", seq, ts, ssrc)
+	}
+	if _, next, nextTS, _ := rewrite(testSourceRTP(2, 5002, 4000, 0x41)); next != 104 || nextTS != ts+3000 {
+		t.Fatalf("expect deltas of source kept, got %d %d", next, nextTS)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	paths := config.RtspConfig().Paths
+	defer func() { config.RtspConfig().Paths = paths }()
+	s := newTestServer(t)
+	base := fmt.Sprintf("rtsp://%s", s.Addr())
+	config.RtspConfig().Paths = []config.RtspPath{{
+		Path:            "/cam",
+		Source:          base + "/live/primary",
+		BackupSources:   []string{base + "/live/backup"},
+		FailoverTimeout: 300 * time.Millisecond,
+	}}
+
+	push := func(path string) *testConn {
+		conn := dialTestConn(t, s)
+		if code, _ := conn.request("ANNOUNCE", base+path, map[string]string{"Content-Type": "application/sdp"}, testPushSDP); code != 200 {
+			t.Fatalf("announce %s failed: %d", path, code)
+		}
+		if code, _ := conn.request("SETUP", base+path+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+			t.Fatalf("setup %s failed: %d", path, code)
+		}
+		if code, _ := conn.request("RECORD", base+path, nil, ""); code != 200 {
+			t.Fatalf("record %s failed: %d", path, code)
+		}
+		return conn
+	}
+	primary, backup := push("/live/primary"), push("/live/backup")
+
+	// sources send packets of their own SSRC, sequence numbers and
+	// timestamps, keyframe every 5 packets
+	var primaryOn int32 = 1
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			nalu := byte(0x41)
+			if i%5 == 0 {
+				nalu = 0x65
+			}
+			if atomic.LoadInt32(&primaryOn) == 1 {
+				primary.writeInterleaved(0, testSourceRTP(1, i, uint32(i*1800), nalu))
+			}
+			backup.writeInterleaved(0, testSourceRTP(2, 30000+i, uint32(1<<31+i*1800), nalu))
+		}
+	}()
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", base+"/cam", nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	if code, _ := play.request("SETUP", base+"/cam/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := play.request("PLAY", base+"/cam", nil, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	pusher := s.GetPusher("/cam")
+	if pusher == nil || pusher.Feeder == nil {
+		t.Fatal("expect sources pulled by failover")
+	}
+	defer pusher.Stop()
+
+	// output continuous of SSRC of primary across switches
+	var lastSeq uint16
+	var lastTS uint32
+	read := func(n int) {
+		for i := 0; i < n; i++ {
+			channel, pkt := play.readInterleaved()
+			if channel != 0 {
+				continue
+			}
+			seq, ts, ssrc := binary.BigEndian.Uint16(pkt[2:]), binary.BigEndian.Uint32(pkt[4:]), binary.BigEndian.Uint32(pkt[8:])
+			if ssrc != 1 || lastTS != 0 && (seq != lastSeq+1 || int32(ts-lastTS) <= 0) {
+				t.Fatalf("output not continuous, seq %d after %d, ts %d after %d, ssrc %d", seq, lastSeq, ts, lastTS, ssrc)
+			}
+			lastSeq, lastTS = seq, ts
+		}
+	}
+	read(5)
+
+	atomic.StoreInt32(&primaryOn, 0)
+	waitFor(t, "switch to backup", func() bool { return pusher.Source() == base+"/live/backup" })
+	read(10)
+
+	atomic.StoreInt32(&primaryOn, 1)
+	waitFor(t, "switch back to primary", func() bool { return pusher.Source() == base+"/live/primary" })
+	read(10)
+	if len(pusher.GetPlayers()) != 1 {
+		t.Fatal("expect player kept across switches")
+	}
+}
@@ -0,0 +1,104 @@
+package rtsp
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sync/atomic"
+	"time"
+
+	"github.com/teris-io/shortid"
+)
+
+// Feeder is a pusher source driven by an in-process producer instead of an
+// RTSP connection, for example a GB28181 device stream. The producer builds
+// the SDP describing its tracks and calls Feed with every RTP packet
+type Feeder struct {
+	Server    *Server
+	logger    *log.Logger
+	ID        string
+	Path      string
+	URL       string
+	SDPRaw    string
+	SDP       *SDP
+	TransType TransType
+	// 1 if stopped, read by producer feeding packets
+	stopped uint32
+	// source feeding packets if switched by producer, URL if never switched
+	source atomic.Value
+
+	// stats info, updated atomically
+	InBytes  int64
+	OutBytes int64
+	StartAt  time.Time
+
+	RTPHandles  []func(*RTPPack)
+	StopHandles []func()
+}
+
+func (feeder *Feeder) String() string {
+	return fmt.Sprintf("feeder[%s][%s]", feeder.Path, feeder.URL)
+}
+
+// Source returns the source feeding packets, which differs from URL once
+// producer switched sources
+func (feeder *Feeder) Source() string {
+	if source, ok := feeder.source.Load().(string); ok {
+		return source
+	}
+	return feeder.URL
+}
+
+// setSource records url as the source feeding packets
+func (feeder *Feeder) setSource(url string) {
+	feeder.source.Store(url)
+}
+
+func NewFeeder(server *Server, path string, url string, sdpRaw string) (*Feeder, error) {
+	sdp, err := ParseSDP(sdpRaw)
+	if err != nil {
+		return nil, err
+	}
+	feeder := &Feeder{
+		Server:      server,
+		ID:          shortid.MustGenerate(),
+		Path:        path,
+		URL:         url,
+		SDPRaw:      sdpRaw,
+		SDP:         sdp,
+		TransType:   TransTypeUdp,
+		StartAt:     time.Now(),
+		RTPHandles:  make([]func(*RTPPack), 0),
+		StopHandles: make([]func(), 0),
+	}
+	feeder.logger = assert.Must(config.LogConfig().Build("rtsp.feeder"))
+	return feeder, nil
+}
+
+// Feed hands a RTP packet produced by the source to the pusher, Track of
+// pack is the index of media in SDP of feeder. The pack is borrowed during
+// the call, caller still owns its reference
+func (feeder *Feeder) Feed(pack *RTPPack) {
+	if feeder.Stopped() || pack == nil {
+		return
+	}
+	atomic.AddInt64(&feeder.InBytes, int64(pack.Len()))
+	for _, h := range feeder.RTPHandles {
+		h(pack)
+	}
+}
+
+// Stopped reports whether feeder stopped
+func (feeder *Feeder) Stopped() bool {
+	return atomic.LoadUint32(&feeder.stopped) == 1
+}
+
+func (feeder *Feeder) Stop() {
+	if atomic.SwapUint32(&feeder.stopped, 1) == 1 {
+		return
+	}
+	for _, h := range feeder.StopHandles {
+		h()
+	}
+}
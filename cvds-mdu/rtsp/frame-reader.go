@@ -0,0 +1,189 @@
+package rtsp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/pool"
+	"github.com/CVDS2020/CVDS2020/common/stream"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	frameChunkSize      = 64 * 1024
+	maxMessageHeaderLen = 64 * 1024
+)
+
+var frameChunkPool = pool.NewDataPool(frameChunkSize)
+
+// Frame is an interleaved binary packet or a RTSP message read from
+// connection
+type Frame struct {
+	// Channel is the interleaved channel of binary packet, -1 for RTSP message
+	Channel int
+	// Data is the binary packet, it is valid until the frame is released or
+	// handed over to a RTPPack
+	Data []byte
+	// Header and Body of RTSP message
+	Header string
+	Body   string
+
+	ref pool.Reference
+}
+
+func (f *Frame) Release() {
+	if f.ref != nil {
+		f.ref.Release()
+		f.ref = nil
+	}
+}
+
+// Pack hands the binary packet over to a new RTPPack
+func (f *Frame) Pack(track int, typ RTPType) *RTPPack {
+	pack := NewRTPPack(track, typ, f.Data, f.ref)
+	f.ref = nil
+	return pack
+}
+
+// FrameReader reads frames of RTSP connection incrementally. Bytes read from
+// connection are kept in pooled chunks queued in stream, a packet lying in a
+// single read references its chunk instead of being copied
+type FrameReader struct {
+	reader  io.Reader
+	stream  *stream.QueueStream
+	chunk   *pool.Data
+	offset  uint
+	scanned uint
+}
+
+func NewFrameReader(reader io.Reader) *FrameReader {
+	return &FrameReader{
+		reader: reader,
+		stream: stream.NewQueueStream(0),
+	}
+}
+
+// fill reads connection once into the free space of current chunk
+func (r *FrameReader) fill() error {
+	if r.chunk == nil {
+		r.chunk = frameChunkPool.Alloc(frameChunkSize)
+		r.offset = 0
+	}
+	n, err := r.reader.Read(r.chunk.Data[r.offset:])
+	if n > 0 {
+		r.chunk.AddRef()
+		r.stream.Write(r.chunk.Data[r.offset:r.offset+uint(n)], r.chunk)
+		r.offset += uint(n)
+		if r.offset == r.chunk.Len() {
+			r.chunk.Release()
+			r.chunk = nil
+		}
+		return nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return err
+}
+
+// ensure reads connection until at least size bytes buffered
+func (r *FrameReader) ensure(size uint) error {
+	for r.stream.Size() < size {
+		if err := r.fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFrame reads next frame, the returned frame should be released or
+// handed over by Pack if it is a binary packet
+func (r *FrameReader) ReadFrame() (frame Frame, err error) {
+	if err = r.ensure(1); err != nil {
+		return
+	}
+	if b, _ := r.stream.PeekByte(); b != '$' {
+		return r.readMessage()
+	}
+	if err = r.ensure(4); err != nil {
+		return
+	}
+	channel, _ := r.stream.PeekIndexByte(1)
+	l1, _ := r.stream.PeekIndexByte(2)
+	l2, _ := r.stream.PeekIndexByte(3)
+	size := uint(l1)<<8 | uint(l2)
+	if err = r.ensure(4 + size); err != nil {
+		return
+	}
+	r.stream.Skip(4)
+	frame.Channel = int(channel)
+	if data, ref, ok := r.stream.ReadReference(size); ok {
+		frame.Data, frame.ref = data, ref
+		return
+	}
+	d := rtpDataPool.Alloc(size)
+	r.stream.ReadTo(d.Data)
+	frame.Data, frame.ref = d.Data, d
+	return
+}
+
+// readMessage reads a RTSP request or response, including its body
+func (r *FrameReader) readMessage() (frame Frame, err error) {
+	end := uint(0)
+	for end == 0 {
+		for size := r.stream.Size(); r.scanned+3 < size; r.scanned++ {
+			if b, _ := r.stream.PeekIndexByte(r.scanned + 3); b != '\n' {
+				continue
+			}
+			if b, _ := r.stream.PeekIndexByte(r.scanned + 2); b != '\r' {
+				continue
+			}
+			if b, _ := r.stream.PeekIndexByte(r.scanned + 1); b != '\n' {
+				continue
+			}
+			if b, _ := r.stream.PeekIndexByte(r.scanned); b == '\r' {
+				end = r.scanned + 4
+				break
+			}
+		}
+		if end > 0 {
+			break
+		}
+		if r.stream.Size() > maxMessageHeaderLen {
+			return frame, fmt.Errorf("rtsp message header exceeds %d bytes", maxMessageHeaderLen)
+		}
+		if err = r.fill(); err != nil {
+			return
+		}
+	}
+	header, _ := r.stream.Peek(end)
+	contentLength := 0
+	for _, line := range bytes.Split(header, []byte("\r\n")) {
+		if kv := strings.SplitN(string(line), ":", 2); len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "Content-Length") {
+			if contentLength, err = strconv.Atoi(strings.TrimSpace(kv[1])); err != nil || contentLength < 0 {
+				return frame, fmt.Errorf("invalid rtsp Content-Length %q", kv[1])
+			}
+		}
+	}
+	if err = r.ensure(end + uint(contentLength)); err != nil {
+		return
+	}
+	frame.Channel = -1
+	frame.Header = string(header)
+	r.stream.Skip(end)
+	body := make([]byte, contentLength)
+	r.stream.ReadTo(body)
+	frame.Body = string(body)
+	r.scanned = 0
+	return
+}
+
+// Close releases the buffered chunks
+func (r *FrameReader) Close() {
+	r.stream.Skip(r.stream.Size())
+	if r.chunk != nil {
+		r.chunk.Release()
+		r.chunk = nil
+	}
+}
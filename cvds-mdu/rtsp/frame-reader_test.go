@@ -0,0 +1,135 @@
+package rtsp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func interleaved(channel int, pkt []byte) []byte {
+	return append([]byte{'$', byte(channel), byte(len(pkt) >> 8), byte(len(pkt))}, pkt...)
+}
+
+func TestFrameReader(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(interleaved(0, testRTP(96, 1, 0x65)))
+	buf.WriteString("OPTIONS rtsp://127.0.0.1/live RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+	buf.Write(interleaved(1, []byte{0x80, 200, 0, 1}))
+	buf.WriteString("ANNOUNCE rtsp://127.0.0.1/live RTSP/1.0\r\nCSeq: 2\r\ncontent-length: 5\r\n\r\nv=0\r\n")
+	buf.Write(interleaved(2, bytes.Repeat([]byte{1}, 3000)))
+
+	for _, reader := range []io.Reader{bytes.NewReader(buf.Bytes()), iotest.HalfReader(bytes.NewReader(buf.Bytes()))} {
+		r := NewFrameReader(reader)
+		frame, err := r.ReadFrame()
+		if err != nil || frame.Channel != 0 || len(frame.Data) != 13 || frame.Data[12] != 0x65 {
+			t.Fatalf("unexpected first frame: %+v %v", frame, err)
+		}
+		pack := frame.Pack(0, RtpTypeVideo)
+		if frame, err = r.ReadFrame(); err != nil || frame.Channel != -1 || NewRequest(frame.Header).Method != "OPTIONS" {
+			t.Fatalf("unexpected options frame: %+v %v", frame, err)
+		}
+		if frame, err = r.ReadFrame(); err != nil || frame.Channel != 1 || len(frame.Data) != 4 {
+			t.Fatalf("unexpected rtcp frame: %+v %v", frame, err)
+		}
+		frame.Release()
+		if frame, err = r.ReadFrame(); err != nil || frame.Channel != -1 || frame.Body != "v=0\r\n" {
+			t.Fatalf("unexpected announce frame: %+v %v", frame, err)
+		}
+		if frame, err = r.ReadFrame(); err != nil || frame.Channel != 2 || len(frame.Data) != 3000 || frame.Data[2999] != 1 {
+			t.Fatalf("unexpected large frame: %v", err)
+		}
+		frame.Release()
+		if _, err = r.ReadFrame(); err != io.EOF {
+			t.Fatalf("expect EOF, got %v", err)
+		}
+		// pack keeps its chunk alive after reader released buffered data
+		r.Close()
+		if pack.Bytes()[12] != 0x65 {
+			t.Fatal("pack data changed after reader closed")
+		}
+		pack.Release()
+	}
+}
+
+// loopReader reads data repeatedly
+type loopReader struct {
+	data   []byte
+	offset int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.offset:])
+	r.offset = (r.offset + n) % len(r.data)
+	return n, nil
+}
+
+func benchmarkPackets() []byte {
+	var buf bytes.Buffer
+	// a GOP of 64 packets starting with SPS
+	for i := 0; i < 64; i++ {
+		nalu := byte(0x41)
+		if i == 0 {
+			nalu = 0x67
+		}
+		pkt := testRTP(96, i, nalu)
+		pkt = append(pkt, bytes.Repeat([]byte{0}, 1187)...)
+		buf.Write(interleaved(0, pkt))
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkFrameReader(b *testing.B) {
+	r := NewFrameReader(&loopReader{data: benchmarkPackets()})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+		frame.Pack(0, RtpTypeVideo).Release()
+	}
+}
+
+// BenchmarkPusherPipeline measures allocations of a packet from connection
+// read through pusher, GOP cache and player to the player TCP connection
+func BenchmarkPusherPipeline(b *testing.B) {
+	feeder, err := NewFeeder(nil, "/bench", "bench://", testPushSDP)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pusher := NewFeederPusher(feeder)
+	conn, peer := testTCPPair(b)
+	go io.Copy(io.Discard, peer)
+	session, player := newTestPlayer(pusher, conn, 0)
+	go pusher.Start()
+	pusher.AddPlayer(player)
+
+	r := NewFrameReader(&loopReader{data: benchmarkPackets()})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame, err := r.ReadFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+		pack := frame.Pack(0, RtpTypeVideo)
+		feeder.Feed(pack)
+		pack.Release()
+		if i%256 == 0 {
+			// keep producer from running too far ahead of player
+			for player.cursor.Lag() > 1024 {
+				time.Sleep(time.Microsecond)
+			}
+		}
+	}
+	for player.cursor.Lag() > 0 {
+		time.Sleep(time.Microsecond)
+	}
+	b.StopTimer()
+	session.stopped = 1
+	feeder.stopped = 1
+	pusher.ring.Close()
+}
@@ -0,0 +1,239 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sequence numbers restarted by source if jumping beyond them, see RFC 3550
+// A.1
+const (
+	jitterMaxDropout  = 3000
+	jitterMaxMisorder = 100
+)
+
+// JitterStats is the statistics of RTP of a track reordered by jitter buffer
+type JitterStats struct {
+	Track    int    `json:"track"`
+	Received uint64 `json:"received"`
+	// packets arriving after packets of larger sequence numbers
+	Reordered uint64 `json:"reordered"`
+	// duplicates, and packets arriving after their sequence numbers released
+	// or skipped
+	Dropped uint64 `json:"dropped"`
+	// packets skipped after waiting for delay or buffer full
+	Lost uint64 `json:"lost"`
+	// gaps of packets skipped, and restarts of sequence numbers
+	Gaps uint64 `json:"gaps"`
+}
+
+type jitterPacket struct {
+	pack *RTPPack
+	at   time.Time
+}
+
+type jitterTrack struct {
+	stats   JitterStats
+	started bool
+	// sequence number of the next packet released
+	next uint16
+	// the largest sequence number received
+	highest uint16
+	held    map[uint16]jitterPacket
+}
+
+// jitterBuffer reorders RTP of tracks received by UDP by sequence numbers.
+// A packet is held until packets before it arrive, packets missing are
+// skipped as lost once a packet held has waited for delay or more than size
+// packets are held, and the gap is marked before packets after it released.
+// RTCP is passed through
+type jitterBuffer struct {
+	delay  time.Duration
+	size   int
+	output func(*RTPPack)
+	gap    func(track int)
+
+	lock   sync.Mutex
+	tracks map[int]*jitterTrack
+	timer  *time.Timer
+	armed  bool
+	closed bool
+}
+
+func newJitterBuffer(delay time.Duration, size int, output func(*RTPPack), gap func(track int)) *jitterBuffer {
+	return &jitterBuffer{
+		delay:  delay,
+		size:   size,
+		output: output,
+		gap:    gap,
+		tracks: make(map[int]*jitterTrack),
+	}
+}
+
+// push holds pack until it is in order, the pack is borrowed during the call
+func (jb *jitterBuffer) push(pack *RTPPack) {
+	data := pack.Bytes()
+	if pack.Type.IsControl() || len(data) < RTP_FIXED_HEADER_LENGTH {
+		jb.output(pack)
+		return
+	}
+	seq := binary.BigEndian.Uint16(data[2:])
+	now := time.Now()
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+	if jb.closed {
+		return
+	}
+	t := jb.tracks[pack.Track]
+	if t == nil {
+		t = &jitterTrack{stats: JitterStats{Track: pack.Track}, held: make(map[uint16]jitterPacket)}
+		jb.tracks[pack.Track] = t
+	}
+	t.stats.Received++
+	if !t.started {
+		t.started, t.next, t.highest = true, seq, seq
+	}
+	d := int(int16(seq - t.next))
+	if d > jitterMaxDropout || d < -jitterMaxMisorder {
+		// sequence numbers restarted by source
+		jb.releaseAll(t)
+		t.stats.Gaps++
+		jb.gap(pack.Track)
+		t.next, t.highest, d = seq, seq, 0
+	}
+	if _, ok := t.held[seq]; ok || d < 0 {
+		t.stats.Dropped++
+		return
+	}
+	if int16(seq-t.highest) < 0 {
+		t.stats.Reordered++
+	} else {
+		t.highest = seq
+	}
+	pack.AddRef()
+	t.held[seq] = jitterPacket{pack: pack, at: now}
+	jb.release(t, now)
+	jb.schedule(now)
+}
+
+// release releases packets of track in order, and skips packets missing if
+// the oldest packet held has waited for delay or buffer is full, lock must
+// be held
+func (jb *jitterBuffer) release(t *jitterTrack, now time.Time) {
+	for {
+		for p, ok := t.held[t.next]; ok; p, ok = t.held[t.next] {
+			delete(t.held, t.next)
+			t.next++
+			jb.output(p.pack)
+			p.pack.Release()
+		}
+		if len(t.held) == 0 {
+			return
+		}
+		lowest, oldest := t.next, now
+		first := true
+		for seq, p := range t.held {
+			if first || int16(seq-lowest) < 0 {
+				lowest, first = seq, false
+			}
+			if p.at.Before(oldest) {
+				oldest = p.at
+			}
+		}
+		if len(t.held) <= jb.size && now.Sub(oldest) < jb.delay {
+			return
+		}
+		t.stats.Lost += uint64(lowest - t.next)
+		t.stats.Gaps++
+		jb.gap(t.stats.Track)
+		t.next = lowest
+	}
+}
+
+// releaseAll releases packets held of track in order, lock must be held
+func (jb *jitterBuffer) releaseAll(t *jitterTrack) {
+	seqs := make([]uint16, 0, len(t.held))
+	for seq := range t.held {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return int16(seqs[i]-t.next) < int16(seqs[j]-t.next) })
+	for _, seq := range seqs {
+		p := t.held[seq]
+		delete(t.held, seq)
+		jb.output(p.pack)
+		p.pack.Release()
+	}
+}
+
+// schedule arms timer releasing packets held when the oldest one has waited
+// for delay, lock must be held
+func (jb *jitterBuffer) schedule(now time.Time) {
+	if jb.armed || jb.closed {
+		return
+	}
+	var oldest time.Time
+	for _, t := range jb.tracks {
+		for _, p := range t.held {
+			if oldest.IsZero() || p.at.Before(oldest) {
+				oldest = p.at
+			}
+		}
+	}
+	if oldest.IsZero() {
+		return
+	}
+	jb.armed = true
+	wait := oldest.Add(jb.delay).Sub(now)
+	if jb.timer == nil {
+		jb.timer = time.AfterFunc(wait, jb.flush)
+	} else {
+		jb.timer.Reset(wait)
+	}
+}
+
+func (jb *jitterBuffer) flush() {
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+	jb.armed = false
+	if jb.closed {
+		return
+	}
+	now := time.Now()
+	for _, t := range jb.tracks {
+		jb.release(t, now)
+	}
+	jb.schedule(now)
+}
+
+// stats returns statistics of tracks in order of track
+func (jb *jitterBuffer) stats() []JitterStats {
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+	stats := make([]JitterStats, 0, len(jb.tracks))
+	for _, t := range jb.tracks {
+		stats = append(stats, t.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Track < stats[j].Track })
+	return stats
+}
+
+// close releases packets held without output
+func (jb *jitterBuffer) close() {
+	jb.lock.Lock()
+	defer jb.lock.Unlock()
+	if jb.closed {
+		return
+	}
+	jb.closed = true
+	if jb.timer != nil {
+		jb.timer.Stop()
+	}
+	for _, t := range jb.tracks {
+		for seq, p := range t.held {
+			delete(t.held, seq)
+			p.pack.Release()
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJitter records sequence numbers released and gaps marked of jitter
+// buffer, a gap is recorded as -1
+type testJitter struct {
+	lock sync.Mutex
+	seqs []int
+}
+
+func (j *testJitter) output(pack *RTPPack) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.seqs = append(j.seqs, int(binary.BigEndian.Uint16(pack.Bytes()[2:])))
+}
+
+func (j *testJitter) gap(track int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.seqs = append(j.seqs, -1)
+}
+
+func (j *testJitter) released() []int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return append([]int{}, j.seqs...)
+}
+
+func pushJitter(jb *jitterBuffer, seqs ...int) {
+	for _, seq := range seqs {
+		pack := copyRTPPack(0, RtpTypeVideo, testRTP(96, seq, 0x41))
+		jb.push(pack)
+		pack.Release()
+	}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	var j testJitter
+	jb := newJitterBuffer(100*time.Millisecond, 8, j.output, j.gap)
+	defer jb.close()
+
+	// reordered and duplicated across wrap of sequence numbers
+	pushJitter(jb, 65534, 0, 65535, 65535, 1, 0, 65533)
+	if seqs := j.released(); !reflect.DeepEqual(seqs, []int{65534, 65535, 0, 1}) {
+		t.Fatalf("expect packets reordered, got %v", seqs)
+	}
+	if stats := jb.stats()[0]; stats.Received != 7 || stats.Reordered != 1 || stats.Dropped != 3 || stats.Lost != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// packets after a gap released after delay
+	pushJitter(jb, 4, 3)
+	if seqs := j.released(); len(seqs) != 4 {
+		t.Fatalf("expect packets after gap held, got %v", seqs)
+	}
+	waitFor(t, "gap skipped", func() bool { return len(j.released()) == 7 })
+	if seqs := j.released()[4:]; !reflect.DeepEqual(seqs, []int{-1, 3, 4}) {
+		t.Fatalf("expect gap marked before packets after it, got %v", seqs)
+	}
+	pushJitter(jb, 2)
+	if stats := jb.stats()[0]; stats.Lost != 1 || stats.Gaps != 1 || stats.Dropped != 4 {
+		t.Fatalf("expect packet late dropped, got %+v", stats)
+	}
+
+	// buffer full skips gap at once
+	pushJitter(jb, 6, 7, 8, 9, 10, 11, 12, 13, 14)
+	if seqs := j.released()[7:]; !reflect.DeepEqual(seqs, []int{-1, 6, 7, 8, 9, 10, 11, 12, 13, 14}) {
+		t.Fatalf("expect gap skipped of buffer full, got %v", seqs)
+	}
+
+	// sequence numbers restarted
+	pushJitter(jb, 16, 30000, 30001)
+	if seqs := j.released()[17:]; !reflect.DeepEqual(seqs, []int{16, -1, 30000, 30001}) {
+		t.Fatalf("expect packets held released on restart, got %v", seqs)
+	}
+	if stats := jb.stats()[0]; stats.Lost != 2 || stats.Gaps != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPusherJitterBuffer(t *testing.T) {
+	cfg := config.GlobalConfig()
+	jitter := cfg.RTSP.Pusher.JitterBuffer
+	t.Cleanup(func() { cfg.RTSP.Pusher.JitterBuffer = jitter })
+	cfg.RTSP.Pusher.JitterBuffer.Delay = 50 * time.Millisecond
+	cfg.RTSP.Pusher.JitterBuffer.Size = 256
+	s := newTestServer(t)
+	url := fmt.Sprintf("rtsp://%s/live/jitter", s.Addr())
+
+	// pusher of UDP transport
+	push := dialTestConn(t, s)
+	if code, _ := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, testPushSDP); code != 200 {
+		t.Fatalf("announce failed: %d", code)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	code, header := push.request("SETUP", url+"/streamid=0", map[string]string{
+		"Transport": fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;mode=record", port, port+1),
+	}, "")
+	matches := regexp.MustCompile(`server_port=(\d+)-(\d+)`).FindStringSubmatch(header["Transport"])
+	if code != 200 || matches == nil {
+		t.Fatalf("setup failed: %d %v", code, header)
+	}
+	if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+		t.Fatalf("record failed: %d", code)
+	}
+	serverPort, _ := strconv.Atoi(matches[1])
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverPort}
+	pusher := s.GetPusher("/live/jitter")
+
+	var packets testPackets
+	client, err := NewRTSPClient(s, url, 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RTPHandles = append(client.RTPHandles, packets.handle)
+	if err := client.Start(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	waitFor(t, "player", func() bool { return len(pusher.GetPlayers()) == 1 })
+
+	for _, seq := range []int{1, 3, 2, 2, 4, 6} {
+		if _, err := conn.WriteToUDP(testRTP(96, seq, 0x41), server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "packets", func() bool { return packets.count(0) == 5 })
+	packets.lock.Lock()
+	var seqs []int
+	for _, pack := range packets.packs[0] {
+		seqs = append(seqs, int(binary.BigEndian.Uint16(pack.Bytes()[2:])))
+	}
+	packets.lock.Unlock()
+	if !reflect.DeepEqual(seqs, []int{1, 2, 3, 4, 6}) {
+		t.Fatalf("expect packets reordered, got %v", seqs)
+	}
+	stats := pusher.JitterStats()
+	if len(stats) != 1 || stats[0].Received != 6 || stats[0].Dropped != 1 || stats[0].Lost != 1 {
+		t.Fatalf("unexpected jitter stats %+v", stats)
+	}
+}
@@ -0,0 +1,220 @@
+package rtsp
+
+import (
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// bytes of RTP packets buffered by the process, updated atomically
+var (
+	// bytes of all packets not released yet
+	bufferedBytes int64
+	// bytes of packets referenced by GOP caches of pushers
+	gopCacheBytes int64
+	// bytes of packets referenced by rings of pushers
+	ringBytes int64
+)
+
+// MemoryUsage is the bytes of RTP packets buffered by the process. Packets
+// are shared by GOP caches, pusher queues and player queues, so Buffered is
+// the memory used and the others are bytes referenced by each of them
+type MemoryUsage struct {
+	Buffered       int64 `json:"buffered"`
+	GopCache       int64 `json:"gopCache"`
+	PusherQueues   int64 `json:"pusherQueues"`
+	PlayerQueues   int64 `json:"playerQueues"`
+	Limit          int64 `json:"limit"`
+	AdmissionLimit int64 `json:"admissionLimit"`
+
+	// pushers and players rejected, bytes trimmed from caches and players
+	// disconnected for memory
+	Rejected     uint64 `json:"rejected"`
+	TrimmedBytes uint64 `json:"trimmedBytes"`
+	Disconnected uint64 `json:"disconnected"`
+}
+
+// MemoryAccountant keeps bytes of RTP packets buffered by GOP caches, pusher
+// queues and player queues of server under limit. New pushers and players are
+// rejected above the admission limit, and above the limit packets read by all
+// players are released, then GOP caches trimmed, and then the laggiest
+// players disconnected
+type MemoryAccountant struct {
+	server         *Server
+	limit          int64
+	admissionLimit int64
+	interval       time.Duration
+
+	rejected     uint64
+	trimmed      uint64
+	disconnected uint64
+
+	logger *log.Logger
+}
+
+func NewMemoryAccountant(server *Server) *MemoryAccountant {
+	c := config.RtspConfig().Memory
+	return &MemoryAccountant{
+		server:         server,
+		limit:          c.Limit.Int64(),
+		admissionLimit: c.AdmissionLimit.Int64(),
+		interval:       c.CheckInterval,
+		logger:         assert.Must(config.LogConfig().Build("rtsp.memory")),
+	}
+}
+
+// reload updates limits and check interval of config reloaded
+func (m *MemoryAccountant) reload() {
+	c := config.RtspConfig().Memory
+	atomic.StoreInt64(&m.limit, c.Limit.Int64())
+	atomic.StoreInt64(&m.admissionLimit, c.AdmissionLimit.Int64())
+	atomic.StoreInt64((*int64)(&m.interval), int64(c.CheckInterval))
+}
+
+func (m *MemoryAccountant) checkInterval() time.Duration {
+	if interval := time.Duration(atomic.LoadInt64((*int64)(&m.interval))); interval > 0 {
+		return interval
+	}
+	return time.Second
+}
+
+// run checks buffered bytes against limit every interval until done closed,
+// limits and interval reloaded are applied at the next check
+func (m *MemoryAccountant) run(done <-chan struct{}) {
+	interval := m.checkInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if i := m.checkInterval(); i != interval {
+				interval = i
+				ticker.Reset(interval)
+			}
+			m.Enforce()
+		}
+	}
+}
+
+// Admit reports whether a new pusher or player, described by what, is
+// admitted. It is rejected if buffered bytes above admission limit
+func (m *MemoryAccountant) Admit(what string) bool {
+	admissionLimit := atomic.LoadInt64(&m.admissionLimit)
+	if admissionLimit <= 0 {
+		return true
+	}
+	if buffered := atomic.LoadInt64(&bufferedBytes); buffered > admissionLimit {
+		atomic.AddUint64(&m.rejected, 1)
+		m.logger.Warn("not enough memory, reject "+what,
+			log.Int64("buffered", buffered),
+			log.Int64("admission limit", admissionLimit),
+		)
+		return false
+	}
+	return true
+}
+
+func (m *MemoryAccountant) over() int64 {
+	return atomic.LoadInt64(&bufferedBytes) - atomic.LoadInt64(&m.limit)
+}
+
+func (m *MemoryAccountant) trimmedBytes(n int64) {
+	if n > 0 {
+		atomic.AddUint64(&m.trimmed, uint64(n))
+	}
+}
+
+// Enforce brings buffered bytes under limit if above it
+func (m *MemoryAccountant) Enforce() {
+	if atomic.LoadInt64(&m.limit) <= 0 || m.over() <= 0 {
+		return
+	}
+	pushers := make([]*Pusher, 0)
+	for _, pusher := range m.server.GetPushers() {
+		pushers = append(pushers, pusher)
+	}
+	for _, pusher := range pushers {
+		m.trimmedBytes(pusher.trimQueue())
+	}
+	if m.over() <= 0 {
+		return
+	}
+
+	sort.Slice(pushers, func(i, j int) bool {
+		return pushers[i].GopCacheBytes() > pushers[j].GopCacheBytes()
+	})
+	for _, pusher := range pushers {
+		if m.over() <= 0 {
+			return
+		}
+		if n := pusher.trimGopCache(); n > 0 {
+			m.trimmedBytes(n)
+			m.logger.Warn("memory limit exceeded, trim gop cache",
+				log.String("pusher", pusher.String()),
+				log.Int64("bytes", n),
+			)
+		}
+	}
+	over := m.over()
+	if over <= 0 {
+		return
+	}
+
+	// packets of stopped players are released by their goroutines, so bytes
+	// released are estimated by queued bytes of players
+	type queued struct {
+		player *Player
+		bytes  int64
+	}
+	players := make([]queued, 0)
+	for _, pusher := range pushers {
+		for _, player := range pusher.GetPlayers() {
+			if n := player.QueuedBytes(); n > 0 {
+				players = append(players, queued{player, n})
+			}
+		}
+	}
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].bytes > players[j].bytes
+	})
+	for _, q := range players {
+		if over <= 0 {
+			break
+		}
+		m.logger.Warn("memory limit exceeded, disconnect the laggiest player",
+			log.String("player", q.player.String()),
+			log.Int64("queued bytes", q.bytes),
+		)
+		q.player.Stop()
+		atomic.AddUint64(&m.disconnected, 1)
+		over -= q.bytes
+	}
+	for _, pusher := range pushers {
+		m.trimmedBytes(pusher.trimQueue())
+	}
+}
+
+// Usage returns current buffered bytes
+func (m *MemoryAccountant) Usage() MemoryUsage {
+	usage := MemoryUsage{
+		Buffered:       atomic.LoadInt64(&bufferedBytes),
+		GopCache:       atomic.LoadInt64(&gopCacheBytes),
+		PusherQueues:   atomic.LoadInt64(&ringBytes),
+		Limit:          atomic.LoadInt64(&m.limit),
+		AdmissionLimit: atomic.LoadInt64(&m.admissionLimit),
+		Rejected:       atomic.LoadUint64(&m.rejected),
+		TrimmedBytes:   atomic.LoadUint64(&m.trimmed),
+		Disconnected:   atomic.LoadUint64(&m.disconnected),
+	}
+	for _, pusher := range m.server.GetPushers() {
+		for _, player := range pusher.GetPlayers() {
+			usage.PlayerQueues += player.QueuedBytes()
+		}
+	}
+	return usage
+}
@@ -0,0 +1,133 @@
+package rtsp
+
+import (
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRTPRingTrim(t *testing.T) {
+	r := newRTPRing(4)
+	c := r.NewCursor(0)
+	for i := 0; i < 6; i++ {
+		pack := copyRTPPack(0, RtpTypeVideo, append(testRTP(96, i, 0x41), make([]byte, 87)...))
+		r.Write(pack)
+		pack.Release()
+	}
+	if r.Bytes() != 400 {
+		t.Fatalf("expect 400 bytes in ring, got %d", r.Bytes())
+	}
+	if lag := c.LagBytes(); lag != 400 {
+		t.Fatalf("expect 400 bytes lagged, got %d", lag)
+	}
+	if n := r.trim(); n != 0 {
+		t.Fatalf("expect packets not read kept, got %d bytes trimmed", n)
+	}
+	for i := 0; i < 3; i++ {
+		pack, _ := c.Next()
+		pack.Release()
+	}
+	// packets 0 and 1 overwritten, 2 to 4 read
+	if n := r.trim(); n != 300 || c.LagBytes() != 100 {
+		t.Fatalf("expect 300 bytes trimmed, got %d", n)
+	}
+	c.Close()
+	if n := r.trim(); n != 100 || r.Bytes() != 0 {
+		t.Fatalf("expect all packets trimmed without cursor, got %d", n)
+	}
+}
+
+func TestMemoryAccountant(t *testing.T) {
+	s := &Server{
+		pushers: make(map[string]*Pusher),
+		logger:  assert.Must(config.LogConfig().Build("rtsp.server")),
+	}
+	m := NewMemoryAccountant(s)
+	s.memory = m
+	feeder, err := NewFeeder(s, "/test", "test://", testPushSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher := NewFeederPusher(feeder)
+	s.AddPusher(pusher)
+	defer feeder.Stop()
+
+	// a player keeping up and a paused one holding all packets
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(io.Discard, peer)
+	_, fast := newTestPlayer(pusher, conn, 0)
+	pusher.AddPlayer(fast)
+	conn, peer = net.Pipe()
+	defer peer.Close()
+	slowSession, slow := newTestPlayer(pusher, conn, 0)
+	slowSession.ID = "slow"
+	slow.Pause(true)
+	pusher.AddPlayer(slow)
+
+	for i := 0; i < 10; i++ {
+		nalu := byte(0x41)
+		if i == 0 {
+			nalu = 0x65
+		}
+		pack := copyRTPPack(0, RtpTypeVideo, append(testRTP(96, i, nalu), make([]byte, 987)...))
+		feeder.Feed(pack)
+		pack.Release()
+	}
+	waitFor(t, "fast player", func() bool { return fast.QueuedBytes() == 0 })
+	usage := m.Usage()
+	if usage.GopCache < 10000 || usage.PusherQueues < 10000 || usage.PlayerQueues < 10000 || usage.Buffered < 10000 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	// no limit, nothing to do
+	m.Enforce()
+	if pusher.GopCacheBytes() != 10000 || len(pusher.GetPlayers()) != 2 {
+		t.Fatal("expect nothing trimmed without limit")
+	}
+
+	// GOP cache trimmed, packets still held by the paused player, which is
+	// disconnected then
+	m.limit = atomic.LoadInt64(&bufferedBytes) - 1
+	m.Enforce()
+	if pusher.GopCacheBytes() != 0 || pusher.QueueBytes() != 0 {
+		t.Fatalf("expect caches trimmed, got gop %d, queue %d", pusher.GopCacheBytes(), pusher.QueueBytes())
+	}
+	if !slowSession.Stopped() || !pusher.HasPlayer(fast) || pusher.HasPlayer(slow) {
+		t.Fatal("expect the paused player disconnected only")
+	}
+	usage = m.Usage()
+	if usage.Disconnected != 1 || usage.TrimmedBytes < 20000 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	// packets not cached until next GOP after trimmed
+	pack := copyRTPPack(0, RtpTypeVideo, testRTP(96, 10, 0x41))
+	feeder.Feed(pack)
+	if pusher.GopCacheBytes() != 0 {
+		t.Fatal("expect GOP cache trimmed until next GOP")
+	}
+	pack.Release()
+
+	m.admissionLimit = 1
+	if m.Admit("player") {
+		t.Fatal("expect player rejected above admission limit")
+	}
+	m.admissionLimit = 0
+	if !m.Admit("player") || m.Usage().Rejected != 1 {
+		t.Fatal("expect player admitted without limit")
+	}
+
+	// limits of config reloaded
+	cfg := config.GlobalConfig()
+	memory := cfg.RTSP.Memory
+	t.Cleanup(func() { cfg.RTSP.Memory = memory })
+	cfg.RTSP.Memory.AdmissionLimit = 1
+	s.reloadPolicies()
+	if m.Admit("player") || m.Usage().AdmissionLimit != 1 {
+		t.Fatal("expect player rejected above admission limit reloaded")
+	}
+}
@@ -0,0 +1,138 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxNackGap is the max RTP lost at a time requested by NACK, larger gaps
+// are taken as sequence numbers restarted
+const maxNackGap = 128
+
+// rtxHistory keeps the latest RTP packets of tracks of pusher by sequence
+// numbers, for retransmission requested by NACKs of players
+type rtxHistory struct {
+	size   int
+	lock   sync.Mutex
+	tracks map[int][]*RTPPack
+}
+
+func newRTXHistory(size int) *rtxHistory {
+	return &rtxHistory{size: size, tracks: make(map[int][]*RTPPack)}
+}
+
+// add keeps RTP pack, replacing the oldest one of its slot
+func (h *rtxHistory) add(pack *RTPPack) {
+	if pack.Type.IsControl() || pack.Len() < RTP_FIXED_HEADER_LENGTH {
+		return
+	}
+	seq := binary.BigEndian.Uint16(pack.Bytes()[2:])
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	packs := h.tracks[pack.Track]
+	if packs == nil {
+		packs = make([]*RTPPack, h.size)
+		h.tracks[pack.Track] = packs
+	}
+	slot := int(seq) % h.size
+	if old := packs[slot]; old != nil {
+		old.Release()
+	}
+	pack.AddRef()
+	packs[slot] = pack
+}
+
+// get returns RTP of track of sequence number seq referenced, nil if not
+// kept any more
+func (h *rtxHistory) get(track int, seq uint16) *RTPPack {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	packs := h.tracks[track]
+	if packs == nil {
+		return nil
+	}
+	pack := packs[int(seq)%h.size]
+	if pack == nil || binary.BigEndian.Uint16(pack.Bytes()[2:]) != seq {
+		return nil
+	}
+	pack.AddRef()
+	return pack
+}
+
+// clear releases packets kept
+func (h *rtxHistory) clear() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for track, packs := range h.tracks {
+		for _, pack := range packs {
+			if pack != nil {
+				pack.Release()
+			}
+		}
+		delete(h.tracks, track)
+	}
+}
+
+// nackTracker detects RTP of a track of source lost by sequence numbers, in
+// order to request retransmission by NACK
+type nackTracker struct {
+	started bool
+	highest uint16
+}
+
+// update returns sequence numbers lost before seq, packets late or
+// retransmitted are not taken as new loss
+func (t *nackTracker) update(seq uint16) (lost []uint16) {
+	if !t.started {
+		t.started, t.highest = true, seq
+		return
+	}
+	d := seq - t.highest
+	if int16(d) <= 0 {
+		return
+	}
+	if d <= maxNackGap {
+		for s := t.highest + 1; s != seq; s++ {
+			lost = append(lost, s)
+		}
+	}
+	t.highest = seq
+	return
+}
+
+// FeedbackNack reports whether receiver of media supports Generic NACK, by
+// a=rtcp-fb:<payload type> nack or a=rtcp-fb:* nack, see RFC 4585 4.2
+func (m *SDPMedia) FeedbackNack() bool {
+	pt := strconv.Itoa(m.PayloadType())
+	for _, attr := range m.Attributes {
+		if attr.Key != "rtcp-fb" {
+			continue
+		}
+		fields := strings.Fields(attr.Value)
+		if len(fields) == 2 && (fields[0] == pt || fields[0] == "*") && strings.EqualFold(fields[1], "nack") {
+			return true
+		}
+	}
+	return false
+}
+
+// announceNack returns SDP of raw announcing Generic NACK of RTP media not
+// announcing it yet
+func announceNack(raw string) string {
+	sdp, err := ParseSDP(raw)
+	if err != nil {
+		return raw
+	}
+	return rewriteMedia(raw, func(track int, lines []string) []string {
+		if track < 0 || track >= len(sdp.Media) {
+			return lines
+		}
+		if m := sdp.Media[track]; strings.HasPrefix(m.Proto, "RTP/") && m.PayloadType() >= 0 && !m.FeedbackNack() {
+			lines = append(lines, fmt.Sprintf("a=rtcp-fb:%d nack", m.PayloadType()))
+		}
+		return lines
+	})
+}
@@ -0,0 +1,159 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNack(t *testing.T) {
+	seqs := []uint16{65534, 0, 3, 14, 15, 40}
+	nack := buildNack(1, 2, seqs)
+	if got := parseNacks(append(testRTCPReport(), nack...)); !reflect.DeepEqual(got, seqs) {
+		t.Fatalf("expect NACK parsed %v, got %v", seqs, got)
+	}
+	if len(nack) != rtcpHeaderLength+4+3*4 || binary.BigEndian.Uint32(nack[8:]) != 2 {
+		t.Fatalf("unexpected NACK %x", nack)
+	}
+
+	var tracker nackTracker
+	for _, c := range []struct {
+		seq  uint16
+		lost []uint16
+	}{{65534, nil}, {65535, nil}, {2, []uint16{0, 1}}, {1, nil}, {2, nil}, {1000, nil}, {1001, nil}} {
+		if lost := tracker.update(c.seq); !reflect.DeepEqual(lost, c.lost) {
+			t.Fatalf("expect %v lost before %d, got %v", c.lost, c.seq, lost)
+		}
+	}
+
+	raw := announceNack(testPushSDP)
+	for _, pt := range []int{96, 8, 107} {
+		if !strings.Contains(raw, fmt.Sprintf("a=rtcp-fb:%d nack\r\n", pt)) {
+			t.Fatalf("expect NACK of %d announced, got %q", pt, raw)
+		}
+	}
+	if again := announceNack(raw); again != raw {
+		t.Fatalf("expect NACK announced once, got %q", again)
+	}
+	sdp, err := ParseSDP(raw)
+	if err != nil || !sdp.Media[0].FeedbackNack() {
+		t.Fatalf("expect NACK feedback of media, got %v %v", sdp, err)
+	}
+}
+
+// testRTCPReport returns an empty receiver report leading compound RTCP
+func testRTCPReport() []byte {
+	return []byte{0x80, 201, 0, 1, 0, 0, 0, 1}
+}
+
+func listenTestUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readTestUDP(t *testing.T, conn *net.UDPConn) []byte {
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestPlayerNack(t *testing.T) {
+	cfg := config.GlobalConfig()
+	nack := cfg.RTSP.Nack
+	t.Cleanup(func() { cfg.RTSP.Nack = nack })
+	cfg.RTSP.Nack.Enable = true
+	cfg.RTSP.Nack.History = 512
+	s := newTestServer(t)
+	url := fmt.Sprintf("rtsp://%s/live/nack", s.Addr())
+
+	// pusher of UDP transport announcing NACK of video
+	sdp := strings.Replace(testPushSDP, "a=control:streamid=0\r\n", "a=control:streamid=0\r\na=rtcp-fb:96 nack\r\n", 1)
+	push := dialTestConn(t, s)
+	if code, _ := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, sdp); code != 200 {
+		t.Fatalf("announce failed: %d", code)
+	}
+	pushRTP, pushRTCP := listenTestUDP(t), listenTestUDP(t)
+	code, header := push.request("SETUP", url+"/streamid=0", map[string]string{
+		"Transport": fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;mode=record",
+			pushRTP.LocalAddr().(*net.UDPAddr).Port, pushRTCP.LocalAddr().(*net.UDPAddr).Port),
+	}, "")
+	matches := regexp.MustCompile(`server_port=(\d+)-(\d+)`).FindStringSubmatch(header["Transport"])
+	if code != 200 || matches == nil {
+		t.Fatalf("setup failed: %d %v", code, header)
+	}
+	if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+		t.Fatalf("record failed: %d", code)
+	}
+	port, _ := strconv.Atoi(matches[1])
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	pusher := s.GetPusher("/live/nack")
+	if raw := pusher.PlayerSDPRaw(); !strings.Contains(raw, "a=rtcp-fb:8 nack") {
+		t.Fatalf("expect NACK announced to players, got %q", raw)
+	}
+
+	// player of UDP transport
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	playRTP, playRTCP := listenTestUDP(t), listenTestUDP(t)
+	code, header = play.request("SETUP", url+"/streamid=0", map[string]string{
+		"Transport": fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d",
+			playRTP.LocalAddr().(*net.UDPAddr).Port, playRTCP.LocalAddr().(*net.UDPAddr).Port),
+	}, "")
+	matches = regexp.MustCompile(`server_port=(\d+)-(\d+)`).FindStringSubmatch(header["Transport"])
+	if code != 200 || matches == nil {
+		t.Fatalf("setup failed: %d %v", code, header)
+	}
+	if code, _ := play.request("PLAY", url, nil, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	port, _ = strconv.Atoi(matches[2])
+	serverRTCP := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	waitFor(t, "player", func() bool { return len(pusher.GetPlayers()) == 1 })
+	var player *Player
+	for _, p := range pusher.GetPlayers() {
+		player = p
+	}
+
+	// RTP lost of pusher requested by NACK
+	for _, seq := range []int{1, 4} {
+		if _, err := pushRTP.WriteToUDP(testRTP(96, seq, byte(seq)), server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seqs := parseNacks(readTestUDP(t, pushRTCP)); !reflect.DeepEqual(seqs, []uint16{2, 3}) {
+		t.Fatalf("expect NACK of RTP lost sent to pusher, got %v", seqs)
+	}
+	for _, seq := range []int{1, 4} {
+		if got := binary.BigEndian.Uint16(readTestUDP(t, playRTP)[2:]); int(got) != seq {
+			t.Fatalf("expect RTP %d played, got %d", seq, got)
+		}
+	}
+
+	// RTP kept retransmitted by NACK of player, and RTP not kept ignored
+	if _, err := playRTCP.WriteToUDP(append(testRTCPReport(), buildNack(1, 0, []uint16{1, 2, 4})...), serverRTCP); err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range []int{1, 4} {
+		if data := readTestUDP(t, playRTP); int(binary.BigEndian.Uint16(data[2:])) != seq || data[12] != byte(seq) {
+			t.Fatalf("expect RTP %d retransmitted, got %x", seq, data)
+		}
+	}
+	waitFor(t, "retransmitted", func() bool { return player.RetransmittedPackets() == 2 })
+}
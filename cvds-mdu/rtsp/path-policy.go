@@ -0,0 +1,233 @@
+package rtsp
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/msu"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy returns the effective policy of pusher path
+func (pusher *Pusher) Policy() *config.PathPolicy {
+	return pusher.policy.Load().(*config.PathPolicy)
+}
+
+// setPolicy applies policy of path to pusher, players added after that use
+// the queue limit of policy
+func (pusher *Pusher) setPolicy(policy *config.PathPolicy) {
+	pusher.policy.Store(policy)
+	pusher.queueLock.Lock()
+	pusher.gopCacheEnable = !policy.DisableGopCache
+	pusher.gopCacheSize = policy.GopCacheSize
+	if !pusher.gopCacheEnable || pusher.gopCacheSize > 0 && pusher.GopCacheBytes() > pusher.gopCacheSize {
+		pusher.releaseGopCache()
+	}
+	pusher.queueLock.Unlock()
+}
+
+// PlayersFull reports whether players of pusher reach max players of policy
+func (pusher *Pusher) PlayersFull() bool {
+	max := pusher.Policy().MaxPlayers
+	if max <= 0 {
+		return false
+	}
+	pusher.playersLock.RLock()
+	defer pusher.playersLock.RUnlock()
+	return len(pusher.players) >= max
+}
+
+// startIdleTimer stops the pusher pulling source on demand after idle
+// timeout without players, playersLock must be held
+func (pusher *Pusher) startIdleTimer() {
+	if pusher.idleTimeout <= 0 || pusher.idleTimer != nil {
+		return
+	}
+	pusher.idleTimer = time.AfterFunc(pusher.idleTimeout, func() {
+		pusher.playersLock.Lock()
+		idle := len(pusher.players) == 0
+		pusher.idleTimer = nil
+		pusher.playersLock.Unlock()
+		if idle {
+			pusher.Logger().Info("on demand source idle, stop it", log.String("pusher", pusher.String()))
+			pusher.Stop()
+		}
+	})
+}
+
+// startRecord hands off pusher to MSU by starting a record channel of the
+// pusher path
+func (pusher *Pusher) startRecord() {
+	pusher.recordLock.Lock()
+	defer pusher.recordLock.Unlock()
+	if pusher.recordChannel != "" || pusher.Stopped() {
+		return
+	}
+	server := pusher.Server()
+	if server == nil {
+		return
+	}
+	policy := pusher.Policy()
+	name := strings.TrimPrefix(pusher.Path(), "/")
+	uuid, err := msu.GetClient().StartChannel(name, server.URL(pusher.Path()), "tcp", policy.RecordMode, map[string]any{
+		"path": pusher.Path(),
+	})
+	if err != nil {
+		pusher.Logger().ErrorWith("start msu record channel error", err, log.String("pusher", pusher.String()))
+		return
+	}
+	pusher.recordChannel = uuid
+	pusher.Logger().Info("pusher recording by msu", log.String("pusher", pusher.String()), log.String("channel", uuid))
+}
+
+// stopRecord stops record channel of pusher if started
+func (pusher *Pusher) stopRecord() {
+	pusher.recordLock.Lock()
+	defer pusher.recordLock.Unlock()
+	if pusher.recordChannel == "" {
+		return
+	}
+	if err := msu.GetClient().StopChannel(pusher.recordChannel); err != nil {
+		pusher.Logger().ErrorWith("stop msu record channel error", err, log.String("pusher", pusher.String()))
+	}
+	pusher.recordChannel = ""
+}
+
+// URL returns rtsp url of path on local server
+func (s *Server) URL(path string) string {
+	host := "127.0.0.1"
+	if s.addr != nil && s.addr.IP != nil && !s.addr.IP.IsUnspecified() {
+		host = s.addr.IP.String()
+	}
+	port := 554
+	if s.addr != nil {
+		port = s.addr.Port
+	}
+	return fmt.Sprintf("rtsp://%s%s", net.JoinHostPort(host, strconv.Itoa(port)), path)
+}
+
+// sourcePull is a pull of source of path in flight, shared by requests of
+// path until done
+type sourcePull struct {
+	done   chan struct{}
+	pusher *Pusher
+	err    error
+}
+
+// pullOnce returns the pusher already started on path if any, otherwise
+// pusher pulled by pull. Requests of path pulled meanwhile wait for the pull
+// in flight and share its result, pulls of other paths are not blocked
+func (s *Server) pullOnce(path string, pull func() (*Pusher, error)) (*Pusher, error) {
+	s.sourceLock.Lock()
+	if pusher := s.GetPusher(path); pusher != nil {
+		s.sourceLock.Unlock()
+		return pusher, nil
+	}
+	if p := s.sourcePulls[path]; p != nil {
+		s.sourceLock.Unlock()
+		<-p.done
+		return p.pusher, p.err
+	}
+	p := &sourcePull{done: make(chan struct{})}
+	if s.sourcePulls == nil {
+		s.sourcePulls = make(map[string]*sourcePull)
+	}
+	s.sourcePulls[path] = p
+	s.sourceLock.Unlock()
+
+	p.pusher, p.err = pull()
+	s.sourceLock.Lock()
+	delete(s.sourcePulls, path)
+	s.sourceLock.Unlock()
+	close(p.done)
+	return p.pusher, p.err
+}
+
+// PullSource starts pulling source of path on demand, the pusher already
+// started on path is returned if any. Sources with backup ones are pulled
+// by failover
+func (s *Server) PullSource(path string, policy *config.PathPolicy) (*Pusher, error) {
+	return s.pullOnce(path, func() (*Pusher, error) {
+		return s.pullSource(path, policy)
+	})
+}
+
+func (s *Server) pullSource(path string, policy *config.PathPolicy) (*Pusher, error) {
+	transType := ParseTransType(policy.SourceTransType)
+	var pusher *Pusher
+	if len(policy.Sources) > 1 {
+		failover, err := NewFailover(s, path, policy.Sources, transType, policy.SourceProfile, policy.FailoverTimeout)
+		if err != nil {
+			return nil, err
+		}
+		pusher = NewFeederPusher(failover.Feeder)
+	} else {
+		var err error
+		if pusher, err = s.pullClient(path, policy.Sources[0], transType, policy.SourceProfile, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.addSourcePusher(pusher, policy.SourceIdleTimeout); err != nil {
+		return nil, err
+	}
+	s.logger.Info("pull source on demand", log.String("path", path), log.Strings("sources", policy.Sources))
+	return pusher, nil
+}
+
+// pullClient starts a client pusher pulling url to path, profile is the name
+// of client profile, default the profile of host matched
+func (s *Server) pullClient(path string, url string, transType TransType, profile string, headers map[string]string) (*Pusher, error) {
+	agent := fmt.Sprintf("MDU/%s", config.GlobalConfig().Version)
+	client, err := NewRTSPClient(s, url, 0, agent)
+	if err != nil {
+		return nil, err
+	}
+	client.CustomPath = path
+	client.TransType = transType
+	client.Headers = headers
+	if profile != "" {
+		client.Profile = config.RtspConfig().ClientProfile(profile, "")
+	}
+	pusher := NewClientPusher(client)
+	if err := client.Start(0); err != nil {
+		return nil, err
+	}
+	return pusher, nil
+}
+
+// addSourcePusher adds pusher pulling source, which is stopped after idle
+// timeout without players
+func (s *Server) addSourcePusher(pusher *Pusher, idleTimeout time.Duration) error {
+	pusher.idleTimeout = idleTimeout
+	if !s.AddPusher(pusher) {
+		pusher.Stop()
+		return fmt.Errorf("rtsp path %s already exists", pusher.Path())
+	}
+	// stopped if no player joins
+	pusher.playersLock.Lock()
+	pusher.startIdleTimer()
+	pusher.playersLock.Unlock()
+	return nil
+}
+
+// reloadPolicies re-resolves policies of pushers and players, memory limits
+// and cluster after config reloaded
+func (s *Server) reloadPolicies() {
+	s.memory.reload()
+	s.reloadCluster()
+	for _, pusher := range s.GetPushers() {
+		policy := config.RtspConfig().PathPolicy(pusher.Path())
+		pusher.setPolicy(policy)
+		for _, player := range pusher.GetPlayers() {
+			player.cursor.SetLimit(policy.QueueLimit)
+		}
+		if policy.Record {
+			go pusher.startRecord()
+		} else {
+			go pusher.stopRecord()
+		}
+	}
+}
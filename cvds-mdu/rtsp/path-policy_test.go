@@ -0,0 +1,128 @@
+package rtsp
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"testing"
+	"time"
+)
+
+func TestPathPolicy(t *testing.T) {
+	disable := true
+	paths := config.RtspConfig().Paths
+	config.RtspConfig().Paths = []config.RtspPath{
+		{Path: "/limited/*", MaxPlayers: 1, DisableGopCache: &disable, QueueLimit: 16},
+		{Path: "/demand"},
+	}
+	defer func() { config.RtspConfig().Paths = paths }()
+	s := newTestServer(t)
+	base := fmt.Sprintf("rtsp://%s", s.Addr())
+	config.RtspConfig().Paths[1].Source = base + "/live/source"
+	config.RtspConfig().Paths[1].SourceIdleTimeout = 100 * time.Millisecond
+
+	push := func(path string) *Pusher {
+		conn := dialTestConn(t, s)
+		if code, _ := conn.request("ANNOUNCE", base+path, map[string]string{"Content-Type": "application/sdp"}, testPushSDP); code != 200 {
+			t.Fatalf("announce %s failed: %d", path, code)
+		}
+		code, _ := conn.request("SETUP", base+path+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, "")
+		if code != 200 {
+			t.Fatalf("setup %s failed: %d", path, code)
+		}
+		if code, _ := conn.request("RECORD", base+path, nil, ""); code != 200 {
+			t.Fatalf("record %s failed: %d", path, code)
+		}
+		return s.GetPusher(path)
+	}
+	play := func(path string) (*testConn, int) {
+		conn := dialTestConn(t, s)
+		if code, _ := conn.request("DESCRIBE", base+path, nil, ""); code != 200 {
+			return conn, code
+		}
+		code, header := conn.request("SETUP", base+path+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, "")
+		if code != 200 {
+			return conn, code
+		}
+		code, _ = conn.request("PLAY", base+path, map[string]string{"Session": header["Session"]}, "")
+		return conn, code
+	}
+
+	// policy of matched entry applied to pusher and players
+	pusher := push("/limited/a")
+	if pusher == nil || pusher.Policy().Pattern != "/limited/*" || pusher.gopCacheEnable {
+		t.Fatal("expect policy of /limited/* applied")
+	}
+	if _, code := play("/limited/a"); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	waitFor(t, "player", func() bool { return len(pusher.GetPlayers()) == 1 })
+	for _, player := range pusher.GetPlayers() {
+		if player.cursor.Limit() != 16 {
+			t.Fatalf("expect queue limit 16, got %d", player.cursor.Limit())
+		}
+	}
+	if _, code := play("/limited/a"); code != 453 {
+		t.Fatalf("expect player over max players rejected, got %d", code)
+	}
+
+	// policy re-resolved after reload
+	config.RtspConfig().Paths[0].DisableGopCache = nil
+	config.RtspConfig().Paths[0].QueueLimit = 0
+	s.reloadPolicies()
+	if pusher.Policy().DisableGopCache || !pusher.gopCacheEnable {
+		t.Fatal("expect gop cache enabled after reload")
+	}
+	for _, player := range pusher.GetPlayers() {
+		if player.cursor.Limit() != pusher.ring.Size() {
+			t.Fatalf("expect queue limit of ring size, got %d", player.cursor.Limit())
+		}
+	}
+
+	// source pulled on demand, and stopped after idle without players
+	push("/live/source")
+	conn, code := play("/demand")
+	if code != 200 {
+		t.Fatalf("play on demand failed: %d", code)
+	}
+	demand := s.GetPusher("/demand")
+	if demand == nil || demand.Client == nil {
+		t.Fatal("expect source pulled on demand")
+	}
+	waitFor(t, "on demand player", func() bool { return len(demand.GetPlayers()) == 1 })
+	conn.request("TEARDOWN", base+"/demand", nil, "")
+	waitFor(t, "on demand source stopped", func() bool { return s.GetPusher("/demand") == nil })
+}
+
+func TestPathPolicySwitch(t *testing.T) {
+	enable := true
+	paths := config.RtspConfig().Paths
+	config.RtspConfig().Paths = []config.RtspPath{{Path: "/protected", EnableAuthorization: &enable}}
+	defer func() { config.RtspConfig().Paths = paths }()
+	s := newTestServer(t)
+	base := fmt.Sprintf("rtsp://%s", s.Addr())
+	announce := map[string]string{"Content-Type": "application/sdp"}
+
+	push := dialTestConn(t, s)
+	if code, _ := push.request("ANNOUNCE", base+"/open", announce, testPushSDP); code != 200 {
+		t.Fatalf("announce failed: %d", code)
+	}
+	if code, _ := dialTestConn(t, s).request("ANNOUNCE", base+"/protected", announce, testPushSDP); code != 401 {
+		t.Fatalf("expect protected path unauthorized, got %d", code)
+	}
+
+	// policy of path requested applied, paths other than the one bound to
+	// session rejected
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", base+"/open", nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	if code, _ := play.request("ANNOUNCE", base+"/protected", announce, testPushSDP); code != 455 {
+		t.Fatalf("expect announce after describe of other path rejected, got %d", code)
+	}
+	if code, _ := push.request("ANNOUNCE", base+"/protected", announce, testPushSDP); code != 455 {
+		t.Fatalf("expect announce of other path rejected, got %d", code)
+	}
+	if s.GetPusher("/protected") != nil {
+		t.Fatal("expect no pusher of protected path")
+	}
+}
@@ -3,114 +3,277 @@ package rtsp
 import (
 	"github.com/CVDS2020/CVDS2020/common/log"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// drop states of player recovering from lagging
+const (
+	dropNone = iota
+	dropFrame
+	dropToKeyframe
+)
+
 type Player struct {
+	// packets overwritten in ring before read since player lagging, and
+	// packets dropped by lag policy
+	lostPackets    uint64
+	droppedPackets uint64
+	// packets retransmitted requested by NACKs of player
+	retransmittedPackets uint64
+	// bytes of gop not sent yet
+	gopBytes int64
+
 	*Session
-	Pusher               *Pusher
-	cond                 *sync.Cond
-	queue                []*RTPPack
+	Pusher *Pusher
+	// gop is the cached GOP of pusher when player added, sent before packets
+	// read from cursor
+	gop                  []*RTPPack
+	cursor               *rtpCursor
 	queueLimit           uint
 	dropPacketWhenPaused bool
 	paused               bool
+	writeLatency         time.Duration
+
+	lagPolicy         string
+	disconnectLag     time.Duration
+	lagSince          time.Time
+	dropping          int
+	damagedFrame      bool
+	damagedTimestamp  int
+	videoTrack        int
+	videoCodec        string
+	spsPpsInSTAPaPack bool
+	rtpInfo           RTPInfo
 }
 
 func NewPlayer(session *Session, pusher *Pusher) (player *Player) {
 	player = &Player{
 		Session:              session,
 		Pusher:               pusher,
-		cond:                 sync.NewCond(&sync.Mutex{}),
-		queue:                make([]*RTPPack, 0),
-		queueLimit:           config.RtspConfig().Player.QueueLimit,
+		queueLimit:           pusher.Policy().QueueLimit,
 		dropPacketWhenPaused: config.RtspConfig().Player.DropPacketWhenPaused,
 		paused:               false,
+		writeLatency:         config.RtspConfig().Player.WriteLatency,
+		lagPolicy:            config.RtspConfig().Player.LagPolicy,
+		disconnectLag:        config.RtspConfig().Player.DisconnectLag,
+		videoTrack:           pusher.VideoTrack(),
+		videoCodec:           pusher.VCodec(),
 	}
+	session.RTPHandles = append(session.RTPHandles, player.talk)
 	session.StopHandles = append(session.StopHandles, func() {
 		pusher.RemovePlayer(player)
-		player.cond.Broadcast()
+		if player.cursor != nil {
+			player.cursor.Close()
+		}
 	})
 	return
 }
 
-func (player *Player) QueueRTP(pack *RTPPack) *Player {
-	logger := player.logger
-	if pack == nil {
-		logger.Warn("player queue enter nil pack, drop it")
-		return player
-	}
-	if player.paused && player.dropPacketWhenPaused {
-		return player
+// next returns next packet to send, the cached GOP first
+func (player *Player) next() (pack *RTPPack, lost uint64) {
+	if len(player.gop) > 0 {
+		pack = player.gop[0]
+		player.gop[0] = nil
+		player.gop = player.gop[1:]
+		atomic.AddInt64(&player.gopBytes, -int64(pack.Len()))
+		return
 	}
-	player.cond.L.Lock()
-	player.queue = append(player.queue, pack)
-	if oldLen := len(player.queue); player.queueLimit > 0 && oldLen > int(player.queueLimit) {
-		player.queue = player.queue[1:]
-		if config.RtspConfig().EnableDebug {
-			l := len(player.queue)
-			logger.Debug("Queue RTP",
-				log.String("player", player.String()),
-				log.Uint("exceeds limit", player.queueLimit),
-				log.Int("dropped old packets", oldLen-l),
-				log.Int("current queue len", l),
-			)
-		}
-	}
-	player.cond.Signal()
-	player.cond.L.Unlock()
-	return player
+	return player.cursor.Next()
 }
 
 func (player *Player) Start() {
 	logger := player.logger
 	timer := time.Unix(0, 0)
-	for !player.Stopped {
-		var pack *RTPPack
-		player.cond.L.Lock()
-		if len(player.queue) == 0 {
-			player.cond.Wait()
-		}
-		if len(player.queue) > 0 {
-			pack = player.queue[0]
-			player.queue = player.queue[1:]
-		}
-		queueLen := len(player.queue)
-		player.cond.L.Unlock()
+	defer player.releaseGop()
+	defer player.releaseBatch()
+	for !player.Stopped() && !player.cursor.Closed() {
 		if player.paused {
+			if !player.flush() {
+				return
+			}
+			if player.dropPacketWhenPaused {
+				player.releaseGop()
+				player.cursor.Skip()
+			}
+			player.cursor.Park()
 			continue
 		}
+		pack, lost := player.next()
+		if lost > 0 {
+			if config.RtspConfig().EnableDebug {
+				logger.Debug("Player lagged",
+					log.String("player", player.String()),
+					log.Uint64("exceeds limit", player.cursor.Limit()),
+					log.Uint64("dropped old packets", lost),
+				)
+			}
+			if player.lagged(lost) {
+				logger.Warn("player lagging too long, disconnect it",
+					log.String("player", player.String()),
+					log.Duration("lagging", time.Since(player.lagSince)),
+					log.Uint64("lost packets", player.LostPackets()),
+				)
+				if pack != nil {
+					pack.Release()
+				}
+				player.Stop()
+				return
+			}
+		}
 		if pack == nil {
-			if !player.Stopped {
-				logger.Warn("player not stoped, but queue take out nil pack")
+			// no more packets ready, write the batch if latency budget used up
+			if n, since := player.BatchedRTP(); n > 0 {
+				if wait := player.writeLatency - time.Since(since); wait > 0 {
+					player.cursor.WaitTimeout(wait)
+					continue
+				}
+				if !player.flush() {
+					return
+				}
+				continue
 			}
+			player.cursor.Wait()
 			continue
 		}
-		if err := player.SendRTP(pack); err != nil {
+		if player.dropping != dropNone && player.shouldDrop(pack) {
+			atomic.AddUint64(&player.droppedPackets, 1)
+			pack.Release()
+			continue
+		}
+		if !player.lagSince.IsZero() && player.cursor.Lag() <= player.cursor.Limit()/2 {
+			player.lagSince = time.Time{}
+		}
+		if err := player.BatchRTP(pack); err != nil {
+			if player.TransType == TransTypeTcp {
+				logger.ErrorWith("rtsp player write rtp error, disconnect it", err, log.String("player", player.String()))
+				pack.Release()
+				player.Stop()
+				return
+			}
 			logger.ErrorWith("rtsp player send rtp error", err)
 		}
+		packType := pack.Type
+		pack.Release()
 		elapsed := time.Now().Sub(timer)
 		if config.RtspConfig().EnableDebug && elapsed >= 30*time.Second {
 			logger.Debug("Send RTP",
 				log.String("player", player.String()),
-				log.String("package type", pack.Type.String()),
-				log.Int("queue len", queueLen),
+				log.String("package type", packType.String()),
+				log.Uint64("lag", player.cursor.Lag()),
 			)
 			timer = time.Now()
 		}
 	}
 }
 
+// flush writes the batched packets, the player of TCP transport is stopped
+// if failed
+func (player *Player) flush() bool {
+	if err := player.FlushRTP(); err != nil {
+		if player.TransType == TransTypeUdp {
+			player.logger.ErrorWith("rtsp player send rtp error", err)
+			return true
+		}
+		player.logger.ErrorWith("rtsp player write rtp error, disconnect it", err, log.String("player", player.String()))
+		player.Stop()
+		return false
+	}
+	return true
+}
+
+// lagged applies lag policy after lost packets, returns true if player
+// should be disconnected
+func (player *Player) lagged(lost uint64) bool {
+	atomic.AddUint64(&player.lostPackets, lost)
+	now := time.Now()
+	if player.lagSince.IsZero() {
+		player.lagSince = now
+	}
+	switch player.lagPolicy {
+	case config.LagPolicyDropFrame:
+		player.dropping, player.damagedFrame = dropFrame, false
+	case config.LagPolicyDropToKeyframe:
+		player.dropping = dropToKeyframe
+	case config.LagPolicyDisconnect:
+		player.dropping = dropToKeyframe
+		return now.Sub(player.lagSince) >= player.disconnectLag
+	}
+	return false
+}
+
+// shouldDrop reports whether pack dropped to recover from lagging, packets
+// of the damaged video frame, or video packets before next keyframe. Packets
+// of other tracks are never dropped
+func (player *Player) shouldDrop(pack *RTPPack) bool {
+	if pack.Track != player.videoTrack || pack.Type != RtpTypeVideo || !parseRTP(pack.Bytes(), &player.rtpInfo) {
+		return false
+	}
+	rtp := &player.rtpInfo
+	if shouldSequenceStart(player.videoCodec, rtp, &player.spsPpsInSTAPaPack) {
+		player.dropping = dropNone
+		return false
+	}
+	if player.dropping == dropFrame {
+		if !player.damagedFrame {
+			player.damagedFrame, player.damagedTimestamp = true, rtp.Timestamp
+			return true
+		}
+		if rtp.Timestamp == player.damagedTimestamp {
+			return true
+		}
+		player.dropping = dropNone
+		return false
+	}
+	return true
+}
+
+// LostPackets returns count of packets lost by lagging
+func (player *Player) LostPackets() uint64 {
+	return atomic.LoadUint64(&player.lostPackets)
+}
+
+// DroppedPackets returns count of packets dropped by lag policy
+func (player *Player) DroppedPackets() uint64 {
+	return atomic.LoadUint64(&player.droppedPackets)
+}
+
+// RetransmittedPackets returns count of packets retransmitted requested by
+// NACKs of player
+func (player *Player) RetransmittedPackets() uint64 {
+	return atomic.LoadUint64(&player.retransmittedPackets)
+}
+
+func (player *Player) countRetransmitted() {
+	atomic.AddUint64(&player.retransmittedPackets, 1)
+}
+
+func (player *Player) releaseGop() {
+	for _, pack := range player.gop {
+		pack.Release()
+	}
+	player.gop = nil
+	atomic.StoreInt64(&player.gopBytes, 0)
+}
+
+// QueuedBytes returns estimated bytes of packets waiting to be sent, of
+// cached GOP and packets in ring not read yet
+func (player *Player) QueuedBytes() int64 {
+	n := atomic.LoadInt64(&player.gopBytes)
+	if player.cursor != nil {
+		n += player.cursor.LagBytes()
+	}
+	return n
+}
+
 func (player *Player) Pause(paused bool) {
 	if paused {
 		player.logger.Info("Player Pause", log.String("player", player.String()))
 	} else {
 		player.logger.Info("Player Play", log.String("player", player.String()))
 	}
-	player.cond.L.Lock()
-	if paused && player.dropPacketWhenPaused && len(player.queue) > 0 {
-		player.queue = make([]*RTPPack, 0)
-	}
 	player.paused = paused
-	player.cond.L.Unlock()
+	if player.cursor != nil {
+		player.cursor.Signal()
+	}
 }
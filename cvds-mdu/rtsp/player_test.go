@@ -0,0 +1,145 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTCPPair returns both ends of a loopback TCP connection
+func testTCPPair(tb testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn, peer
+}
+
+// newTestPlayer creates TCP player of the first track of pusher on conn
+func newTestPlayer(pusher *Pusher, conn net.Conn, writeTimeout time.Duration) (*Session, *Player) {
+	rc := NewRichConn(conn, 0, writeTimeout)
+	session := &Session{
+		ID:     "player",
+		Conn:   rc,
+		Type:   SessionTypePlayer,
+		connRW: bufio.NewReadWriter(bufio.NewReader(rc), bufio.NewWriter(rc)),
+		logger: assert.Must(config.LogConfig().Build("rtsp.session")),
+	}
+	session.channels.set(0, pusher.SDP().Media[0], 0, 1)
+	return session, NewPlayer(session, pusher)
+}
+
+func TestPlayerLagPolicy(t *testing.T) {
+	frame := func(track int, typ RTPType, ts uint32, nalu byte) *RTPPack {
+		pkt := testRTP(96, 0, nalu)
+		binary.BigEndian.PutUint32(pkt[4:], ts)
+		return copyRTPPack(track, typ, append(pkt, 0))
+	}
+	// packets after lagging: rest of damaged frame, a P frame, audio, keyframe
+	packs := []*RTPPack{
+		frame(0, RtpTypeVideo, 1, 0x41),
+		frame(0, RtpTypeVideo, 1, 0x41),
+		frame(0, RtpTypeVideo, 2, 0x41),
+		frame(1, RtpTypeAudio, 2, 0xD5),
+		frame(0, RtpTypeVideo, 3, 0x65),
+		frame(0, RtpTypeVideo, 4, 0x41),
+	}
+	defer func() {
+		for _, pack := range packs {
+			pack.Release()
+		}
+	}()
+	tests := []struct {
+		policy string
+		sent   string
+	}{
+		{config.LagPolicyDropOldest, "111111"},
+		{config.LagPolicyDropFrame, "001111"},
+		{config.LagPolicyDropToKeyframe, "000111"},
+		{config.LagPolicyDisconnect, "000111"},
+	}
+	for _, test := range tests {
+		player := &Player{lagPolicy: test.policy, disconnectLag: time.Minute, videoCodec: CodecH264}
+		if player.lagged(3) {
+			t.Fatalf("%s: unexpected disconnect", test.policy)
+		}
+		sent := ""
+		for _, pack := range packs {
+			if player.dropping != dropNone && player.shouldDrop(pack) {
+				sent += "0"
+			} else {
+				sent += "1"
+			}
+		}
+		if sent != test.sent || player.LostPackets() != 3 {
+			t.Errorf("%s: expect sent %s, got %s", test.policy, test.sent, sent)
+		}
+	}
+
+	player := &Player{lagPolicy: config.LagPolicyDisconnect, disconnectLag: time.Minute}
+	player.lagged(1)
+	player.lagSince = player.lagSince.Add(-time.Minute)
+	if !player.lagged(1) || player.LostPackets() != 2 {
+		t.Fatal("expect disconnect after lagging sustained")
+	}
+}
+
+func TestPlayerBatchWrite(t *testing.T) {
+	feeder, err := NewFeeder(nil, "/test", "test://", testPushSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher := NewFeederPusher(feeder)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session, player := newTestPlayer(pusher, conn, 100*time.Millisecond)
+	pusher.AddPlayer(player)
+
+	feed := func(seq int) {
+		pack := copyRTPPack(0, RtpTypeVideo, testRTP(96, seq, 0x41))
+		feeder.Feed(pack)
+		pack.Release()
+	}
+	for i := 0; i < 10; i++ {
+		feed(i)
+	}
+	reader := NewFrameReader(peer)
+	defer reader.Close()
+	for i := 0; i < 10; i++ {
+		peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq := int(binary.BigEndian.Uint16(frame.Data[2:])); frame.Channel != 0 || seq != i {
+			t.Fatalf("expect packet %d on channel 0, got %d on %d", i, seq, frame.Channel)
+		}
+		frame.Release()
+	}
+
+	// peer stops reading, player disconnected by write deadline
+	for i := 10; i < 20; i++ {
+		feed(i)
+	}
+	waitFor(t, "player disconnected", func() bool { return len(pusher.GetPlayers()) == 0 })
+	if !session.Stopped() {
+		t.Fatal("expect session stopped")
+	}
+}
@@ -5,27 +5,59 @@ import (
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Pusher struct {
 	*Session
 	*Client
-	players           map[string]*Player //SessionID <-> Player
-	playersLock       sync.RWMutex
-	gopCacheEnable    bool
-	gopCache          []*RTPPack
-	gopCacheLock      sync.RWMutex
+	*Feeder
+	players        map[string]*Player //SessionID <-> Player
+	playersLock    sync.RWMutex
+	gopCacheEnable bool
+	gopCacheSize   int64
+	gopCache       []*RTPPack
+	gopBytes       int64
+	// gopTrimmed is set when GOP cache trimmed for memory, GOP larger than
+	// cache size or video packets lost, packets are not cached until next GOP
+	gopTrimmed        bool
 	UDPServer         *UDPServer
 	spsPpsInSTAPaPack bool
-	cond              *sync.Cond
-	queue             []*RTPPack
+	ring              *rtpRing
+	// queueLock serializes packets of receiving goroutines writing to ring,
+	// and guards gopCache
+	queueLock sync.Mutex
+	rtpInfo   RTPInfo
+	// analyzer of stream created on the first packet, guarded by queueLock
+	analyzer *streamAnalyzer
+	// RTP kept for retransmission requested by NACKs of players, created on
+	// the first packet if NACK enabled, guarded by queueLock
+	rtx *rtxHistory
+
+	policy atomic.Value // *config.PathPolicy
+	// source pulled on demand is stopped after idle without players
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	// uuid of MSU record channel of pusher
+	recordChannel string
+	recordLock    sync.Mutex
+	// called with the new SDP when SDP changed incompatibly, for muxers of
+	// the stream to reset
+	SDPChangeHandles []func(*SDP)
+	// talker holding backchannel of source and time it talked last
+	talker   string
+	talkAt   time.Time
+	talkLock sync.Mutex
 }
 
 func (pusher *Pusher) String() string {
 	if pusher.Session != nil {
 		return pusher.Session.String()
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.String()
+	}
 	return pusher.Client.String()
 }
 
@@ -33,6 +65,9 @@ func (pusher *Pusher) Server() *Server {
 	if pusher.Session != nil {
 		return pusher.Session.Server
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.Server
+	}
 	return pusher.Client.Server
 }
 
@@ -40,20 +75,52 @@ func (pusher *Pusher) SDPRaw() string {
 	if pusher.Session != nil {
 		return pusher.Session.SDPRaw
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.SDPRaw
+	}
 	return pusher.Client.SDPRaw
 }
 
+// PlayerSDPRaw returns SDP described to players, which announces Generic
+// NACK of media if NACK enabled. Keys and secured profiles of source are
+// removed since RTP of source is unprotected by server
+func (pusher *Pusher) PlayerSDPRaw() string {
+	raw := plainSDP(pusher.SDPRaw())
+	if !config.RtspConfig().Nack.Enable {
+		return raw
+	}
+	return announceNack(raw)
+}
+
+// retransmission returns RTP of track of sequence number seq kept for
+// retransmission referenced, nil if not kept
+func (pusher *Pusher) retransmission(track int, seq uint16) *RTPPack {
+	pusher.queueLock.Lock()
+	rtx := pusher.rtx
+	pusher.queueLock.Unlock()
+	if rtx == nil {
+		return nil
+	}
+	return rtx.get(track, seq)
+}
+
 func (pusher *Pusher) Stopped() bool {
 	if pusher.Session != nil {
-		return pusher.Session.Stopped
+		return pusher.Session.Stopped()
+	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.Stopped()
 	}
-	return pusher.Client.Stopped
+	return pusher.Client.Stopped()
 }
 
 func (pusher *Pusher) Path() string {
 	if pusher.Session != nil {
 		return pusher.Session.Path
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.Path
+	}
 	if pusher.Client.CustomPath != "" {
 		return pusher.Client.CustomPath
 	}
@@ -64,6 +131,9 @@ func (pusher *Pusher) ID() string {
 	if pusher.Session != nil {
 		return pusher.Session.ID
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.ID
+	}
 	return pusher.Client.ID
 }
 
@@ -71,77 +141,127 @@ func (pusher *Pusher) Logger() *log.Logger {
 	if pusher.Session != nil {
 		return pusher.Session.logger
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.logger
+	}
 	return pusher.Client.logger
 }
 
-func (pusher *Pusher) VCodec() string {
+func (pusher *Pusher) SDP() *SDP {
 	if pusher.Session != nil {
-		return pusher.Session.VCodec
+		return pusher.Session.SDP
 	}
-	return pusher.Client.VCodec
+	if pusher.Feeder != nil {
+		return pusher.Feeder.SDP
+	}
+	return pusher.Client.SDP
+}
+
+// VideoTrack returns index of the first video track, -1 if no video
+func (pusher *Pusher) VideoTrack() int {
+	i, _ := pusher.SDP().Track("video")
+	return i
+}
+
+func (pusher *Pusher) VCodec() string {
+	if _, media := pusher.SDP().Track("video"); media != nil {
+		return media.Codec()
+	}
+	return ""
 }
 
 func (pusher *Pusher) ACodec() string {
-	if pusher.Session != nil {
-		return pusher.Session.ACodec
+	if _, media := pusher.SDP().Track("audio"); media != nil {
+		return media.Codec()
 	}
-	return pusher.Client.ACodec
+	return ""
 }
 
 func (pusher *Pusher) AControl() string {
-	if pusher.Session != nil {
-		return pusher.Session.AControl
+	if _, media := pusher.SDP().Track("audio"); media != nil {
+		return media.Control()
 	}
-	return pusher.Client.AControl
+	return ""
 }
 
 func (pusher *Pusher) VControl() string {
-	if pusher.Session != nil {
-		return pusher.Session.VControl
+	if _, media := pusher.SDP().Track("video"); media != nil {
+		return media.Control()
 	}
-	return pusher.Client.VControl
+	return ""
 }
 
 func (pusher *Pusher) URL() string {
 	if pusher.Session != nil {
 		return pusher.Session.URL
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.Source()
+	}
 	return pusher.Client.URL
 }
 
 func (pusher *Pusher) AddOutputBytes(size int) {
 	if pusher.Session != nil {
-		pusher.Session.OutBytes += size
+		atomic.AddInt64(&pusher.Session.OutBytes, int64(size))
+		return
+	}
+	if pusher.Feeder != nil {
+		atomic.AddInt64(&pusher.Feeder.OutBytes, int64(size))
 		return
 	}
-	pusher.Client.OutBytes += size
+	atomic.AddInt64(&pusher.Client.OutBytes, int64(size))
 }
 
 func (pusher *Pusher) InBytes() int {
 	if pusher.Session != nil {
-		return pusher.Session.InBytes
+		return int(atomic.LoadInt64(&pusher.Session.InBytes))
+	}
+	if pusher.Feeder != nil {
+		return int(atomic.LoadInt64(&pusher.Feeder.InBytes))
 	}
-	return pusher.Client.InBytes
+	return int(atomic.LoadInt64(&pusher.Client.InBytes))
 }
 
 func (pusher *Pusher) OutBytes() int {
 	if pusher.Session != nil {
-		return pusher.Session.OutBytes
+		return int(atomic.LoadInt64(&pusher.Session.OutBytes))
 	}
-	return pusher.Client.OutBytes
+	if pusher.Feeder != nil {
+		return int(atomic.LoadInt64(&pusher.Feeder.OutBytes))
+	}
+	return int(atomic.LoadInt64(&pusher.Client.OutBytes))
 }
 
 func (pusher *Pusher) TransType() string {
 	if pusher.Session != nil {
 		return pusher.Session.TransType.String()
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.TransType.String()
+	}
 	return pusher.Client.TransType.String()
 }
 
+// AutoTransType reports whether transport of source pulled is selected
+// automatically, TransType of client pulled is the one selected
+func (pusher *Pusher) AutoTransType() bool {
+	if pusher.Session != nil {
+		return false
+	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.TransType == TransTypeAuto
+	}
+	return pusher.Client.AutoTransType()
+}
+
 func (pusher *Pusher) StartAt() time.Time {
 	if pusher.Session != nil {
 		return pusher.Session.StartAt
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.StartAt
+	}
 	return pusher.Client.StartAt
 }
 
@@ -149,43 +269,62 @@ func (pusher *Pusher) Source() string {
 	if pusher.Session != nil {
 		return pusher.Session.URL
 	}
+	if pusher.Feeder != nil {
+		return pusher.Feeder.Source()
+	}
 	return pusher.Client.URL
 }
 
 func NewClientPusher(client *Client) (pusher *Pusher) {
 	pusher = &Pusher{
-		Client:         client,
-		Session:        nil,
-		players:        make(map[string]*Player),
-		gopCacheEnable: !config.RtspConfig().Pusher.DisableGopCache,
-		gopCache:       make([]*RTPPack, 0),
-
-		cond:  sync.NewCond(&sync.Mutex{}),
-		queue: make([]*RTPPack, 0),
+		Client:   client,
+		Session:  nil,
+		players:  make(map[string]*Player),
+		gopCache: make([]*RTPPack, 0),
+		ring:     newRTPRing(config.RtspConfig().Pusher.RingSize),
 	}
+	pusher.setPolicy(config.RtspConfig().PathPolicy(pusher.Path()))
 	client.RTPHandles = append(client.RTPHandles, func(pack *RTPPack) {
 		pusher.QueueRTP(pack)
 	})
+	client.GapHandles = append(client.GapHandles, pusher.markGap)
 	client.StopHandles = append(client.StopHandles, func() {
 		pusher.ClearPlayer()
 		pusher.Server().RemovePusher(pusher)
-		pusher.cond.Broadcast()
+		pusher.ring.Close()
 	})
 	return
 }
 
-func NewPusher(session *Session) (pusher *Pusher) {
+func NewFeederPusher(feeder *Feeder) (pusher *Pusher) {
 	pusher = &Pusher{
-		Session:        session,
-		Client:         nil,
-		players:        make(map[string]*Player),
-		gopCacheEnable: !config.RtspConfig().Pusher.DisableGopCache,
-		gopCache:       make([]*RTPPack, 0),
+		Feeder:   feeder,
+		players:  make(map[string]*Player),
+		gopCache: make([]*RTPPack, 0),
+		ring:     newRTPRing(config.RtspConfig().Pusher.RingSize),
+	}
+	pusher.setPolicy(config.RtspConfig().PathPolicy(pusher.Path()))
+	feeder.RTPHandles = append(feeder.RTPHandles, func(pack *RTPPack) {
+		pusher.QueueRTP(pack)
+	})
+	feeder.StopHandles = append(feeder.StopHandles, func() {
+		pusher.ClearPlayer()
+		pusher.Server().RemovePusher(pusher)
+		pusher.ring.Close()
+	})
+	return
+}
 
-		cond:  sync.NewCond(&sync.Mutex{}),
-		queue: make([]*RTPPack, 0),
+func NewPusher(session *Session) (pusher *Pusher) {
+	pusher = &Pusher{
+		Session:  session,
+		Client:   nil,
+		players:  make(map[string]*Player),
+		gopCache: make([]*RTPPack, 0),
+		ring:     newRTPRing(config.RtspConfig().Pusher.RingSize),
 	}
 	pusher.bindSession(session)
+	pusher.setPolicy(config.RtspConfig().PathPolicy(pusher.Path()))
 	return
 }
 
@@ -198,6 +337,11 @@ func (pusher *Pusher) bindSession(session *Session) {
 		}
 		pusher.QueueRTP(pack)
 	})
+	session.GapHandles = append(session.GapHandles, func(track int) {
+		if session == pusher.Session {
+			pusher.markGap(track)
+		}
+	})
 	session.StopHandles = append(session.StopHandles, func() {
 		if session != pusher.Session {
 			session.logger.Info("Session stop to release pusher.but pusher got a new session.", log.String("session", pusher.Session.ID))
@@ -205,7 +349,7 @@ func (pusher *Pusher) bindSession(session *Session) {
 		}
 		pusher.ClearPlayer()
 		pusher.Server().RemovePusher(pusher)
-		pusher.cond.Broadcast()
+		pusher.ring.Close()
 		if pusher.UDPServer != nil {
 			pusher.UDPServer.Stop()
 			pusher.UDPServer = nil
@@ -218,16 +362,20 @@ func (pusher *Pusher) RebindSession(session *Session) bool {
 		pusher.Logger().Warn("call RebindSession to a Client-Pusher. got false", log.String("session", session.ID))
 		return false
 	}
+	if pusher.Feeder != nil {
+		pusher.Logger().Warn("call RebindSession to a Feeder-Pusher. got false", log.String("session", session.ID))
+		return false
+	}
 	sess := pusher.Session
+	old := pusher.SDP()
 	pusher.bindSession(session)
 	session.Pusher = pusher
 
-	pusher.gopCacheLock.Lock()
-	pusher.gopCache = make([]*RTPPack, 0)
-	pusher.gopCacheLock.Unlock()
+	pusher.clearGopCache()
 	if sess != nil {
 		sess.Stop()
 	}
+	pusher.changeSDP(old)
 	return true
 }
 
@@ -236,6 +384,10 @@ func (pusher *Pusher) RebindClient(client *Client) bool {
 		pusher.Logger().Info("call RebindClient to a Session-Pusher. got false", log.String("client", client.ID))
 		return false
 	}
+	if pusher.Feeder != nil {
+		pusher.Logger().Info("call RebindClient to a Feeder-Pusher. got false", log.String("client", client.ID))
+		return false
+	}
 	sess := pusher.Client
 	pusher.Client = client
 	if sess != nil {
@@ -244,44 +396,155 @@ func (pusher *Pusher) RebindClient(client *Client) bool {
 	return true
 }
 
+// QueueRTP writes pack to the ring read by players, and caches it if it is
+// a packet of the current GOP. The ring holds a reference of pack until it
+// is overwritten
 func (pusher *Pusher) QueueRTP(pack *RTPPack) *Pusher {
-	pusher.cond.L.Lock()
-	pusher.queue = append(pusher.queue, pack)
-	pusher.cond.Signal()
-	pusher.cond.L.Unlock()
-	return pusher
-}
-
-func (pusher *Pusher) Start() {
-	logger := pusher.Logger()
-	for !pusher.Stopped() {
-		var pack *RTPPack
-		pusher.cond.L.Lock()
-		if len(pusher.queue) == 0 {
-			pusher.cond.Wait()
+	pusher.queueLock.Lock()
+	defer pusher.queueLock.Unlock()
+	if pusher.analyzer == nil {
+		pusher.analyzer = newStreamAnalyzer(pusher.SDP())
+	}
+	pusher.analyzer.observe(pack, time.Now())
+	if cfg := config.RtspConfig().Nack; cfg.Enable {
+		if pusher.rtx == nil {
+			pusher.rtx = newRTXHistory(cfg.History)
 		}
-		if len(pusher.queue) > 0 {
-			pack = pusher.queue[0]
-			pusher.queue = pusher.queue[1:]
+		pusher.rtx.add(pack)
+	}
+	if pusher.gopCacheEnable && pack.Type == RtpTypeVideo && pack.Track == pusher.VideoTrack() {
+		if parseRTP(pack.Bytes(), &pusher.rtpInfo) && pusher.shouldSequenceStart(&pusher.rtpInfo) {
+			pusher.releaseGopCache()
+			pusher.gopTrimmed = false
 		}
-		pusher.cond.L.Unlock()
-		if pack == nil {
-			if !pusher.Stopped() {
-				logger.Warn("pusher not stopped, but queue take out nil pack")
+		if !pusher.gopTrimmed {
+			if pusher.gopCacheSize > 0 && pusher.GopCacheBytes()+int64(pack.Len()) > pusher.gopCacheSize {
+				// GOP larger than cache size is not cached
+				pusher.releaseGopCache()
+				pusher.gopTrimmed = true
+			} else {
+				pack.AddRef()
+				pusher.gopCache = append(pusher.gopCache, pack)
+				pusher.addGopBytes(int64(pack.Len()))
 			}
-			continue
 		}
+	}
+	pusher.AddOutputBytes(pack.Len() * pusher.ring.Write(pack))
+	return pusher
+}
 
-		if pusher.gopCacheEnable && pack.Type == RtpTypeVideo {
-			pusher.gopCacheLock.Lock()
-			if rtp := ParseRTP(pack.Buffer.Bytes()); rtp != nil && pusher.shouldSequenceStart(rtp) {
-				pusher.gopCache = make([]*RTPPack, 0)
-			}
-			pusher.gopCache = append(pusher.gopCache, pack)
-			pusher.gopCacheLock.Unlock()
-		}
-		pusher.BroadcastRTP(pack)
+// markGap stops caching the current GOP after video packets of track lost,
+// players joining start from the next GOP intact
+func (pusher *Pusher) markGap(track int) {
+	if track != pusher.VideoTrack() {
+		return
+	}
+	pusher.queueLock.Lock()
+	defer pusher.queueLock.Unlock()
+	if pusher.gopCacheEnable {
+		pusher.releaseGopCache()
+		pusher.gopTrimmed = true
+	}
+}
+
+// JitterStats returns statistics of tracks reordered by jitter buffer of UDP
+// source, nil if no jitter buffer
+func (pusher *Pusher) JitterStats() []JitterStats {
+	var s *UDPServer
+	switch {
+	case pusher.Session != nil:
+		s = pusher.UDPServer
+	case pusher.Client != nil:
+		s = pusher.Client.UDPServer
+	}
+	if s == nil {
+		return nil
+	}
+	return s.JitterStats()
+}
+
+// StreamInfo returns codec parameters and frame statistics of video and audio
+func (pusher *Pusher) StreamInfo() StreamInfo {
+	return pusher.streamAnalyzer().info()
+}
+
+// ParameterSets returns the latest parameter sets of video and config of
+// audio parsed
+func (pusher *Pusher) ParameterSets() ParameterSets {
+	return pusher.streamAnalyzer().parameterSets()
+}
+
+func (pusher *Pusher) streamAnalyzer() *streamAnalyzer {
+	pusher.queueLock.Lock()
+	defer pusher.queueLock.Unlock()
+	if pusher.analyzer == nil {
+		pusher.analyzer = newStreamAnalyzer(pusher.SDP())
+	}
+	return pusher.analyzer
+}
+
+// Start waits until pusher stopped, and releases the packets buffered
+func (pusher *Pusher) Start() {
+	<-pusher.ring.Done()
+	pusher.queueLock.Lock()
+	pusher.ring.clear()
+	if pusher.rtx != nil {
+		pusher.rtx.clear()
+	}
+	pusher.queueLock.Unlock()
+	pusher.clearGopCache()
+}
+
+func (pusher *Pusher) clearGopCache() {
+	pusher.queueLock.Lock()
+	pusher.releaseGopCache()
+	pusher.gopCache = make([]*RTPPack, 0)
+	pusher.queueLock.Unlock()
+}
+
+// releaseGopCache empties GOP cache, queueLock must be held
+func (pusher *Pusher) releaseGopCache() {
+	for i, pack := range pusher.gopCache {
+		pack.Release()
+		pusher.gopCache[i] = nil
 	}
+	pusher.gopCache = pusher.gopCache[:0]
+	pusher.addGopBytes(-atomic.LoadInt64(&pusher.gopBytes))
+}
+
+func (pusher *Pusher) addGopBytes(n int64) {
+	atomic.AddInt64(&pusher.gopBytes, n)
+	atomic.AddInt64(&gopCacheBytes, n)
+}
+
+// GopCacheBytes returns bytes of packets in GOP cache
+func (pusher *Pusher) GopCacheBytes() int64 {
+	return atomic.LoadInt64(&pusher.gopBytes)
+}
+
+// QueueBytes returns bytes of packets buffered in ring for players
+func (pusher *Pusher) QueueBytes() int64 {
+	return pusher.ring.Bytes()
+}
+
+// trimQueue releases packets read by all players, returns bytes released
+func (pusher *Pusher) trimQueue() int64 {
+	pusher.queueLock.Lock()
+	defer pusher.queueLock.Unlock()
+	return pusher.ring.trim()
+}
+
+// trimGopCache releases GOP cache until next GOP, players added before that
+// start from live packets. It returns bytes released
+func (pusher *Pusher) trimGopCache() int64 {
+	pusher.queueLock.Lock()
+	defer pusher.queueLock.Unlock()
+	n := pusher.GopCacheBytes()
+	if n > 0 {
+		pusher.releaseGopCache()
+		pusher.gopTrimmed = true
+	}
+	return n
 }
 
 func (pusher *Pusher) Stop() {
@@ -289,15 +552,11 @@ func (pusher *Pusher) Stop() {
 		pusher.Session.Stop()
 		return
 	}
-	pusher.Client.Stop()
-}
-
-func (pusher *Pusher) BroadcastRTP(pack *RTPPack) *Pusher {
-	for _, player := range pusher.GetPlayers() {
-		player.QueueRTP(pack)
-		pusher.AddOutputBytes(pack.Buffer.Len())
+	if pusher.Feeder != nil {
+		pusher.Feeder.Stop()
+		return
 	}
-	return pusher
+	pusher.Client.Stop()
 }
 
 func (pusher *Pusher) GetPlayers() (players map[string]*Player) {
@@ -317,20 +576,28 @@ func (pusher *Pusher) HasPlayer(player *Player) bool {
 	return ok
 }
 
+// AddPlayer starts player reading packets from the cached GOP and then the
+// packets written after
 func (pusher *Pusher) AddPlayer(player *Player) *Pusher {
 	logger := pusher.Logger()
-	if pusher.gopCacheEnable {
-		pusher.gopCacheLock.RLock()
-		for _, pack := range pusher.gopCache {
-			player.QueueRTP(pack)
-			pusher.AddOutputBytes(pack.Buffer.Len())
-		}
-		pusher.gopCacheLock.RUnlock()
-	}
-
 	pusher.playersLock.Lock()
 	if _, ok := pusher.players[player.ID]; !ok {
+		pusher.queueLock.Lock()
+		if pusher.gopCacheEnable {
+			for _, pack := range pusher.gopCache {
+				pack.AddRef()
+				player.gop = append(player.gop, pack)
+				pusher.AddOutputBytes(pack.Len())
+			}
+			atomic.StoreInt64(&player.gopBytes, pusher.GopCacheBytes())
+		}
+		player.cursor = pusher.ring.NewCursor(player.queueLimit)
+		pusher.queueLock.Unlock()
 		pusher.players[player.ID] = player
+		if pusher.idleTimer != nil {
+			pusher.idleTimer.Stop()
+			pusher.idleTimer = nil
+		}
 		go player.Start()
 		logger.Info("player start", log.String("player", player.String()), log.Int("player size", len(pusher.players)))
 	}
@@ -347,6 +614,9 @@ func (pusher *Pusher) RemovePlayer(player *Player) *Pusher {
 	}
 	delete(pusher.players, player.ID)
 	logger.Info("player end", log.String("player", player.String()), log.Int("player size", len(pusher.players)))
+	if len(pusher.players) == 0 {
+		pusher.startIdleTimer()
+	}
 	pusher.playersLock.Unlock()
 	return pusher
 }
@@ -365,7 +635,17 @@ func (pusher *Pusher) ClearPlayer() {
 }
 
 func (pusher *Pusher) shouldSequenceStart(rtp *RTPInfo) bool {
-	if strings.EqualFold(pusher.VCodec(), "h264") {
+	return shouldSequenceStart(pusher.VCodec(), rtp, &pusher.spsPpsInSTAPaPack)
+}
+
+// shouldSequenceStart reports whether rtp of video codec starts a GOP,
+// spsPpsInSTAPaPack is the state of the stream whether sps and pps are sent
+// in STAP-A packet
+func shouldSequenceStart(codec string, rtp *RTPInfo, spsPpsInSTAPaPack *bool) bool {
+	if len(rtp.Payload) < 2 {
+		return false
+	}
+	if strings.EqualFold(codec, "h264") {
 		var realNALU uint8
 		payloadHeader := rtp.Payload[0] //https://tools.ietf.org/html/rfc6184#section-5.2
 		NaluType := uint8(payloadHeader & 0x1F)
@@ -403,12 +683,12 @@ func (pusher *Pusher) shouldSequenceStart(rtp *RTPInfo) bool {
 				}
 			}
 			if singleSPSPPS == 0x0F {
-				pusher.spsPpsInSTAPaPack = true
+				*spsPpsInSTAPaPack = true
 				return true
 			}
 		}
 		if realNALU&0x1F == 0x05 {
-			if pusher.spsPpsInSTAPaPack {
+			if *spsPpsInSTAPaPack {
 				return false
 			}
 			return true
@@ -420,7 +700,7 @@ func (pusher *Pusher) shouldSequenceStart(rtp *RTPInfo) bool {
 			return true
 		}
 		return false
-	} else if strings.EqualFold(pusher.VCodec(), "h265") {
+	} else if strings.EqualFold(codec, "h265") {
 		if len(rtp.Payload) >= 3 {
 			firstByte := rtp.Payload[0]
 			headerType := (firstByte >> 1) & 0x3f
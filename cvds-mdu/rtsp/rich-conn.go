@@ -5,9 +5,15 @@ import (
 	"time"
 )
 
+// RichConn sets read and write deadline of every read and write of conn
 type RichConn struct {
 	net.Conn
-	timeout time.Duration
+	timeout      time.Duration
+	writeTimeout time.Duration
+}
+
+func NewRichConn(conn net.Conn, timeout time.Duration, writeTimeout time.Duration) *RichConn {
+	return &RichConn{Conn: conn, timeout: timeout, writeTimeout: writeTimeout}
 }
 
 func (conn *RichConn) Read(b []byte) (n int, err error) {
@@ -20,12 +26,22 @@ func (conn *RichConn) Read(b []byte) (n int, err error) {
 	return conn.Conn.Read(b)
 }
 
-func (conn *RichConn) Write(b []byte) (n int, err error) {
-	if conn.timeout > 0 {
-		conn.Conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+func (conn *RichConn) setWriteDeadline() {
+	if conn.writeTimeout > 0 {
+		conn.Conn.SetWriteDeadline(time.Now().Add(conn.writeTimeout))
 	} else {
 		var t time.Time
 		conn.Conn.SetWriteDeadline(t)
 	}
+}
+
+func (conn *RichConn) Write(b []byte) (n int, err error) {
+	conn.setWriteDeadline()
 	return conn.Conn.Write(b)
 }
+
+// WriteBuffers writes buffers in one vectored write if supported by conn
+func (conn *RichConn) WriteBuffers(buffers *net.Buffers) (n int64, err error) {
+	conn.setWriteDeadline()
+	return buffers.WriteTo(conn.Conn)
+}
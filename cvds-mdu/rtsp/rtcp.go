@@ -0,0 +1,74 @@
+package rtsp
+
+import (
+	"encoding/binary"
+)
+
+// RTCP packet type of transport layer feedback and its feedback message type
+// of Generic NACK, see RFC 4585 6.2
+const (
+	rtcpRTPFeedback = 205
+	rtcpFmtNack     = 1
+)
+
+// rtcpHeaderLength is the length of common header of RTCP and SSRC of
+// sender, and feedback packets are followed by SSRC of media source
+const rtcpHeaderLength = 8
+
+// maxNackFCI is the max FCI entries of a NACK built, each of them requests
+// up to 17 packets
+const maxNackFCI = 16
+
+// parseNacks returns sequence numbers of RTP lost requested by Generic NACKs
+// of compound RTCP packet, see RFC 4585 6.2.1
+func parseNacks(data []byte) (seqs []uint16) {
+	for len(data) >= rtcpHeaderLength {
+		if data[0]>>6 != 2 {
+			return
+		}
+		length := (int(binary.BigEndian.Uint16(data[2:])) + 1) * 4
+		if length > len(data) {
+			return
+		}
+		packet := data[:length]
+		data = data[length:]
+		if packet[1] != rtcpRTPFeedback || packet[0]&0x1f != rtcpFmtNack || len(packet) < rtcpHeaderLength+4 {
+			continue
+		}
+		// FCI of PID and BLP of following 16 packets lost
+		for fci := packet[rtcpHeaderLength+4:]; len(fci) >= 4; fci = fci[4:] {
+			pid, blp := binary.BigEndian.Uint16(fci), binary.BigEndian.Uint16(fci[2:])
+			seqs = append(seqs, pid)
+			for i := uint16(0); i < 16; i++ {
+				if blp&(1<<i) != 0 {
+					seqs = append(seqs, pid+i+1)
+				}
+			}
+		}
+	}
+	return
+}
+
+// buildNack builds Generic NACK of sender requesting RTP of media source of
+// sequence numbers seqs, which are ascending without duplicates
+func buildNack(sender uint32, media uint32, seqs []uint16) []byte {
+	var fci []byte
+	for i := 0; i < len(seqs) && len(fci) < maxNackFCI*4; {
+		pid, blp := seqs[i], uint16(0)
+		for i++; i < len(seqs); i++ {
+			d := seqs[i] - pid
+			if d > 16 {
+				break
+			}
+			blp |= 1 << (d - 1)
+		}
+		fci = append(fci, byte(pid>>8), byte(pid), byte(blp>>8), byte(blp))
+	}
+	packet := make([]byte, rtcpHeaderLength+4, rtcpHeaderLength+4+len(fci))
+	packet[0] = 2<<6 | rtcpFmtNack
+	packet[1] = rtcpRTPFeedback
+	binary.BigEndian.PutUint16(packet[2:], uint16((rtcpHeaderLength+4+len(fci))/4-1))
+	binary.BigEndian.PutUint32(packet[4:], sender)
+	binary.BigEndian.PutUint32(packet[8:], media)
+	return append(packet, fci...)
+}
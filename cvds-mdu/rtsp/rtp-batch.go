@@ -0,0 +1,82 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// rtpBatch collects interleaved packets to write to connection in one
+// vectored write, references of packets are held until written
+type rtpBatch struct {
+	headers []byte // 4 bytes interleaved header per packet
+	vec     [][]byte
+	out     net.Buffers
+	packs   []*RTPPack
+	bytes   int
+	since   time.Time
+}
+
+func newRTPBatch(size int) *rtpBatch {
+	if size <= 0 {
+		size = 1
+	}
+	return &rtpBatch{
+		headers: make([]byte, 0, 4*size),
+		vec:     make([][]byte, 0, 2*size),
+		packs:   make([]*RTPPack, 0, size),
+	}
+}
+
+func (b *rtpBatch) Len() int {
+	return len(b.packs)
+}
+
+func (b *rtpBatch) Full() bool {
+	return len(b.packs) == cap(b.packs)
+}
+
+// Since returns time the first packet of batch added
+func (b *rtpBatch) Since() time.Time {
+	return b.since
+}
+
+// add appends pack of interleaved channel, batch must not be full
+func (b *rtpBatch) add(channel int, pack *RTPPack) {
+	if len(b.packs) == 0 {
+		b.since = time.Now()
+	}
+	i := len(b.headers)
+	b.headers = b.headers[:i+4]
+	header := b.headers[i : i+4]
+	header[0] = 0x24
+	header[1] = byte(channel)
+	binary.BigEndian.PutUint16(header[2:], uint16(pack.Len()))
+	pack.AddRef()
+	b.packs = append(b.packs, pack)
+	b.vec = append(b.vec, header, pack.Bytes())
+	b.bytes += pack.Len() + 4
+}
+
+// writeTo writes packets of batch to conn and resets batch, returns bytes
+// written
+func (b *rtpBatch) writeTo(conn *RichConn) (n int64, err error) {
+	b.out = b.vec
+	n, err = conn.WriteBuffers(&b.out)
+	b.out = nil
+	b.reset()
+	return
+}
+
+// reset releases packets of batch
+func (b *rtpBatch) reset() {
+	for i, pack := range b.packs {
+		pack.Release()
+		b.packs[i] = nil
+	}
+	for i := range b.vec {
+		b.vec[i] = nil
+	}
+	b.packs, b.vec, b.headers = b.packs[:0], b.vec[:0], b.headers[:0]
+	b.bytes = 0
+}
@@ -0,0 +1,88 @@
+package rtsp
+
+import (
+	"github.com/CVDS2020/CVDS2020/common/pool"
+	"sync/atomic"
+)
+
+// rtpDataPool holds packets copied from UDP reads and interleaved packets
+// spanning read chunks, larger packets fall back to plain allocation
+var rtpDataPool = pool.NewDataPool(2048)
+
+var rtpPackPool = pool.NewPool(func() *RTPPack { return new(RTPPack) })
+
+// RTPPack is a RTP or RTCP packet of a track, Track is the index of media
+// section in SDP of the stream.
+//
+// RTPPack is reference counted and pooled. Handlers of RTPHandles borrow the
+// pack during the call, anyone keeping the pack after that, such as the
+// pusher queue, the GOP cache and players, should AddRef it and Release it
+// when done. The bytes of pack must not be used after released
+type RTPPack struct {
+	Track int
+	Type  RTPType
+
+	data   []byte
+	ref    int64
+	holder pool.Reference
+}
+
+// NewRTPPack creates pack of data with reference count 1, the reference of
+// holder, which keeps data alive, is taken over by the pack and released
+// with it. holder may be nil if data is not pooled
+func NewRTPPack(track int, typ RTPType, data []byte, holder pool.Reference) *RTPPack {
+	pack := rtpPackPool.Get()
+	pack.Track, pack.Type = track, typ
+	pack.data, pack.holder = data, holder
+	atomic.StoreInt64(&pack.ref, 1)
+	atomic.AddInt64(&bufferedBytes, int64(len(data)))
+	return pack
+}
+
+// copyRTPPack creates pack of a copy of data in pooled buffer
+func copyRTPPack(track int, typ RTPType, data []byte) *RTPPack {
+	d := rtpDataPool.Alloc(uint(len(data)))
+	copy(d.Data, data)
+	return NewRTPPack(track, typ, d.Data, d)
+}
+
+func (pack *RTPPack) Bytes() []byte {
+	return pack.data
+}
+
+func (pack *RTPPack) Len() int {
+	return len(pack.data)
+}
+
+func (pack *RTPPack) AddRef() {
+	if atomic.AddInt64(&pack.ref, 1) <= 1 {
+		panic("rtp pack used after released")
+	}
+}
+
+// tryAddRef takes a reference of pack unless it has been released, used by
+// readers racing with the releasing owner
+func (pack *RTPPack) tryAddRef() bool {
+	for {
+		ref := atomic.LoadInt64(&pack.ref)
+		if ref <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&pack.ref, ref, ref+1) {
+			return true
+		}
+	}
+}
+
+func (pack *RTPPack) Release() {
+	if c := atomic.AddInt64(&pack.ref, -1); c == 0 {
+		atomic.AddInt64(&bufferedBytes, -int64(len(pack.data)))
+		if pack.holder != nil {
+			pack.holder.Release()
+		}
+		pack.data, pack.holder = nil, nil
+		rtpPackPool.Put(pack)
+	} else if c < 0 {
+		panic("rtp pack repeat release")
+	}
+}
@@ -23,12 +23,21 @@ type RTPInfo struct {
 }
 
 func ParseRTP(rtpBytes []byte) *RTPInfo {
-	if len(rtpBytes) < RTP_FIXED_HEADER_LENGTH {
+	info := new(RTPInfo)
+	if !parseRTP(rtpBytes, info) {
 		return nil
 	}
+	return info
+}
+
+// parseRTP parses rtp into info without allocation, false if invalid
+func parseRTP(rtpBytes []byte, info *RTPInfo) bool {
+	if len(rtpBytes) < RTP_FIXED_HEADER_LENGTH {
+		return false
+	}
 	firstByte := rtpBytes[0]
 	secondByte := rtpBytes[1]
-	info := &RTPInfo{
+	*info = RTPInfo{
 		Version:   int(firstByte >> 6),
 		Padding:   (firstByte>>5)&1 == 1,
 		Extension: (firstByte>>4)&1 == 1,
@@ -61,8 +70,8 @@ func ParseRTP(rtpBytes []byte) *RTPInfo {
 	info.Payload = rtpBytes[offset:end]
 	info.PayloadOffset = offset
 	if end-offset < 1 {
-		return nil
+		return false
 	}
 
-	return info
+	return true
 }
@@ -0,0 +1,368 @@
+package rtsp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rtpSlot is a slot of rtpRing, seq is sequence+1 of the packet in slot, 0
+// while the slot is being overwritten
+type rtpSlot struct {
+	seq  uint64
+	pack atomic.Value // *RTPPack
+}
+
+// rtpRing is a ring buffer of RTP packets fanning out packets of a pusher to
+// its players. A packet is stored once and referenced by the ring until it is
+// overwritten, each player reads the ring through its own rtpCursor without
+// locking. A cursor lagging behind the writer more than the ring size, or the
+// limit of the cursor, loses the overwritten packets.
+//
+// Write must be called by a single writer at a time, the pusher serializes
+// packets of all receiving goroutines before writing
+type rtpRing struct {
+	head  uint64 // sequence of next packet to write
+	tail  uint64 // sequence of the oldest packet not trimmed
+	slots []rtpSlot
+	mask  uint64
+
+	// bytes and count of packets referenced by ring
+	bytes int64
+	packs int64
+
+	cursors     atomic.Value // []*rtpCursor, copied on write
+	cursorsLock sync.Mutex
+
+	closed    uint32
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newRTPRing creates ring of size rounded up to power of 2
+func newRTPRing(size uint) *rtpRing {
+	n := uint64(1)
+	for n < uint64(size) {
+		n <<= 1
+	}
+	r := &rtpRing{
+		slots: make([]rtpSlot, n),
+		mask:  n - 1,
+		done:  make(chan struct{}),
+	}
+	r.cursors.Store([]*rtpCursor(nil))
+	return r
+}
+
+func (r *rtpRing) Size() uint64 {
+	return uint64(len(r.slots))
+}
+
+func (r *rtpRing) Head() uint64 {
+	return atomic.LoadUint64(&r.head)
+}
+
+// Bytes returns bytes of packets referenced by ring
+func (r *rtpRing) Bytes() int64 {
+	return atomic.LoadInt64(&r.bytes)
+}
+
+func (r *rtpRing) Closed() bool {
+	return atomic.LoadUint32(&r.closed) == 1
+}
+
+func (r *rtpRing) loadCursors() []*rtpCursor {
+	return r.cursors.Load().([]*rtpCursor)
+}
+
+// overwrite replaces packet of slot, readers holding the old sequence fail
+// to take reference of the old packet once the slot invalidated
+func (r *rtpRing) overwrite(slot *rtpSlot, seq uint64, pack *RTPPack) {
+	var bytes, packs int64
+	if pack != nil {
+		bytes, packs = int64(pack.Len()), 1
+	}
+	atomic.StoreUint64(&slot.seq, 0)
+	if old, _ := slot.pack.Swap(pack).(*RTPPack); old != nil {
+		bytes, packs = bytes-int64(old.Len()), packs-1
+		old.Release()
+	}
+	atomic.StoreUint64(&slot.seq, seq)
+	if bytes != 0 {
+		atomic.AddInt64(&r.bytes, bytes)
+		atomic.AddInt64(&ringBytes, bytes)
+	}
+	if packs != 0 {
+		atomic.AddInt64(&r.packs, packs)
+	}
+}
+
+// Write stores a reference of pack in the ring, wakes waiting cursors and
+// returns count of cursors
+func (r *rtpRing) Write(pack *RTPPack) int {
+	if r.Closed() {
+		return 0
+	}
+	seq := atomic.LoadUint64(&r.head)
+	pack.AddRef()
+	r.overwrite(&r.slots[seq&r.mask], seq+1, pack)
+	atomic.StoreUint64(&r.head, seq+1)
+	cursors := r.loadCursors()
+	for _, c := range cursors {
+		c.wake()
+	}
+	return len(cursors)
+}
+
+// NewCursor creates cursor reading from next packet written, limit is the
+// max lag of cursor, 0 or larger than ring size means the ring size
+func (r *rtpRing) NewCursor(limit uint) *rtpCursor {
+	c := &rtpCursor{
+		ring:   r,
+		next:   r.Head(),
+		signal: make(chan struct{}, 1),
+	}
+	c.SetLimit(limit)
+	r.cursorsLock.Lock()
+	old := r.loadCursors()
+	cursors := make([]*rtpCursor, len(old), len(old)+1)
+	copy(cursors, old)
+	r.cursors.Store(append(cursors, c))
+	r.cursorsLock.Unlock()
+	if r.Closed() {
+		c.Close()
+	}
+	return c
+}
+
+func (r *rtpRing) removeCursor(c *rtpCursor) {
+	r.cursorsLock.Lock()
+	old := r.loadCursors()
+	cursors := make([]*rtpCursor, 0, len(old))
+	for _, o := range old {
+		if o != c {
+			cursors = append(cursors, o)
+		}
+	}
+	r.cursors.Store(cursors)
+	r.cursorsLock.Unlock()
+}
+
+// Close stops writing and wakes all cursors, packets in ring are released
+func (r *rtpRing) Close() {
+	r.closeOnce.Do(func() {
+		atomic.StoreUint32(&r.closed, 1)
+		for _, c := range r.loadCursors() {
+			c.Close()
+		}
+		close(r.done)
+	})
+}
+
+// Done returns channel closed when ring closed
+func (r *rtpRing) Done() <-chan struct{} {
+	return r.done
+}
+
+// clear releases all packets in ring, the head is kept so that cursors see
+// the released packets as lost. It must not be called concurrently with Write
+func (r *rtpRing) clear() {
+	for i := range r.slots {
+		r.overwrite(&r.slots[i], 0, (*RTPPack)(nil))
+	}
+	r.tail = r.Head()
+}
+
+// trim releases packets read by all cursors, they are never read again since
+// new cursors start from head. It must not be called concurrently with Write
+// or NewCursor, returns bytes released
+func (r *rtpRing) trim() int64 {
+	head := r.Head()
+	read := head
+	for _, c := range r.loadCursors() {
+		if next := atomic.LoadUint64(&c.next); next < read {
+			read = next
+		}
+	}
+	from := r.tail
+	if head > r.Size() && head-r.Size() > from {
+		from = head - r.Size()
+	}
+	bytes := r.Bytes()
+	for seq := from; seq < read; seq++ {
+		if slot := &r.slots[seq&r.mask]; atomic.LoadUint64(&slot.seq) == seq+1 {
+			r.overwrite(slot, 0, (*RTPPack)(nil))
+		}
+	}
+	if read > r.tail {
+		r.tail = read
+	}
+	return bytes - r.Bytes()
+}
+
+// rtpCursor is the read position of a player in rtpRing
+type rtpCursor struct {
+	next    uint64 // sequence of next packet to read
+	limit   uint64
+	ring    *rtpRing
+	waiting uint32
+	closed  uint32
+	signal  chan struct{}
+	timer   *time.Timer
+}
+
+func (c *rtpCursor) wake() {
+	if atomic.LoadUint32(&c.waiting) == 1 {
+		select {
+		case c.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Lag returns count of packets written but not read yet
+func (c *rtpCursor) Lag() uint64 {
+	return c.ring.Head() - atomic.LoadUint64(&c.next)
+}
+
+// Limit returns max lag of cursor
+func (c *rtpCursor) Limit() uint64 {
+	return atomic.LoadUint64(&c.limit)
+}
+
+// SetLimit changes max lag of cursor, 0 or larger than ring size means the
+// ring size
+func (c *rtpCursor) SetLimit(limit uint) {
+	l := uint64(limit)
+	if l == 0 || l > c.ring.Size() {
+		l = c.ring.Size()
+	}
+	atomic.StoreUint64(&c.limit, l)
+}
+
+// LagBytes returns estimated bytes of packets written but not read yet, by
+// the average packet size of ring
+func (c *rtpCursor) LagBytes() int64 {
+	lag := c.Lag()
+	if limit := c.Limit(); lag > limit {
+		lag = limit
+	}
+	packs := atomic.LoadInt64(&c.ring.packs)
+	if lag == 0 || packs <= 0 {
+		return 0
+	}
+	return int64(lag) * (c.ring.Bytes() / packs)
+}
+
+func (c *rtpCursor) Closed() bool {
+	return atomic.LoadUint32(&c.closed) == 1
+}
+
+// Next returns next packet with a reference taken, caller should release it
+// after used. lost is count of packets skipped since cursor lagged behind
+// more than its limit. pack is nil if no packet to read
+func (c *rtpCursor) Next() (pack *RTPPack, lost uint64) {
+	r := c.ring
+	next := atomic.LoadUint64(&c.next)
+	limit := c.Limit()
+	for {
+		head := r.Head()
+		if next >= head {
+			return nil, lost
+		}
+		if lag := head - next; lag > limit {
+			lost += lag - limit
+			next = head - limit
+			atomic.StoreUint64(&c.next, next)
+		}
+		slot := &r.slots[next&r.mask]
+		if seq := next + 1; atomic.LoadUint64(&slot.seq) == seq {
+			if pack, _ = slot.pack.Load().(*RTPPack); pack != nil && pack.tryAddRef() {
+				if atomic.LoadUint64(&slot.seq) == seq {
+					atomic.StoreUint64(&c.next, next+1)
+					return pack, lost
+				}
+				pack.Release()
+			}
+		}
+		pack = nil
+		if r.Closed() {
+			return nil, lost
+		}
+		// slot overwritten by writer while reading, retry by the new head
+	}
+}
+
+// Skip drops all packets written, returns count of packets dropped
+func (c *rtpCursor) Skip() uint64 {
+	head := c.ring.Head()
+	return head - atomic.SwapUint64(&c.next, head)
+}
+
+// Wait blocks until a packet written, or the cursor woken by Signal or
+// closed. It returns false if the cursor closed
+func (c *rtpCursor) Wait() bool {
+	atomic.StoreUint32(&c.waiting, 1)
+	defer atomic.StoreUint32(&c.waiting, 0)
+	if c.Closed() {
+		return false
+	}
+	if c.Lag() > 0 {
+		return true
+	}
+	<-c.signal
+	return !c.Closed()
+}
+
+// WaitTimeout is Wait returning after timeout at most
+func (c *rtpCursor) WaitTimeout(timeout time.Duration) bool {
+	atomic.StoreUint32(&c.waiting, 1)
+	defer atomic.StoreUint32(&c.waiting, 0)
+	if c.Closed() {
+		return false
+	}
+	if c.Lag() > 0 {
+		return true
+	}
+	if c.timer == nil {
+		c.timer = time.NewTimer(timeout)
+	} else {
+		c.timer.Reset(timeout)
+	}
+	select {
+	case <-c.signal:
+		if !c.timer.Stop() {
+			select {
+			case <-c.timer.C:
+			default:
+			}
+		}
+	case <-c.timer.C:
+	}
+	return !c.Closed()
+}
+
+// Park blocks until the cursor woken by Signal or closed, packets written do
+// not wake it
+func (c *rtpCursor) Park() {
+	if !c.Closed() {
+		<-c.signal
+	}
+}
+
+// Signal wakes the waiting reader of cursor
+func (c *rtpCursor) Signal() {
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Close removes cursor from ring and wakes the waiting reader
+func (c *rtpCursor) Close() {
+	if atomic.SwapUint32(&c.closed, 1) == 1 {
+		return
+	}
+	c.ring.removeCursor(c)
+	c.Signal()
+}
@@ -0,0 +1,108 @@
+package rtsp
+
+import (
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRTPRing(t *testing.T) {
+	if size := newRTPRing(config.RtspConfig().Pusher.RingSize).Size(); size != 4096 {
+		t.Fatalf("expect default ring size 4096, got %d", size)
+	}
+	r := newRTPRing(3)
+	if r.Size() != 4 {
+		t.Fatalf("expect ring size 4, got %d", r.Size())
+	}
+	fast, slow := r.NewCursor(0), r.NewCursor(2)
+	packs := make([]*RTPPack, 6)
+	for i := range packs {
+		packs[i] = copyRTPPack(0, RtpTypeVideo, testRTP(96, i, 0x41))
+		if n := r.Write(packs[i]); n != 2 {
+			t.Fatalf("expect 2 cursors, got %d", n)
+		}
+		if pack, lost := fast.Next(); pack != packs[i] || lost != 0 {
+			t.Fatalf("unexpected packet %d of fast cursor, lost %d", i, lost)
+		} else {
+			pack.Release()
+		}
+	}
+	// slow cursor keeps the last 2 packets only
+	if slow.Lag() != 6 {
+		t.Fatalf("expect lag 6, got %d", slow.Lag())
+	}
+	pack, lost := slow.Next()
+	if pack != packs[4] || lost != 4 {
+		t.Fatalf("expect packet 4 after 4 lost, got lost %d", lost)
+	}
+	pack.Release()
+	if pack, _ = fast.Next(); pack != nil {
+		t.Fatal("expect no packet")
+	}
+
+	// packets overwritten are released by ring, the rest by clear
+	for i, pack := range packs {
+		pack.Release()
+		if i < 2 && atomic.LoadInt64(&pack.ref) != 0 || i >= 2 && atomic.LoadInt64(&pack.ref) != 1 {
+			t.Fatalf("unexpected reference %d of packet %d", pack.ref, i)
+		}
+	}
+	fast.Close()
+	if n := r.Write(packs[5]); n != 1 {
+		t.Fatalf("expect 1 cursor after closed, got %d", n)
+	}
+	r.Close()
+	r.clear()
+	if slow.Wait() || !slow.Closed() {
+		t.Fatal("expect cursor closed with ring")
+	}
+	for i, pack := range packs[2:] {
+		if atomic.LoadInt64(&pack.ref) != 0 {
+			t.Fatalf("packet %d not released", i+2)
+		}
+	}
+}
+
+func TestRTPRingConcurrent(t *testing.T) {
+	r := newRTPRing(64)
+	const count = 20000
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		c := r.NewCursor(uint(16 << i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var read, lost uint64
+			last := -1
+			for {
+				pack, n := c.Next()
+				lost += n
+				if pack == nil {
+					if !c.Wait() {
+						break
+					}
+					continue
+				}
+				seq := int(pack.Bytes()[2])<<8 | int(pack.Bytes()[3])
+				if seq <= last {
+					t.Errorf("packet %d read after %d", seq, last)
+				}
+				last = seq
+				read++
+				pack.Release()
+			}
+			if read+lost+c.Lag() != count {
+				t.Errorf("read %d and lost %d of %d packets", read, lost, count)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		pack := copyRTPPack(0, RtpTypeVideo, testRTP(96, i, 0x41))
+		r.Write(pack)
+		pack.Release()
+	}
+	r.Close()
+	wg.Wait()
+	r.clear()
+}
@@ -3,6 +3,7 @@ package rtsp
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 type Response struct {
@@ -30,9 +31,51 @@ func NewResponse(statusCode int, status, cSeq, sid, body string) *Response {
 	return res
 }
 
+// ParseResponse parses header and body of RTSP response, values of headers
+// repeated are kept as []string
+func ParseResponse(header string, body string) (*Response, error) {
+	lines := strings.Split(strings.TrimSpace(header), "\r\n")
+	status := strings.SplitN(lines[0], " ", 3)
+	if len(status) < 2 || !strings.HasPrefix(status[0], "RTSP/") {
+		return nil, fmt.Errorf("StatusCode Line error:%s", lines[0])
+	}
+	code, err := strconv.Atoi(status[1])
+	if err != nil {
+		return nil, fmt.Errorf("StatusCode Line error:%s", lines[0])
+	}
+	res := &Response{Version: status[0], StatusCode: code, Header: make(map[string]interface{}), Body: body}
+	if len(status) == 3 {
+		res.Status = status[2]
+	}
+	for _, line := range lines[1:] {
+		// values such as uri of WWW-Authenticate may contain ':'
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch v := res.Header[key].(type) {
+		case nil:
+			res.Header[key] = value
+		case string:
+			res.Header[key] = []string{v, value}
+		case []string:
+			res.Header[key] = append(v, value)
+		}
+	}
+	return res, nil
+}
+
 func (r *Response) String() string {
 	str := fmt.Sprintf("%s %d %s\r\n", r.Version, r.StatusCode, r.Status)
 	for key, value := range r.Header {
+		// headers of several values, such as WWW-Authenticate, are repeated
+		if values, ok := value.([]string); ok {
+			for _, v := range values {
+				str += fmt.Sprintf("%s: %s\r\n", key, v)
+			}
+			continue
+		}
 		str += fmt.Sprintf("%s: %s\r\n", key, value)
 	}
 	str += "\r\n"
@@ -40,6 +83,30 @@ func (r *Response) String() string {
 	return str
 }
 
+// Values returns values of header key, which is case insensitive
+func (r *Response) Values(key string) []string {
+	for k, value := range r.Header {
+		if !strings.EqualFold(k, key) {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			return []string{v}
+		case []string:
+			return v
+		}
+	}
+	return nil
+}
+
+// Get returns the first value of header key, which is case insensitive
+func (r *Response) Get(key string) string {
+	if values := r.Values(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
 func (r *Response) SetBody(body string) {
 	len := len(body)
 	r.Body = body
@@ -5,6 +5,7 @@ import (
 	"github.com/CVDS2020/CVDS2020/common/log"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
 	"net"
+	"reflect"
 	"sync"
 )
 
@@ -19,6 +20,24 @@ type Server struct {
 	pushers     map[string]*Pusher // Path <-> Pusher
 	pushersLock sync.RWMutex
 
+	memory     *MemoryAccountant
+	memoryDone chan struct{}
+
+	// view of cluster nodes, nil if cluster disabled, rebuilt if config of
+	// cluster reloaded
+	cluster     *Cluster
+	clusterLock sync.RWMutex
+
+	// pulls of sources started on demand in flight by path, guarded by
+	// sourceLock
+	sourcePulls map[string]*sourcePull
+	sourceLock  sync.Mutex
+
+	// id of server in Via header of requests to origins, for detecting loops
+	// of cascading
+	id     string
+	idOnce sync.Once
+
 	logger *log.Logger
 }
 
@@ -86,6 +105,13 @@ func (s *Server) Start() error {
 
 	s.stopped = false
 	s.listener = listener
+	s.memoryDone = make(chan struct{})
+	go s.memory.run(s.memoryDone)
+	if cluster := s.Cluster(); cluster != nil {
+		if err := cluster.Start(); err != nil {
+			s.logger.ErrorWith("rtsp cluster start error", err)
+		}
+	}
 	s.logger.Info("rtsp server start", log.String("addr", s.addr.String()))
 	for !s.stopped {
 		conn, err := s.listener.AcceptTCP()
@@ -114,6 +140,13 @@ func (s *Server) Stop() {
 		s.listener.Close()
 		s.listener = nil
 	}
+	if s.memoryDone != nil {
+		close(s.memoryDone)
+		s.memoryDone = nil
+	}
+	if cluster := s.Cluster(); cluster != nil {
+		cluster.Stop()
+	}
 	s.pushersLock.Lock()
 	s.pushers = make(map[string]*Pusher)
 	s.pushersLock.Unlock()
@@ -123,12 +156,53 @@ func (s *Server) Addr() *net.TCPAddr {
 	return s.addr
 }
 
+// Memory returns accountant of bytes buffered by pushers and players
+func (s *Server) Memory() *MemoryAccountant {
+	return s.memory
+}
+
+// Cluster returns view of cluster nodes, nil if cluster disabled
+func (s *Server) Cluster() *Cluster {
+	s.clusterLock.RLock()
+	defer s.clusterLock.RUnlock()
+	return s.cluster
+}
+
+// reloadCluster rebuilds cluster if config of cluster changed, the cluster
+// rebuilt is started if server running. Peers are learned again by gossip
+func (s *Server) reloadCluster() {
+	c := config.RtspConfig().Cluster
+	s.clusterLock.Lock()
+	defer s.clusterLock.Unlock()
+	if s.cluster == nil && !c.Enable || s.cluster != nil && reflect.DeepEqual(s.cluster.config, c) {
+		return
+	}
+	if s.cluster != nil {
+		s.cluster.Stop()
+		s.cluster = nil
+	}
+	if !c.Enable {
+		s.logger.Info("rtsp cluster disabled")
+		return
+	}
+	s.cluster = NewCluster(s, c)
+	if !s.stopped {
+		if err := s.cluster.Start(); err != nil {
+			s.logger.ErrorWith("rtsp cluster start error", err)
+		}
+	}
+	s.logger.Info("rtsp cluster reloaded")
+}
+
 func (s *Server) AddPusher(pusher *Pusher) bool {
 	s.pushersLock.Lock()
 	if _, ok := s.pushers[pusher.Path()]; !ok {
 		s.pushers[pusher.Path()] = pusher
 		s.pushersLock.Unlock()
 		go pusher.Start()
+		if pusher.Policy().Record {
+			go pusher.startRecord()
+		}
 		s.logger.Info("pusher start", log.String("pusher", pusher.String()), log.Int("pusher size", len(s.pushers)))
 		return true
 	}
@@ -157,6 +231,7 @@ func (s *Server) RemovePusher(pusher *Pusher) {
 	if _pusher, ok := s.pushers[pusher.Path()]; ok && pusher.ID() == _pusher.ID() {
 		delete(s.pushers, pusher.Path())
 		s.pushersLock.Unlock()
+		go pusher.stopRecord()
 		s.logger.Info("pusher end", log.String("pusher", pusher.String()), log.Int("pusher size", len(s.pushers)))
 		return
 	}
@@ -201,6 +276,11 @@ func GetServer() *Server {
 			pushers: make(map[string]*Pusher),
 			logger:  assert.Must(config.LogConfig().Build("rtsp.server")),
 		}
+		server.memory = NewMemoryAccountant(server)
+		if c := config.RtspConfig().Cluster; c.Enable {
+			server.cluster = NewCluster(server, c)
+		}
+		config.RegisterConfigReloadedCallback(server.reloadPolicies)
 	})
 	return server
 }
@@ -0,0 +1,196 @@
+package rtsp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"strconv"
+	"strings"
+)
+
+var UnsupportedCryptoError = errors.New("sdp crypto unsupported")
+
+// newSRTPKey generates random master key and master salt of suite
+func newSRTPKey(suite string) (*srtpKey, error) {
+	b := make([]byte, srtpMasterKeyLength+srtpMasterSaltLength)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &srtpKey{suite: suite, key: b[:srtpMasterKeyLength], salt: b[srtpMasterKeyLength:]}, nil
+}
+
+// crypto returns value of a=crypto of key of tag, see RFC 4568 9.1
+func (k *srtpKey) crypto(tag int) string {
+	b := append(append([]byte{}, k.key...), k.salt...)
+	return fmt.Sprintf("%d %s inline:%s", tag, k.suite, base64.StdEncoding.EncodeToString(b))
+}
+
+// parseCrypto parses value of a=crypto, such as
+// "1 AES_CM_128_HMAC_SHA1_80 inline:<key||salt>|2^20|1:4". Keys of MKI,
+// keys derived at a rate and session parameters disabling encryption or
+// authentication are not supported
+func parseCrypto(value string) (tag int, key *srtpKey, err error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return 0, nil, fmt.Errorf("%w: %s", InvalidSDPError, value)
+	}
+	if tag, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, nil, fmt.Errorf("%w: %s", InvalidSDPError, value)
+	}
+	suite := strings.ToUpper(fields[1])
+	switch suite {
+	case config.SRTPSuiteAES128SHA1_80, config.SRTPSuiteAES128SHA1_32:
+	default:
+		return 0, nil, fmt.Errorf("%w: suite %s", UnsupportedCryptoError, fields[1])
+	}
+	for _, param := range fields[3:] {
+		if p := strings.ToUpper(param); p != "KDR=0" && !strings.HasPrefix(p, "FEC_") && !strings.HasPrefix(p, "WSH=") {
+			return 0, nil, fmt.Errorf("%w: session param %s", UnsupportedCryptoError, param)
+		}
+	}
+	// the first of key params, the others are keys of MKI
+	params := strings.Split(strings.SplitN(fields[2], ";", 2)[0], "|")
+	if !strings.HasPrefix(params[0], "inline:") {
+		return 0, nil, fmt.Errorf("%w: key method of %s", UnsupportedCryptoError, fields[2])
+	}
+	for _, param := range params[1:] {
+		if strings.Contains(param, ":") {
+			return 0, nil, fmt.Errorf("%w: MKI %s", UnsupportedCryptoError, param)
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(params[0], "inline:"))
+	if err != nil || len(b) != srtpMasterKeyLength+srtpMasterSaltLength {
+		return 0, nil, fmt.Errorf("%w: key of %s", InvalidSDPError, value)
+	}
+	return tag, &srtpKey{suite: suite, key: b[:srtpMasterKeyLength], salt: b[srtpMasterKeyLength:]}, nil
+}
+
+// Secured reports whether media declares profile of SRTP
+func (m *SDPMedia) Secured() bool {
+	return strings.Contains(strings.ToUpper(m.Proto), "SAVP")
+}
+
+// srtpKey returns key of the first a=crypto of media supported, nil if
+// media declares no a=crypto
+func (m *SDPMedia) srtpKey() (key *srtpKey, err error) {
+	for _, attr := range m.Attributes {
+		if attr.Key != "crypto" {
+			continue
+		}
+		if _, key, err = parseCrypto(attr.Value); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+// rewriteMedia returns SDP of raw which lines of sections are rewritten by
+// rewrite, track is -1 for lines of session and index of media for lines of
+// media section starting with the m= line
+func rewriteMedia(raw string, rewrite func(track int, lines []string) []string) string {
+	var out, section []string
+	track := -1
+	flush := func() {
+		out = append(out, rewrite(track, section)...)
+		section = nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(raw, "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "m=") {
+			flush()
+			track++
+		}
+		section = append(section, line)
+	}
+	flush()
+	return strings.Join(out, "\r\n") + "\r\n"
+}
+
+// mediaProto replaces proto of m= line by secured or plain profile of it
+func mediaProto(line string, secured bool) string {
+	fields := strings.Split(line, " ")
+	if len(fields) < 3 || !strings.HasPrefix(fields[2], "RTP/") {
+		return line
+	}
+	if secured && !strings.Contains(fields[2], "SAVP") {
+		fields[2] = strings.Replace(fields[2], "AVP", "SAVP", 1)
+	} else if !secured {
+		fields[2] = strings.Replace(fields[2], "SAVP", "AVP", 1)
+	}
+	return strings.Join(fields, " ")
+}
+
+// plainSDP returns SDP of raw without keys and secured profiles of source,
+// since RTP of source is unprotected by server
+func plainSDP(raw string) string {
+	if !strings.Contains(raw, "SAVP") && !strings.Contains(raw, "a=crypto:") && !strings.Contains(raw, "a=key-mgmt:") {
+		return raw
+	}
+	return rewriteMedia(raw, func(track int, lines []string) []string {
+		out := make([]string, 0, len(lines))
+		for i, line := range lines {
+			switch {
+			case track >= 0 && i == 0:
+				line = mediaProto(line, false)
+			case strings.HasPrefix(line, "a=crypto:"), strings.HasPrefix(line, "a=key-mgmt:"):
+				continue
+			}
+			out = append(out, line)
+		}
+		return out
+	})
+}
+
+// offerSRTP returns SDP of raw offering key of RTP media of track returned
+// by keys by a=crypto, and declaring secured profiles if savp
+func offerSRTP(raw string, keys func(track int) *srtpKey, savp bool) string {
+	return rewriteMedia(raw, func(track int, lines []string) []string {
+		if track < 0 || !strings.Contains(lines[0], " RTP/") {
+			return lines
+		}
+		key := keys(track)
+		if key == nil {
+			return lines
+		}
+		if savp {
+			lines[0] = mediaProto(lines[0], true)
+		}
+		return append(lines, "a=crypto:"+key.crypto(1))
+	})
+}
+
+// offerSRTP returns SDP of raw described to player offering keys of SRTP of
+// tracks if SRTP enabled, keys offered before are kept for SDP announced.
+// Player protects RTP of backchannel by key offered for it as well
+func (session *Session) offerSRTP(raw string) string {
+	cfg := config.RtspConfig().Srtp
+	if !cfg.Enable {
+		return raw
+	}
+	session.srtpLock.Lock()
+	defer session.srtpLock.Unlock()
+	if session.srtpKeys == nil {
+		session.srtpKeys = make(map[int]*srtpKey)
+	}
+	return offerSRTP(raw, func(track int) *srtpKey {
+		key := session.srtpKeys[track]
+		if key == nil {
+			var err error
+			if key, err = newSRTPKey(cfg.Suite); err != nil {
+				session.logger.ErrorWith("generate srtp key error", err)
+				return nil
+			}
+			session.srtpKeys[track] = key
+		}
+		return key
+	}, cfg.Require)
+}
+
+// srtpKey returns key of SRTP of track offered to player, nil if not offered
+func (session *Session) srtpKey(track int) *srtpKey {
+	session.srtpLock.Lock()
+	defer session.srtpLock.Unlock()
+	return session.srtpKeys[track]
+}
@@ -0,0 +1,162 @@
+package rtsp
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"strconv"
+	"sync/atomic"
+)
+
+// sdpChange is how SDP of pusher changed by the source re-announced or
+// reconnected
+type sdpChange int
+
+const (
+	// tracks and parameters of decoders unchanged, such as attributes of
+	// session or the same parameter sets encoded differently
+	sdpCompatible sdpChange = iota
+	// tracks and codecs unchanged, but parameters of decoders changed, such
+	// as resolution of video or config of AAC
+	sdpParametersChanged
+	// tracks added, removed, or of other media types or codecs
+	sdpTracksChanged
+)
+
+func (c sdpChange) String() string {
+	switch c {
+	case sdpCompatible:
+		return "compatible"
+	case sdpParametersChanged:
+		return "parameters changed"
+	case sdpTracksChanged:
+		return "tracks changed"
+	}
+	return "unknown"
+}
+
+// compareSDP returns how sdp changed from old, and the first difference
+// found. Parameters of video and audio are compared as analyzed from SDP,
+// those not signaled in either SDP are not compared
+func compareSDP(old *SDP, sdp *SDP) (sdpChange, string) {
+	if old == nil || sdp == nil {
+		return sdpCompatible, ""
+	}
+	if len(old.Media) != len(sdp.Media) {
+		return sdpTracksChanged, fmt.Sprintf("%d tracks to %d", len(old.Media), len(sdp.Media))
+	}
+	for i, m := range sdp.Media {
+		o := old.Media[i]
+		if o.Type != m.Type || o.Codec() != m.Codec() {
+			return sdpTracksChanged, fmt.Sprintf("track %d of %s %s to %s %s", i, o.Type, o.Codec(), m.Type, m.Codec())
+		}
+	}
+	for i, m := range sdp.Media {
+		o := old.Media[i]
+		if o.PayloadType() != m.PayloadType() || o.ClockRate() != m.ClockRate() {
+			return sdpParametersChanged, fmt.Sprintf("track %d of payload type %d/%d to %d/%d", i, o.PayloadType(), o.ClockRate(), m.PayloadType(), m.ClockRate())
+		}
+	}
+
+	before, after := newStreamAnalyzer(old).info(), newStreamAnalyzer(sdp).info()
+	if v, w := before.Video, after.Video; v != nil && w != nil {
+		if changed(v.Width, w.Width) || changed(v.Height, w.Height) {
+			return sdpParametersChanged, fmt.Sprintf("video of %dx%d to %dx%d", v.Width, v.Height, w.Width, w.Height)
+		}
+		if changed(v.Profile, w.Profile) || changed(v.Level, w.Level) {
+			return sdpParametersChanged, fmt.Sprintf("video of %s %s to %s %s", v.Profile, v.Level, w.Profile, w.Level)
+		}
+	}
+	if a, b := before.Audio, after.Audio; a != nil && b != nil {
+		if changed(a.SampleRate, b.SampleRate) || changed(a.Channels, b.Channels) || changed(a.Profile, b.Profile) {
+			return sdpParametersChanged, fmt.Sprintf("audio of %s %d/%d to %s %d/%d", a.Profile, a.SampleRate, a.Channels, b.Profile, b.SampleRate, b.Channels)
+		}
+	}
+	return sdpCompatible, ""
+}
+
+// changed reports whether parameter changed, the zero value is unknown
+func changed[T comparable](before T, after T) bool {
+	var zero T
+	return before != zero && after != zero && before != after
+}
+
+// changeSDP handles SDP of pusher changed from old by the source re-announced
+// or reconnected. Compatible changes pass through, and for incompatible ones
+// stream analysis is reset, handles of SDP changed are called and players are
+// re-announced the SDP or stopped to reconnect by SDP change policy
+func (pusher *Pusher) changeSDP(old *SDP) {
+	sdp, sdpRaw := pusher.SDP(), pusher.PlayerSDPRaw()
+	change, diff := compareSDP(old, sdp)
+	logger := pusher.Logger()
+	if change == sdpCompatible {
+		logger.Info("sdp of pusher changed compatibly", log.String("pusher", pusher.String()))
+		return
+	}
+	logger.Warn("sdp of pusher changed incompatibly",
+		log.String("pusher", pusher.String()),
+		log.String("change", change.String()),
+		log.String("diff", diff),
+	)
+	pusher.queueLock.Lock()
+	pusher.analyzer = nil
+	pusher.releaseGopCache()
+	pusher.gopTrimmed = false
+	if pusher.rtx != nil {
+		pusher.rtx.clear()
+	}
+	pusher.queueLock.Unlock()
+	for _, h := range pusher.SDPChangeHandles {
+		h(sdp)
+	}
+
+	announce := change == sdpParametersChanged && config.RtspConfig().Pusher.SDPChange == config.SDPChangeAnnounce
+	players := pusher.GetPlayers()
+	go func() { // do not block
+		for _, player := range players {
+			if announce {
+				err := player.announce(sdp, player.offerSRTP(sdpRaw))
+				if err == nil {
+					continue
+				}
+				logger.ErrorWith("announce sdp to player error", err, log.String("player", player.String()))
+			}
+			logger.Info("stop player to reconnect for sdp changed", log.String("player", player.String()))
+			player.Stop()
+		}
+	}()
+}
+
+// announce sends server to client ANNOUNCE of sdp to player, which updates
+// the session description of the player
+func (session *Session) announce(sdp *SDP, sdpRaw string) error {
+	session.connWLock.Lock()
+	defer session.connWLock.Unlock()
+	if session.Conn == nil {
+		return fmt.Errorf("player connection closed")
+	}
+	session.serverCSeq++
+	req := &Request{
+		Method:  ANNOUNCE,
+		URL:     session.URL,
+		Version: RTSP_VERSION,
+		Header: map[string]string{
+			"CSeq":           strconv.Itoa(session.serverCSeq),
+			"Session":        session.ID,
+			"Content-Type":   "application/sdp",
+			"Content-Length": strconv.Itoa(len(sdpRaw)),
+		},
+		Body: sdpRaw,
+	}
+	session.logger.Debug(">>>\n" + req.String())
+	outBytes := []byte(req.String())
+	if _, err := session.connRW.Write(outBytes); err != nil {
+		return err
+	}
+	if err := session.connRW.Flush(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&session.OutBytes, int64(len(outBytes)))
+	session.SDP, session.SDPRaw = sdp, sdpRaw
+	return nil
+}
@@ -0,0 +1,155 @@
+package rtsp
+
+import (
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSpropSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=Test\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=Z00AKZpkA8ARPy4C3AQEBQAAAwPoAADDUOhgAJiWAAJiVlF3lgA=,aO48gA==\r\n" +
+	"a=control:streamid=0\r\n" +
+	"m=audio 0 RTP/AVP 8\r\n" +
+	"a=control:streamid=1\r\n" +
+	"m=application 0 RTP/AVP 107\r\n" +
+	"a=rtpmap:107 vnd.onvif.metadata/90000\r\n" +
+	"a=control:streamid=2\r\n"
+
+func TestCompareSDP(t *testing.T) {
+	parse := func(raw string) *SDP {
+		sdp, err := ParseSDP(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sdp
+	}
+	// 1280x720 of the same profile and level
+	resized := strings.Replace(testSpropSDP, "Z00AKZpkA8ARPy4C3AQEBQAAAwPoAADDUOhgAJiWAAJiVlF3lgA=", "Z00AKZpkAoAt2AtwEBAUAAAPoAADDUOhgAJiWAAJiVlF3lgA", 1)
+	tests := []struct {
+		old    string
+		sdp    string
+		change sdpChange
+	}{
+		{testPushSDP, strings.Replace(testPushSDP, "s=Test", "s=Camera", 1), sdpCompatible},
+		// parameters signaled by one SDP only are not compared
+		{testPushSDP, testSpropSDP, sdpCompatible},
+		{testSpropSDP, resized, sdpParametersChanged},
+		{testPushSDP, strings.Replace(testPushSDP, "RTP/AVP 8", "RTP/AVP 0", 1), sdpTracksChanged},
+		{testPushSDP, strings.Replace(testPushSDP, "H264/90000", "H265/90000", 1), sdpTracksChanged},
+		{testPushSDP, testPushSDP[:strings.Index(testPushSDP, "m=application")], sdpTracksChanged},
+	}
+	for i, test := range tests {
+		if change, diff := compareSDP(parse(test.old), parse(test.sdp)); change != test.change {
+			t.Errorf("case %d: expect %s, got %s: %s", i, test.change, change, diff)
+		}
+	}
+}
+
+// readRequest reads request sent by server, and returns method, header and
+// body
+func (c *testConn) readRequest() (string, map[string]string, string) {
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, err := c.rw.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read request error: %v", err)
+	}
+	header := make(map[string]string)
+	for {
+		line, err := c.rw.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("read request error: %v", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			header[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	body := make([]byte, 0)
+	if n, _ := strconv.Atoi(header["Content-Length"]); n > 0 {
+		body = make([]byte, n)
+		io.ReadFull(c.rw, body)
+	}
+	return strings.Fields(line)[0], header, string(body)
+}
+
+func TestSDPChange(t *testing.T) {
+	policy := config.RtspConfig().Pusher.SDPChange
+	defer func() { config.RtspConfig().Pusher.SDPChange = policy }()
+	config.RtspConfig().Pusher.SDPChange = config.SDPChangeAnnounce
+	s := newTestServer(t)
+	url := fmt.Sprintf("rtsp://%s/live/change", s.Addr())
+
+	push := dialTestConn(t, s)
+	announce := func(sdp string) {
+		if code, _ := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, sdp); code != 200 {
+			t.Fatalf("announce failed: %d", code)
+		}
+	}
+	announce(testSpropSDP)
+	if code, _ := push.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+		t.Fatalf("record failed: %d", code)
+	}
+	pusher := s.GetPusher("/live/change")
+
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	if code, _ := play.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := play.request("PLAY", url, nil, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	waitFor(t, "player", func() bool { return len(pusher.GetPlayers()) == 1 })
+
+	// compatible change passes through without notifying players
+	announce(strings.Replace(testSpropSDP, "s=Test", "s=Camera", 1))
+	push.writeInterleaved(0, testRTP(96, 1, 0x65))
+	if _, pkt := play.readInterleaved(); pkt[12] != 0x65 {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+
+	// resolution changed, player announced the new SDP and kept playing
+	resized := strings.Replace(testSpropSDP, "Z00AKZpkA8ARPy4C3AQEBQAAAwPoAADDUOhgAJiWAAJiVlF3lgA=", "Z00AKZpkAoAt2AtwEBAUAAAPoAADDUOhgAJiWAAJiVlF3lgA", 1)
+	announce(resized)
+	method, header, body := play.readRequest()
+	if method != "ANNOUNCE" || header["Content-Type"] != "application/sdp" || body != resized {
+		t.Fatalf("expect ANNOUNCE of new sdp, got %s %v", method, header)
+	}
+	fmt.Fprintf(play.rw, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: %s\r\n\r\n", header["CSeq"], header["Session"])
+	play.rw.Flush()
+	push.writeInterleaved(0, testRTP(96, 2, 0x65))
+	if _, pkt := play.readInterleaved(); pkt[12] != 0x65 {
+		t.Fatalf("unexpected packet %v", pkt)
+	}
+	if info := pusher.StreamInfo(); info.Video.Width != 1280 || info.Video.Height != 720 {
+		t.Fatalf("expect stream analyzed of new sdp, got %+v", info.Video)
+	}
+
+	// codec changed, player stopped to reconnect
+	announce(strings.Replace(testPushSDP, "H264/90000", "H265/90000", 1))
+	waitFor(t, "player stopped", func() bool { return len(pusher.GetPlayers()) == 0 })
+	play.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.ReadAll(play.rw); err != nil {
+		t.Fatalf("expect player connection closed, got %v", err)
+	}
+	if s.GetPusher("/live/change") != pusher || pusher.VCodec() != CodecH265 {
+		t.Fatal("expect pusher kept with new sdp")
+	}
+}
@@ -3,103 +3,464 @@ package rtsp
 import (
 	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	urlpkg "net/url"
 	"strconv"
 	"strings"
 )
 
-type SDPInfo struct {
-	AVType             string
-	Codec              string
-	TimeScale          int
-	Control            string
-	Rtpmap             int
-	Config             []byte
-	SpropParameterSets [][]byte
-	PayloadType        int
-	SizeLength         int
-	IndexLength        int
-}
-
-func ParseSDP(sdpRaw string) map[string]*SDPInfo {
-	sdpMap := make(map[string]*SDPInfo)
-	var info *SDPInfo
+var InvalidSDPError = errors.New("invalid sdp")
+
+// normalized codec names of media
+const (
+	CodecH264          = "h264"
+	CodecH265          = "h265"
+	CodecAV1           = "av1"
+	CodecVP8           = "vp8"
+	CodecVP9           = "vp9"
+	CodecMJPEG         = "mjpeg"
+	CodecAAC           = "aac"
+	CodecPCMA          = "pcma"
+	CodecPCMU          = "pcmu"
+	CodecG722          = "g722"
+	CodecG726          = "g726"
+	CodecOpus          = "opus"
+	CodecONVIFMetadata = "onvif-metadata"
+)
+
+// media directions
+const (
+	DirectionSendRecv = "sendrecv"
+	DirectionSendOnly = "sendonly"
+	DirectionRecvOnly = "recvonly"
+	DirectionInactive = "inactive"
+)
+
+// staticPayloadTypes is the payload types of RFC 3551 which may be used
+// without rtpmap attribute
+var staticPayloadTypes = map[int]RTPMap{
+	0:  {PayloadType: 0, Encoding: "PCMU", ClockRate: 8000, Channels: 1},
+	3:  {PayloadType: 3, Encoding: "GSM", ClockRate: 8000, Channels: 1},
+	4:  {PayloadType: 4, Encoding: "G723", ClockRate: 8000, Channels: 1},
+	8:  {PayloadType: 8, Encoding: "PCMA", ClockRate: 8000, Channels: 1},
+	9:  {PayloadType: 9, Encoding: "G722", ClockRate: 8000, Channels: 1},
+	10: {PayloadType: 10, Encoding: "L16", ClockRate: 44100, Channels: 2},
+	11: {PayloadType: 11, Encoding: "L16", ClockRate: 44100, Channels: 1},
+	14: {PayloadType: 14, Encoding: "MPA", ClockRate: 90000},
+	15: {PayloadType: 15, Encoding: "G728", ClockRate: 8000, Channels: 1},
+	18: {PayloadType: 18, Encoding: "G729", ClockRate: 8000, Channels: 1},
+	26: {PayloadType: 26, Encoding: "JPEG", ClockRate: 90000},
+	32: {PayloadType: 32, Encoding: "MPV", ClockRate: 90000},
+	33: {PayloadType: 33, Encoding: "MP2T", ClockRate: 90000},
+	34: {PayloadType: 34, Encoding: "H263", ClockRate: 90000},
+}
+
+// SDP is a session description of RFC 4566, every media section of it is a
+// track of the stream
+type SDP struct {
+	Raw        string
+	Version    int
+	Origin     string
+	Name       string
+	Info       string
+	URI        string
+	Connection string
+	Timing     []string
+	Bandwidth  []string
+	Attributes []SDPAttribute
+	Media      []*SDPMedia
+}
+
+type SDPAttribute struct {
+	Key   string
+	Value string
+}
+
+// RTPMap is the rtpmap and fmtp attributes of a payload type
+type RTPMap struct {
+	PayloadType int
+	Encoding    string
+	ClockRate   int
+	Channels    int
+	Fmtp        map[string]string
+}
+
+// SDPMedia is a media section of SDP
+type SDPMedia struct {
+	Type       string
+	Port       int
+	PortCount  int
+	Proto      string
+	Formats    []int
+	Info       string
+	Connection string
+	Bandwidth  []string
+	Attributes []SDPAttribute
+	RTPMaps    map[int]*RTPMap
+
+	session *SDP
+}
+
+func attribute(attributes []SDPAttribute, key string) (string, bool) {
+	for _, attr := range attributes {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+func direction(attributes []SDPAttribute) string {
+	for _, attr := range attributes {
+		switch attr.Key {
+		case DirectionSendRecv, DirectionSendOnly, DirectionRecvOnly, DirectionInactive:
+			return attr.Key
+		}
+	}
+	return ""
+}
+
+func parseFmtp(s string) map[string]string {
+	fmtp := make(map[string]string)
+	for _, param := range strings.Split(s, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			fmtp[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		} else {
+			fmtp[strings.ToLower(kv[0])] = ""
+		}
+	}
+	return fmtp
+}
+
+func (m *SDPMedia) rtpMap(pt int) *RTPMap {
+	rtpMap, ok := m.RTPMaps[pt]
+	if !ok {
+		rtpMap = &RTPMap{PayloadType: pt}
+		if static, ok := staticPayloadTypes[pt]; ok {
+			*rtpMap = static
+		}
+		m.RTPMaps[pt] = rtpMap
+	}
+	return rtpMap
+}
+
+func (m *SDPMedia) addAttribute(key string, value string) {
+	m.Attributes = append(m.Attributes, SDPAttribute{Key: key, Value: value})
+	switch key {
+	case "rtpmap":
+		// a=rtpmap:<payload type> <encoding name>/<clock rate>[/<encoding parameters>]
+		fields := strings.SplitN(value, " ", 2)
+		pt, err := strconv.Atoi(fields[0])
+		if err != nil || len(fields) < 2 {
+			return
+		}
+		rtpMap := m.rtpMap(pt)
+		params := strings.Split(strings.TrimSpace(fields[1]), "/")
+		rtpMap.Encoding = params[0]
+		rtpMap.ClockRate, rtpMap.Channels = 0, 0
+		if len(params) > 1 {
+			rtpMap.ClockRate, _ = strconv.Atoi(params[1])
+		}
+		if len(params) > 2 {
+			rtpMap.Channels, _ = strconv.Atoi(params[2])
+		}
+	case "fmtp":
+		fields := strings.SplitN(value, " ", 2)
+		pt, err := strconv.Atoi(fields[0])
+		if err != nil || len(fields) < 2 {
+			return
+		}
+		m.rtpMap(pt).Fmtp = parseFmtp(fields[1])
+	}
+}
+
+// ParseSDP parses session description, unknown lines are ignored
+func ParseSDP(sdpRaw string) (*SDP, error) {
+	s := &SDP{Raw: sdpRaw}
+	var media *SDPMedia
 	for _, line := range strings.Split(sdpRaw, "\n") {
 		line = strings.TrimSpace(line)
-		typeval := strings.SplitN(line, "=", 2)
-		if len(typeval) == 2 {
-			fields := strings.SplitN(typeval[1], " ", 2)
-			switch typeval[0] {
-			case "m":
-				if len(fields) > 0 {
-					switch fields[0] {
-					case "audio", "video":
-						sdpMap[fields[0]] = &SDPInfo{AVType: fields[0]}
-						info = sdpMap[fields[0]]
-						mfields := strings.Split(fields[1], " ")
-						if len(mfields) >= 3 {
-							info.PayloadType, _ = strconv.Atoi(mfields[2])
-						}
-					}
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		typ, value := line[0], line[2:]
+		if typ == 'm' {
+			// m=<media> <port>[/<number of ports>] <proto> <fmt> ...
+			fields := strings.Fields(value)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%w: media line %q", InvalidSDPError, line)
+			}
+			media = &SDPMedia{Type: fields[0], Proto: fields[2], RTPMaps: make(map[int]*RTPMap), session: s}
+			ports := strings.SplitN(fields[1], "/", 2)
+			port, err := strconv.Atoi(ports[0])
+			if err != nil {
+				return nil, fmt.Errorf("%w: media line %q", InvalidSDPError, line)
+			}
+			media.Port = port
+			if len(ports) == 2 {
+				media.PortCount, _ = strconv.Atoi(ports[1])
+			}
+			for _, f := range fields[3:] {
+				if pt, err := strconv.Atoi(f); err == nil {
+					media.Formats = append(media.Formats, pt)
+					media.rtpMap(pt)
 				}
-
-			case "a":
-				if info != nil {
-					for _, field := range fields {
-						keyval := strings.SplitN(field, ":", 2)
-						if len(keyval) >= 2 {
-							key := keyval[0]
-							val := keyval[1]
-							switch key {
-							case "control":
-								info.Control = val
-							case "rtpmap":
-								info.Rtpmap, _ = strconv.Atoi(val)
-							}
-						}
-						keyval = strings.Split(field, "/")
-						if len(keyval) >= 2 {
-							key := keyval[0]
-							switch key {
-							case "MPEG4-GENERIC":
-								info.Codec = "aac"
-							case "H264":
-								info.Codec = "h264"
-							case "H265":
-								info.Codec = "h265"
-							}
-							if i, err := strconv.Atoi(keyval[1]); err == nil {
-								info.TimeScale = i
-							}
-						}
-						keyval = strings.Split(field, ";")
-						if len(keyval) > 1 {
-							for _, field := range keyval {
-								keyval := strings.SplitN(field, "=", 2)
-								if len(keyval) == 2 {
-									key := strings.TrimSpace(keyval[0])
-									val := keyval[1]
-									switch key {
-									case "config":
-										info.Config, _ = hex.DecodeString(val)
-									case "sizelength":
-										info.SizeLength, _ = strconv.Atoi(val)
-									case "indexlength":
-										info.IndexLength, _ = strconv.Atoi(val)
-									case "sprop-parameter-sets":
-										fields := strings.Split(val, ",")
-										for _, field := range fields {
-											val, _ := base64.StdEncoding.DecodeString(field)
-											info.SpropParameterSets = append(info.SpropParameterSets, val)
-										}
-									}
-								}
-							}
-						}
-					}
+			}
+			s.Media = append(s.Media, media)
+			continue
+		}
+		if media == nil {
+			switch typ {
+			case 'v':
+				s.Version, _ = strconv.Atoi(value)
+			case 'o':
+				s.Origin = value
+			case 's':
+				s.Name = value
+			case 'i':
+				s.Info = value
+			case 'u':
+				s.URI = value
+			case 'c':
+				s.Connection = value
+			case 't':
+				s.Timing = append(s.Timing, value)
+			case 'b':
+				s.Bandwidth = append(s.Bandwidth, value)
+			case 'a':
+				kv := strings.SplitN(value, ":", 2)
+				attr := SDPAttribute{Key: kv[0]}
+				if len(kv) == 2 {
+					attr.Value = kv[1]
 				}
-
+				s.Attributes = append(s.Attributes, attr)
+			}
+			continue
+		}
+		switch typ {
+		case 'i':
+			media.Info = value
+		case 'c':
+			media.Connection = value
+		case 'b':
+			media.Bandwidth = append(media.Bandwidth, value)
+		case 'a':
+			kv := strings.SplitN(value, ":", 2)
+			if len(kv) == 2 {
+				media.addAttribute(kv[0], kv[1])
+			} else {
+				media.addAttribute(kv[0], "")
 			}
 		}
 	}
-	return sdpMap
+	return s, nil
+}
+
+// Attribute returns value of session level attribute
+func (s *SDP) Attribute(key string) string {
+	v, _ := attribute(s.Attributes, key)
+	return v
+}
+
+// Control returns session level control url
+func (s *SDP) Control() string {
+	return s.Attribute("control")
+}
+
+// Direction returns session level direction, default sendrecv
+func (s *SDP) Direction() string {
+	if d := direction(s.Attributes); d != "" {
+		return d
+	}
+	return DirectionSendRecv
+}
+
+// Track returns the first track of media type and its index, index is -1
+// if not found
+func (s *SDP) Track(mediaType string) (int, *SDPMedia) {
+	if s == nil {
+		return -1, nil
+	}
+	for i, m := range s.Media {
+		if m.Type == mediaType {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+// normalizeURL adds default port of rtsp url, controls and setup urls are
+// compared in this form
+func normalizeURL(u string) string {
+	if !strings.HasPrefix(strings.ToLower(u), "rtsp://") {
+		return u
+	}
+	l, err := urlpkg.Parse(u)
+	if err != nil {
+		return u
+	}
+	l.User = nil
+	if l.Port() == "" {
+		l.Host = fmt.Sprintf("%s:554", l.Host)
+	}
+	return l.String()
+}
+
+// MatchTrack finds the track the setup url refers to by control attribute.
+// control may be a path like `trackID=1`, `?ctype=video` or the whole url,
+// so setup url matches control if it is equal to or ends with control
+func (s *SDP) MatchTrack(setupURL string) int {
+	setupURL = normalizeURL(setupURL)
+	for i, m := range s.Media {
+		if control := normalizeURL(m.Control()); control != "" && control == setupURL {
+			return i
+		}
+	}
+	for i, m := range s.Media {
+		if control := normalizeURL(m.Control()); control != "" && control != "*" && strings.HasSuffix(setupURL, control) {
+			return i
+		}
+	}
+	if len(s.Media) == 1 {
+		return 0
+	}
+	return -1
+}
+
+func (m *SDPMedia) Attribute(key string) string {
+	v, _ := attribute(m.Attributes, key)
+	return v
+}
+
+func (m *SDPMedia) Control() string {
+	return m.Attribute("control")
+}
+
+// Direction returns direction of media, inherited from session if not
+// specified
+func (m *SDPMedia) Direction() string {
+	if d := direction(m.Attributes); d != "" {
+		return d
+	}
+	if m.session != nil {
+		return m.session.Direction()
+	}
+	return DirectionSendRecv
+}
+
+// PayloadType returns the first payload type of media, -1 if no format
+func (m *SDPMedia) PayloadType() int {
+	if len(m.Formats) == 0 {
+		return -1
+	}
+	return m.Formats[0]
+}
+
+// RTPMap returns rtpmap of the first payload type
+func (m *SDPMedia) RTPMap() *RTPMap {
+	if len(m.Formats) == 0 {
+		return nil
+	}
+	return m.RTPMaps[m.Formats[0]]
+}
+
+// Codec returns normalized codec name of the first payload type, the
+// lowercase encoding name is returned for codec not known
+func (m *SDPMedia) Codec() string {
+	rtpMap := m.RTPMap()
+	if rtpMap == nil {
+		return ""
+	}
+	encoding := strings.ToUpper(rtpMap.Encoding)
+	switch {
+	case encoding == "H264":
+		return CodecH264
+	case encoding == "H265" || encoding == "HEVC":
+		return CodecH265
+	case encoding == "AV1":
+		return CodecAV1
+	case encoding == "VP8":
+		return CodecVP8
+	case encoding == "VP9":
+		return CodecVP9
+	case encoding == "JPEG":
+		return CodecMJPEG
+	case encoding == "MPEG4-GENERIC" || encoding == "MPEG4-LATM" || encoding == "MP4A-LATM":
+		return CodecAAC
+	case encoding == "PCMA":
+		return CodecPCMA
+	case encoding == "PCMU":
+		return CodecPCMU
+	case encoding == "G722":
+		return CodecG722
+	case strings.HasPrefix(encoding, "G726") || strings.HasPrefix(encoding, "AAL2-G726"):
+		return CodecG726
+	case encoding == "OPUS":
+		return CodecOpus
+	case encoding == "VND.ONVIF.METADATA":
+		return CodecONVIFMetadata
+	}
+	return strings.ToLower(rtpMap.Encoding)
+}
+
+// ClockRate returns clock rate of the first payload type
+func (m *SDPMedia) ClockRate() int {
+	if rtpMap := m.RTPMap(); rtpMap != nil {
+		return rtpMap.ClockRate
+	}
+	return 0
+}
+
+// Fmtp returns fmtp parameter of the first payload type
+func (m *SDPMedia) Fmtp(key string) string {
+	if rtpMap := m.RTPMap(); rtpMap != nil && rtpMap.Fmtp != nil {
+		return rtpMap.Fmtp[strings.ToLower(key)]
+	}
+	return ""
+}
+
+// SpropParameterSets returns H.264 SPS and PPS of fmtp
+func (m *SDPMedia) SpropParameterSets() [][]byte {
+	var sets [][]byte
+	for _, s := range strings.Split(m.Fmtp("sprop-parameter-sets"), ",") {
+		if s == "" {
+			continue
+		}
+		if set, err := base64.StdEncoding.DecodeString(s); err == nil {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// Config returns AAC AudioSpecificConfig of fmtp
+func (m *SDPMedia) Config() []byte {
+	config, _ := hex.DecodeString(m.Fmtp("config"))
+	return config
+}
+
+// rtpType returns RTPType of packets of the media
+func (m *SDPMedia) rtpType(control bool) RTPType {
+	switch m.Type {
+	case "video":
+		if control {
+			return RtpTypeVideoControl
+		}
+		return RtpTypeVideo
+	case "audio":
+		if control {
+			return RtpTypeAudioControl
+		}
+		return RtpTypeAudio
+	}
+	if control {
+		return RtpTypeDataControl
+	}
+	return RtpTypeData
 }
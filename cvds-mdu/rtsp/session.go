@@ -2,30 +2,21 @@ package rtsp
 
 import (
 	"bufio"
-	"bytes"
-	"crypto/md5"
-	"encoding/binary"
 	"fmt"
 	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/common/errors"
 	"github.com/CVDS2020/CVDS2020/common/log"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
-	"io"
 	"net"
 	urlpkg "net/url"
-	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teris-io/shortid"
 )
 
-type RTPPack struct {
-	Type   RTPType
-	Buffer *bytes.Buffer
-}
-
 type SessionType int
 
 const (
@@ -50,6 +41,9 @@ const (
 	RtpTypeVideo
 	RtpTypeAudioControl
 	RtpTypeVideoControl
+	// packets of media other than audio and video, such as ONVIF metadata
+	RtpTypeData
+	RtpTypeDataControl
 )
 
 func (rt RTPType) String() string {
@@ -62,23 +56,47 @@ func (rt RTPType) String() string {
 		return "audio control"
 	case RtpTypeVideoControl:
 		return "video control"
+	case RtpTypeData:
+		return "data"
+	case RtpTypeDataControl:
+		return "data control"
 	}
 	return "unknown"
 }
 
+// IsControl reports whether packet is RTCP
+func (rt RTPType) IsControl() bool {
+	return rt == RtpTypeAudioControl || rt == RtpTypeVideoControl || rt == RtpTypeDataControl
+}
+
 type TransType int
 
 const (
 	TransTypeTcp TransType = iota
 	TransTypeUdp
+	// transport of client selected at start, see Client.AutoTransType
+	TransTypeAuto
 )
 
+// ParseTransType returns trans type of name tcp, udp or auto, default TCP
+func ParseTransType(name string) TransType {
+	switch strings.ToLower(name) {
+	case "udp":
+		return TransTypeUdp
+	case "auto":
+		return TransTypeAuto
+	}
+	return TransTypeTcp
+}
+
 func (tt TransType) String() string {
 	switch tt {
 	case TransTypeTcp:
 		return "TCP"
 	case TransTypeUdp:
 		return "UDP"
+	case TransTypeAuto:
+		return "AUTO"
 	}
 	return "unknown"
 }
@@ -86,6 +104,12 @@ func (tt TransType) String() string {
 const UdpBufSize = 1048576
 
 type Session struct {
+	// unix nanoseconds of the last request, RTP or RTCP received, accessed
+	// atomically
+	lastActive int64
+	// closes session inactive for Timeout
+	keepaliveTimer *time.Timer
+
 	logger    *log.Logger
 	ID        string
 	Server    *Server
@@ -97,44 +121,66 @@ type Session struct {
 	Path      string
 	URL       string
 	SDPRaw    string
-	SDPMap    map[string]*SDPInfo
-
-	authorizationEnable bool
-	nonce               string
-	closeOld            bool
-
-	AControl string
-	VControl string
-	ACodec   string
-	VCodec   string
-
-	// stats info
-	InBytes  int
-	OutBytes int
+	SDP       *SDP
+
+	// nonce and nonce count of the last request authenticated
+	nonce string
+	nc    uint64
+	// user of the last request authenticated, nil if not authenticated
+	user *config.User
+	// CSeq of the last request sent to player, guarded by connWLock
+	serverCSeq int
+
+	// stats info, updated atomically
+	InBytes  int64
+	OutBytes int64
 	StartAt  time.Time
-	Timeout  int
+	// session timeout in milliseconds
+	Timeout int
 
-	Stopped bool
+	// 1 if stopped, stopped once by any of goroutines of session
+	stopped uint32
 
 	//tcp channels
-	aRTPChannel        int
-	aRTPControlChannel int
-	vRTPChannel        int
-	vRTPControlChannel int
+	channels interleavedChannels
+	// interleaved packets to write of player
+	batch *rtpBatch
+	// keys of SRTP of tracks offered to player
+	srtpKeys map[int]*srtpKey
+	srtpLock sync.Mutex
+	// backchannel of source described to player
+	backchannel bool
 
 	Pusher      *Pusher
 	Player      *Player
 	UDPClient   *UDPClient
 	RTPHandles  []func(*RTPPack)
 	StopHandles []func()
+	// called with track of RTP lost by jitter buffer, before packets after
+	// the gap handled
+	GapHandles []func(track int)
 }
 
 func (session *Session) String() string {
-	return fmt.Sprintf("session[%v][%v][%s][%s][%s]", session.Type, session.TransType, session.Path, session.ID, session.Conn.RemoteAddr().String())
+	addr := ""
+	if conn := session.Conn; conn != nil {
+		addr = conn.RemoteAddr().String()
+	}
+	return fmt.Sprintf("session[%v][%v][%s][%s][%s]", session.Type, session.TransType, session.Path, session.ID, addr)
+}
+
+// remoteIP returns IP of peer, nil if connection not of TCP
+func (session *Session) remoteIP() net.IP {
+	if conn := session.Conn; conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			return addr.IP
+		}
+	}
+	return nil
 }
 
 func NewSession(server *Server, conn net.Conn) *Session {
-	timeoutTCPConn := &RichConn{conn, config.RtspConfig().Timeout}
+	timeoutTCPConn := NewRichConn(conn, config.RtspConfig().Timeout, config.RtspConfig().WriteTimeout)
 	session := &Session{
 		ID:     shortid.MustGenerate(),
 		Server: server,
@@ -143,217 +189,167 @@ func NewSession(server *Server, conn net.Conn) *Session {
 			bufio.NewReaderSize(timeoutTCPConn, config.RtspConfig().ReaderSize),
 			bufio.NewWriterSize(timeoutTCPConn, config.RtspConfig().WriterSize),
 		),
-		StartAt:             time.Now(),
-		Timeout:             int(config.RtspConfig().Timeout.Milliseconds()),
-		authorizationEnable: config.RtspConfig().EnableAuthorization,
-		RTPHandles:          make([]func(*RTPPack), 0),
-		StopHandles:         make([]func(), 0),
-		vRTPChannel:         -1,
-		vRTPControlChannel:  -1,
-		aRTPChannel:         -1,
-		aRTPControlChannel:  -1,
-		closeOld:            config.RtspConfig().CloseOld,
+		StartAt:     time.Now(),
+		Timeout:     int(config.RtspConfig().SessionTimeout.Milliseconds()),
+		RTPHandles:  make([]func(*RTPPack), 0),
+		StopHandles: make([]func(), 0),
 	}
 
 	session.logger = assert.Must(config.LogConfig().Build("rtsp.session", "rtsp"))
 	return session
 }
 
+// Stopped reports whether session stopped
+func (session *Session) Stopped() bool {
+	return atomic.LoadUint32(&session.stopped) == 1
+}
+
 func (session *Session) Stop() {
-	if session.Stopped {
+	if atomic.SwapUint32(&session.stopped, 1) == 1 {
 		return
 	}
-	session.Stopped = true
+	if session.keepaliveTimer != nil {
+		session.keepaliveTimer.Stop()
+	}
 	for _, h := range session.StopHandles {
 		h()
 	}
+	session.connWLock.Lock()
 	if session.Conn != nil {
 		session.connRW.Flush()
 		session.Conn.Close()
 		session.Conn = nil
 	}
+	session.connWLock.Unlock()
 	if session.UDPClient != nil {
 		session.UDPClient.Stop()
 		session.UDPClient = nil
 	}
 }
 
+// touch marks session active, it is called on requests, RTP and RTCP received
+func (session *Session) touch() {
+	atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+}
+
+// timeout returns session timeout, sessions are never closed for inactivity
+// if zero
+func (session *Session) timeout() time.Duration {
+	return time.Duration(session.Timeout) * time.Millisecond
+}
+
+// startKeepalive closes session after timeout without requests, RTP or RTCP
+// received. Half-open TCP sessions and UDP players stopping RTCP receiver
+// reports and keepalive requests are closed this way
+func (session *Session) startKeepalive() {
+	timeout := session.timeout()
+	if timeout <= 0 {
+		return
+	}
+	session.touch()
+	var check func()
+	check = func() {
+		if session.Stopped() {
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&session.lastActive)))
+		if idle < timeout {
+			session.keepaliveTimer.Reset(timeout - idle)
+			return
+		}
+		session.logger.Warn("rtsp session timeout, stop it",
+			log.String("session", session.String()),
+			log.Duration("idle", idle),
+		)
+		session.Stop()
+	}
+	session.keepaliveTimer = time.AfterFunc(timeout, check)
+}
+
 func (session *Session) Start() {
 	defer session.Stop()
-	buf1 := make([]byte, 1)
-	buf2 := make([]byte, 2)
 	logger := session.logger
 	timer := time.Unix(0, 0)
-	for !session.Stopped {
-		if _, err := io.ReadFull(session.connRW, buf1); err != nil {
-			logger.ErrorWith("rtsp session read full error", err)
+	reader := NewFrameReader(session.connRW)
+	defer reader.Close()
+	session.startKeepalive()
+	for !session.Stopped() {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			logger.ErrorWith("rtsp session read frame error", err)
 			return
 		}
-		if buf1[0] == '$' { //rtp data
-			if _, err := io.ReadFull(session.connRW, buf1); err != nil {
-				logger.ErrorWith("rtsp session read full error", err)
-				return
-			}
-			if _, err := io.ReadFull(session.connRW, buf2); err != nil {
-				logger.ErrorWith("rtsp session read full error", err)
-				return
-			}
-			channel := int(buf1[0])
-			rtpLen := int(binary.BigEndian.Uint16(buf2))
-			rtpBytes := make([]byte, rtpLen)
-			if _, err := io.ReadFull(session.connRW, rtpBytes); err != nil {
-				logger.ErrorWith("rtsp session read full error", err)
-				return
-			}
-			rtpBuf := bytes.NewBuffer(rtpBytes)
-			var pack *RTPPack
-			switch channel {
-			case session.aRTPChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeAudio,
-					Buffer: rtpBuf,
-				}
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Info("Recv an audio RTP package")
-					timer = time.Now()
-				}
-			case session.aRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeAudioControl,
-					Buffer: rtpBuf,
-				}
-			case session.vRTPChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeVideo,
-					Buffer: rtpBuf,
-				}
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Info("Recv an video RTP package")
-					timer = time.Now()
-				}
-			case session.vRTPControlChannel:
-				pack = &RTPPack{
-					Type:   RtpTypeVideoControl,
-					Buffer: rtpBuf,
-				}
-			default:
-				logger.Warn("unknown rtp pack type, %v", log.Int("channel", channel))
+		session.touch()
+		if frame.Channel < 0 { // rtsp cmd
+			if strings.HasPrefix(frame.Header, RTSP_VERSION) {
+				// response of player to request sent, such as ANNOUNCE
+				atomic.AddInt64(&session.InBytes, int64(len(frame.Header)+len(frame.Body)))
+				logger.Debug("<<<\n" + frame.Header)
 				continue
 			}
-			session.InBytes += rtpLen + 4
-			for _, h := range session.RTPHandles {
-				h(pack)
+			req := NewRequest(frame.Header)
+			if req == nil {
+				continue
 			}
-		} else { // rtsp cmd
-			reqBuf := bytes.NewBuffer(nil)
-			reqBuf.Write(buf1)
-			for !session.Stopped {
-				if line, isPrefix, err := session.connRW.ReadLine(); err != nil {
-					logger.ErrorWith("rtsp session read line error", err)
-					return
-				} else {
-					reqBuf.Write(line)
-					if !isPrefix {
-						reqBuf.WriteString("\r\n")
-					}
-					if len(line) == 0 {
-						req := NewRequest(reqBuf.String())
-						if req == nil {
-							break
-						}
-						session.InBytes += reqBuf.Len()
-						contentLen := req.GetContentLength()
-						session.InBytes += contentLen
-						if contentLen > 0 {
-							bodyBuf := make([]byte, contentLen)
-							if n, err := io.ReadFull(session.connRW, bodyBuf); err != nil {
-								logger.ErrorWith("rtsp session read full error", err)
-								return
-							} else if n != contentLen {
-								logger.Error(fmt.Sprintf("read rtsp request body failed, expect size[%d], got size[%d]", contentLen, n))
-								return
-							}
-							req.Body = string(bodyBuf)
-						}
-						session.handleRequest(req)
-						break
-					}
-				}
+			atomic.AddInt64(&session.InBytes, int64(len(frame.Header)+len(frame.Body)))
+			req.Body = frame.Body
+			session.handleRequest(req)
+			continue
+		}
+		tc, ok := session.channels.lookup(frame.Channel)
+		if !ok {
+			frame.Release()
+			logger.Warn("unknown rtp pack channel", log.Int("channel", frame.Channel))
+			continue
+		}
+		if !tc.typ.IsControl() {
+			elapsed := time.Now().Sub(timer)
+			if elapsed >= 30*time.Second {
+				logger.Info("Recv an RTP package", log.Int("track", tc.track), log.String("type", tc.typ.String()))
+				timer = time.Now()
 			}
 		}
+		atomic.AddInt64(&session.InBytes, int64(len(frame.Data)+4))
+		pack := frame.Pack(tc.track, tc.typ)
+		for _, h := range session.RTPHandles {
+			h(pack)
+		}
+		pack.Release()
 	}
 }
 
-func CheckAuth(authLine string, method string, sessionNonce string) error {
-	realmRex := regexp.MustCompile(`realm="(.*?)"`)
-	nonceRex := regexp.MustCompile(`nonce="(.*?)"`)
-	usernameRex := regexp.MustCompile(`username="(.*?)"`)
-	responseRex := regexp.MustCompile(`response="(.*?)"`)
-	uriRex := regexp.MustCompile(`uri="(.*?)"`)
-
-	realm := ""
-	nonce := ""
-	username := ""
-	response := ""
-	uri := ""
-	result1 := realmRex.FindStringSubmatch(authLine)
-	if len(result1) == 2 {
-		realm = result1[1]
-	} else {
-		return fmt.Errorf("CheckAuth error : no realm found")
-	}
-	result1 = nonceRex.FindStringSubmatch(authLine)
-	if len(result1) == 2 {
-		nonce = result1[1]
-	} else {
-		return fmt.Errorf("CheckAuth error : no nonce found")
-	}
-	if sessionNonce != nonce {
-		return fmt.Errorf("CheckAuth error : sessionNonce not same as nonce")
-	}
-
-	result1 = usernameRex.FindStringSubmatch(authLine)
-	if len(result1) == 2 {
-		username = result1[1]
-	} else {
-		return fmt.Errorf("CheckAuth error : username not found")
-	}
-
-	result1 = responseRex.FindStringSubmatch(authLine)
-	if len(result1) == 2 {
-		response = result1[1]
-	} else {
-		return fmt.Errorf("CheckAuth error : response not found")
-	}
-
-	result1 = uriRex.FindStringSubmatch(authLine)
-	if len(result1) == 2 {
-		uri = result1[1]
-	} else {
-		return fmt.Errorf("CheckAuth error : uri not found")
+// requestPath returns path of URL of request, and whether request is of the
+// path bound to session by ANNOUNCE or DESCRIBE before. Requests of path
+// bound are of the path, paths under it or controls of tracks of it, and
+// ANNOUNCE or DESCRIBE of other paths are not
+func (session *Session) requestPath(req *Request) (string, bool) {
+	path := ""
+	if url, err := urlpkg.Parse(req.URL); err == nil {
+		path = url.Path
 	}
-
-	if username != "admin" {
-		return fmt.Errorf("CheckAuth error : user not exists")
+	if session.Path == "" {
+		return path, true
 	}
-	md5UserRealmPwd := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", username, realm, "admin"))))
-	md5MethodURL := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s", method, uri))))
-	myResponse := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", md5UserRealmPwd, nonce, md5MethodURL))))
-	if myResponse != response {
-		return fmt.Errorf("CheckAuth error : response not equal")
+	switch {
+	case req.URL == "*", path == session.Path:
+	case req.Method == "ANNOUNCE" || req.Method == "DESCRIBE":
+		return path, false
+	case strings.HasPrefix(path, strings.TrimSuffix(session.Path, "/")+"/"):
+	case req.Method == "SETUP" && session.SDP != nil && session.SDP.MatchTrack(req.URL) >= 0:
+	default:
+		return path, false
 	}
-	return nil
+	return session.Path, true
 }
 
 func (session *Session) handleRequest(req *Request) {
-	//if session.Timeout > 0 {
-	//	session.Conn.SetDeadline(time.Now().Add(time.Duration(session.Timeout) * time.Second))
-	//}
 	logger := session.logger
 	logger.Debug("<<<\n" + req.String())
 	res := NewResponse(200, "OK", req.Header["CSeq"], session.ID, "")
+	if timeout := session.timeout(); timeout > 0 {
+		// in seconds, rounded up not to advertise 0
+		res.Header["Session"] = fmt.Sprintf("%s;timeout=%d", session.ID, (timeout+time.Second-1)/time.Second)
+	}
 	defer func() {
 		if p := recover(); p != nil {
 			logger.Error("handleRequest err occurs", log.Any("error", p))
@@ -366,7 +362,7 @@ func (session *Session) handleRequest(req *Request) {
 		session.connRW.Write(outBytes)
 		session.connRW.Flush()
 		session.connWLock.Unlock()
-		session.OutBytes += len(outBytes)
+		atomic.AddInt64(&session.OutBytes, int64(len(outBytes)))
 		switch req.Method {
 		case "PLAY", "RECORD":
 			switch session.Type {
@@ -385,36 +381,53 @@ func (session *Session) handleRequest(req *Request) {
 				return
 			}
 		}
-		if res.StatusCode != 200 && res.StatusCode != 401 {
+		switch res.StatusCode {
+		// client may retry SETUP of other transport on unsupported transport,
+		// or DESCRIBE without option not supported
+		case 200, 401, 451, 461, 551:
+		case 301, 302:
+			// player connects to location
+			session.Stop()
+		default:
 			logger.Error("Response request error. stop session.", log.Int("code", res.StatusCode))
 			session.Stop()
 		}
 	}()
-	if req.Method != "OPTIONS" {
-		if session.authorizationEnable {
-			authLine := req.Header["Authorization"]
-			authFailed := true
-			if authLine != "" {
-				err := CheckAuth(authLine, req.Method, session.nonce)
-				if err == nil {
-					authFailed = false
-				} else {
+	// policy of path requested, requests after ANNOUNCE or DESCRIBE are of
+	// the path bound to session
+	path, ok := session.requestPath(req)
+	if !ok {
+		logger.Warn("request of path other than session", log.String("path", session.Path), log.String("url", req.URL))
+		res.StatusCode = 455
+		res.Status = "Method Not Valid in This State"
+		return
+	}
+	policy := config.RtspConfig().PathPolicy(path)
+	if req.Method != "OPTIONS" && req.Method != "GET_PARAMETER" {
+		if policy.EnableAuthorization {
+			err := session.authenticate(req.Header["Authorization"], req.Method)
+			if err != nil {
+				if req.Header["Authorization"] != "" {
 					logger.Info("check authentication error", log.Error(err))
 				}
-			}
-			if authFailed {
 				res.StatusCode = 401
 				res.Status = "Unauthorized"
-				nonce := fmt.Sprintf("%x", md5.Sum([]byte(shortid.MustGenerate())))
-				session.nonce = nonce
-				res.Header["WWW-Authenticate"] = fmt.Sprintf(`Digest realm="EasyDarwin", nonce="%s", algorithm="MD5"`, nonce)
+				res.Header["WWW-Authenticate"] = authChallenges(errors.Is(err, StaleNonceError))
 				return
 			}
 		}
 	}
 	switch req.Method {
 	case "OPTIONS":
-		res.Header["Public"] = "DESCRIBE, SETUP, TEARDOWN, PLAY, PAUSE, OPTIONS, ANNOUNCE, RECORD"
+		res.Header["Public"] = "DESCRIBE, SETUP, TEARDOWN, PLAY, PAUSE, OPTIONS, ANNOUNCE, RECORD, GET_PARAMETER, SET_PARAMETER"
+	case "GET_PARAMETER":
+		// keepalive, no parameters supported
+	case "SET_PARAMETER":
+		// keepalive if without body, no parameters supported
+		if req.Body != "" {
+			res.StatusCode = 451
+			res.Status = "Parameter Not Understood"
+		}
 	case "ANNOUNCE":
 		session.Type = SessionTypePusher
 		session.URL = req.URL
@@ -426,23 +439,35 @@ func (session *Session) handleRequest(req *Request) {
 			return
 		}
 		session.Path = url.Path
+		if !policy.AllowPublisher(session.remoteIP()) {
+			logger.Warn("publisher not allowed to push path", log.String("path", session.Path))
+			res.StatusCode = 403
+			res.Status = "Forbidden"
+			return
+		}
 
+		sdp, err := ParseSDP(req.Body)
+		if err != nil {
+			res.StatusCode = 400
+			res.Status = "Bad Request"
+			logger.ErrorWith("parse announced sdp error", err)
+			return
+		}
+		old := session.SDP
 		session.SDPRaw = req.Body
-		session.SDPMap = ParseSDP(req.Body)
-		sdp, ok := session.SDPMap["audio"]
-		if ok {
-			session.AControl = sdp.Control
-			session.ACodec = sdp.Codec
-			logger.Debug("", log.String("audio codec", session.ACodec))
-		}
-		sdp, ok = session.SDPMap["video"]
-		if ok {
-			session.VControl = sdp.Control
-			session.VCodec = sdp.Codec
-			logger.Debug("", log.String("video codec", session.VCodec))
+		session.SDP = sdp
+		for i, media := range sdp.Media {
+			logger.Debug("announced track", log.Int("track", i), log.String("media", media.Type),
+				log.String("codec", media.Codec()), log.String("control", media.Control()))
+		}
+		if pusher := session.Pusher; pusher != nil && pusher.Session == session {
+			// re-announced mid-stream by the pusher session
+			logger.Info("pusher re-announced", log.String("pusher", pusher.String()))
+			pusher.changeSDP(old)
+			return
 		}
 		addPusher := false
-		if session.closeOld {
+		if policy.CloseOld {
 			r, _ := session.Server.TryAttachToPusher(session)
 			if r < -1 {
 				logger.Warn("reject pusher.")
@@ -452,27 +477,15 @@ func (session *Session) handleRequest(req *Request) {
 				addPusher = true
 			} else {
 				logger.Warn("Attached to old pusher")
-				// 尝试发给客户端ANNOUCE
-				// players := pusher.GetPlayers()
-				// for _, v := range players {
-				// 	sess := v.Session
-
-				// 	hearers := make(map[string]string)
-				// 	hearers["Content-Type"] = "application/sdp"
-				// 	hearers["Session"] = sess.ID
-				// 	hearers["Content-Length"] = strconv.Itoa(len(v.SDPRaw))
-				// 	var req = Request{Method: ANNOUNCE, URL: v.URL, Version: "1.0", Header: hearers, Body: pusher.SDPRaw()}
-				// 	sess.connWLock.Lock()
-				// 	logger.Println(req.String())
-				// 	outBytes := []byte(req.String())
-				// 	sess.connRW.Write(outBytes)
-				// 	sess.connRW.Flush()
-				// 	sess.connWLock.Unlock()
-				// }
 			}
 		} else {
 			addPusher = true
 		}
+		if addPusher && !session.Server.Memory().Admit("pusher") {
+			res.StatusCode = 453
+			res.Status = "Not Enough Bandwidth"
+			return
+		}
 		if addPusher {
 			session.Pusher = NewPusher(session)
 			addedToServer := session.Server.AddPusher(session.Pusher)
@@ -494,21 +507,89 @@ func (session *Session) handleRequest(req *Request) {
 		}
 		session.Path = url.Path
 		pusher := session.Server.GetPusher(session.Path)
+		if cluster := session.Server.Cluster(); cluster != nil {
+			location, reject := cluster.Route(session.Path, pusher != nil)
+			if location != "" {
+				logger.Info("redirect player to cluster peer", log.String("path", session.Path), log.String("location", location))
+				res.StatusCode, res.Status = cluster.RedirectStatus()
+				res.Header["Location"] = location
+				return
+			}
+			if reject {
+				logger.Warn("limits of cluster node reached", log.String("path", session.Path))
+				res.StatusCode = 453
+				res.Status = "Not Enough Bandwidth"
+				return
+			}
+		}
+		if pusher == nil && len(policy.Sources) > 0 {
+			if pusher, err = session.Server.PullSource(session.Path, policy); err != nil {
+				logger.ErrorWith("pull source on demand error", err, log.Strings("sources", policy.Sources))
+				res.StatusCode = 404
+				res.Status = "NOT FOUND"
+				return
+			}
+		}
+		if pusher == nil && len(policy.Sources) == 0 {
+			if origins := config.RtspConfig().Edge.OriginsOf(session.Path); len(origins) > 0 {
+				if pusher, err = session.Server.PullOrigin(session.Path, origins, req.Header["Via"]); err != nil {
+					logger.ErrorWith("pull from origins error", err, log.Strings("origins", origins))
+					res.StatusCode = 404
+					res.Status = "NOT FOUND"
+					return
+				}
+			}
+		}
 		if pusher == nil {
 			res.StatusCode = 404
 			res.Status = "NOT FOUND"
 			return
 		}
+		backchannel := requiresBackchannel(req.Header["Require"])
+		if backchannel && pusher.BackchannelTrack() < 0 {
+			res.StatusCode = 551
+			res.Status = "Option not supported"
+			res.Header["Unsupported"] = RequireBackchannel
+			return
+		}
+		if backchannel && !session.allowTalk() {
+			logger.Warn("talk permission denied", log.String("path", session.Path))
+			res.StatusCode = 403
+			res.Status = "Forbidden"
+			return
+		}
+		if pusher.PlayersFull() {
+			logger.Warn("max players of path reached", log.String("path", session.Path))
+			res.StatusCode = 453
+			res.Status = "Not Enough Bandwidth"
+			return
+		}
+		if !session.Server.Memory().Admit("player") {
+			res.StatusCode = 453
+			res.Status = "Not Enough Bandwidth"
+			return
+		}
 		session.Player = NewPlayer(session, pusher)
 		session.Pusher = pusher
-		session.AControl = pusher.AControl()
-		session.VControl = pusher.VControl()
-		session.ACodec = pusher.ACodec()
-		session.VCodec = pusher.VCodec()
+		session.SDP = pusher.SDP()
+		// players may send nothing on connection, closed by session timeout
+		// instead if inactive
 		session.Conn.timeout = 0
-		res.SetBody(session.Pusher.SDPRaw())
+		session.backchannel = backchannel
+		raw := session.Pusher.PlayerSDPRaw()
+		if track := pusher.BackchannelTrack(); track >= 0 && !backchannel {
+			// backchannel described to players requiring it only
+			raw = withoutTrack(raw, track)
+		}
+		res.SetBody(session.offerSRTP(raw))
 	case "SETUP":
 		ts := req.Header["Transport"]
+		// error status. SETUP without ANNOUNCE or DESCRIBE.
+		if session.Pusher == nil || session.SDP == nil {
+			res.StatusCode = 500
+			res.Status = "Error Status"
+			return
+		}
 		// control字段可能是`stream=1`字样，也可能是rtsp://...字样。即control可能是url的path，也可能是整个url
 		// 例1：
 		// a=control:streamid=1
@@ -516,81 +597,80 @@ func (session *Session) handleRequest(req *Request) {
 		// a=control:rtsp://192.168.1.64/trackID=1
 		// 例3：
 		// a=control:?ctype=video
-		setupUrl, err := urlpkg.Parse(req.URL)
-		if err != nil {
-			res.StatusCode = 500
-			res.Status = "Invalid URL"
-			return
+		track := session.SDP.MatchTrack(req.URL)
+		if session.Type == SessionTypePlayer && !session.backchannel && track >= 0 && track == session.Pusher.BackchannelTrack() {
+			// backchannel not described
+			track = -1
 		}
-		if setupUrl.Port() == "" {
-			setupUrl.Host = fmt.Sprintf("%s:554", setupUrl.Host)
+		if track < 0 {
+			res.StatusCode = 404
+			res.Status = "Not Found"
+			logger.Warn("SETUP got unknown control", log.String("setup url", req.URL))
+			return
 		}
-		setupPath := setupUrl.String()
-
-		// error status. SETUP without ANNOUNCE or DESCRIBE.
-		if session.Pusher == nil {
-			res.StatusCode = 500
-			res.Status = "Error Status"
+		if session.Type == SessionTypePlayer && track == session.Pusher.BackchannelTrack() && !session.allowTalk() {
+			logger.Warn("talk permission denied", log.String("path", session.Path))
+			res.StatusCode = 403
+			res.Status = "Forbidden"
 			return
 		}
-		//setupPath = setupPath[strings.LastIndex(setupPath, "/")+1:]
-		vPath := ""
-		if strings.Index(strings.ToLower(session.VControl), "rtsp://") == 0 {
-			vControlUrl, err := urlpkg.Parse(session.VControl)
-			if err != nil {
-				res.StatusCode = 500
-				res.Status = "Invalid VControl"
+		media := session.SDP.Media[track]
+
+		// RTP/SAVP of SRTP is supported by UDP transport
+		savp := strings.Contains(strings.ToUpper(ts), "RTP/SAVP")
+		if tcpMatchs := interleavedRegexp.FindStringSubmatch(ts); tcpMatchs != nil || strings.Contains(strings.ToUpper(ts), "/TCP") {
+			if savp {
+				res.StatusCode = 461
+				res.Status = "Unsupported Transport"
+				logger.Warn("SETUP [TCP] srtp unsupported", log.String("transport", ts))
 				return
 			}
-			if vControlUrl.Port() == "" {
-				vControlUrl.Host = fmt.Sprintf("%s:554", vControlUrl.Host)
-			}
-			vPath = vControlUrl.String()
-		} else {
-			vPath = session.VControl
-		}
-
-		aPath := ""
-		if strings.Index(strings.ToLower(session.AControl), "rtsp://") == 0 {
-			aControlUrl, err := urlpkg.Parse(session.AControl)
-			if err != nil {
-				res.StatusCode = 500
-				res.Status = "Invalid AControl"
+			if config.RtspConfig().Srtp.Require {
+				res.StatusCode = 461
+				res.Status = "Unsupported Transport"
+				logger.Warn("SETUP [TCP] srtp required", log.String("transport", ts))
 				return
 			}
-			if aControlUrl.Port() == "" {
-				aControlUrl.Host = fmt.Sprintf("%s:554", aControlUrl.Host)
-			}
-			aPath = aControlUrl.String()
-		} else {
-			aPath = session.AControl
-		}
-
-		mtcp := regexp.MustCompile("interleaved=(\\d+)(-(\\d+))?")
-		mudp := regexp.MustCompile("client_port=(\\d+)(-(\\d+))?")
-
-		if tcpMatchs := mtcp.FindStringSubmatch(ts); tcpMatchs != nil {
 			session.TransType = TransTypeTcp
-			if setupPath == aPath || aPath != "" && strings.LastIndex(setupPath, aPath) == len(setupPath)-len(aPath) {
-				session.aRTPChannel, _ = strconv.Atoi(tcpMatchs[1])
-				session.aRTPControlChannel, _ = strconv.Atoi(tcpMatchs[3])
-			} else if setupPath == vPath || vPath != "" && strings.LastIndex(setupPath, vPath) == len(setupPath)-len(vPath) {
-				session.vRTPChannel, _ = strconv.Atoi(tcpMatchs[1])
-				session.vRTPControlChannel, _ = strconv.Atoi(tcpMatchs[3])
+			var rtpChannel, rtcpChannel int
+			if tcpMatchs != nil {
+				rtpChannel, rtcpChannel = parsePortRange(tcpMatchs)
+				if !session.channels.free(track, rtpChannel, rtcpChannel) {
+					res.StatusCode = 400
+					res.Status = "Bad Request"
+					logger.Warn("SETUP [TCP] interleaved channels in use", log.String("transport", ts))
+					return
+				}
 			} else {
-				res.StatusCode = 500
-				res.Status = fmt.Sprintf("SETUP [TCP] got unknown control:%s", setupPath)
-				logger.Warn("SETUP [TCP] got unknown control", log.String("setup path", setupPath))
+				// client leaves channels to server, allocate and return them in transport
+				rtpChannel, rtcpChannel = session.channels.allocate(track)
+				ts = fmt.Sprintf("%s;interleaved=%d-%d", strings.TrimRight(ts, ";"), rtpChannel, rtcpChannel)
 			}
+			session.channels.set(track, media, rtpChannel, rtcpChannel)
 			logger.Debug("Parse SETUP request",
 				log.String("req.TRANSPORT:TCP.Session.Type", session.Type.String()),
-				log.String("control", setupPath),
-				log.String("AControl", aPath),
-				log.String("VControl", vPath),
+				log.String("control", req.URL),
+				log.Int("track", track),
+				log.Int("rtp channel", rtpChannel),
+				log.Int("rtcp channel", rtcpChannel),
 			)
-		} else if udpMatchs := mudp.FindStringSubmatch(ts); udpMatchs != nil {
+		} else if udpMatchs := clientPortRegexp.FindStringSubmatch(ts); udpMatchs != nil {
+			// key of SRTP offered to player, or key of pusher announced
+			var key *srtpKey
+			if savp && session.Type == SessionTypePlayer {
+				key = session.srtpKey(track)
+			} else if savp {
+				key, _ = media.srtpKey()
+			}
+			if savp && key == nil || !savp && config.RtspConfig().Srtp.Require {
+				res.StatusCode = 461
+				res.Status = "Unsupported Transport"
+				logger.Warn("SETUP [UDP] srtp not negotiated", log.String("transport", ts))
+				return
+			}
 			session.TransType = TransTypeUdp
-			// no need for tcp timeout.
+			// connection idle with UDP transport, closed by session timeout
+			// instead if inactive
 			session.Conn.timeout = 0
 			if session.Type == SessionTypePlayer && session.UDPClient == nil {
 				session.UDPClient = &UDPClient{
@@ -604,70 +684,48 @@ func (session *Session) handleRequest(req *Request) {
 			}
 			logger.Debug("Parse SETUP request",
 				log.String("req.TRANSPORT:UDP.Session.Type", session.Type.String()),
-				log.String("control", setupPath),
-				log.String("AControl", aPath),
-				log.String("VControl", vPath),
+				log.String("control", req.URL),
+				log.Int("track", track),
 			)
-			if setupPath == aPath || aPath != "" && strings.LastIndex(setupPath, aPath) == len(setupPath)-len(aPath) {
-				if session.Type == SessionTypePlayer {
-					session.UDPClient.APort, _ = strconv.Atoi(udpMatchs[1])
-					session.UDPClient.AControlPort, _ = strconv.Atoi(udpMatchs[3])
-					if err := session.UDPClient.SetupAudio(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp client setup audio error, %v", err)
-						return
-					}
+			var serverPort, serverControlPort int
+			if session.Type == SessionTypePlayer {
+				port, controlPort := parsePortRange(udpMatchs)
+				t, err := session.UDPClient.SetupTrack(track, media, port, controlPort, key)
+				if err != nil {
+					res.StatusCode = 500
+					res.Status = fmt.Sprintf("udp client setup track error, %v", err)
+					return
 				}
-				if session.Type == SessionTypePusher {
-					if err := session.Pusher.UDPServer.SetupAudio(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp server setup audio error, %v", err)
-						return
-					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.APort, session.Pusher.UDPServer.AControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+				// RTCP receiver reports of player sent to server port keep
+				// session alive
+				serverPort = t.Conn.LocalAddr().(*net.UDPAddr).Port
+				serverControlPort = t.ControlConn.LocalAddr().(*net.UDPAddr).Port
+			}
+			if session.Type == SessionTypePusher {
+				t, err := session.Pusher.UDPServer.SetupTrack(track, media, key)
+				if err != nil {
+					res.StatusCode = 500
+					res.Status = fmt.Sprintf("udp server setup track error, %v", err)
+					return
 				}
-			} else if setupPath == vPath || vPath != "" && strings.LastIndex(setupPath, vPath) == len(setupPath)-len(vPath) {
-				if session.Type == SessionTypePlayer {
-					session.UDPClient.VPort, _ = strconv.Atoi(udpMatchs[1])
-					session.UDPClient.VControlPort, _ = strconv.Atoi(udpMatchs[3])
-					if err := session.UDPClient.SetupVideo(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp client setup video error, %v", err)
-						return
-					}
+				serverPort, serverControlPort = t.Port, t.ControlPort
+				// NACKs of RTP lost sent to RTCP port of pusher
+				if addr, ok := session.Conn.RemoteAddr().(*net.TCPAddr); ok {
+					port, controlPort := parsePortRange(udpMatchs)
+					session.Pusher.UDPServer.SetSource(track, &net.UDPAddr{IP: addr.IP, Port: port}, &net.UDPAddr{IP: addr.IP, Port: controlPort})
 				}
-
-				if session.Type == SessionTypePusher {
-					if err := session.Pusher.UDPServer.SetupVideo(); err != nil {
-						res.StatusCode = 500
-						res.Status = fmt.Sprintf("udp server setup video error, %v", err)
-						return
-					}
-					tss := strings.Split(ts, ";")
-					idx := -1
-					for i, val := range tss {
-						if val == udpMatchs[0] {
-							idx = i
-						}
-					}
-					tail := append([]string{}, tss[idx+1:]...)
-					tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", session.Pusher.UDPServer.VPort, session.Pusher.UDPServer.VControlPort))
-					tss = append(tss, tail...)
-					ts = strings.Join(tss, ";")
+			}
+			tss := strings.Split(ts, ";")
+			idx := -1
+			for i, val := range tss {
+				if val == udpMatchs[0] {
+					idx = i
 				}
-			} else {
-				logger.Warn("SETUP [UDP] got unknown control", log.String("setup path", setupPath))
 			}
+			tail := append([]string{}, tss[idx+1:]...)
+			tss = append(tss[:idx+1], fmt.Sprintf("server_port=%d-%d", serverPort, serverControlPort))
+			tss = append(tss, tail...)
+			ts = strings.Join(tss, ";")
 		}
 		res.Header["Transport"] = ts
 	case "PLAY":
@@ -677,6 +735,11 @@ func (session *Session) handleRequest(req *Request) {
 			res.Status = "Error Status"
 			return
 		}
+		if session.Type == SessionTypePlayer && !session.Pusher.HasPlayer(session.Player) && session.Pusher.PlayersFull() {
+			res.StatusCode = 453
+			res.Status = "Not Enough Bandwidth"
+			return
+		}
 		res.Header["Range"] = req.Header["Range"]
 	case "RECORD":
 		// error status. RECORD without ANNOUNCE or DESCRIBE.
@@ -695,7 +758,19 @@ func (session *Session) handleRequest(req *Request) {
 	}
 }
 
+// SendRTP sends pack to player immediately
 func (session *Session) SendRTP(pack *RTPPack) (err error) {
+	if err = session.BatchRTP(pack); err != nil {
+		return
+	}
+	return session.FlushRTP()
+}
+
+// BatchRTP adds pack to the batch of packets written together by FlushRTP,
+// the batch is flushed if full. Packets of TCP transport are batched in
+// interleaved frames, packets of UDP transport in batches of UDP sockets.
+// The batch should be used by one goroutine only
+func (session *Session) BatchRTP(pack *RTPPack) (err error) {
 	if pack == nil {
 		err = fmt.Errorf("player send rtp got nil pack")
 		return
@@ -705,64 +780,68 @@ func (session *Session) SendRTP(pack *RTPPack) (err error) {
 			err = fmt.Errorf("player use udp transport but udp client not found")
 			return
 		}
-		err = session.UDPClient.SendRTP(pack)
+		err = session.UDPClient.BatchRTP(pack)
 		return
 	}
-	switch pack.Type {
-	case RtpTypeAudio:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.aRTPChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	case RtpTypeAudioControl:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.aRTPControlChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	case RtpTypeVideo:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.vRTPChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	case RtpTypeVideoControl:
-		bufChannel := make([]byte, 2)
-		bufChannel[0] = 0x24
-		bufChannel[1] = byte(session.vRTPControlChannel)
-		session.connWLock.Lock()
-		session.connRW.Write(bufChannel)
-		bufLen := make([]byte, 2)
-		binary.BigEndian.PutUint16(bufLen, uint16(pack.Buffer.Len()))
-		session.connRW.Write(bufLen)
-		session.connRW.Write(pack.Buffer.Bytes())
-		session.connRW.Flush()
-		session.connWLock.Unlock()
-		session.OutBytes += pack.Buffer.Len() + 4
-	default:
-		err = fmt.Errorf("session tcp send rtp got unkown pack type[%v]", pack.Type)
+	channel, ok := session.channels.channel(pack.Track, pack.Type.IsControl())
+	if !ok {
+		// track not set up by player
+		return
+	}
+	if session.batch == nil {
+		session.batch = newRTPBatch(config.RtspConfig().Player.WriteBatch)
+	}
+	session.batch.add(channel, pack)
+	if session.batch.Full() {
+		err = session.FlushRTP()
 	}
 	return
 }
+
+// BatchedRTP returns count of packets in batch and time the first one added
+func (session *Session) BatchedRTP() (int, time.Time) {
+	if session.TransType == TransTypeUdp {
+		if c := session.UDPClient; c != nil {
+			return c.Batched()
+		}
+		return 0, time.Time{}
+	}
+	if session.batch == nil {
+		return 0, time.Time{}
+	}
+	return session.batch.Len(), session.batch.Since()
+}
+
+// FlushRTP writes packets batched, interleaved packets in one vectored write
+func (session *Session) FlushRTP() (err error) {
+	if session.TransType == TransTypeUdp {
+		if c := session.UDPClient; c != nil {
+			err = c.FlushRTP()
+		}
+		return
+	}
+	if session.batch == nil || session.batch.Len() == 0 {
+		return
+	}
+	session.connWLock.Lock()
+	defer session.connWLock.Unlock()
+	if session.Conn == nil {
+		session.batch.reset()
+		return fmt.Errorf("player connection closed")
+	}
+	// responses are flushed when written, just in case
+	if err = session.connRW.Flush(); err != nil {
+		session.batch.reset()
+		return
+	}
+	n, err := session.batch.writeTo(session.Conn)
+	atomic.AddInt64(&session.OutBytes, int64(n))
+	return
+}
+
+// releaseBatch releases packets batched but not written
+func (session *Session) releaseBatch() {
+	if session.batch != nil {
+		session.batch.reset()
+	}
+}
@@ -0,0 +1,408 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/assert"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPushSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=Test\r\n" +
+	"t=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=control:streamid=0\r\n" +
+	"m=audio 0 RTP/AVP 8\r\n" +
+	"a=control:streamid=1\r\n" +
+	"m=application 0 RTP/AVP 107\r\n" +
+	"a=rtpmap:107 vnd.onvif.metadata/90000\r\n" +
+	"a=control:streamid=2\r\n"
+
+func newTestServer(t *testing.T) *Server {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		listener: listener,
+		addr:     listener.Addr().(*net.TCPAddr),
+		pushers:  make(map[string]*Pusher),
+		logger:   assert.Must(config.LogConfig().Build("rtsp.server")),
+	}
+	s.memory = NewMemoryAccountant(s)
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go NewSession(s, conn).Start()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+// testConn is a raw RTSP connection for pushing or playing
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	seq  int
+	// body of the last response
+	body string
+}
+
+func dialTestConn(t *testing.T, s *Server) *testConn {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+}
+
+func (c *testConn) request(method string, url string, headers map[string]string, body string) (int, map[string]string) {
+	c.seq++
+	fmt.Fprintf(c.rw, "%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.seq)
+	for k, v := range headers {
+		fmt.Fprintf(c.rw, "%s: %s\r\n", k, v)
+	}
+	if body != "" {
+		fmt.Fprintf(c.rw, "Content-Length: %d\r\n", len(body))
+	}
+	c.rw.WriteString("\r\n" + body)
+	c.rw.Flush()
+
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	status, err := c.rw.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("%s: read response error: %v", method, err)
+	}
+	code, _ := strconv.Atoi(strings.Fields(status)[1])
+	header := make(map[string]string)
+	for {
+		line, err := c.rw.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%s: read response error: %v", method, err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			header[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	c.body = ""
+	if n, _ := strconv.Atoi(header["Content-Length"]); n > 0 {
+		body := make([]byte, n)
+		io.ReadFull(c.rw, body)
+		c.body = string(body)
+	}
+	return code, header
+}
+
+func (c *testConn) writeInterleaved(channel int, pkt []byte) {
+	header := []byte{'$', byte(channel), 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(pkt)))
+	c.rw.Write(header)
+	c.rw.Write(pkt)
+	c.rw.Flush()
+}
+
+func (c *testConn) readInterleaved() (int, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.rw, header); err != nil || header[0] != '$' {
+		c.t.Fatalf("read interleaved error: %v %v", err, header)
+	}
+	pkt := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.rw, pkt); err != nil {
+		c.t.Fatalf("read interleaved error: %v", err)
+	}
+	return int(header[1]), pkt
+}
+
+func testRTP(pt int, seq int, payload byte) []byte {
+	pkt := make([]byte, 13)
+	pkt[0] = 0x80
+	pkt[1] = byte(pt)
+	binary.BigEndian.PutUint16(pkt[2:], uint16(seq))
+	pkt[12] = payload
+	return pkt
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type testPackets struct {
+	lock  sync.Mutex
+	packs map[int][]*RTPPack
+}
+
+func (p *testPackets) handle(pack *RTPPack) {
+	pack.AddRef()
+	p.lock.Lock()
+	if p.packs == nil {
+		p.packs = make(map[int][]*RTPPack)
+	}
+	p.packs[pack.Track] = append(p.packs[pack.Track], pack)
+	p.lock.Unlock()
+}
+
+func (p *testPackets) count(track int) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.packs[track])
+}
+
+func TestSessionTracks(t *testing.T) {
+	s := newTestServer(t)
+	url := fmt.Sprintf("rtsp://%s/live/test", s.Addr())
+
+	push := dialTestConn(t, s)
+	if code, _ := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, testPushSDP); code != 200 {
+		t.Fatalf("announce failed: %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		code, header := push.request("SETUP", fmt.Sprintf("%s/streamid=%d", url, i), map[string]string{
+			"Transport": fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", 2*i, 2*i+1),
+		}, "")
+		if code != 200 || !strings.Contains(header["Transport"], fmt.Sprintf("interleaved=%d-%d", 2*i, 2*i+1)) {
+			t.Fatalf("setup track %d failed: %d %v", i, code, header)
+		}
+	}
+	if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+		t.Fatalf("record failed: %d", code)
+	}
+	pusher := s.GetPusher("/live/test")
+	if pusher == nil {
+		t.Fatal("pusher not found")
+	}
+	if len(pusher.SDP().Media) != 3 || pusher.VCodec() != CodecH264 || pusher.ACodec() != CodecPCMA {
+		t.Fatalf("unexpected pusher sdp: %s %s", pusher.VCodec(), pusher.ACodec())
+	}
+
+	// players pulling all tracks through TCP and UDP
+	var tcpPackets, udpPackets testPackets
+	tcpClient, err := NewRTSPClient(s, url, 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpClient.RTPHandles = append(tcpClient.RTPHandles, tcpPackets.handle)
+	udpClient, err := NewRTSPClient(s, url, 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpClient.TransType = TransTypeUdp
+	udpClient.RTPHandles = append(udpClient.RTPHandles, udpPackets.handle)
+	for _, client := range []*Client{tcpClient, udpClient} {
+		if err := client.Start(3 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Stop()
+		if _, m := client.SDP.Track("application"); m == nil || m.Codec() != CodecONVIFMetadata {
+			t.Fatal("metadata track not described")
+		}
+	}
+
+	// player pulling metadata track only, channels are allocated by server
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	code, header := play.request("SETUP", url+"/streamid=2", map[string]string{"Transport": "RTP/AVP/TCP;unicast"}, "")
+	if code != 200 || !strings.Contains(header["Transport"], "interleaved=4-5") {
+		t.Fatalf("setup metadata failed: %d %v", code, header)
+	}
+	if code, _ := play.request("PLAY", url, map[string]string{"Session": header["Session"]}, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	waitFor(t, "players", func() bool { return len(pusher.GetPlayers()) == 3 })
+
+	for i := 0; i < 3; i++ {
+		push.writeInterleaved(0, testRTP(96, i, 0x65))
+		push.writeInterleaved(2, testRTP(8, i, 0xD5))
+		push.writeInterleaved(4, testRTP(107, i, '<'))
+	}
+	push.writeInterleaved(5, []byte{0x80, 200, 0, 6, 0, 0, 0, 0})
+
+	for _, packets := range []*testPackets{&tcpPackets, &udpPackets} {
+		waitFor(t, "packets of all tracks", func() bool {
+			return packets.count(0) == 3 && packets.count(1) == 3 && packets.count(2) == 4
+		})
+		packets.lock.Lock()
+		controls := 0
+		for _, pack := range packets.packs[2] {
+			if pack.Type == RtpTypeDataControl {
+				controls++
+			} else if pack.Type != RtpTypeData {
+				t.Fatalf("unexpected metadata packet type %v", pack.Type)
+			}
+		}
+		if packets.packs[0][0].Type != RtpTypeVideo || packets.packs[1][0].Type != RtpTypeAudio || controls != 1 {
+			t.Fatalf("unexpected packet types")
+		}
+		packets.lock.Unlock()
+	}
+	for i := 0; i < 4; i++ {
+		channel, pkt := play.readInterleaved()
+		if i < 3 && (channel != 4 || pkt[1] != 107) || i == 3 && channel != 5 {
+			t.Fatalf("unexpected packet %d of metadata player on channel %d", i, channel)
+		}
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	if id, timeout := parseSession("12345678; timeout=60"); id != "12345678" || timeout != time.Minute {
+		t.Fatalf("unexpected session %s timeout %v", id, timeout)
+	}
+	sessionTimeout := config.RtspConfig().SessionTimeout
+	config.RtspConfig().SessionTimeout = time.Second
+	defer func() { config.RtspConfig().SessionTimeout = sessionTimeout }()
+	s := newTestServer(t)
+	url := fmt.Sprintf("rtsp://%s/live/test", s.Addr())
+
+	push := dialTestConn(t, s)
+	if code, header := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, testPushSDP); code != 200 || !strings.HasSuffix(header["Session"], ";timeout=1") {
+		t.Fatalf("announce failed: %d %v", code, header)
+	}
+	if code, _ := push.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+		t.Fatalf("record failed: %d", code)
+	}
+	pusher := s.GetPusher("/live/test")
+
+	// a TCP player stopping requests, a UDP player sending receiver reports
+	// and a client keeping alive by the timeout advertised
+	tcp := dialTestConn(t, s)
+	if code, _ := tcp.request("DESCRIBE", url, nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	if code, _ := tcp.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := tcp.request("PLAY", url, nil, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	if code, _ := tcp.request("SET_PARAMETER", url, map[string]string{"Content-Type": "text/parameters"}, "unknown: 1\r\n"); code != 451 {
+		t.Fatalf("expect parameter not understood, got %d", code)
+	}
+	if code, _ := tcp.request("GET_PARAMETER", url, nil, ""); code != 200 {
+		t.Fatalf("expect session kept after SET_PARAMETER, got %d", code)
+	}
+
+	udp := dialTestConn(t, s)
+	rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtp.Close()
+	rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rtcp.Close()
+	if code, _ := udp.request("DESCRIBE", url, nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	code, header := udp.request("SETUP", url+"/streamid=0", map[string]string{
+		"Transport": fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", rtp.LocalAddr().(*net.UDPAddr).Port, rtcp.LocalAddr().(*net.UDPAddr).Port),
+	}, "")
+	matches := regexp.MustCompile(`server_port=(\d+)-(\d+)`).FindStringSubmatch(header["Transport"])
+	if code != 200 || matches == nil {
+		t.Fatalf("setup failed: %d %v", code, header)
+	}
+	if code, _ := udp.request("PLAY", url, nil, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	serverControlPort, _ := strconv.Atoi(matches[2])
+	serverControl := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverControlPort}
+
+	client, err := NewRTSPClient(s, url, 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.TransType = TransTypeUdp
+	if err := client.Start(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if client.OptionIntervalMillis != 500 || client.Session == "" || strings.Contains(client.Session, ";") {
+		t.Fatalf("expect keepalive of session timeout, got %d %s", client.OptionIntervalMillis, client.Session)
+	}
+	waitFor(t, "players", func() bool { return len(pusher.GetPlayers()) == 3 })
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(300 * time.Millisecond)
+		if code, _ := push.request("GET_PARAMETER", url, nil, ""); code != 200 {
+			t.Fatalf("keepalive failed: %d", code)
+		}
+		if _, err := rtcp.WriteToUDP([]byte{0x80, 201, 0, 1, 0, 0, 0, 1}, serverControl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.GetPusher("/live/test") != pusher {
+		t.Fatal("expect pusher kept alive by GET_PARAMETER")
+	}
+	players := pusher.GetPlayers()
+	if len(players) != 2 {
+		t.Fatalf("expect TCP player timeout only, got %d players", len(players))
+	}
+	for _, player := range players {
+		if player.TransType != TransTypeUdp {
+			t.Fatal("expect UDP players kept alive")
+		}
+	}
+	tcp.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := tcp.rw.ReadByte(); err != io.EOF {
+		t.Fatalf("expect connection of TCP player closed, got %v", err)
+	}
+
+	// pusher timeout without keepalive
+	waitFor(t, "pusher timeout", func() bool { return s.GetPusher("/live/test") == nil })
+}
+
+func TestSessionStopOnce(t *testing.T) {
+	server, conn := net.Pipe()
+	defer conn.Close()
+	session := NewSession(nil, server)
+	var stops int32
+	session.StopHandles = append(session.StopHandles, func() { atomic.AddInt32(&stops, 1) })
+
+	// keepalive timer, request loop and players stopping session together
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session.Stop()
+		}()
+	}
+	wg.Wait()
+	if !session.Stopped() || atomic.LoadInt32(&stops) != 1 {
+		t.Fatalf("expect session stopped once, got %d", stops)
+	}
+}
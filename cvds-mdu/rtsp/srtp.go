@@ -0,0 +1,292 @@
+package rtsp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/errors"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"hash"
+	"sync"
+)
+
+var InvalidSRTPError = errors.New("invalid srtp packet")
+
+const (
+	srtpMasterKeyLength  = 16
+	srtpMasterSaltLength = 14
+	srtpAuthKeyLength    = 20
+	// SRTCP is authenticated by 80 bits tag of both suites
+	srtcpTagLength = 10
+	// E flag and SRTCP index following RTCP packets
+	srtcpIndexLength = 4
+)
+
+// labels of session keys derived from master key, see RFC 3711 4.3.1
+const (
+	srtpLabelEncryption = iota
+	srtpLabelAuth
+	srtpLabelSalt
+	srtcpLabelEncryption
+	srtcpLabelAuth
+	srtcpLabelSalt
+)
+
+// srtpKey is the master key and master salt of SRTP of a crypto suite
+type srtpKey struct {
+	suite string
+	key   []byte
+	salt  []byte
+}
+
+// tagLength returns length of authentication tag of SRTP
+func (k *srtpKey) tagLength() int {
+	if k.suite == config.SRTPSuiteAES128SHA1_32 {
+		return 4
+	}
+	return 10
+}
+
+// srtpSession is the session keys of SRTP or SRTCP
+type srtpSession struct {
+	block cipher.Block
+	salt  []byte
+	auth  hash.Hash
+}
+
+func newSRTPSession(master cipher.Block, salt []byte, labels [3]byte) (s srtpSession, err error) {
+	if s.block, err = aes.NewCipher(deriveSRTPKey(master, salt, labels[0], srtpMasterKeyLength)); err != nil {
+		return
+	}
+	s.auth = hmac.New(sha1.New, deriveSRTPKey(master, salt, labels[1], srtpAuthKeyLength))
+	s.salt = deriveSRTPKey(master, salt, labels[2], srtpMasterSaltLength)
+	return
+}
+
+// deriveSRTPKey derives session key of label with key derivation rate 0,
+// see RFC 3711 4.3
+func deriveSRTPKey(master cipher.Block, salt []byte, label byte, n int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	iv[7] ^= label
+	key := make([]byte, n)
+	cipher.NewCTR(master, iv).XORKeyStream(key, key)
+	return key
+}
+
+// xor encrypts or decrypts data by AES-CM of session, ssrc and packet index
+func (s *srtpSession) xor(data []byte, ssrc uint32, index uint64) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, s.salt)
+	for i := 0; i < 4; i++ {
+		iv[4+i] ^= byte(ssrc >> (24 - 8*i))
+	}
+	for i := 0; i < 6; i++ {
+		iv[8+i] ^= byte(index >> (40 - 8*i))
+	}
+	cipher.NewCTR(s.block, iv).XORKeyStream(data, data)
+}
+
+// tag returns authentication tag of data followed by trailer
+func (s *srtpSession) tag(data []byte, trailer []byte, n int) []byte {
+	s.auth.Reset()
+	s.auth.Write(data)
+	s.auth.Write(trailer)
+	return s.auth.Sum(nil)[:n]
+}
+
+// srtpStream is the state of packets of a SSRC
+type srtpStream struct {
+	started bool
+	// rollover counter and the highest sequence number of SRTP
+	roc uint32
+	seq uint16
+	// index of the next SRTCP sent
+	rtcpIndex uint32
+}
+
+// estimate returns rollover counter of RTP of seq, see RFC 3711 3.3.1
+func (s *srtpStream) estimate(seq uint16) uint32 {
+	switch {
+	case !s.started:
+		return s.roc
+	case s.seq < 32768 && int(seq)-int(s.seq) > 32768:
+		return s.roc - 1
+	case s.seq >= 32768 && int(s.seq)-32768 > int(seq):
+		return s.roc + 1
+	}
+	return s.roc
+}
+
+func (s *srtpStream) update(seq uint16, roc uint32) {
+	if !s.started || roc == s.roc+1 || (roc == s.roc && seq > s.seq) {
+		s.started, s.roc, s.seq = true, roc, seq
+	}
+}
+
+// srtpContext protects or unprotects SRTP and SRTCP of a master key, see
+// RFC 3711. Replay protection is not performed
+type srtpContext struct {
+	tagLength int
+
+	lock    sync.Mutex
+	rtp     srtpSession
+	rtcp    srtpSession
+	streams map[uint32]*srtpStream
+}
+
+func newSRTPContext(key *srtpKey) (*srtpContext, error) {
+	master, err := aes.NewCipher(key.key)
+	if err != nil {
+		return nil, err
+	}
+	c := &srtpContext{tagLength: key.tagLength(), streams: make(map[uint32]*srtpStream)}
+	if c.rtp, err = newSRTPSession(master, key.salt, [3]byte{srtpLabelEncryption, srtpLabelAuth, srtpLabelSalt}); err != nil {
+		return nil, err
+	}
+	if c.rtcp, err = newSRTPSession(master, key.salt, [3]byte{srtcpLabelEncryption, srtcpLabelAuth, srtcpLabelSalt}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *srtpContext) stream(ssrc uint32) *srtpStream {
+	s := c.streams[ssrc]
+	if s == nil {
+		s = &srtpStream{}
+		c.streams[ssrc] = s
+	}
+	return s
+}
+
+// rtpHeaderLength returns length of header of RTP with CSRCs and extension,
+// -1 if truncated
+func rtpHeaderLength(data []byte) int {
+	if len(data) < RTP_FIXED_HEADER_LENGTH {
+		return -1
+	}
+	n := RTP_FIXED_HEADER_LENGTH + 4*int(data[0]&0x0f)
+	if data[0]&0x10 != 0 {
+		if len(data) < n+4 {
+			return -1
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(data[n+2:]))
+	}
+	if n > len(data) {
+		return -1
+	}
+	return n
+}
+
+// protect returns SRTP or SRTCP of pack by its type
+func (c *srtpContext) protect(pack *RTPPack) (*RTPPack, error) {
+	data := pack.Bytes()
+	n := len(data) + c.tagLength
+	if pack.Type.IsControl() {
+		n = len(data) + srtcpIndexLength + srtcpTagLength
+	}
+	d := rtpDataPool.Alloc(uint(n))
+	copy(d.Data, data)
+	var err error
+	if pack.Type.IsControl() {
+		err = c.protectRTCP(d.Data[:len(data)])
+	} else {
+		err = c.protectRTP(d.Data[:len(data)])
+	}
+	if err != nil {
+		d.Release()
+		return nil, err
+	}
+	return NewRTPPack(pack.Track, pack.Type, d.Data[:n], d), nil
+}
+
+// protectRTP encrypts RTP of data in place and writes tag following it in
+// its capacity
+func (c *srtpContext) protectRTP(data []byte) error {
+	header := rtpHeaderLength(data)
+	if header < 0 {
+		return fmt.Errorf("%w: rtp truncated", InvalidSRTPError)
+	}
+	ssrc, seq := binary.BigEndian.Uint32(data[8:]), binary.BigEndian.Uint16(data[2:])
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := c.stream(ssrc)
+	roc := s.estimate(seq)
+	s.update(seq, roc)
+	c.rtp.xor(data[header:], ssrc, uint64(roc)<<16|uint64(seq))
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, roc)
+	copy(data[len(data):len(data)+c.tagLength], c.rtp.tag(data, trailer, c.tagLength))
+	return nil
+}
+
+// protectRTCP encrypts compound RTCP of data in place and writes SRTCP index
+// and tag following it in its capacity
+func (c *srtpContext) protectRTCP(data []byte) error {
+	if len(data) < rtcpHeaderLength {
+		return fmt.Errorf("%w: rtcp truncated", InvalidSRTPError)
+	}
+	ssrc := binary.BigEndian.Uint32(data[4:])
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := c.stream(ssrc)
+	index := s.rtcpIndex
+	s.rtcpIndex = (s.rtcpIndex + 1) & 0x7fffffff
+	c.rtcp.xor(data[rtcpHeaderLength:], ssrc, uint64(index))
+	trailer := data[len(data) : len(data)+srtcpIndexLength]
+	binary.BigEndian.PutUint32(trailer, 1<<31|index)
+	copy(data[len(data)+srtcpIndexLength:len(data)+srtcpIndexLength+srtcpTagLength], c.rtcp.tag(data[:len(data)+srtcpIndexLength], nil, srtcpTagLength))
+	return nil
+}
+
+// unprotect authenticates and decrypts SRTP or SRTCP of data in place,
+// returns RTP or RTCP of data
+func (c *srtpContext) unprotect(data []byte, control bool) ([]byte, error) {
+	if control {
+		return c.unprotectRTCP(data)
+	}
+	return c.unprotectRTP(data)
+}
+
+func (c *srtpContext) unprotectRTP(data []byte) ([]byte, error) {
+	n := len(data) - c.tagLength
+	if n < 0 {
+		return nil, fmt.Errorf("%w: srtp truncated", InvalidSRTPError)
+	}
+	header := rtpHeaderLength(data[:n])
+	if header < 0 {
+		return nil, fmt.Errorf("%w: rtp truncated", InvalidSRTPError)
+	}
+	ssrc, seq := binary.BigEndian.Uint32(data[8:]), binary.BigEndian.Uint16(data[2:])
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := c.stream(ssrc)
+	roc := s.estimate(seq)
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, roc)
+	if !hmac.Equal(c.rtp.tag(data[:n], trailer, c.tagLength), data[n:]) {
+		return nil, fmt.Errorf("%w: srtp authentication failed", InvalidSRTPError)
+	}
+	s.update(seq, roc)
+	c.rtp.xor(data[header:n], ssrc, uint64(roc)<<16|uint64(seq))
+	return data[:n], nil
+}
+
+func (c *srtpContext) unprotectRTCP(data []byte) ([]byte, error) {
+	n := len(data) - srtcpIndexLength - srtcpTagLength
+	if n < rtcpHeaderLength {
+		return nil, fmt.Errorf("%w: srtcp truncated", InvalidSRTPError)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !hmac.Equal(c.rtcp.tag(data[:n+srtcpIndexLength], nil, srtcpTagLength), data[n+srtcpIndexLength:]) {
+		return nil, fmt.Errorf("%w: srtcp authentication failed", InvalidSRTPError)
+	}
+	if index := binary.BigEndian.Uint32(data[n:]); index&(1<<31) != 0 {
+		c.rtcp.xor(data[rtcpHeaderLength:n], binary.BigEndian.Uint32(data[4:]), uint64(index&0x7fffffff))
+	}
+	return data[:n], nil
+}
@@ -0,0 +1,223 @@
+package rtsp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSRTP(t *testing.T) {
+	// key derivation of RFC 3711 B.3
+	key, _ := hex.DecodeString("E1F97A0D3E018BE0D64FA32C06DE4139")
+	salt, _ := hex.DecodeString("0EC675AD498AFEEBB6960B3AABE6")
+	master, _ := aes.NewCipher(key)
+	for _, c := range []struct {
+		label  byte
+		n      int
+		expect string
+	}{
+		{srtpLabelEncryption, 16, "C61E7A93744F39EE10734AFE3FF7A087"},
+		{srtpLabelSalt, 14, "30CBBC08863D8C85D49DB34A9AE1"},
+		{srtpLabelAuth, 20, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"},
+	} {
+		if got := fmt.Sprintf("%X", deriveSRTPKey(master, salt, c.label, c.n)); got != c.expect {
+			t.Fatalf("expect key of label %d %s, got %s", c.label, c.expect, got)
+		}
+	}
+
+	for _, suite := range []string{config.SRTPSuiteAES128SHA1_80, config.SRTPSuiteAES128SHA1_32} {
+		k := &srtpKey{suite: suite, key: key, salt: salt}
+		sender, _ := newSRTPContext(k)
+		receiver, _ := newSRTPContext(k)
+		// sequence numbers wrapping with rollover counter
+		for _, seq := range []int{65534, 65535, 0, 1} {
+			rtp := append(testRTP(96, seq, byte(seq)), bytes.Repeat([]byte{byte(seq)}, 31)...)
+			pack := copyRTPPack(0, RtpTypeVideo, rtp)
+			protected, err := sender.protect(pack)
+			pack.Release()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := append([]byte{}, protected.Bytes()...)
+			protected.Release()
+			if len(data) != len(rtp)+k.tagLength() || bytes.Equal(data[12:len(rtp)], rtp[12:]) {
+				t.Fatalf("expect rtp %d encrypted, got %x", seq, data)
+			}
+			if got, err := receiver.unprotect(data, false); err != nil || !bytes.Equal(got, rtp) {
+				t.Fatalf("expect rtp %d unprotected, got %x %v", seq, got, err)
+			}
+		}
+		if roc := receiver.streams[0].roc; roc != 1 {
+			t.Fatalf("expect rollover counter 1, got %d", roc)
+		}
+
+		rtcp := append(testRTCPReport(), 1, 2, 3, 4)
+		pack := copyRTPPack(0, RtpTypeVideoControl, rtcp)
+		protected, _ := sender.protect(pack)
+		pack.Release()
+		data := append([]byte{}, protected.Bytes()...)
+		protected.Release()
+		if len(data) != len(rtcp)+srtcpIndexLength+srtcpTagLength || bytes.Equal(data[8:12], rtcp[8:]) {
+			t.Fatalf("expect rtcp encrypted, got %x", data)
+		}
+		tampered := append([]byte{}, data...)
+		tampered[9] ^= 1
+		if _, err := receiver.unprotect(tampered, true); !errors.Is(err, InvalidSRTPError) {
+			t.Fatalf("expect srtcp tampered unauthenticated, got %v", err)
+		}
+		if got, err := receiver.unprotect(data, true); err != nil || !bytes.Equal(got, rtcp) {
+			t.Fatalf("expect rtcp unprotected, got %x %v", got, err)
+		}
+	}
+}
+
+func TestSDES(t *testing.T) {
+	k, _ := newSRTPKey(config.SRTPSuiteAES128SHA1_80)
+	tag, parsed, err := parseCrypto(k.crypto(1) + "|2^31 KDR=0")
+	if err != nil || tag != 1 || !bytes.Equal(parsed.key, k.key) || !bytes.Equal(parsed.salt, k.salt) {
+		t.Fatalf("expect crypto parsed, got %d %+v %v", tag, parsed, err)
+	}
+	for _, value := range []string{
+		k.crypto(1) + "|2^20|1:4",
+		strings.Replace(k.crypto(1), config.SRTPSuiteAES128SHA1_80, "F8_128_HMAC_SHA1_80", 1),
+		k.crypto(1) + " UNENCRYPTED_SRTP",
+	} {
+		if _, _, err := parseCrypto(value); !errors.Is(err, UnsupportedCryptoError) {
+			t.Fatalf("expect crypto %q unsupported, got %v", value, err)
+		}
+	}
+
+	secured := strings.Replace(testPushSDP, "m=video 0 RTP/AVP 96\r\n", "m=video 0 RTP/SAVP 96\r\n", 1)
+	secured = strings.Replace(secured, "a=control:streamid=0\r\n", "a=control:streamid=0\r\na=crypto:"+k.crypto(1)+"\r\n", 1)
+	sdp, _ := ParseSDP(secured)
+	if key, err := sdp.Media[0].srtpKey(); !sdp.Media[0].Secured() || err != nil || !bytes.Equal(key.key, k.key) {
+		t.Fatalf("expect key of media, got %+v %v", key, err)
+	}
+	if plain := plainSDP(secured); plain != testPushSDP {
+		t.Fatalf("expect keys of source removed, got %q", plain)
+	}
+	offered := offerSRTP(testPushSDP, func(track int) *srtpKey { return k }, true)
+	if strings.Count(offered, "RTP/SAVP") != 3 || strings.Count(offered, "a=crypto:"+k.crypto(1)) != 3 {
+		t.Fatalf("expect keys offered, got %q", offered)
+	}
+}
+
+func TestSessionSRTP(t *testing.T) {
+	cfg := config.GlobalConfig()
+	srtp := cfg.RTSP.Srtp
+	t.Cleanup(func() { cfg.RTSP.Srtp = srtp })
+	cfg.RTSP.Srtp.Enable = true
+	cfg.RTSP.Srtp.Require = true
+	cfg.RTSP.Srtp.Suite = config.SRTPSuiteAES128SHA1_32
+	s := newTestServer(t)
+	url := fmt.Sprintf("rtsp://%s/live/srtp", s.Addr())
+
+	// pusher of RTP/SAVP with key announced
+	pushKey, _ := newSRTPKey(config.SRTPSuiteAES128SHA1_80)
+	sdp := strings.Replace(testPushSDP, "m=video 0 RTP/AVP 96\r\n", "m=video 0 RTP/SAVP 96\r\n", 1)
+	sdp = strings.Replace(sdp, "a=control:streamid=0\r\n", "a=control:streamid=0\r\na=crypto:"+pushKey.crypto(1)+"\r\n", 1)
+	push := dialTestConn(t, s)
+	if code, _ := push.request("ANNOUNCE", url, map[string]string{"Content-Type": "application/sdp"}, sdp); code != 200 {
+		t.Fatalf("announce failed: %d", code)
+	}
+	pushRTP, pushRTCP := listenTestUDP(t), listenTestUDP(t)
+	ports := fmt.Sprintf("client_port=%d-%d", pushRTP.LocalAddr().(*net.UDPAddr).Port, pushRTCP.LocalAddr().(*net.UDPAddr).Port)
+	if code, _ := push.request("SETUP", url+"/streamid=1", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record"}, ""); code != 461 {
+		t.Fatalf("expect RTP/AVP of TCP refused, got %d", code)
+	}
+	if code, _ := push.request("SETUP", url+"/streamid=1", map[string]string{"Transport": "RTP/AVP;unicast;" + ports + ";mode=record"}, ""); code != 461 {
+		t.Fatalf("expect RTP/AVP refused, got %d", code)
+	}
+	if code, _ := push.request("SETUP", url+"/streamid=1", map[string]string{"Transport": "RTP/SAVP;unicast;" + ports + ";mode=record"}, ""); code != 461 {
+		t.Fatalf("expect RTP/SAVP without key refused, got %d", code)
+	}
+	code, header := push.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/SAVP;unicast;" + ports + ";mode=record"}, "")
+	matches := regexp.MustCompile(`server_port=(\d+)-(\d+)`).FindStringSubmatch(header["Transport"])
+	if code != 200 || matches == nil || !strings.HasPrefix(header["Transport"], "RTP/SAVP") {
+		t.Fatalf("setup failed: %d %v", code, header)
+	}
+	if code, _ := push.request("RECORD", url, nil, ""); code != 200 {
+		t.Fatalf("record failed: %d", code)
+	}
+	port, _ := strconv.Atoi(matches[1])
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	pusher := s.GetPusher("/live/srtp")
+
+	// player of RTP/SAVP with key offered
+	play := dialTestConn(t, s)
+	if code, _ := play.request("DESCRIBE", url, nil, ""); code != 200 {
+		t.Fatalf("describe failed: %d", code)
+	}
+	described, err := ParseSDP(play.body)
+	if err != nil || strings.Contains(play.body, pushKey.crypto(1)) || !described.Media[0].Secured() {
+		t.Fatalf("expect key of server offered, got %q %v", play.body, err)
+	}
+	playKey, err := described.Media[0].srtpKey()
+	if err != nil || playKey.suite != config.SRTPSuiteAES128SHA1_32 {
+		t.Fatalf("expect key offered, got %+v %v", playKey, err)
+	}
+	playRTP, playRTCP := listenTestUDP(t), listenTestUDP(t)
+	ports = fmt.Sprintf("client_port=%d-%d", playRTP.LocalAddr().(*net.UDPAddr).Port, playRTCP.LocalAddr().(*net.UDPAddr).Port)
+	if code, _ := play.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/SAVP/TCP;unicast;interleaved=0-1"}, ""); code != 461 {
+		t.Fatalf("expect RTP/SAVP of TCP refused, got %d", code)
+	}
+	if code, _ := play.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"}, ""); code != 461 {
+		t.Fatalf("expect RTP/AVP of TCP refused, got %d", code)
+	}
+	if code, _ := play.request("SETUP", url+"/streamid=0", map[string]string{"Transport": "RTP/SAVP;unicast;" + ports}, ""); code != 200 {
+		t.Fatalf("setup failed: %d", code)
+	}
+	if code, _ := play.request("PLAY", url, nil, ""); code != 200 {
+		t.Fatalf("play failed: %d", code)
+	}
+	waitFor(t, "player", func() bool { return len(pusher.GetPlayers()) == 1 })
+
+	// SRTP of pusher unprotected and protected again for player, packets
+	// unauthenticated dropped
+	encrypt, _ := newSRTPContext(pushKey)
+	decrypt, _ := newSRTPContext(playKey)
+	for _, seq := range []int{1, 2} {
+		pack := copyRTPPack(0, RtpTypeVideo, testRTP(96, seq, byte(seq)))
+		protected, _ := encrypt.protect(pack)
+		pack.Release()
+		data := append([]byte{}, protected.Bytes()...)
+		protected.Release()
+		if seq == 1 {
+			data[12] ^= 1
+		}
+		if _, err := pushRTP.WriteToUDP(data, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := readTestUDP(t, playRTP)
+	if rtp, err := decrypt.unprotect(data, false); err != nil || !bytes.Equal(rtp, testRTP(96, 2, 2)) {
+		t.Fatalf("expect srtp of player, got %x %v", rtp, err)
+	}
+	if binary.BigEndian.Uint16(data[2:]) != 2 {
+		t.Fatalf("expect packet unauthenticated dropped, got %x", data)
+	}
+}
+
+func TestUDPClientSRTPError(t *testing.T) {
+	k, _ := newSRTPKey(config.SRTPSuiteAES128SHA1_80)
+	srtp, _ := newSRTPContext(k)
+	client, _ := testUDPPair(t)
+	c := &UDPClient{Session: &Session{}, Tracks: map[int]*UDPTrack{0: {batch: newUDPBatch(client, 4, false), srtp: srtp}}}
+	pack := copyRTPPack(0, RtpTypeVideo, []byte{0x80, 96, 0})
+	defer pack.Release()
+	if err := c.BatchRTP(pack); !errors.Is(err, InvalidSRTPError) {
+		t.Fatalf("expect rtp truncated not protected, got %v", err)
+	}
+	if n, _ := c.Batched(); n != 0 {
+		t.Fatalf("expect rtp not protected not batched, got %d", n)
+	}
+}
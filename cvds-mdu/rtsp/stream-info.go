@@ -0,0 +1,325 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/codec"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VideoInfo is the codec parameters of video track parsed from parameter
+// sets of SDP or in band, and frame statistics measured live
+type VideoInfo struct {
+	Track      int    `json:"track"`
+	Codec      string `json:"codec"`
+	Profile    string `json:"profile,omitempty"`
+	Tier       string `json:"tier,omitempty"`
+	Level      string `json:"level,omitempty"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	BitDepth   int    `json:"bitDepth,omitempty"`
+	Interlaced bool   `json:"interlaced"`
+	// frame rate signaled in parameter sets, 0 if not signaled
+	FrameRate float64 `json:"frameRate"`
+	// frames per second measured
+	FPS float64 `json:"fps"`
+	// frames of the last complete GOP
+	GOP int `json:"gop"`
+	// seconds between the last two keyframes by RTP timestamps
+	KeyframeInterval float64 `json:"keyframeInterval"`
+	// bits of payload per second
+	Bitrate   int64 `json:"bitrate"`
+	Frames    int64 `json:"frames"`
+	Keyframes int64 `json:"keyframes"`
+}
+
+// AudioInfo is the codec parameters of audio track parsed from SDP, and
+// bitrate measured live
+type AudioInfo struct {
+	Track      int    `json:"track"`
+	Codec      string `json:"codec"`
+	Profile    string `json:"profile,omitempty"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+	// bits of payload per second
+	Bitrate int64 `json:"bitrate"`
+}
+
+// StreamInfo is the video and audio of a pusher, nil if no such track
+type StreamInfo struct {
+	Video *VideoInfo `json:"video"`
+	Audio *AudioInfo `json:"audio"`
+}
+
+// ParameterSets is the latest parameter sets of video and AudioSpecificConfig
+// of audio parsed, nil if not received or not parsed
+type ParameterSets struct {
+	VPS         *codec.H265VPS             `json:"vps,omitempty"`
+	SPS         interface{}                `json:"sps,omitempty"`
+	PPS         interface{}                `json:"pps,omitempty"`
+	AudioConfig *codec.AudioSpecificConfig `json:"audioConfig,omitempty"`
+}
+
+// rateWindow counts bytes and frames in windows of a second
+type rateWindow struct {
+	start  time.Time
+	bytes  int64
+	frames int64
+}
+
+// roll returns bitrate and frame rate of the window and starts the next one,
+// ok is false if the window has not elapsed a second
+func (w *rateWindow) roll(now time.Time) (bitrate int64, fps float64, ok bool) {
+	if w.start.IsZero() {
+		w.start = now
+		return 0, 0, false
+	}
+	elapsed := now.Sub(w.start)
+	if elapsed < time.Second {
+		return 0, 0, false
+	}
+	seconds := elapsed.Seconds()
+	bitrate, fps = int64(float64(w.bytes*8)/seconds), math.Round(float64(w.frames)/seconds*100)/100
+	*w = rateWindow{start: now}
+	return bitrate, fps, true
+}
+
+// streamAnalyzer taps packets of a pusher to analyze parameter sets in band
+// and measure frame statistics. Frames are counted by RTP timestamps of
+// video, and keyframes by the starts of GOP
+type streamAnalyzer struct {
+	lock  sync.Mutex
+	video VideoInfo
+	audio AudioInfo
+	sets  ParameterSets
+	// raw parameter sets parsed, which are reparsed only if changed
+	vps, sps, pps []byte
+
+	clockRate   int
+	videoWindow rateWindow
+	audioWindow rateWindow
+	started     bool
+	lastTS      uint32
+	lastKeyTS   uint32
+	gopFrames   int
+
+	rtpInfo           RTPInfo
+	spsPpsInSTAPaPack bool
+}
+
+// newStreamAnalyzer creates analyzer of tracks of sdp, parameter sets of
+// sprop-parameter-sets, or sprop-vps, sprop-sps and sprop-pps of H.265, and
+// config of AAC parsed
+func newStreamAnalyzer(sdp *SDP) *streamAnalyzer {
+	a := &streamAnalyzer{video: VideoInfo{Track: -1}, audio: AudioInfo{Track: -1}}
+	if sdp == nil {
+		return a
+	}
+	if i, media := sdp.Track("video"); media != nil {
+		a.video.Track, a.video.Codec = i, media.Codec()
+		a.clockRate = media.ClockRate()
+		switch a.video.Codec {
+		case CodecH264:
+			for _, set := range media.SpropParameterSets() {
+				a.parameterSet(set)
+			}
+		case CodecH265:
+			for _, key := range []string{"sprop-vps", "sprop-sps", "sprop-pps"} {
+				for _, s := range strings.Split(media.Fmtp(key), ",") {
+					if set, err := base64.StdEncoding.DecodeString(s); err == nil && len(set) > 0 {
+						a.parameterSet(set)
+					}
+				}
+			}
+		}
+	}
+	if i, media := sdp.Track("audio"); media != nil {
+		a.audio.Track, a.audio.Codec = i, media.Codec()
+		if rtpMap := media.RTPMap(); rtpMap != nil {
+			a.audio.SampleRate, a.audio.Channels = rtpMap.ClockRate, rtpMap.Channels
+			// config of MP4A-LATM is StreamMuxConfig, which is not parsed
+			if strings.EqualFold(rtpMap.Encoding, "MPEG4-GENERIC") {
+				if asc, err := codec.ParseAudioSpecificConfig(media.Config()); err == nil {
+					a.sets.AudioConfig = asc
+					a.audio.Profile, a.audio.SampleRate, a.audio.Channels = asc.Profile, asc.SampleRate, asc.Channels
+				}
+			}
+		}
+		if a.audio.Channels == 0 {
+			a.audio.Channels = 1
+		}
+	}
+	return a
+}
+
+// observe counts pack received at now
+func (a *streamAnalyzer) observe(pack *RTPPack, now time.Time) {
+	video := pack.Type == RtpTypeVideo && pack.Track == a.video.Track
+	audio := pack.Type == RtpTypeAudio && pack.Track == a.audio.Track
+	if !video && !audio {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !parseRTP(pack.Bytes(), &a.rtpInfo) {
+		return
+	}
+	// windows roll before pack counted, which is of the next window
+	if audio {
+		if bitrate, _, ok := a.audioWindow.roll(now); ok {
+			a.audio.Bitrate = bitrate
+		}
+		a.audioWindow.bytes += int64(len(a.rtpInfo.Payload))
+		return
+	}
+	if bitrate, fps, ok := a.videoWindow.roll(now); ok {
+		a.video.Bitrate, a.video.FPS = bitrate, fps
+	}
+
+	ts := uint32(a.rtpInfo.Timestamp)
+	if !a.started || ts != a.lastTS {
+		a.started, a.lastTS = true, ts
+		a.video.Frames++
+		a.videoWindow.frames++
+		a.gopFrames++
+	}
+	a.videoWindow.bytes += int64(len(a.rtpInfo.Payload))
+	a.inBand(a.rtpInfo.Payload)
+	// parameter sets and keyframe of the same timestamp start one GOP
+	if shouldSequenceStart(a.video.Codec, &a.rtpInfo, &a.spsPpsInSTAPaPack) && (a.video.Keyframes == 0 || ts != a.lastKeyTS) {
+		if a.video.Keyframes > 0 {
+			a.video.GOP = a.gopFrames - 1
+			if a.clockRate > 0 {
+				a.video.KeyframeInterval = math.Round(float64(ts-a.lastKeyTS)/float64(a.clockRate)*1000) / 1000
+			}
+		}
+		a.video.Keyframes++
+		a.lastKeyTS, a.gopFrames = ts, 1
+	}
+}
+
+// inBand parses parameter sets of payload of video, in single NAL unit
+// packets or aggregation packets
+func (a *streamAnalyzer) inBand(payload []byte) {
+	switch a.video.Codec {
+	case CodecH264:
+		if len(payload) < 1 {
+			return
+		}
+		switch typ := payload[0] & 0x1F; {
+		case typ == codec.H264NALUTypeSPS || typ == codec.H264NALUTypePPS:
+			a.parameterSet(payload)
+		case typ == 24: // STAP-A
+			a.aggregated(payload[1:])
+		}
+	case CodecH265:
+		if len(payload) < 2 {
+			return
+		}
+		switch typ := payload[0] >> 1 & 0x3F; {
+		case typ >= codec.H265NALUTypeVPS && typ <= codec.H265NALUTypePPS:
+			a.parameterSet(payload)
+		case typ == 48: // aggregation packet
+			a.aggregated(payload[2:])
+		}
+	}
+}
+
+// aggregated parses parameter sets of NAL units of aggregation packet
+func (a *streamAnalyzer) aggregated(data []byte) {
+	for len(data) > 2 {
+		size := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if size > len(data) {
+			return
+		}
+		a.parameterSet(data[:size])
+		data = data[size:]
+	}
+}
+
+// parameterSet parses parameter set nal of video if it changed, NAL units of
+// other types and parameter sets failed to parse are ignored
+func (a *streamAnalyzer) parameterSet(nal []byte) {
+	switch a.video.Codec {
+	case CodecH264:
+		switch codec.H264NALUType(nal) {
+		case codec.H264NALUTypeSPS:
+			if bytes.Equal(nal, a.sps) {
+				return
+			}
+			sps, err := codec.ParseH264SPS(nal)
+			if err != nil {
+				return
+			}
+			a.sps, a.sets.SPS = append(a.sps[:0], nal...), sps
+			a.video.Profile, a.video.Level = sps.Profile, sps.Level
+			a.video.Width, a.video.Height = sps.Width, sps.Height
+			a.video.BitDepth, a.video.Interlaced = sps.BitDepth, sps.Interlaced
+			a.video.FrameRate = sps.FrameRate
+		case codec.H264NALUTypePPS:
+			if bytes.Equal(nal, a.pps) {
+				return
+			}
+			if pps, err := codec.ParseH264PPS(nal); err == nil {
+				a.pps, a.sets.PPS = append(a.pps[:0], nal...), pps
+			}
+		}
+	case CodecH265:
+		switch codec.H265NALUType(nal) {
+		case codec.H265NALUTypeVPS:
+			if bytes.Equal(nal, a.vps) {
+				return
+			}
+			if vps, err := codec.ParseH265VPS(nal); err == nil {
+				a.vps, a.sets.VPS = append(a.vps[:0], nal...), vps
+				a.video.FrameRate = vps.FrameRate
+			}
+		case codec.H265NALUTypeSPS:
+			if bytes.Equal(nal, a.sps) {
+				return
+			}
+			sps, err := codec.ParseH265SPS(nal)
+			if err != nil {
+				return
+			}
+			a.sps, a.sets.SPS = append(a.sps[:0], nal...), sps
+			a.video.Profile, a.video.Tier, a.video.Level = sps.Profile, sps.Tier, sps.Level
+			a.video.Width, a.video.Height = sps.Width, sps.Height
+			a.video.BitDepth = sps.BitDepth
+		case codec.H265NALUTypePPS:
+			if bytes.Equal(nal, a.pps) {
+				return
+			}
+			if pps, err := codec.ParseH265PPS(nal); err == nil {
+				a.pps, a.sets.PPS = append(a.pps[:0], nal...), pps
+			}
+		}
+	}
+}
+
+// info returns copy of video and audio analyzed
+func (a *streamAnalyzer) info() StreamInfo {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var info StreamInfo
+	if a.video.Track >= 0 {
+		video := a.video
+		info.Video = &video
+	}
+	if a.audio.Track >= 0 {
+		audio := a.audio
+		info.Audio = &audio
+	}
+	return info
+}
+
+func (a *streamAnalyzer) parameterSets() ParameterSets {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.sets
+}
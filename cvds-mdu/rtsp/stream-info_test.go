@@ -0,0 +1,98 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestStreamAnalyzerSDP(t *testing.T) {
+	sdp, err := ParseSDP(testCameraSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := newStreamAnalyzer(sdp).info()
+	if v := info.Video; v == nil || v.Codec != CodecH264 || v.Profile != "Main" || v.Level != "4.1" || v.Width != 1920 || v.Height != 1080 || v.FrameRate != 25 {
+		t.Fatalf("unexpected video of sprop-parameter-sets: %+v", info.Video)
+	}
+	if a := info.Audio; a == nil || a.Codec != CodecPCMA || a.SampleRate != 8000 || a.Channels != 1 {
+		t.Fatalf("unexpected audio: %+v", info.Audio)
+	}
+
+	sdp, err = ParseSDP("v=0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H265/90000\r\n" +
+		"a=fmtp:96 sprop-vps=QAEMAf//AWAAAAMAkAAAAwAAAwBdlZgJ; sprop-sps=QgEBAWAAAAMAkAAAAwAAAwBdoAKAgC0WWVmkkyvAQEAAAAMAQAAABkI=; sprop-pps=RAHBcrRiQA==\r\n" +
+		"m=audio 0 RTP/AVP 97\r\n" +
+		"a=rtpmap:97 MPEG4-GENERIC/44100/2\r\n" +
+		"a=fmtp:97 streamtype=5;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1210\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newStreamAnalyzer(sdp)
+	info = a.info()
+	if v := info.Video; v == nil || v.Codec != CodecH265 || v.Profile != "Main" || v.Tier != "Main" || v.Level != "3.1" || v.Width != 1280 || v.Height != 720 {
+		t.Fatalf("unexpected video of sprop-vps, sprop-sps and sprop-pps: %+v", info.Video)
+	}
+	if info.Audio == nil || info.Audio.Profile != "LC" || info.Audio.SampleRate != 44100 || info.Audio.Channels != 2 {
+		t.Fatalf("unexpected audio of config: %+v", info.Audio)
+	}
+	if sets := a.parameterSets(); sets.VPS == nil || sets.SPS == nil || sets.PPS == nil || sets.AudioConfig == nil {
+		t.Fatalf("expect parameter sets parsed: %+v", sets)
+	}
+}
+
+func TestStreamAnalyzerFrames(t *testing.T) {
+	sdp, err := ParseSDP(testPushSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newStreamAnalyzer(sdp)
+	if info := a.info(); info.Video.Width != 0 {
+		t.Fatalf("expect size unknown without parameter sets: %+v", info.Video)
+	}
+	sps, _ := base64.StdEncoding.DecodeString("Z00AKZpkA8ARPy4C3AQEBQAAAwPoAADDUOhgAJiWAAJiVlF3lgA=")
+	pps, _ := base64.StdEncoding.DecodeString("aO48gA==")
+
+	// 25 fps with SPS and PPS in STAP-A and keyframe every 10 frames
+	start := time.Now()
+	seq := 0
+	observe := func(pkt []byte, frame int) {
+		pack := copyRTPPack(0, RtpTypeVideo, pkt)
+		a.observe(pack, start.Add(time.Duration(frame)*40*time.Millisecond))
+		pack.Release()
+		seq++
+	}
+	for frame := 0; frame <= 75; frame++ {
+		ts := uint32(frame * 3600)
+		if frame%10 == 0 {
+			stap := append(testSourceRTP(1, seq, ts, 24)[:13], byte(len(sps)>>8), byte(len(sps)))
+			stap = append(append(stap, sps...), byte(len(pps)>>8), byte(len(pps)))
+			observe(append(stap, pps...), frame)
+			observe(testSourceRTP(1, seq, ts, 0x65), frame)
+			continue
+		}
+		observe(testSourceRTP(1, seq, ts, 0x41), frame)
+	}
+	info := a.info().Video
+	if info.Width != 1920 || info.Height != 1080 || info.Profile != "Main" {
+		t.Fatalf("expect in band SPS parsed: %+v", info)
+	}
+	if info.FPS != 25 || info.GOP != 10 || info.KeyframeInterval != 0.4 || info.Bitrate <= 0 {
+		t.Fatalf("unexpected frame statistics: %+v", info)
+	}
+	if info.Frames != 76 || info.Keyframes != 8 {
+		t.Fatalf("expect 76 frames and 8 keyframes, got %d %d", info.Frames, info.Keyframes)
+	}
+
+	// audio and other tracks not counted as video
+	pkt := testRTP(8, 0, 0xD5)
+	binary.BigEndian.PutUint32(pkt[4:], 1)
+	pack := copyRTPPack(1, RtpTypeAudio, pkt)
+	a.observe(pack, start)
+	pack.Release()
+	if a.info().Video.Frames != 76 {
+		t.Fatal("expect audio not counted as video frames")
+	}
+}
@@ -0,0 +1,119 @@
+package rtsp
+
+import (
+	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+var (
+	interleavedRegexp = regexp.MustCompile(`interleaved=(\d+)(-(\d+))?`)
+	clientPortRegexp  = regexp.MustCompile(`client_port=(\d+)(-(\d+))?`)
+	serverPortRegexp  = regexp.MustCompile(`server_port=(\d+)(-(\d+))?`)
+)
+
+// parsePortRange parses `a-b` submatches of transport, b is a+1 if omitted
+func parsePortRange(matches []string) (int, int) {
+	first, _ := strconv.Atoi(matches[1])
+	second, err := strconv.Atoi(matches[3])
+	if err != nil {
+		second = first + 1
+	}
+	return first, second
+}
+
+type trackChannel struct {
+	track int
+	typ   RTPType
+}
+
+// interleavedChannels maps interleaved channels of TCP transport to tracks
+// in both directions, RTP and RTCP of a track use a pair of channels
+type interleavedChannels struct {
+	lock     sync.RWMutex
+	channels map[int]trackChannel
+	tracks   map[int][2]int
+}
+
+func (ic *interleavedChannels) set(track int, media *SDPMedia, rtpChannel int, rtcpChannel int) {
+	ic.lock.Lock()
+	defer ic.lock.Unlock()
+	if ic.channels == nil {
+		ic.channels = make(map[int]trackChannel)
+		ic.tracks = make(map[int][2]int)
+	}
+	if old, ok := ic.tracks[track]; ok {
+		delete(ic.channels, old[0])
+		delete(ic.channels, old[1])
+	}
+	ic.channels[rtpChannel] = trackChannel{track: track, typ: media.rtpType(false)}
+	ic.channels[rtcpChannel] = trackChannel{track: track, typ: media.rtpType(true)}
+	ic.tracks[track] = [2]int{rtpChannel, rtcpChannel}
+}
+
+// lookup returns the track and packet type of channel
+func (ic *interleavedChannels) lookup(channel int) (trackChannel, bool) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	tc, ok := ic.channels[channel]
+	return tc, ok
+}
+
+// channel returns the channel of packet of track, false if track not set up
+func (ic *interleavedChannels) channel(track int, control bool) (int, bool) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	channels, ok := ic.tracks[track]
+	if !ok {
+		return 0, false
+	}
+	if control {
+		return channels[1], true
+	}
+	return channels[0], true
+}
+
+// free reports whether both channels are not used by other tracks
+func (ic *interleavedChannels) free(track int, rtpChannel int, rtcpChannel int) bool {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	for _, channel := range []int{rtpChannel, rtcpChannel} {
+		if tc, ok := ic.channels[channel]; ok && tc.track != track {
+			return false
+		}
+	}
+	return true
+}
+
+// allocate returns the first free pair of channels for track, starting
+// from 2*track
+func (ic *interleavedChannels) allocate(track int) (int, int) {
+	for channel := 2 * track; channel < 255; channel += 2 {
+		if ic.free(track, channel, channel+1) {
+			return channel, channel + 1
+		}
+	}
+	return 2 * track, 2*track + 1
+}
+
+// udpBuffers returns socket buffer sizes configured for media type, video
+// has its own buffers and other media share the audio buffers
+func udpBuffers(mediaType string, control bool, server bool) config.ReadWriteBuffer {
+	cfg := config.RtspConfig()
+	var av *config.AV
+	switch {
+	case mediaType == "video" && control:
+		av = &cfg.VideoControl
+	case mediaType == "video":
+		av = &cfg.Video
+	case control:
+		av = &cfg.AudioControl
+	default:
+		av = &cfg.Audio
+	}
+	if server {
+		return av.Server
+	}
+	return av.Client
+}
@@ -0,0 +1,83 @@
+package rtsp
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// datagrams read from UDP socket in one read
+	udpReadBatch = 8
+	// max size of UDP datagram
+	udpMaxDatagram = 65536
+)
+
+// udpBatch collects packets to send to a connected UDP socket in one batched
+// write, references of packets are held until written
+type udpBatch struct {
+	writer *udpBatchWriter
+	packs  []*RTPPack
+	bufs   [][]byte
+	since  time.Time
+}
+
+func newUDPBatch(conn *net.UDPConn, size int, gso bool) *udpBatch {
+	if size <= 0 {
+		size = 1
+	}
+	return &udpBatch{
+		writer: newUDPBatchWriter(conn, gso),
+		packs:  make([]*RTPPack, 0, size),
+		bufs:   make([][]byte, 0, size),
+	}
+}
+
+func (b *udpBatch) Len() int {
+	return len(b.packs)
+}
+
+func (b *udpBatch) Full() bool {
+	return len(b.packs) == cap(b.packs)
+}
+
+// add appends pack to batch, batch must not be full
+func (b *udpBatch) add(pack *RTPPack) {
+	if len(b.packs) == 0 {
+		b.since = time.Now()
+	}
+	pack.AddRef()
+	b.packs = append(b.packs, pack)
+	b.bufs = append(b.bufs, pack.Bytes())
+}
+
+// flush writes packets of batch and resets batch, returns bytes written
+func (b *udpBatch) flush() (n int, err error) {
+	if len(b.bufs) == 0 {
+		return
+	}
+	n, err = b.writer.WriteBatch(b.bufs)
+	b.reset()
+	return
+}
+
+// reset releases packets of batch
+func (b *udpBatch) reset() {
+	for i, pack := range b.packs {
+		pack.Release()
+		b.packs[i] = nil
+		b.bufs[i] = nil
+	}
+	b.packs, b.bufs = b.packs[:0], b.bufs[:0]
+}
+
+// writeEach writes datagrams one by one, the portable path of batched write
+func writeEach(conn *net.UDPConn, bufs [][]byte) (n int, err error) {
+	for _, buf := range bufs {
+		var c int
+		if c, err = conn.Write(buf); err != nil {
+			return
+		}
+		n += c
+	}
+	return
+}
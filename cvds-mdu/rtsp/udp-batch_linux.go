@@ -0,0 +1,227 @@
+//go:build linux
+
+package rtsp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// UDP_SEGMENT socket option and cmsg type of UDP GSO, linux 4.18
+	udpSegment = 103
+	// max segments of a GSO datagram, UDP_MAX_SEGMENTS of kernel
+	udpMaxSegments = 64
+	// max payload of a GSO datagram
+	udpMaxGSOSize = 65000
+)
+
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// udpBatchWriter writes datagrams of a connected UDP socket by sendmmsg.
+// Consecutive datagrams of the same size are merged into a GSO datagram if
+// supported, the kernel or NIC splits it into the original datagrams
+type udpBatchWriter struct {
+	conn *net.UDPConn
+	raw  syscall.RawConn
+	gso  bool
+
+	hdrs  []mmsghdr
+	first []int // index of first datagram of message
+	iovs  []unix.Iovec
+	oob   []byte
+
+	// state of a write, kept in writer to write without allocation
+	sent  int
+	bytes int
+	errno syscall.Errno
+	write func(fd uintptr) bool
+}
+
+func newUDPBatchWriter(conn *net.UDPConn, gso bool) *udpBatchWriter {
+	w := &udpBatchWriter{conn: conn}
+	if raw, err := conn.SyscallConn(); err == nil {
+		w.raw = raw
+		if gso {
+			raw.Control(func(fd uintptr) {
+				_, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, udpSegment)
+				w.gso = err == nil
+			})
+		}
+	}
+	w.write = w.sendmmsg
+	return w
+}
+
+// build fills messages of bufs, datagrams are merged if GSO enabled
+func (w *udpBatchWriter) build(bufs [][]byte) {
+	if cap(w.iovs) < len(bufs) {
+		w.iovs = make([]unix.Iovec, 0, len(bufs))
+		w.hdrs = make([]mmsghdr, 0, len(bufs))
+		w.first = make([]int, 0, len(bufs))
+		w.oob = make([]byte, unix.CmsgSpace(2)*len(bufs))
+	}
+	w.iovs, w.hdrs, w.first = w.iovs[:0], w.hdrs[:0], w.first[:0]
+	for i := 0; i < len(bufs); {
+		size := len(bufs[i])
+		j := i + 1
+		if w.gso {
+			// all segments but the last have the same size
+			for total := size; j < len(bufs) && j-i < udpMaxSegments && len(bufs[j-1]) == size &&
+				len(bufs[j]) <= size && total+len(bufs[j]) <= udpMaxGSOSize; j++ {
+				total += len(bufs[j])
+			}
+		}
+		k := len(w.iovs)
+		for _, buf := range bufs[i:j] {
+			var iov unix.Iovec
+			if len(buf) > 0 {
+				iov.Base = &buf[0]
+			}
+			iov.SetLen(len(buf))
+			w.iovs = append(w.iovs, iov)
+		}
+		var h mmsghdr
+		h.hdr.Iov = &w.iovs[k]
+		h.hdr.SetIovlen(j - i)
+		if j-i > 1 {
+			space := unix.CmsgSpace(2)
+			oob := w.oob[len(w.hdrs)*space : (len(w.hdrs)+1)*space]
+			cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+			cmsg.Level = unix.IPPROTO_UDP
+			cmsg.Type = udpSegment
+			cmsg.SetLen(unix.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(size)
+			h.hdr.Control = &oob[0]
+			h.hdr.SetControllen(space)
+		}
+		w.hdrs = append(w.hdrs, h)
+		w.first = append(w.first, i)
+		i = j
+	}
+}
+
+func (w *udpBatchWriter) sendmmsg(fd uintptr) bool {
+	n, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&w.hdrs[w.sent])), uintptr(len(w.hdrs)-w.sent), 0, 0, 0)
+	if e == unix.EAGAIN {
+		return false
+	}
+	if e == 0 {
+		for _, h := range w.hdrs[w.sent : w.sent+int(n)] {
+			w.bytes += int(h.len)
+		}
+		w.sent += int(n)
+	} else if e != unix.EINTR {
+		w.errno = e
+	}
+	return true
+}
+
+// WriteBatch writes bufs as datagrams, returns bytes written
+func (w *udpBatchWriter) WriteBatch(bufs [][]byte) (n int, err error) {
+	if w.raw == nil {
+		return writeEach(w.conn, bufs)
+	}
+	w.build(bufs)
+	w.sent, w.bytes = 0, 0
+	for w.sent < len(w.hdrs) {
+		w.errno = 0
+		if err = w.raw.Write(w.write); err == nil && w.errno != 0 {
+			err = w.errno
+		}
+		if err != nil {
+			if w.gso && (w.errno == unix.EIO || w.errno == unix.EINVAL) {
+				// GSO not supported by NIC or path, write the rest without it
+				w.gso = false
+				sent := w.bytes
+				n, err = w.WriteBatch(bufs[w.first[w.sent]:])
+				return sent + n, err
+			}
+			return w.bytes, err
+		}
+	}
+	return w.bytes, nil
+}
+
+// udpBatchReader reads datagrams of UDP socket by recvmmsg
+type udpBatchReader struct {
+	conn *net.UDPConn
+	raw  syscall.RawConn
+	bufs [][]byte
+	hdrs []mmsghdr
+	iovs []unix.Iovec
+
+	// state of a read, kept in reader to read without allocation
+	n     int
+	errno syscall.Errno
+	read  func(fd uintptr) bool
+}
+
+func newUDPBatchReader(conn *net.UDPConn, count int, size int) *udpBatchReader {
+	r := &udpBatchReader{conn: conn}
+	if raw, err := conn.SyscallConn(); err == nil {
+		r.raw = raw
+	} else {
+		count = 1
+	}
+	r.bufs = make([][]byte, count)
+	r.hdrs = make([]mmsghdr, count)
+	r.iovs = make([]unix.Iovec, count)
+	for i := range r.bufs {
+		r.bufs[i] = make([]byte, size)
+		r.iovs[i].Base = &r.bufs[i][0]
+		r.iovs[i].SetLen(size)
+		r.hdrs[i].hdr.Iov = &r.iovs[i]
+		r.hdrs[i].hdr.SetIovlen(1)
+	}
+	r.read = r.recvmmsg
+	return r
+}
+
+func (r *udpBatchReader) recvmmsg(fd uintptr) bool {
+	n, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&r.hdrs[0])), uintptr(len(r.hdrs)), 0, 0, 0)
+	if e == unix.EAGAIN {
+		return false
+	}
+	if e == 0 {
+		r.n = int(n)
+	} else if e != unix.EINTR {
+		r.errno = e
+	}
+	return true
+}
+
+// Read reads datagrams, returns count of datagrams read
+func (r *udpBatchReader) Read() (int, error) {
+	if r.raw == nil {
+		n, err := r.conn.Read(r.bufs[0])
+		if err != nil {
+			return 0, err
+		}
+		r.hdrs[0].len = uint32(n)
+		return 1, nil
+	}
+	for {
+		r.n, r.errno = 0, 0
+		if err := r.raw.Read(r.read); err != nil {
+			return 0, err
+		}
+		if r.errno != 0 {
+			return 0, r.errno
+		}
+		if r.n > 0 {
+			return r.n, nil
+		}
+	}
+}
+
+// Buffer returns datagram i of last read, valid until next read
+func (r *udpBatchReader) Buffer(i int) []byte {
+	return r.bufs[i][:r.hdrs[i].len]
+}
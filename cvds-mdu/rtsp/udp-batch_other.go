@@ -0,0 +1,47 @@
+//go:build !linux
+
+package rtsp
+
+import (
+	"net"
+)
+
+// udpBatchWriter writes datagrams one by one where sendmmsg not available
+type udpBatchWriter struct {
+	conn *net.UDPConn
+}
+
+func newUDPBatchWriter(conn *net.UDPConn, gso bool) *udpBatchWriter {
+	return &udpBatchWriter{conn: conn}
+}
+
+// WriteBatch writes bufs as datagrams, returns bytes written
+func (w *udpBatchWriter) WriteBatch(bufs [][]byte) (int, error) {
+	return writeEach(w.conn, bufs)
+}
+
+// udpBatchReader reads a datagram at a time where recvmmsg not available
+type udpBatchReader struct {
+	conn *net.UDPConn
+	buf  []byte
+	n    int
+}
+
+func newUDPBatchReader(conn *net.UDPConn, count int, size int) *udpBatchReader {
+	return &udpBatchReader{conn: conn, buf: make([]byte, size)}
+}
+
+// Read reads datagrams, returns count of datagrams read
+func (r *udpBatchReader) Read() (int, error) {
+	n, err := r.conn.Read(r.buf)
+	if err != nil {
+		return 0, err
+	}
+	r.n = n
+	return 1, nil
+}
+
+// Buffer returns datagram i of last read, valid until next read
+func (r *udpBatchReader) Buffer(i int) []byte {
+	return r.buf[:r.n]
+}
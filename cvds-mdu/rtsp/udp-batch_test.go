@@ -0,0 +1,189 @@
+package rtsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// testUDPPair returns a socket connected to a listening one on loopback
+func testUDPPair(tb testing.TB) (*net.UDPConn, *net.UDPConn) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		server.Close()
+		tb.Fatal(err)
+	}
+	server.SetReadBuffer(4 << 20)
+	client.SetWriteBuffer(4 << 20)
+	tb.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestUDPBatch(t *testing.T) {
+	// runs of equal sizes merged by GSO, a larger packet ends the run
+	sizes := []int{1200, 1200, 1200, 800, 1200, 1200, 1400, 12, 12, 1200}
+	for _, gso := range []bool{false, true} {
+		client, server := testUDPPair(t)
+		batch := newUDPBatch(client, len(sizes), gso)
+		var packs []*RTPPack
+		total := 0
+		for i, size := range sizes {
+			data := bytes.Repeat([]byte{byte(i)}, size)
+			binary.BigEndian.PutUint16(data, uint16(i))
+			pack := copyRTPPack(0, RtpTypeVideo, data)
+			batch.add(pack)
+			packs = append(packs, pack)
+			total += size
+		}
+		if !batch.Full() {
+			t.Fatal("expect batch full")
+		}
+		n, err := batch.flush()
+		if err != nil {
+			t.Fatalf("gso %v: %v", gso, err)
+		}
+		if n != total || batch.Len() != 0 {
+			t.Fatalf("gso %v: expect %d bytes written, got %d", gso, total, n)
+		}
+		for _, pack := range packs {
+			pack.Release()
+		}
+
+		reader := newUDPBatchReader(server, udpReadBatch, udpMaxDatagram)
+		for i := 0; i < len(sizes); {
+			server.SetReadDeadline(time.Now().Add(3 * time.Second))
+			n, err := reader.Read()
+			if err != nil {
+				t.Fatalf("gso %v: %v", gso, err)
+			}
+			for j := 0; j < n; j, i = j+1, i+1 {
+				data := reader.Buffer(j)
+				if len(data) != sizes[i] || int(binary.BigEndian.Uint16(data)) != i || data[len(data)-1] != byte(i) {
+					t.Fatalf("gso %v: expect datagram %d of %d bytes, got %d bytes", gso, i, sizes[i], len(data))
+				}
+			}
+		}
+	}
+}
+
+func benchmarkUDPSend(b *testing.B, send func(conn *net.UDPConn, packs []*RTPPack) error) {
+	client, server := testUDPPair(b)
+	go func() {
+		buf := make([]byte, udpMaxDatagram)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	// a GOP of 64 packets as BenchmarkPusherPipeline
+	var packs []*RTPPack
+	for i := 0; i < 64; i++ {
+		pkt := append(testRTP(96, i, 0x41), make([]byte, 1187)...)
+		packs = append(packs, copyRTPPack(0, RtpTypeVideo, pkt))
+	}
+	defer func() {
+		for _, pack := range packs {
+			pack.Release()
+		}
+	}()
+	b.SetBytes(int64(len(packs) * packs[0].Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := send(client, packs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUDPSendEach writes a GOP a datagram at a time as before batching
+func BenchmarkUDPSendEach(b *testing.B) {
+	benchmarkUDPSend(b, func(conn *net.UDPConn, packs []*RTPPack) error {
+		for _, pack := range packs {
+			if _, err := conn.Write(pack.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func benchmarkUDPSendBatch(b *testing.B, gso bool) {
+	var batch *udpBatch
+	benchmarkUDPSend(b, func(conn *net.UDPConn, packs []*RTPPack) error {
+		if batch == nil {
+			batch = newUDPBatch(conn, 64, gso)
+		}
+		for _, pack := range packs {
+			batch.add(pack)
+			if batch.Full() {
+				if _, err := batch.flush(); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := batch.flush()
+		return err
+	})
+}
+
+func BenchmarkUDPSendBatch(b *testing.B) {
+	benchmarkUDPSendBatch(b, false)
+}
+
+func BenchmarkUDPSendBatchGSO(b *testing.B) {
+	benchmarkUDPSendBatch(b, true)
+}
+
+func benchmarkUDPReceive(b *testing.B, read func(conn *net.UDPConn) func() (int, error)) {
+	client, server := testUDPPair(b)
+	buf := make([]byte, 1200)
+	next := read(server)
+	// a GOP of 64 datagrams queued on socket is read per op
+	b.SetBytes(64 * 1200)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 64; j++ {
+			if _, err := client.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+		for j := 0; j < 64; {
+			n, err := next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			j += n
+		}
+	}
+}
+
+// BenchmarkUDPReceiveEach reads a datagram at a time as before batching
+func BenchmarkUDPReceiveEach(b *testing.B) {
+	benchmarkUDPReceive(b, func(conn *net.UDPConn) func() (int, error) {
+		buf := make([]byte, udpMaxDatagram)
+		return func() (int, error) {
+			_, _, err := conn.ReadFromUDP(buf)
+			return 1, err
+		}
+	})
+}
+
+func BenchmarkUDPReceiveBatch(b *testing.B) {
+	benchmarkUDPReceive(b, func(conn *net.UDPConn) func() (int, error) {
+		return newUDPBatchReader(conn, udpReadBatch, udpMaxDatagram).Read
+	})
+}
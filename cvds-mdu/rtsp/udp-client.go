@@ -1,166 +1,253 @@
 package rtsp
 
 import (
+	"errors"
 	"fmt"
+	"github.com/CVDS2020/CVDS2020/common/log"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type UDPClient struct {
 	*Session
 
-	APort        int
-	AConn        *net.UDPConn
-	AControlPort int
-	AControlConn *net.UDPConn
-	VPort        int
-	VConn        *net.UDPConn
-	VControlPort int
-	VControlConn *net.UDPConn
+	Tracks     map[int]*UDPTrack
+	tracksLock sync.RWMutex
 
 	Stoped bool
 }
 
 func (s *UDPClient) Stop() {
+	s.tracksLock.Lock()
+	defer s.tracksLock.Unlock()
 	if s.Stoped {
 		return
 	}
 	s.Stoped = true
-	if s.AConn != nil {
-		s.AConn.Close()
-		s.AConn = nil
+	for _, t := range s.Tracks {
+		t.close()
 	}
-	if s.AControlConn != nil {
-		s.AControlConn.Close()
-		s.AControlConn = nil
+}
+
+func (c *UDPClient) dial(host string, port int, mediaType string, control bool) (conn *net.UDPConn, err error) {
+	var addr *net.UDPAddr
+	if addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port)); err != nil {
+		return
+	}
+	if conn, err = net.DialUDP("udp", nil, addr); err != nil {
+		return
 	}
-	if s.VConn != nil {
-		s.VConn.Close()
-		s.VConn = nil
+	buffers := udpBuffers(mediaType, control, false)
+	if err := conn.SetReadBuffer(buffers.ReadBuffer); err != nil {
+		c.logger.ErrorWith("udp client conn set read buffer error", err, log.String("media", mediaType))
 	}
-	if s.VControlConn != nil {
-		s.VControlConn.Close()
-		s.VControlConn = nil
+	if err := conn.SetWriteBuffer(buffers.WriteBuffer); err != nil {
+		c.logger.ErrorWith("udp client conn set write buffer error", err, log.String("media", mediaType))
 	}
+	return
 }
 
-func (c *UDPClient) SetupAudio() (err error) {
-	var (
-		logger = c.logger
-		addr   *net.UDPAddr
-	)
+// SetupTrack dials the RTP and RTCP ports of player for track, packets of
+// player received on the sockets keep session alive. Packets are protected
+// by SRTP of key if not nil
+func (c *UDPClient) SetupTrack(track int, media *SDPMedia, port int, controlPort int, key *srtpKey) (t *UDPTrack, err error) {
+	t = &UDPTrack{Track: track, Type: media.Type, Port: port, ControlPort: controlPort}
 	defer func() {
 		if err != nil {
-			logger.ErrorWith("setup audio error", err)
-			c.Stop()
+			c.logger.ErrorWith("setup track error", err, log.Int("track", track))
+			t.close()
 		}
 	}()
+	if key != nil {
+		if t.srtp, err = newSRTPContext(key); err != nil {
+			return
+		}
+	}
 	host := c.Conn.RemoteAddr().String()
 	host = host[:strings.LastIndex(host, ":")]
-	if addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.APort)); err != nil {
+	if t.Conn, err = c.dial(host, port, media.Type, false); err != nil {
 		return
 	}
-	c.AConn, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
+	if t.ControlConn, err = c.dial(host, controlPort, media.Type, true); err != nil {
 		return
 	}
-	if err = c.AConn.SetReadBuffer(config.RtspConfig().Audio.Client.ReadBuffer); err != nil {
-		logger.ErrorWith("udp client audio conn set read buffer error", err)
-	}
-	if err = c.AConn.SetWriteBuffer(config.RtspConfig().Audio.Client.WriteBuffer); err != nil {
-		logger.ErrorWith("udp client audio conn set write buffer error", err)
+	batch, gso := config.RtspConfig().Player.WriteBatch, !config.RtspConfig().DisableUDPGSO
+	t.batch = newUDPBatch(t.Conn, batch, gso)
+	t.controlBatch = newUDPBatch(t.ControlConn, batch, gso)
+	c.tracksLock.Lock()
+	defer c.tracksLock.Unlock()
+	if c.Stoped {
+		return nil, fmt.Errorf("udp client stopped")
 	}
-
-	addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.AControlPort))
-	if err != nil {
-		return
-	}
-	c.AControlConn, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return
+	if c.Tracks == nil {
+		c.Tracks = make(map[int]*UDPTrack)
 	}
-	if err = c.AControlConn.SetReadBuffer(config.RtspConfig().AudioControl.Client.ReadBuffer); err != nil {
-		logger.ErrorWith("udp client audio control conn set read buffer error", err)
+	if old := c.Tracks[track]; old != nil {
+		old.close()
 	}
-	if err = c.AControlConn.SetWriteBuffer(config.RtspConfig().AudioControl.Client.WriteBuffer); err != nil {
-		logger.ErrorWith("udp client audio control conn set write buffer error", err)
+	c.Tracks[track] = t
+	// NACKs of SRTCP of player are not decrypted
+	rtp := t.Conn
+	if t.srtp != nil {
+		rtp = nil
 	}
+	go c.receive(t.Conn, track, media.rtpType(false), nil, t.srtp)
+	go c.receive(t.ControlConn, track, media.rtpType(true), rtp, nil)
 	return
 }
 
-func (c *UDPClient) SetupVideo() (err error) {
-	var (
-		logger = c.logger
-		addr   *net.UDPAddr
-	)
-	defer func() {
+// receive reads RTCP receiver reports, NAT keepalive packets and backchannel
+// RTP of player until conn closed. RTP is handed to RTP handles of session.
+// NACKs received on RTCP socket are answered by RTP of track retransmitted
+// on rtp, which is nil for RTP socket or if not answered. Backchannel RTP is
+// unprotected by srtp if not nil, packets failed authentication are dropped
+func (c *UDPClient) receive(conn *net.UDPConn, track int, typ RTPType, rtp *net.UDPConn, srtp *srtpContext) {
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
 		if err != nil {
-			logger.ErrorWith("setup video error", err)
-			c.Stop()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// ICMP errors of player reported on connected socket, the session
+			// is closed by timeout if player gone
+			continue
+		}
+		atomic.AddInt64(&c.Session.InBytes, int64(n))
+		c.Session.touch()
+		if !typ.IsControl() && n >= RTP_FIXED_HEADER_LENGTH {
+			data := buf[:n]
+			if srtp != nil {
+				if data, err = srtp.unprotect(data, false); err != nil {
+					c.logger.Debug("udp client drop srtp", log.Int("track", track), log.Error(err))
+					continue
+				}
+			}
+			pack := copyRTPPack(track, typ, data)
+			for _, h := range c.RTPHandles {
+				h(pack)
+			}
+			pack.Release()
+		}
+		if rtp != nil && config.RtspConfig().Nack.Enable {
+			c.retransmit(rtp, track, parseNacks(buf[:n]))
 		}
-	}()
-	host := c.Conn.RemoteAddr().String()
-	host = host[:strings.LastIndex(host, ":")]
-	if addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.VPort)); err != nil {
-		return
 	}
-	if c.VConn, err = net.DialUDP("udp", nil, addr); err != nil {
+}
+
+// retransmit writes RTP of track of sequence numbers seqs kept by pusher to
+// player, packets not kept any more are ignored
+func (c *UDPClient) retransmit(rtp *net.UDPConn, track int, seqs []uint16) {
+	if len(seqs) == 0 || c.Player == nil {
 		return
 	}
-	if err = c.VConn.SetReadBuffer(config.RtspConfig().Video.Client.ReadBuffer); err != nil {
-		logger.ErrorWith("udp client video conn set read buffer error", err)
-	}
-	if err = c.VConn.SetWriteBuffer(config.RtspConfig().Video.Client.WriteBuffer); err != nil {
-		logger.ErrorWith("udp client video conn set write buffer error", err)
+	for _, seq := range seqs {
+		pack := c.Player.Pusher.retransmission(track, seq)
+		if pack == nil {
+			continue
+		}
+		n, err := rtp.Write(pack.Bytes())
+		pack.Release()
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&c.Session.OutBytes, int64(n))
+		c.Player.countRetransmitted()
 	}
+}
 
-	addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, c.VControlPort))
-	if err != nil {
-		return
-	}
-	c.VControlConn, err = net.DialUDP("udp", nil, addr)
-	if err != nil {
+// SendRTP sends pack to player immediately
+func (c *UDPClient) SendRTP(pack *RTPPack) (err error) {
+	if err = c.BatchRTP(pack); err != nil {
 		return
 	}
-	if err = c.VControlConn.SetReadBuffer(config.RtspConfig().VideoControl.Client.ReadBuffer); err != nil {
-		logger.ErrorWith("udp client video control conn set read buffer error", err)
-	}
-	if err = c.VControlConn.SetWriteBuffer(config.RtspConfig().VideoControl.Client.WriteBuffer); err != nil {
-		logger.ErrorWith("udp client video control conn set write buffer error", err)
-	}
-	return
+	return c.FlushRTP()
 }
 
-func (c *UDPClient) SendRTP(pack *RTPPack) (err error) {
+// BatchRTP adds pack to the batch of its socket, the batch is written if
+// full. Packs of tracks not set up are ignored
+func (c *UDPClient) BatchRTP(pack *RTPPack) (err error) {
 	if pack == nil {
 		err = fmt.Errorf("udp client send rtp got nil pack")
 		return
 	}
-	var conn *net.UDPConn
-	switch pack.Type {
-	case RtpTypeAudio:
-		conn = c.AConn
-	case RtpTypeAudioControl:
-		conn = c.AControlConn
-	case RtpTypeVideo:
-		conn = c.VConn
-	case RtpTypeVideoControl:
-		conn = c.VControlConn
-	default:
-		err = fmt.Errorf("udp client send rtp got unkown pack type[%v]", pack.Type)
+	c.tracksLock.RLock()
+	defer c.tracksLock.RUnlock()
+	if c.Stoped {
+		return
+	}
+	t := c.Tracks[pack.Track]
+	if t == nil {
 		return
 	}
-	if conn == nil {
+	batch := t.batch
+	if pack.Type.IsControl() {
+		batch = t.controlBatch
+	}
+	if batch == nil {
 		err = fmt.Errorf("udp client send rtp pack type[%v] failed, conn not found", pack.Type)
 		return
 	}
-	var n int
-	if n, err = conn.Write(pack.Buffer.Bytes()); err != nil {
-		err = fmt.Errorf("udp client write bytes error, %v", err)
+	if t.srtp != nil {
+		// packets of player are protected by its own key
+		if pack, err = t.srtp.protect(pack); err != nil {
+			return fmt.Errorf("udp client protect rtp pack error, %w", err)
+		}
+		defer pack.Release()
+	}
+	batch.add(pack)
+	if batch.Full() {
+		err = c.flush(batch)
+	}
+	return
+}
+
+// Batched returns count of packets batched and time the first one added
+func (c *UDPClient) Batched() (n int, since time.Time) {
+	c.tracksLock.RLock()
+	defer c.tracksLock.RUnlock()
+	for _, t := range c.Tracks {
+		for _, batch := range []*udpBatch{t.batch, t.controlBatch} {
+			if batch != nil && batch.Len() > 0 {
+				if n == 0 || batch.since.Before(since) {
+					since = batch.since
+				}
+				n += batch.Len()
+			}
+		}
+	}
+	return
+}
+
+// FlushRTP writes packets batched of all sockets
+func (c *UDPClient) FlushRTP() (err error) {
+	c.tracksLock.RLock()
+	defer c.tracksLock.RUnlock()
+	if c.Stoped {
 		return
 	}
-	// logger.Printf("udp client write [%d/%d]", n, pack.Buffer.Len())
-	c.Session.OutBytes += n
+	for _, t := range c.Tracks {
+		for _, batch := range []*udpBatch{t.batch, t.controlBatch} {
+			if batch != nil {
+				if e := c.flush(batch); e != nil {
+					err = e
+				}
+			}
+		}
+	}
 	return
 }
+
+func (c *UDPClient) flush(batch *udpBatch) error {
+	n, err := batch.flush()
+	// logger.Printf("udp client write [%d/%d]", n, pack.Len())
+	atomic.AddInt64(&c.Session.OutBytes, int64(n))
+	if err != nil {
+		return fmt.Errorf("udp client write bytes error, %v", err)
+	}
+	return nil
+}
@@ -1,45 +1,95 @@
 package rtsp
 
 import (
-	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/CVDS2020/CVDS2020/common/log"
 	"github.com/CVDS2020/CVDS2020/cvds-mdu/config"
+	"math/rand"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// UDPTrack is the pair of UDP sockets of a track, RTP and RTCP
+type UDPTrack struct {
+	Track       int
+	Type        string
+	Port        int
+	Conn        *net.UDPConn
+	ControlPort int
+	ControlConn *net.UDPConn
+
+	// RTP and RTCP addresses of source, and RTP lost of source, NACKs are
+	// sent to source if tracked
+	source        *net.UDPAddr
+	sourceControl *net.UDPAddr
+	nack          *nackTracker
+	// SRTP of track, nil if RTP/AVP
+	srtp *srtpContext
+
+	// packets batched to send of player
+	batch        *udpBatch
+	controlBatch *udpBatch
+}
+
+func (t *UDPTrack) close() {
+	if t.batch != nil {
+		t.batch.reset()
+	}
+	if t.controlBatch != nil {
+		t.controlBatch.reset()
+	}
+	if t.Conn != nil {
+		t.Conn.Close()
+		t.Conn = nil
+	}
+	if t.ControlConn != nil {
+		t.ControlConn.Close()
+		t.ControlConn = nil
+	}
+}
+
 type UDPServer struct {
 	*Session
 	*Client
 
-	APort        int
-	AConn        *net.UDPConn
-	AControlPort int
-	AControlConn *net.UDPConn
-	VPort        int
-	VConn        *net.UDPConn
-	VControlPort int
-	VControlConn *net.UDPConn
+	Tracks     map[int]*UDPTrack
+	tracksLock sync.Mutex
+	// reorders RTP received before handled, nil if jitter buffer disabled
+	jitter *jitterBuffer
+	// SSRC of NACKs sent to source
+	ssrc uint32
 
-	Stoped bool
+	// 1 if stopped, set under tracksLock and read by receiving goroutines
+	stopped uint32
 }
 
 func (s *UDPServer) AddInputBytes(bytes int) {
 	if s.Session != nil {
-		s.Session.InBytes += bytes
+		atomic.AddInt64(&s.Session.InBytes, int64(bytes))
+		s.Session.touch()
 		return
 	}
 	if s.Client != nil {
-		s.Client.InBytes += bytes
+		atomic.AddInt64(&s.Client.InBytes, int64(bytes))
 		return
 	}
 	panic(fmt.Errorf("session and Client both nil"))
 }
 
+// HandleRTP hands pack received to RTP handles of session or client, through
+// jitter buffer if enabled
 func (s *UDPServer) HandleRTP(pack *RTPPack) {
+	if s.jitter != nil {
+		s.jitter.push(pack)
+		return
+	}
+	s.handleRTP(pack)
+}
+
+func (s *UDPServer) handleRTP(pack *RTPPack) {
 	if s.Session != nil {
 		for _, v := range s.Session.RTPHandles {
 			v(pack)
@@ -48,14 +98,39 @@ func (s *UDPServer) HandleRTP(pack *RTPPack) {
 	}
 
 	if s.Client != nil {
-		for _, v := range s.Client.RTPHandles {
-			v(pack)
+		s.Client.handleRTP(pack)
+		return
+	}
+	panic(fmt.Errorf("session and Client both nil"))
+}
+
+// handleGap hands track of RTP lost by jitter buffer to gap handles of
+// session or client
+func (s *UDPServer) handleGap(track int) {
+	if s.Session != nil {
+		for _, h := range s.Session.GapHandles {
+			h(track)
+		}
+		return
+	}
+	if s.Client != nil {
+		for _, h := range s.Client.GapHandles {
+			h(track)
 		}
 		return
 	}
 	panic(fmt.Errorf("session and Client both nil"))
 }
 
+// JitterStats returns statistics of tracks reordered by jitter buffer, nil
+// if jitter buffer disabled
+func (s *UDPServer) JitterStats() []JitterStats {
+	if s.jitter == nil {
+		return nil
+	}
+	return s.jitter.stats()
+}
+
 func (s *UDPServer) Logger() *log.Logger {
 	if s.Session != nil {
 		return s.Session.logger
@@ -66,216 +141,186 @@ func (s *UDPServer) Logger() *log.Logger {
 	panic(fmt.Errorf("session and Client both nil"))
 }
 
+// Stopped reports whether server stopped
+func (s *UDPServer) Stopped() bool {
+	return atomic.LoadUint32(&s.stopped) == 1
+}
+
 func (s *UDPServer) Stop() {
-	if s.Stoped {
+	s.tracksLock.Lock()
+	defer s.tracksLock.Unlock()
+	if s.Stopped() {
 		return
 	}
-	s.Stoped = true
-	if s.AConn != nil {
-		s.AConn.Close()
-		s.AConn = nil
+	atomic.StoreUint32(&s.stopped, 1)
+	for _, t := range s.Tracks {
+		t.close()
 	}
-	if s.AControlConn != nil {
-		s.AControlConn.Close()
-		s.AControlConn = nil
-	}
-	if s.VConn != nil {
-		s.VConn.Close()
-		s.VConn = nil
-	}
-	if s.VControlConn != nil {
-		s.VControlConn.Close()
-		s.VControlConn = nil
+	if s.jitter != nil {
+		s.jitter.close()
 	}
 }
 
-func (s *UDPServer) SetupAudio() (err error) {
-	var (
-		logger = s.Logger()
-		addr   *net.UDPAddr
-	)
-	if addr, err = net.ResolveUDPAddr("udp", ":0"); err != nil {
+func (s *UDPServer) listen(mediaType string, control bool) (conn *net.UDPConn, port int, err error) {
+	logger := s.Logger()
+	if conn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
 		return
 	}
-	if s.AConn, err = net.ListenUDP("udp", addr); err != nil {
-		return
-	}
-	if err = s.AConn.SetReadBuffer(config.RtspConfig().Audio.Server.ReadBuffer); err != nil {
-		logger.ErrorWith("udp server audio conn set read buffer error", err)
-	}
-	if err = s.AConn.SetWriteBuffer(config.RtspConfig().Audio.Server.WriteBuffer); err != nil {
-		logger.ErrorWith("udp server audio conn set write buffer error", err)
+	buffers := udpBuffers(mediaType, control, true)
+	if err := conn.SetReadBuffer(buffers.ReadBuffer); err != nil {
+		logger.ErrorWith("udp server conn set read buffer error", err, log.String("media", mediaType))
 	}
-	la := s.AConn.LocalAddr().String()
-	strPort := la[strings.LastIndex(la, ":")+1:]
-	s.APort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
+	if err := conn.SetWriteBuffer(buffers.WriteBuffer); err != nil {
+		logger.ErrorWith("udp server conn set write buffer error", err, log.String("media", mediaType))
 	}
-	go func() {
-		bufUDP := make([]byte, UdpBufSize)
-		logger.Info("udp server start listen audio", log.Int("APort", s.APort))
-		defer logger.Info("udp server stop listen audio", log.Int("APort", s.APort))
-		timer := time.Unix(0, 0)
-		for !s.Stoped {
-			if n, _, err := s.AConn.ReadFromUDP(bufUDP); err == nil {
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Debug("Package recv from AConn.len", log.Int("len", n))
-					timer = time.Now()
-				}
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RtpTypeAudio,
-					Buffer: bytes.NewBuffer(rtpBytes),
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// receive reads RTP or RTCP of track until server stopped, which are
+// unprotected by srtp if not nil and dropped if unauthenticated
+func (s *UDPServer) receive(conn *net.UDPConn, track int, typ RTPType, port int, srtp *srtpContext) {
+	logger := s.Logger().With(log.Int("track", track), log.String("type", typ.String()), log.Int("port", port))
+	reader := newUDPBatchReader(conn, udpReadBatch, udpMaxDatagram)
+	logger.Info("udp server start listen")
+	defer logger.Info("udp server stop listen")
+	timer := time.Unix(0, 0)
+	for !s.Stopped() {
+		n, err := reader.Read()
+		if err != nil {
+			if !s.Stopped() {
+				logger.ErrorWith("udp server read pack error", err)
+			}
+			continue
+		}
+		for i := 0; i < n; i++ {
+			data := reader.Buffer(i)
+			if elapsed := time.Now().Sub(timer); elapsed >= 30*time.Second {
+				logger.Debug("Package recv from udp conn", log.Int("len", len(data)))
+				timer = time.Now()
+			}
+			s.AddInputBytes(len(data))
+			if srtp != nil {
+				if data, err = srtp.unprotect(data, typ.IsControl()); err != nil {
+					logger.Debug("udp server drop srtp", log.Error(err))
+					continue
 				}
-				s.HandleRTP(pack)
-			} else {
-				logger.ErrorWith("udp server read audio pack error", err)
-				continue
 			}
+			if !typ.IsControl() {
+				s.requestLost(track, data)
+			}
+			pack := copyRTPPack(track, typ, data)
+			s.HandleRTP(pack)
+			pack.Release()
 		}
-	}()
-	addr, err = net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
-		return
 	}
-	s.AControlConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return
+}
+
+// SetupTrack listens a pair of UDP ports for RTP and RTCP of track, which
+// are protected by SRTP of key if not nil
+func (s *UDPServer) SetupTrack(track int, media *SDPMedia, key *srtpKey) (t *UDPTrack, err error) {
+	s.tracksLock.Lock()
+	defer s.tracksLock.Unlock()
+	if s.Stopped() {
+		return nil, fmt.Errorf("udp server stopped")
 	}
-	if err = s.AControlConn.SetReadBuffer(config.RtspConfig().AudioControl.Server.ReadBuffer); err != nil {
-		logger.ErrorWith("udp server audio control conn set read buffer error", err)
+	if s.Tracks == nil {
+		s.Tracks = make(map[int]*UDPTrack)
 	}
-	if err = s.AControlConn.SetWriteBuffer(config.RtspConfig().AudioControl.Server.WriteBuffer); err != nil {
-		logger.ErrorWith("udp server audio control conn set write buffer error", err)
+	if cfg := config.RtspConfig().Pusher.JitterBuffer; s.jitter == nil && cfg.Delay > 0 {
+		s.jitter = newJitterBuffer(cfg.Delay, cfg.Size, s.handleRTP, s.handleGap)
 	}
-	la = s.AControlConn.LocalAddr().String()
-	strPort = la[strings.LastIndex(la, ":")+1:]
-	s.AControlPort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
+	if t = s.Tracks[track]; t != nil {
+		return t, nil
 	}
-	go func() {
-		bufUDP := make([]byte, UdpBufSize)
-		logger.Info("udp server start listen audio control", log.Int("AControlPort", s.AControlPort))
-		defer logger.Info("udp server stop listen audio control", log.Int("AControlPort", s.AControlPort))
-		for !s.Stoped {
-			if n, _, err := s.AControlConn.ReadFromUDP(bufUDP); err == nil {
-				//logger.Printf("Package recv from AControlConn.len:%d\n", n)
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RtpTypeAudioControl,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.ErrorWith("udp server read audio control pack error", err)
-				continue
-			}
+	t = &UDPTrack{Track: track, Type: media.Type}
+	if key != nil {
+		if t.srtp, err = newSRTPContext(key); err != nil {
+			return nil, err
+		}
+	}
+	// NACKs of SRTCP are not supported
+	if config.RtspConfig().Nack.Enable && media.FeedbackNack() && key == nil {
+		t.nack = &nackTracker{}
+		if s.ssrc == 0 {
+			s.ssrc = rand.Uint32()
+		}
+	}
+	defer func() {
+		if err != nil {
+			t.close()
 		}
 	}()
-	return
-}
-
-func (s *UDPServer) SetupVideo() (err error) {
-	var (
-		logger = s.Logger()
-		addr   *net.UDPAddr
-	)
-	addr, err = net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
+	if t.Conn, t.Port, err = s.listen(media.Type, false); err != nil {
 		return
 	}
-	s.VConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
+	if t.ControlConn, t.ControlPort, err = s.listen(media.Type, true); err != nil {
 		return
 	}
-	if err = s.VConn.SetReadBuffer(config.RtspConfig().Video.Server.ReadBuffer); err != nil {
-		logger.ErrorWith("udp server video conn set read buffer error", err)
-	}
-	if err = s.VConn.SetWriteBuffer(config.RtspConfig().Video.Server.WriteBuffer); err != nil {
-		logger.ErrorWith("udp server video conn set write buffer error", err)
+	s.Tracks[track] = t
+	go s.receive(t.Conn, track, media.rtpType(false), t.Port, t.srtp)
+	go s.receive(t.ControlConn, track, media.rtpType(true), t.ControlPort, t.srtp)
+	return t, nil
+}
+
+// SetSource sets RTP and RTCP addresses of source of track, which RTP lost
+// are requested by NACKs from if source supports, and backchannel audio is
+// sent to
+func (s *UDPServer) SetSource(track int, addr *net.UDPAddr, controlAddr *net.UDPAddr) {
+	s.tracksLock.Lock()
+	defer s.tracksLock.Unlock()
+	if t := s.Tracks[track]; t != nil {
+		t.source, t.sourceControl = addr, controlAddr
 	}
-	la := s.VConn.LocalAddr().String()
-	strPort := la[strings.LastIndex(la, ":")+1:]
-	s.VPort, err = strconv.Atoi(strPort)
-	if err != nil {
-		return
+}
+
+// sendSource sends RTP of pack to source of track, protected if track is
+// secured
+func (s *UDPServer) sendSource(track int, pack *RTPPack) error {
+	s.tracksLock.Lock()
+	t := s.Tracks[track]
+	if t == nil || t.Conn == nil || t.source == nil {
+		s.tracksLock.Unlock()
+		return fmt.Errorf("%w: source of track %d unknown", BackchannelUnavailableError, track)
 	}
-	go func() {
-		bufUDP := make([]byte, UdpBufSize)
-		logger.Info("udp server start listen video", log.Int("VPort", s.VPort))
-		defer logger.Info("udp server stop listen video", log.Int("VPort", s.VPort))
-		timer := time.Unix(0, 0)
-		for !s.Stoped {
-			var n int
-			if n, _, err = s.VConn.ReadFromUDP(bufUDP); err == nil {
-				elapsed := time.Now().Sub(timer)
-				if elapsed >= 30*time.Second {
-					logger.Debug("Package recv from VConn.len", log.Int("len", n))
-					timer = time.Now()
-				}
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RtpTypeVideo,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.ErrorWith("udp server read video pack error", err)
-				continue
-			}
+	conn, source, srtp := t.Conn, t.source, t.srtp
+	s.tracksLock.Unlock()
+	if srtp != nil {
+		protected, err := srtp.protect(pack)
+		if err != nil {
+			return err
 		}
-	}()
+		defer protected.Release()
+		pack = protected
+	}
+	if _, err := conn.WriteToUDP(pack.Bytes(), source); err != nil {
+		return err
+	}
+	if s.Client != nil {
+		atomic.AddInt64(&s.Client.OutBytes, int64(pack.Len()))
+	}
+	return nil
+}
 
-	addr, err = net.ResolveUDPAddr("udp", ":0")
-	if err != nil {
+// requestLost sends NACK to source of track requesting RTP lost before RTP
+// of data
+func (s *UDPServer) requestLost(track int, data []byte) {
+	if len(data) < RTP_FIXED_HEADER_LENGTH {
 		return
 	}
-	s.VControlConn, err = net.ListenUDP("udp", addr)
-	if err != nil {
+	s.tracksLock.Lock()
+	t := s.Tracks[track]
+	if t == nil || t.nack == nil || t.sourceControl == nil || t.ControlConn == nil {
+		s.tracksLock.Unlock()
 		return
 	}
-	if err = s.VControlConn.SetReadBuffer(config.RtspConfig().VideoControl.Server.ReadBuffer); err != nil {
-		logger.ErrorWith("udp server video control conn set read buffer error", err)
-	}
-	if err = s.VControlConn.SetWriteBuffer(config.RtspConfig().VideoControl.Server.WriteBuffer); err != nil {
-		logger.ErrorWith("udp server video control conn set write buffer error", err)
-	}
-	la = s.VControlConn.LocalAddr().String()
-	strPort = la[strings.LastIndex(la, ":")+1:]
-	s.VControlPort, err = strconv.Atoi(strPort)
-	if err != nil {
+	lost := t.nack.update(binary.BigEndian.Uint16(data[2:]))
+	conn, source := t.ControlConn, t.sourceControl
+	s.tracksLock.Unlock()
+	if len(lost) == 0 {
 		return
 	}
-	go func() {
-		bufUDP := make([]byte, UdpBufSize)
-		logger.Info("udp server start listen video control", log.Int("VControlPort", s.VControlPort))
-		defer logger.Info("udp server stop listen video control", log.Int("VControlPort", s.VControlPort))
-		for !s.Stoped {
-			var n int
-			if n, _, err = s.VControlConn.ReadFromUDP(bufUDP); err == nil {
-				//logger.Printf("Package recv from VControlConn.len:%d\n", n)
-				rtpBytes := make([]byte, n)
-				s.AddInputBytes(n)
-				copy(rtpBytes, bufUDP)
-				pack := &RTPPack{
-					Type:   RtpTypeVideoControl,
-					Buffer: bytes.NewBuffer(rtpBytes),
-				}
-				s.HandleRTP(pack)
-			} else {
-				logger.ErrorWith("udp server read video control pack error", err)
-				continue
-			}
-		}
-	}()
-	return
+	nack := buildNack(s.ssrc, binary.BigEndian.Uint32(data[8:]), lost)
+	if _, err := conn.WriteToUDP(nack, source); err != nil {
+		s.Logger().ErrorWith("udp server send nack error", err, log.Int("track", track))
+	}
 }
@@ -2,9 +2,11 @@ package controller
 
 import (
 	"github.com/CVDS2020/CVDS2020/cvds-msu/service"
+	"github.com/CVDS2020/CVDS2020/cvds-msu/storage"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type Channel struct {
@@ -18,13 +20,14 @@ func (s *Channel) StartChannel(ctx *gin.Context) {
 		Transport string         `json:"transport"`
 		Cover     uint           `json:"cover"`
 		Fields    map[string]any `yaml:"fields" json:"fields"`
+		Mode      string         `json:"mode"`
 	}{}
 	if err := ctx.ShouldBindJSON(&model); err != nil {
 		ctx.AbortWithError(http.StatusBadRequest, err).SetType(gin.ErrorTypeBind)
 		return
 	}
 
-	channel, err := s.svc.CreateChannel(model.Name, model.URL, model.Transport, model.Cover, model.Fields)
+	channel, err := s.svc.CreateChannel(model.Name, model.URL, model.Transport, model.Cover, model.Fields, model.Mode)
 	if err != nil {
 		ctx.JSON(http.StatusOK, gin.H{
 			"code": http.StatusBadRequest,
@@ -71,6 +74,7 @@ func (s *Channel) GetChannel(ctx *gin.Context) {
 		"transport": channel.Transport(),
 		"cover":     channel.Cover(),
 		"fields":    channel.Fields(),
+		"mode":      channel.Mode(),
 	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"code":    http.StatusOK,
@@ -95,6 +99,106 @@ func (s *Channel) StopChannel(c *gin.Context) {
 	})
 }
 
+// MarkChannel appends a mark to channel recordings, such as an event
+// reported by the camera
+func (s *Channel) MarkChannel(ctx *gin.Context) {
+	model := struct {
+		UUID string `json:"uuid"`
+		storage.Mark
+	}{}
+	if err := ctx.ShouldBindJSON(&model); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	channel, err := s.svc.GetChannel(model.UUID)
+	if err == nil {
+		err = channel.Mark(model.Mark)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"code": http.StatusBadRequest,
+			"msg":  err.Error(),
+		})
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"code": http.StatusOK,
+		"msg":  "success",
+	})
+}
+
+// GetChannelMarks returns marks of channel, optional start and end are unix
+// timestamps in seconds
+func (s *Channel) GetChannelMarks(ctx *gin.Context) {
+	form := struct {
+		UUID  string `form:"uuid"`
+		Start int64  `form:"start"`
+		End   int64  `form:"end"`
+	}{}
+	if err := ctx.ShouldBindQuery(&form); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	var start, end time.Time
+	if form.Start > 0 {
+		start = time.Unix(form.Start, 0)
+	}
+	if form.End > 0 {
+		end = time.Unix(form.End, 0)
+	}
+	channel, err := s.svc.GetChannel(form.UUID)
+	var marks []storage.Mark
+	if err == nil {
+		marks, err = channel.Marks(start, end)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"code": http.StatusBadRequest,
+			"msg":  err.Error(),
+		})
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"code":  http.StatusOK,
+		"msg":   "success",
+		"marks": marks,
+	})
+}
+
+// TriggerChannel starts recording of event mode channel, duration is in
+// seconds
+func (s *Channel) TriggerChannel(ctx *gin.Context) {
+	model := struct {
+		UUID     string `json:"uuid"`
+		Duration uint   `json:"duration"`
+	}{}
+	if err := ctx.ShouldBindJSON(&model); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err).SetType(gin.ErrorTypeBind)
+		return
+	}
+	if model.Duration == 0 {
+		model.Duration = 30
+	}
+	channel, err := s.svc.GetChannel(model.UUID)
+	if err == nil {
+		err = channel.Trigger(time.Duration(model.Duration) * time.Second)
+	}
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"code": http.StatusBadRequest,
+			"msg":  err.Error(),
+		})
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"code": http.StatusOK,
+		"msg":  "success",
+	})
+}
+
 func (s *Channel) StopAll() {
 	s.svc.RemoveAll()
 }
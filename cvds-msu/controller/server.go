@@ -94,6 +94,9 @@ func (s *Server) init() {
 			channelApi.POST("/start", s.channel.StartChannel)
 			channelApi.Group("/", s.channel.GetChannel)
 			channelApi.DELETE("/stop", s.channel.StopChannel)
+			channelApi.POST("/mark", s.channel.MarkChannel)
+			channelApi.GET("/marks", s.channel.GetChannelMarks)
+			channelApi.POST("/trigger", s.channel.TriggerChannel)
 		}
 	}
 
@@ -15,6 +15,7 @@ import (
 var (
 	InvalidChannelNameError = errors.New("invalid channel name")
 	InvalidChannelURLError  = errors.New("invalid channel url")
+	InvalidChannelModeError = errors.New("invalid channel mode")
 	ChannelExistError       = errors.New("channel exist")
 	ChannelNotFoundError    = errors.New("channel not found")
 )
@@ -52,19 +53,27 @@ func (s *Channel) removeChannel(id string) *storage.Channel {
 	return ch
 }
 
-func (s *Channel) CreateChannel(name string, url string, transport string, cover uint, fields map[string]any) (*storage.Channel, error) {
+func (s *Channel) CreateChannel(name string, url string, transport string, cover uint, fields map[string]any, mode string) (*storage.Channel, error) {
 	transport = strings.ToLower(transport)
 	switch transport {
 	case "tcp", "udp":
 	default:
 		transport = "tcp"
 	}
+	mode = strings.ToLower(mode)
+	switch mode {
+	case storage.ChannelModeContinuous, storage.ChannelModeEvent:
+	case "":
+		mode = storage.ChannelModeContinuous
+	default:
+		return nil, InvalidChannelModeError
+	}
 	up, err := urlpkg.Parse(url)
 	if err != nil || up.Scheme != "rtsp" {
 		return nil, InvalidChannelURLError
 	}
 	def.SetDefault(&cover, 24)
-	ch := storage.NewChannel(name, url, transport, cover, fields)
+	ch := storage.NewChannel(name, url, transport, cover, fields, mode)
 	if !s.addChannel(ch) {
 		return nil, ChannelExistError
 	}
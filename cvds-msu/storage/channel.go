@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"github.com/CVDS2020/CVDS2020/common/assert"
 	"github.com/CVDS2020/CVDS2020/common/errors"
 	"github.com/CVDS2020/CVDS2020/common/lifecycle"
@@ -16,6 +18,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -32,8 +35,30 @@ var (
 	ChannelClosedError     = errors.New("channel has been closed")
 	ChannelIsRunningError  = errors.New("channel is running")
 	ChannelRestartingError = errors.New("channel is restarting")
+	ChannelNotStartedError = errors.New("channel not started")
+	ChannelNotEventError   = errors.New("channel is not event recording mode")
 )
 
+// recording mode of channel
+const (
+	// ChannelModeContinuous records all the time
+	ChannelModeContinuous = "continuous"
+	// ChannelModeEvent records only when triggered by events
+	ChannelModeEvent = "event"
+)
+
+// marksFileName is the file in channel data directory that marks are appended
+// to, one json object per line
+const marksFileName = ".marks"
+
+// Mark is a event noted on the timeline of channel recordings
+type Mark struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
 type ChannelState struct {
 	Closed     bool
 	Running    bool
@@ -52,6 +77,7 @@ type Channel struct {
 	transport string
 	cover     uint
 	fields    map[string]any
+	mode      string
 
 	//seq int64
 
@@ -66,23 +92,28 @@ type Channel struct {
 	destroyRequest bool
 	destroyed      bool
 
+	marksLock   sync.Mutex
+	triggerChan chan time.Time
+
 	closeSignal chan struct{}
 	logger      *log.Logger
 }
 
-func NewChannel(name string, url string, transport string, cover uint, fields map[string]any) *Channel {
+func NewChannel(name string, url string, transport string, cover uint, fields map[string]any, mode string) *Channel {
 	c := new(Channel)
-	c.init(name, url, transport, cover, fields)
+	c.init(name, url, transport, cover, fields, mode)
 	return c
 }
 
-func (c *Channel) init(name string, url string, transport string, cover uint, fields map[string]any) {
+func (c *Channel) init(name string, url string, transport string, cover uint, fields map[string]any, mode string) {
 	c.uuid = uuid.Must(uuid.NewV4()).String()
 	c.name = name
 	c.url = url
 	c.transport = transport
 	c.cover = cover
 	c.fields = fields
+	c.mode = mode
+	c.triggerChan = make(chan time.Time, 1)
 	c.closeSignal = make(chan struct{}, 1)
 	//c.seq = -1
 	c.logger = assert.Must(config.LogConfig().Build("storage.channel"))
@@ -403,14 +434,49 @@ func (c *Channel) doRun() error {
 		ffmpegBin := config.StorageConfig().FFMpeg.Bin
 		restartTimer := timer.NewTimer(make(chan struct{}, 1))
 		defer restartTimer.Stop()
+		// in event mode, ffmpeg runs until recordUntil and stopped by recordTimer
+		recordTimer := timer.NewTimer(make(chan struct{}, 1))
+		defer recordTimer.Stop()
+		eventMode := c.mode == ChannelModeEvent
+		var recordUntil time.Time
 
 		exitChan, killChan := make(chan error, 1), make(chan struct{}, 1)
 		closing, started := false, false
 
 		var cmd *exec.Cmd
-		for restartTimer.Trigger(); true; {
+		if !eventMode {
+			restartTimer.Trigger()
+		}
+		for {
 			select {
+			case until := <-c.triggerChan:
+				if closing || !until.After(recordUntil) {
+					continue
+				}
+				recordUntil = until
+				recordTimer.After(time.Until(until))
+				if !started {
+					c.logger.Info("event recording triggered", log.String("until", until.String()))
+					select {
+					case restartTimer.C <- struct{}{}:
+					default:
+					}
+				}
+
+			case <-recordTimer.C:
+				if remain := time.Until(recordUntil); remain > 0 {
+					recordTimer.After(remain)
+					continue
+				}
+				if started && cmd != nil && cmd.Process != nil {
+					c.logger.Info("event recording finished, interrupt ffmpeg")
+					cmd.Process.Signal(os.Interrupt)
+				}
+
 			case <-restartTimer.C:
+				if eventMode && (started || time.Until(recordUntil) <= 0) {
+					continue
+				}
 				//moveRequestChan <- struct{}{}
 				//<-moveResponseChan
 				args := []string{
@@ -449,6 +515,10 @@ func (c *Channel) doRun() error {
 				if closing {
 					return
 				}
+				if eventMode && time.Until(recordUntil) <= 0 {
+					// wait for next trigger
+					continue
+				}
 				restartTimer.After(config.StorageConfig().FFMpeg.ExitRestartInterval)
 
 			case signal := <-ffmpegSignal:
@@ -575,6 +645,85 @@ func (c *Channel) Fields() map[string]any {
 	return c.fields
 }
 
+// Mode function is getter of Channel.mode
+func (c *Channel) Mode() string {
+	return c.mode
+}
+
+// Trigger starts recording of event mode channel for duration, if recording is
+// in progress, it is extended to the later end
+func (c *Channel) Trigger(duration time.Duration) error {
+	if c.mode != ChannelModeEvent {
+		return ChannelNotEventError
+	}
+	until := time.Now().Add(duration)
+	for {
+		select {
+		case c.triggerChan <- until:
+			return nil
+		case old := <-c.triggerChan:
+			// merge with the pending trigger
+			if old.After(until) {
+				until = old
+			}
+		}
+	}
+}
+
+// Mark appends a mark to channel, mark time is set to now if it is zero
+func (c *Channel) Mark(mark Mark) error {
+	if c.dataDir == "" {
+		return ChannelNotStartedError
+	}
+	if mark.Time.IsZero() {
+		mark.Time = time.Now()
+	}
+	data, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+	c.marksLock.Lock()
+	defer c.marksLock.Unlock()
+	file, err := os.OpenFile(path.Join(c.dataDir, marksFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return c.logger.ErrorWith("open marks file error", err)
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Marks returns marks of channel in time range [start, end), zero start or
+// end means unbounded
+func (c *Channel) Marks(start time.Time, end time.Time) ([]Mark, error) {
+	if c.dataDir == "" {
+		return nil, ChannelNotStartedError
+	}
+	c.marksLock.Lock()
+	defer c.marksLock.Unlock()
+	marks := make([]Mark, 0)
+	file, err := os.Open(path.Join(c.dataDir, marksFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return marks, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var mark Mark
+		if err := json.Unmarshal(scanner.Bytes(), &mark); err != nil {
+			continue
+		}
+		if (!start.IsZero() && mark.Time.Before(start)) || (!end.IsZero() && !mark.Time.Before(end)) {
+			continue
+		}
+		marks = append(marks, mark)
+	}
+	return marks, scanner.Err()
+}
+
 func (c *Channel) Destroy() error {
 	c.destroyRequest = true
 	err, _ := c.CloseWait()
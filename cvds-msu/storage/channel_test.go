@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChannelMarks(t *testing.T) {
+	c := NewChannel("cam1", "rtsp://127.0.0.1/cam1", "tcp", 24, nil, ChannelModeContinuous)
+	if err := c.Mark(Mark{Type: "motion"}); err != ChannelNotStartedError {
+		t.Fatalf("expect channel not started error, got %v", err)
+	}
+	c.dataDir = t.TempDir()
+	marks, err := c.Marks(time.Time{}, time.Time{})
+	if err != nil || len(marks) != 0 {
+		t.Fatalf("unexpected marks of new channel: %v %v", marks, err)
+	}
+
+	base := time.Date(2022, 3, 1, 8, 0, 0, 0, time.Local)
+	for i, typ := range []string{"motion", "tamper", "line-crossing"} {
+		if err := c.Mark(Mark{Time: base.Add(time.Duration(i) * time.Minute), Type: typ, Source: "onvif"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Mark(Mark{Type: "manual"}); err != nil {
+		t.Fatal(err)
+	}
+
+	marks, err = c.Marks(base.Add(time.Minute), base.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 1 || marks[0].Type != "tamper" || marks[0].Source != "onvif" {
+		t.Fatalf("unexpected marks in range: %+v", marks)
+	}
+	marks, err = c.Marks(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 4 || marks[3].Type != "manual" || marks[3].Time.Before(base) {
+		t.Fatalf("unexpected marks: %+v", marks)
+	}
+}
+
+func TestChannelTrigger(t *testing.T) {
+	c := NewChannel("cam1", "rtsp://127.0.0.1/cam1", "tcp", 24, nil, ChannelModeContinuous)
+	if err := c.Trigger(time.Second); err != ChannelNotEventError {
+		t.Fatalf("expect not event mode error, got %v", err)
+	}
+	c = NewChannel("cam2", "rtsp://127.0.0.1/cam2", "tcp", 24, nil, ChannelModeEvent)
+	if err := c.Trigger(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// pending triggers are merged to the later end
+	if err := c.Trigger(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if until := <-c.triggerChan; time.Until(until) < 50*time.Second {
+		t.Fatalf("expect pending trigger keep later end, got %v", until)
+	}
+}